@@ -0,0 +1,81 @@
+package cacheUpdater
+
+//----------------------------------------------
+// CopyRight 2019 La Crosse Technology, LTD.
+//----------------------------------------------
+
+//----------------------------------------------
+// Imports
+//----------------------------------------------
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sibivishnu/Weather/common"
+	"github.com/sibivishnu/Weather/common/cache"
+	"github.com/sibivishnu/Weather/common/clock"
+	"github.com/urfave/cli"
+)
+
+// ----------------------------------------------
+// Local Funcs
+// ----------------------------------------------
+
+// listDeadLetters - deadletter list
+func listDeadLetters(c *cli.Context) error {
+	connectRedis()
+	failed, err := GetDeadLetters()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SERIAL\tATTEMPTS\tFIRST FAILED\tLAST FAILED\tERROR")
+	for _, x := range failed {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", x.Serial, x.Attempts, x.FirstFailed.Format(time.RFC3339), x.LastFailed.Format(time.RFC3339), x.LastError)
+	}
+	return w.Flush()
+}
+
+// requeueDeadLetters - deadletter requeue [--all] [serial...], the running
+// updater picks the devices up at its next retry poll
+func requeueDeadLetters(c *cli.Context) error {
+	serials := []string(c.Args())
+	if len(serials) == 0 && !c.Bool("all") {
+		return errors.New("serials or --all required")
+	}
+
+	connectRedis()
+	if c.Bool("all") {
+		failed, err := GetDeadLetters()
+		if err != nil {
+			return err
+		}
+		serials = serials[:0]
+		for _, x := range failed {
+			serials = append(serials, x.Serial)
+		}
+	}
+
+	requeued := 0
+	for _, serial := range serials {
+		if err := RequeueDeadLetter(clock.SystemClock{}, serial); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", serial, err)
+			continue
+		}
+		requeued++
+	}
+	fmt.Printf("%d of %d devices requeued\n", requeued, len(serials))
+	return nil
+}
+
+// connectRedis - the commands only need Redis, not the whole environment
+func connectRedis() {
+	host := os.Getenv(ENV_REDIS_HOST)
+	password := ""
+	common.RedisClient = cache.SetupRedis(&host, &password, 0)
+	common.RedisInstance = &cache.RedisInstance{RedisSession: common.RedisClient}
+}
@@ -0,0 +1,306 @@
+package cacheUpdater
+
+//----------------------------------------------
+// CopyRight 2019 La Crosse Technology, LTD.
+//----------------------------------------------
+
+//----------------------------------------------
+// Imports
+//----------------------------------------------
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/go-redis/redis"
+	"github.com/sibivishnu/Weather/common"
+	"github.com/sibivishnu/Weather/common/clock"
+	"golang.org/x/net/context"
+)
+
+// ----------------------------------------------
+// Constants
+// ----------------------------------------------
+const (
+	PUBSUB_DEADLETTER_SUFFIX = "_DeadLetter"
+
+	// Message IDs are remembered this long, redeliveries within it are acked unprocessed
+	PUBSUB_DEDUP_TTL = 24 * time.Hour
+	// A message being processed holds its ID this long, renewed while the handler
+	// runs. The claim of a crashed consumer lapses within it
+	PUBSUB_CLAIM_TTL   = 30 * time.Second
+	PUBSUB_CLAIM_RENEW = PUBSUB_CLAIM_TTL / 3
+
+	// Nacked messages, claimed ones included, come back after a backoff
+	PUBSUB_RETRY_MIN_BACKOFF = 10 * time.Second
+	PUBSUB_RETRY_MAX_BACKOFF = 10 * time.Minute
+
+	PUBSUB_RECONNECT_MIN_DELAY = time.Second
+	PUBSUB_RECONNECT_MAX_DELAY = time.Minute
+	// A receive lasting this long is considered healthy, the backoff starts over
+	PUBSUB_RECONNECT_RESET = 5 * time.Minute
+
+	pubsubClaimProcessing = "processing"
+	pubsubClaimDone       = "done"
+)
+
+// ----------------------------------------------
+// Types
+// ----------------------------------------------
+type (
+	// MessageHandler - processes one message with the clock of the consumer. A
+	// PoisonError sends the message to the dead-letter topic, any other error
+	// has it redelivered.
+	MessageHandler func(ctx context.Context, clk clock.Clock, m *pubsub.Message) error
+
+	// Consumer - subscription kept alive by Run, created on the topic if missing.
+	Consumer struct {
+		Name            string
+		Subscription    string
+		Topic           string
+		DeadLetterTopic string
+		Handler         MessageHandler
+		Clock           clock.Clock
+	}
+
+	// PoisonError - a message no redelivery can fix.
+	PoisonError struct {
+		Err error
+	}
+)
+
+// ----------------------------------------------
+// Exports
+// ----------------------------------------------
+
+// Poison - marks err as permanent.
+func Poison(err error) error {
+	return &PoisonError{Err: err}
+}
+
+func (e *PoisonError) Error() string {
+	return "poison message: " + e.Err.Error()
+}
+
+func (e *PoisonError) Unwrap() error {
+	return e.Err
+}
+
+// Run - receives until ctx is done, reconnecting with backoff when the
+// subscription cannot be set up or Receive fails.
+func (c *Consumer) Run(ctx context.Context) {
+	delay := PUBSUB_RECONNECT_MIN_DELAY
+	for {
+		started := c.Clock.Now()
+		err := c.receive(ctx)
+		if ctx.Err() != nil {
+			log.Printf("[Listen] %s: Stopped", c.Name)
+			return
+		}
+
+		if c.Clock.Now().Sub(started) > PUBSUB_RECONNECT_RESET {
+			delay = PUBSUB_RECONNECT_MIN_DELAY
+		}
+		log.Printf("[Listen] %s: Receive ended, reconnecting in %v| %v", c.Name, delay, err)
+
+		select {
+		case <-ctx.Done():
+			log.Printf("[Listen] %s: Stopped", c.Name)
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > PUBSUB_RECONNECT_MAX_DELAY {
+			delay = PUBSUB_RECONNECT_MAX_DELAY
+		}
+	}
+}
+
+// ----------------------------------------------
+// Local Funcs
+// ----------------------------------------------
+func (c *Consumer) receive(ctx context.Context) error {
+	log.Println("[Listen] " + c.Name + ": " + c.Subscription + " @ " + c.Topic)
+	client, err := pubsub.NewClient(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// We check if the subscription exists
+	sub := client.Subscription(c.Subscription)
+	ok, err := sub.Exists(ctx)
+	if err != nil {
+		return err
+	}
+
+	// If the subscription doesn't exist, then we need to create one
+	retryPolicy := &pubsub.RetryPolicy{MinimumBackoff: PUBSUB_RETRY_MIN_BACKOFF, MaximumBackoff: PUBSUB_RETRY_MAX_BACKOFF}
+	if !ok {
+		log.Printf("[Listen] %s: Subscription does not exist. Creating one", c.Name)
+		sub, err = client.CreateSubscription(ctx, c.Subscription, pubsub.SubscriptionConfig{Topic: client.Topic(c.Topic), RetryPolicy: retryPolicy})
+		if err != nil {
+			return err
+		}
+	} else if config, err := sub.Config(ctx); err == nil && config.RetryPolicy == nil {
+		// Without a retry policy nacked messages come back immediately
+		if _, err := sub.Update(ctx, pubsub.SubscriptionConfigToUpdate{RetryPolicy: retryPolicy}); err != nil {
+			log.Printf("[Listen] %s: Unable to set the retry policy| %v", c.Name, err)
+		}
+	}
+
+	deadLetter, err := ensureTopic(ctx, client, c.DeadLetterTopic)
+	if err != nil {
+		return err
+	}
+	defer deadLetter.Stop()
+
+	// Receive messages
+	log.Printf("[Listen] %s: Receiving", c.Name)
+	err = sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+		c.process(ctx, deadLetter, m)
+	})
+	if err == nil && ctx.Err() == nil {
+		err = errors.New("receive returned")
+	}
+	return err
+}
+
+// process - runs the handler once per message ID. Transient failures are
+// nacked, poison messages are acked once on the dead-letter topic.
+func (c *Consumer) process(ctx context.Context, deadLetter *pubsub.Topic, m *pubsub.Message) {
+	claimed, err := c.claim(m)
+	if err != nil {
+		log.Printf("[Listen] %s: Unable to claim message %s| %v", c.Name, m.ID, err)
+		m.Nack()
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	stopRenewal := c.renewClaim(m)
+	err = c.handle(ctx, m)
+	stopRenewal()
+	var poison *PoisonError
+	switch {
+	case err == nil:
+		c.release(m, pubsubClaimDone)
+		m.Ack()
+	case errors.As(err, &poison):
+		log.Printf("[Listen] %s: Message %s dead-lettered| %v", c.Name, m.ID, err)
+		result := deadLetter.Publish(ctx, &pubsub.Message{
+			Data: m.Data,
+			Attributes: map[string]string{
+				"subscription": c.Subscription,
+				"messageId":    m.ID,
+				"publishTime":  m.PublishTime.UTC().Format(time.RFC3339),
+				"error":        poison.Err.Error(),
+			},
+		})
+		if _, err := result.Get(ctx); err != nil {
+			log.Printf("[Listen] %s: Unable to dead-letter message %s| %v", c.Name, m.ID, err)
+			c.release(m, "")
+			m.Nack()
+			return
+		}
+		c.release(m, pubsubClaimDone)
+		m.Ack()
+	default:
+		log.Printf("[Listen] %s: Message %s failed, redelivering| %v", c.Name, m.ID, err)
+		c.release(m, "")
+		m.Nack()
+	}
+}
+
+// handle - a panicking handler poisons the message
+func (c *Consumer) handle(ctx context.Context, m *pubsub.Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = Poison(fmt.Errorf("panic: %v", r))
+		}
+	}()
+	return c.Handler(ctx, c.Clock, m)
+}
+
+// claim - false when the message was already processed (acked) or is being
+// processed by another delivery (nacked, it comes back if that one fails).
+func (c *Consumer) claim(m *pubsub.Message) (bool, error) {
+	key := c.dedupKey(m)
+	ok, err := common.RedisInstance.RedisSession.SetNX(key, pubsubClaimProcessing, PUBSUB_CLAIM_TTL).Result()
+	if err != nil || ok {
+		return ok, err
+	}
+
+	state, err := common.RedisInstance.RedisSession.Get(key).Result()
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+	if state == pubsubClaimDone {
+		log.Printf("[Listen] %s: Message %s already processed", c.Name, m.ID)
+		m.Ack()
+	} else {
+		m.Nack()
+	}
+	return false, nil
+}
+
+// renewClaim - keeps the claim of m while it is processed. The returned func
+// stops the renewal, once it returns the claim is no longer touched.
+func (c *Consumer) renewClaim(m *pubsub.Message) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(PUBSUB_CLAIM_RENEW)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := common.RedisInstance.RedisSession.Expire(c.dedupKey(m), PUBSUB_CLAIM_TTL).Err(); err != nil {
+					log.Printf("[Listen] %s: Unable to renew the claim of message %s| %v", c.Name, m.ID, err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// release - records the outcome of a claim, an empty state lets a
+// redelivery process the message again.
+func (c *Consumer) release(m *pubsub.Message, state string) {
+	var err error
+	if state == "" {
+		err = common.RedisInstance.RedisSession.Del(c.dedupKey(m)).Err()
+	} else {
+		err = common.RedisInstance.RedisSession.Set(c.dedupKey(m), state, PUBSUB_DEDUP_TTL).Err()
+	}
+	if err != nil {
+		log.Printf("[Listen] %s: Unable to release message %s| %v", c.Name, m.ID, err)
+	}
+}
+
+func (c *Consumer) dedupKey(m *pubsub.Message) string {
+	return "pubsub.processed:" + c.Subscription + ":" + m.ID
+}
+
+func ensureTopic(ctx context.Context, client *pubsub.Client, name string) (*pubsub.Topic, error) {
+	topic := client.Topic(name)
+	ok, err := topic.Exists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		log.Printf("[Listen] Topic %s does not exist. Creating one", name)
+		if topic, err = client.CreateTopic(ctx, name); err != nil {
+			return nil, err
+		}
+	}
+	return topic, nil
+}
@@ -0,0 +1,209 @@
+package cacheUpdater
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/sibivishnu/Weather/common"
+	"github.com/sibivishnu/Weather/common/clock"
+	"github.com/sibivishnu/Weather/common/const/device"
+	"golang.org/x/net/context"
+)
+
+func TestGeoMessagesApplyInPublishOrder(t *testing.T) {
+	useTestStore(t)
+	ctx := context.Background()
+	at := time.Date(2020, 5, 4, 10, 0, 0, 0, time.UTC)
+	clk := clock.NewFakeClock(at)
+	geoMessage := func(id string, published time.Time, zip string, countryCode string) *pubsub.Message {
+		data, _ := json.Marshal(device.DevicePubSub{Serial: "A1", Zip: zip, CountryCode: countryCode})
+		return &pubsub.Message{ID: id, Data: data, PublishTime: published}
+	}
+	current := func() device.Device {
+		t.Helper()
+		d, err := device.Store.Get("A1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	if err := handleGeoMessage(ctx, clk, geoMessage("1", at, "54601", "USA")); err != nil {
+		t.Fatal(err)
+	}
+	if d := current(); d.Geo.Zip != "54601" || d.Geo.CountryCode != "US" || !d.GeoPublished.Equal(at) {
+		t.Errorf("first message stored %+v at %v", d.Geo, d.GeoPublished)
+	}
+
+	// Published before the applied one, redelivered late
+	if err := handleGeoMessage(ctx, clk, geoMessage("0", at.Add(-time.Minute), "10001", "US")); err != nil {
+		t.Fatal(err)
+	}
+	if d := current(); d.Geo.Zip != "54601" {
+		t.Errorf("older message applied, zip %s", d.Geo.Zip)
+	}
+
+	// Same location once normalized, only the publish time moves
+	if err := handleGeoMessage(ctx, clk, geoMessage("2", at.Add(time.Minute), " 54601 ", "usa")); err != nil {
+		t.Fatal(err)
+	}
+	if d := current(); !d.GeoPublished.Equal(at.Add(time.Minute)) {
+		t.Errorf("publish time left at %v", d.GeoPublished)
+	}
+	if history, _ := device.GetLocationHistory("A1", 10); len(history) != 1 {
+		t.Errorf("%d location changes recorded", len(history))
+	}
+}
+
+func TestStaleClaimLapses(t *testing.T) {
+	m := useTestStore(t)
+	handled := 0
+	c := &Consumer{Name: "Geo", Subscription: "geo", Handler: func(context.Context, clock.Clock, *pubsub.Message) error {
+		handled++
+		return nil
+	}}
+	msg := &pubsub.Message{ID: "1"}
+
+	// Claimed by a consumer that crashed while processing
+	common.RedisInstance.RedisSession.Set(c.dedupKey(msg), pubsubClaimProcessing, PUBSUB_CLAIM_TTL)
+	c.process(context.Background(), nil, msg)
+	if handled != 0 {
+		t.Fatalf("claimed message processed")
+	}
+
+	m.FastForward(PUBSUB_CLAIM_TTL)
+	c.process(context.Background(), nil, msg)
+	c.process(context.Background(), nil, msg)
+	if handled != 1 {
+		t.Errorf("processed %d times once the claim lapsed", handled)
+	}
+	if state, _ := m.Get(c.dedupKey(msg)); state != pubsubClaimDone || m.TTL(c.dedupKey(msg)) != PUBSUB_DEDUP_TTL {
+		t.Errorf("claim left %q for %v", state, m.TTL(c.dedupKey(msg)))
+	}
+}
+
+func TestConsumerAgainstPstest(t *testing.T) {
+	useTestStore(t)
+	server := pstest.NewServer()
+	defer server.Close()
+	t.Setenv("PUBSUB_EMULATOR_HOST", server.Addr)
+	defer func(id string) { projectID = id }(projectID)
+	projectID = "weather-test"
+
+	ctx := context.Background()
+	client, err := pubsub.NewClient(ctx, projectID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	topic, err := client.CreateTopic(ctx, "Geo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer topic.Stop()
+	deadLetterTopic, err := client.CreateTopic(ctx, "Geo"+PUBSUB_DEADLETTER_SUFFIX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadLetters, err := client.CreateSubscription(ctx, "dead-letters", pubsub.SubscriptionConfig{Topic: deadLetterTopic})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	handled := map[string]int{}
+	count := func(data string) int {
+		lock.Lock()
+		defer lock.Unlock()
+		return handled[data]
+	}
+	c := &Consumer{
+		Name:            "Geo",
+		Subscription:    "geo",
+		Topic:           "Geo",
+		DeadLetterTopic: "Geo" + PUBSUB_DEADLETTER_SUFFIX,
+		Clock:           clock.SystemClock{},
+		Handler: func(ctx context.Context, clk clock.Clock, m *pubsub.Message) error {
+			lock.Lock()
+			handled[string(m.Data)]++
+			n := handled[string(m.Data)]
+			lock.Unlock()
+			switch {
+			case string(m.Data) == "poison":
+				return Poison(errors.New("bad payload"))
+			case string(m.Data) == "flaky" && n == 1:
+				return errors.New("redis down")
+			}
+			return nil
+		},
+	}
+	consumerCtx, stop := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	go func() {
+		c.Run(consumerCtx)
+		close(stopped)
+	}()
+	defer func() {
+		stop()
+		<-stopped
+	}()
+
+	// Messages published before the subscription exists are not delivered
+	waitFor(t, "the subscription", func() bool {
+		ok, _ := client.Subscription("geo").Exists(ctx)
+		return ok
+	})
+	if config, err := client.Subscription("geo").Config(ctx); err != nil || config.RetryPolicy == nil {
+		t.Errorf("subscription created without a retry policy, %v", err)
+	}
+	for _, data := range []string{"ok", "poison", "flaky"} {
+		if _, err := topic.Publish(ctx, &pubsub.Message{Data: []byte(data)}).Get(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor(t, "the messages", func() bool {
+		return count("ok") == 1 && count("poison") == 1 && count("flaky") == 2
+	})
+
+	received := make(chan *pubsub.Message, 1)
+	receiveCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	deadLetters.Receive(receiveCtx, func(_ context.Context, m *pubsub.Message) {
+		m.Ack()
+		select {
+		case received <- m:
+			cancel()
+		default:
+		}
+	})
+	select {
+	case m := <-received:
+		if string(m.Data) != "poison" || m.Attributes["subscription"] != "geo" || m.Attributes["error"] != "bad payload" {
+			t.Errorf("dead-lettered %q %v", m.Data, m.Attributes)
+		}
+	default:
+		t.Errorf("nothing dead-lettered")
+	}
+
+	// Acked messages are not delivered again
+	time.Sleep(200 * time.Millisecond)
+	if count("ok") != 1 || count("poison") != 1 || count("flaky") != 2 {
+		t.Errorf("handled ok:%d poison:%d flaky:%d", count("ok"), count("poison"), count("flaky"))
+	}
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if done() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
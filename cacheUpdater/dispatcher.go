@@ -8,54 +8,243 @@ package cacheUpdater
 // Imports
 //----------------------------------------------
 import (
-	"fmt"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/sibivishnu/Weather/common/clock"
+	"golang.org/x/net/context"
+)
+
+// ----------------------------------------------
+// Constants
+// ----------------------------------------------
+const (
+	DEFAULT_MAX_QUEUE   = 1024
+	DEFAULT_MAX_WORKER  = 16
+	DEFAULT_JOB_TIMEOUT = 2 * time.Minute
+
+	// Throughput is averaged over this window, one bucket per second
+	THROUGHPUT_WINDOW_SECONDS = 60
 )
 
 // ----------------------------------------------
 // Types
 // ----------------------------------------------
-type Dispatcher struct {
-	// A pool of workers channels that are registered with the dispatcher
-	maxWorkers int
-	WorkerPool chan chan Job
-}
+type (
+	// JobHandler - processes one job, ctx is cancelled at the job timeout or on Stop.
+	JobHandler func(ctx context.Context, clk clock.Clock, job Job) error
+
+	// Dispatcher - fixed pool of workers fed by a bounded queue. Submit blocks
+	// while the queue is full.
+	Dispatcher struct {
+		clock      clock.Clock
+		maxWorkers int
+		jobTimeout time.Duration
+		handler    JobHandler
+		queue      chan Job
+
+		ctx     context.Context
+		cancel  context.CancelFunc
+		workers sync.WaitGroup
+
+		// Held by Submit while it waits for room in the queue, Stop closes the queue under it
+		submitLock sync.RWMutex
+		stopped    bool
+
+		lock       sync.RWMutex
+		started    time.Time
+		busy       int
+		processed  int64
+		failed     int64
+		timedOut   int64
+		lastJob    time.Time
+		throughput [THROUGHPUT_WINDOW_SECONDS]throughputBucket
+	}
+
+	// DispatcherStats - queue and worker state, for the status endpoint.
+	DispatcherStats struct {
+		Workers       int       `json:"workers"`
+		Busy          int       `json:"busy"`
+		QueueDepth    int       `json:"queueDepth"`
+		QueueCapacity int       `json:"queueCapacity"`
+		Processed     int64     `json:"processed"`
+		Failed        int64     `json:"failed"`
+		TimedOut      int64     `json:"timedOut"`
+		JobsPerMinute int64     `json:"jobsPerMinute"` // last THROUGHPUT_WINDOW_SECONDS
+		Started       time.Time `json:"started"`
+		LastJob       time.Time `json:"lastJob,omitempty"`
+		Stopped       bool      `json:"stopped"`
+	}
+
+	throughputBucket struct {
+		second int64
+		count  int64
+	}
+)
+
+// ----------------------------------------------
+// Errors
+// ----------------------------------------------
+var (
+	ErrDispatcherStopped = errors.New("dispatcher stopped")
+)
 
 // ----------------------------------------------
 // Exports
 // ----------------------------------------------
-func NewDispatcher(maxWorkers int) *Dispatcher {
-	pool := make(chan chan Job, maxWorkers)
-	return &Dispatcher{WorkerPool: pool, maxWorkers: maxWorkers}
+func NewDispatcher(clk clock.Clock, maxWorkers int, maxQueue int, jobTimeout time.Duration, handler JobHandler) *Dispatcher {
+	if maxWorkers <= 0 {
+		maxWorkers = DEFAULT_MAX_WORKER
+	}
+	if maxQueue <= 0 {
+		maxQueue = DEFAULT_MAX_QUEUE
+	}
+	if jobTimeout <= 0 {
+		jobTimeout = DEFAULT_JOB_TIMEOUT
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Dispatcher{
+		clock:      clk,
+		maxWorkers: maxWorkers,
+		jobTimeout: jobTimeout,
+		handler:    handler,
+		queue:      make(chan Job, maxQueue),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
 }
 
 func (d *Dispatcher) Run() {
+	d.lock.Lock()
+	d.started = d.clock.Now()
+	d.lock.Unlock()
+
 	// starting n number of workers
 	for i := 0; i < d.maxWorkers; i++ {
-		worker := NewWorker(d.WorkerPool)
+		d.workers.Add(1)
+		worker := NewWorker(i, d)
 		worker.Start()
 	}
+	log.Printf("[CacheUpdater] Dispatcher started, %d workers, queue of %d", d.maxWorkers, cap(d.queue))
+}
 
-	go d.dispatch()
+// Submit - queues a job, blocking while the queue is full. The job counts
+// towards its run until a worker is done with it.
+func (d *Dispatcher) Submit(ctx context.Context, job Job) error {
+	d.submitLock.RLock()
+	defer d.submitLock.RUnlock()
+	if d.stopped {
+		return ErrDispatcherStopped
+	}
+
+	if job.run != nil {
+		job.run.add()
+	}
+	select {
+	case d.queue <- job:
+		return nil
+	case <-ctx.Done():
+		if job.run != nil {
+			job.run.cancelled()
+		}
+		return ctx.Err()
+	case <-d.ctx.Done():
+		if job.run != nil {
+			job.run.cancelled()
+		}
+		return ErrDispatcherStopped
+	}
+}
+
+// Stop - stops accepting jobs and lets the workers drain the queue. In-flight
+// jobs are cancelled once ctx is done.
+func (d *Dispatcher) Stop(ctx context.Context) error {
+	d.submitLock.Lock()
+	if !d.stopped {
+		d.stopped = true
+		close(d.queue)
+	}
+	d.submitLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		d.cancel()
+		return nil
+	case <-ctx.Done():
+		d.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (d *Dispatcher) Stats() DispatcherStats {
+	d.submitLock.RLock()
+	stopped := d.stopped
+	d.submitLock.RUnlock()
+
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	stats := DispatcherStats{
+		Workers:       d.maxWorkers,
+		Busy:          d.busy,
+		QueueDepth:    len(d.queue),
+		QueueCapacity: cap(d.queue),
+		Processed:     d.processed,
+		Failed:        d.failed,
+		TimedOut:      d.timedOut,
+		Started:       d.started,
+		LastJob:       d.lastJob,
+		Stopped:       stopped,
+	}
+
+	now := d.clock.Now().Unix()
+	for _, bucket := range d.throughput {
+		if now-bucket.second < THROUGHPUT_WINDOW_SECONDS {
+			stats.JobsPerMinute += bucket.count
+		}
+	}
+	stats.JobsPerMinute = stats.JobsPerMinute * 60 / THROUGHPUT_WINDOW_SECONDS
+	return stats
 }
 
 // ----------------------------------------------
 // Local Funcs
 // ----------------------------------------------
-func (d *Dispatcher) dispatch() {
-	fmt.Println("[CacheUpdater] Worker que dispatcher started...")
-	for {
-
-		select {
-		case job := <-JobQueue:
-			// a job request has been received
-			go func(job Job) {
-				// try to obtain a worker job channel that is available.
-				// this will block until a worker is idle
-				jobChannel := <-d.WorkerPool
-
-				// dispatch the job to the worker job channel
-				jobChannel <- job
-			}(job)
-		}
+func (d *Dispatcher) jobStarted() {
+	d.lock.Lock()
+	d.busy++
+	d.lock.Unlock()
+}
+
+func (d *Dispatcher) jobDone(err error, timedOut bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.busy--
+	d.processed++
+	if err != nil {
+		d.failed++
+	}
+	if timedOut {
+		d.timedOut++
+	}
+
+	now := d.clock.Now()
+	d.lastJob = now
+	bucket := &d.throughput[now.Unix()%THROUGHPUT_WINDOW_SECONDS]
+	if bucket.second != now.Unix() {
+		bucket.second = now.Unix()
+		bucket.count = 0
 	}
+	bucket.count++
 }
@@ -0,0 +1,188 @@
+package cacheUpdater
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sibivishnu/Weather/common/clock"
+	"golang.org/x/net/context"
+)
+
+// blockingHandler - jobs wait for release, or for their ctx
+func blockingHandler(release chan struct{}) JobHandler {
+	return func(ctx context.Context, clk clock.Clock, job Job) error {
+		select {
+		case <-release:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func TestSubmitWaitsForRoomInQueue(t *testing.T) {
+	release := make(chan struct{})
+	d := NewDispatcher(clock.SystemClock{}, 1, 1, time.Minute, blockingHandler(release))
+	d.Run()
+	defer d.Stop(context.Background())
+
+	run := NewRun()
+	if err := d.Submit(context.Background(), run.Job([]string{"A1"})); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the worker to take the first job", func() bool { return d.Stats().Busy == 1 })
+	if err := d.Submit(context.Background(), run.Job([]string{"B2"})); err != nil {
+		t.Fatal(err)
+	}
+	if stats := d.Stats(); stats.QueueDepth != 1 || stats.QueueCapacity != 1 {
+		t.Errorf("queue %d of %d", stats.QueueDepth, stats.QueueCapacity)
+	}
+
+	// Full, Submit waits until its ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	if err := d.Submit(ctx, run.Job([]string{"C3"})); err != context.DeadlineExceeded {
+		t.Errorf("full queue got %v", err)
+	}
+	if waited := time.Since(started); waited < 50*time.Millisecond {
+		t.Errorf("returned after %v without room", waited)
+	}
+
+	// Room again once a worker is done
+	submitted := make(chan error)
+	go func() { submitted <- d.Submit(context.Background(), run.Job([]string{"C3"})) }()
+	release <- struct{}{}
+	if err := <-submitted; err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if err := run.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if submitted, succeeded, failed, _ := run.Counts(); submitted != 3 || succeeded != 3 || failed != 0 {
+		t.Errorf("run counts %d submitted %d succeeded %d failed", submitted, succeeded, failed)
+	}
+}
+
+func TestJobTimeout(t *testing.T) {
+	d := NewDispatcher(clock.SystemClock{}, 2, 4, 20*time.Millisecond, blockingHandler(nil))
+	d.Run()
+	defer d.Stop(context.Background())
+
+	run := NewRun()
+	d.Submit(context.Background(), run.Job([]string{"A1"}))
+	if err := run.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, succeeded, failed, timedOut := run.Counts(); succeeded != 0 || failed != 1 || timedOut != 1 {
+		t.Errorf("run counts %d succeeded %d failed %d timed out", succeeded, failed, timedOut)
+	}
+	if stats := d.Stats(); stats.Processed != 1 || stats.Failed != 1 || stats.TimedOut != 1 || stats.Busy != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+func TestStopDrainsQueue(t *testing.T) {
+	var handled []string
+	d := NewDispatcher(clock.SystemClock{}, 1, 10, time.Minute, func(ctx context.Context, clk clock.Clock, job Job) error {
+		time.Sleep(5 * time.Millisecond)
+		handled = append(handled, job.Lines[0])
+		return nil
+	})
+	d.Run()
+
+	for _, serial := range []string{"A1", "B2", "C3", "D4", "E5"} {
+		if err := d.Submit(context.Background(), Job{Lines: []string{serial}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(handled) != 5 {
+		t.Errorf("handled %v before stopping", handled)
+	}
+
+	if err := d.Submit(context.Background(), Job{Lines: []string{"F6"}}); err != ErrDispatcherStopped {
+		t.Errorf("submit after stop got %v", err)
+	}
+	if !d.Stats().Stopped {
+		t.Errorf("stats not stopped")
+	}
+	if err := d.Stop(context.Background()); err != nil {
+		t.Errorf("second stop got %v", err)
+	}
+}
+
+func TestStopCancelsInFlightJobs(t *testing.T) {
+	cancelled := make(chan error, 1)
+	d := NewDispatcher(clock.SystemClock{}, 1, 1, time.Minute, func(ctx context.Context, clk clock.Clock, job Job) error {
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return ctx.Err()
+	})
+	d.Run()
+
+	run := NewRun()
+	d.Submit(context.Background(), run.Job([]string{"A1"}))
+	waitFor(t, "the job to start", func() bool { return d.Stats().Busy == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := d.Stop(ctx); err != context.DeadlineExceeded {
+		t.Errorf("stop got %v", err)
+	}
+	if err := <-cancelled; err != context.Canceled {
+		t.Errorf("in-flight job got %v", err)
+	}
+
+	// Cancelled on stop, not timed out
+	run.Wait(context.Background())
+	if _, succeeded, failed, timedOut := run.Counts(); succeeded != 0 || failed != 1 || timedOut != 0 {
+		t.Errorf("run counts %d succeeded %d failed %d timed out", succeeded, failed, timedOut)
+	}
+}
+
+func TestDispatcherStats(t *testing.T) {
+	fake := clock.NewFakeClock(time.Date(2020, 5, 4, 18, 0, 0, 0, time.UTC))
+	d := NewDispatcher(fake, 4, 16, time.Minute, func(ctx context.Context, clk clock.Clock, job Job) error {
+		switch job.Lines[0] {
+		case "fail":
+			return errors.New("failed")
+		case "panic":
+			panic("broken line")
+		}
+		return nil
+	})
+	d.Run()
+	defer d.Stop(context.Background())
+
+	run := NewRun()
+	for _, line := range []string{"ok", "ok", "fail", "panic", "ok"} {
+		if err := d.Submit(context.Background(), run.Job([]string{line})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := run.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if submitted, succeeded, failed, timedOut := run.Counts(); submitted != 5 || succeeded != 3 || failed != 2 || timedOut != 0 {
+		t.Errorf("run counts %d %d %d %d", submitted, succeeded, failed, timedOut)
+	}
+
+	stats := d.Stats()
+	if stats.Workers != 4 || stats.Processed != 5 || stats.Failed != 2 || stats.Busy != 0 || stats.QueueDepth != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+	if !stats.Started.Equal(fake.Now()) || !stats.LastJob.Equal(fake.Now()) || stats.JobsPerMinute != 5 {
+		t.Errorf("times and throughput %+v", stats)
+	}
+
+	// Out of the throughput window
+	fake.Advance(THROUGHPUT_WINDOW_SECONDS * time.Second)
+	if stats := d.Stats(); stats.JobsPerMinute != 0 {
+		t.Errorf("%d jobs per minute after the window", stats.JobsPerMinute)
+	}
+}
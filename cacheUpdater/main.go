@@ -9,13 +9,20 @@ package cacheUpdater
 //----------------------------------------------
 import (
 	"log"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"strconv"
+	"syscall"
 	"time"
 
+	"github.com/sibivishnu/Weather/common"
+	"github.com/sibivishnu/Weather/common/clock"
 	"github.com/sibivishnu/Weather/common/init"
 	"github.com/urfave/cli"
+	"golang.org/x/net/context"
 )
 
 // ----------------------------------------------
@@ -27,15 +34,29 @@ const (
 	FLAG_HTTP_PORT                 = "HTTP_PORT"
 	ENV_MAX_QUEUE                  = "MAX_QUEUE"
 	ENV_MAX_WORKER                 = "MAX_WORKER"
+	ENV_JOB_TIMEOUT                = "JOB_TIMEOUT"
+	ENV_RETRY_MAX_ATTEMPTS         = "RETRY_MAX_ATTEMPTS"
 	ENV_SCP_SERVER_HOST            = "SCP_SERVER_HOST"
 	ENV_SCP_SERVER_USER            = "SCP_SERVER_USER"
 	ENV_SCP_SERVER_RSA             = "SCP_SERVER_RSA"
+	ENV_SCP_SERVER_KNOWN_HOSTS     = "SCP_SERVER_KNOWN_HOSTS"
+	ENV_DEVICE_LIST_SOURCE         = "DEVICE_LIST_SOURCE"
+	ENV_DEVICE_LIST_URL            = "DEVICE_LIST_URL"
+	ENV_DEVICE_LIST_VERIFY         = "DEVICE_LIST_VERIFY"
+	ENV_DEVICE_REMOVAL_POLICY      = "DEVICE_REMOVAL_POLICY"
+	ENV_DEVICE_REMOVAL_TTL         = "DEVICE_REMOVAL_TTL"
 	ENV_DEVICE_REMOTE_FILE_PATH    = "DEVICE_REMOTE_FILE_PATH"
 	ENV_DEVICE_LOCAL_TARGET_FOLDER = "DEVICE_LOCAL_TARGET_FOLDER"
 	ENV_PROJECT_ID                 = "PROJECT_ID"
 	ENV_SUBSCRIPTION_NAME          = "SUBSCRIPTION_NAME"
 	ENV_TOPIC_NAME                 = "TOPIC_NAME"
 	ENV_ATTRIBUTE_TOPIC_NAME       = "ATTRIBUTE_TOPIC_NAME"
+	ENV_DEADLETTER_TOPIC_NAME      = "DEADLETTER_TOPIC_NAME"
+	ENV_SCHEDULE_FILE              = "SCHEDULE_FILE"
+	ENV_ADMIN_TOKEN                = "ADMIN_TOKEN"
+
+	DISPATCHER_STOP_TIMEOUT = 30 * time.Second
+	DEFAULT_SCHEDULE_FILE   = "/conf/schedule.json"
 )
 
 // ----------------------------------------------
@@ -47,16 +68,30 @@ var (
 	scpServerHost  string
 	scpServerUser  string
 	scpServerRSA   string
+	scpKnownHosts  string
 	remoteFilePath string
+	deviceListURL  string
+	verifyLocal    bool
 	targetFolder   string
 	devicesFile    string
 
+	deviceListSource DeviceListSource
+	dispatcher       *Dispatcher
+	scheduler        *Scheduler
+	adminToken       string
+
+	deviceRemovalPolicy string
+	deviceRemovalTTL    time.Duration
+
+	deviceRetryMaxAttempts = DEVICE_RETRY_DEFAULT_MAX_ATTEMPTS
+
 	projectID        string
 	subscriptionName string
 	topicName        string
 
 	attributeSubscription string
 	attributeTopic        string
+	deadLetterTopic       string
 )
 
 // ----------------------------------------------
@@ -67,30 +102,100 @@ func main() {
 	app.Name = "Weather Cache updater Service"
 	app.Usage = "Weather Cache updater Service"
 	app.Action = runIt
+	app.Commands = []cli.Command{
+		{
+			Name:  "deadletter",
+			Usage: "Devices the sync gave up on",
+			Subcommands: []cli.Command{
+				{
+					Name:   "list",
+					Usage:  "List dead-lettered devices",
+					Action: listDeadLetters,
+				},
+				{
+					Name:      "requeue",
+					Usage:     "Retry dead-lettered devices",
+					ArgsUsage: "[serial...]",
+					Flags:     []cli.Flag{cli.BoolFlag{Name: "all", Usage: "requeue every dead-lettered device"}},
+					Action:    requeueDeadLetters,
+				},
+			},
+		},
+	}
 	app.Run(os.Args)
 }
 
 func runIt(c *cli.Context) {
 	log.Println("[CacheUpdater] Begin")
+	clk := clock.SystemClock{}
 
 	// Load Paths from Environment
 	scpServerHost = os.Getenv(ENV_SCP_SERVER_HOST)
 	scpServerUser = os.Getenv(ENV_SCP_SERVER_USER)
 	scpServerRSA = os.Getenv(ENV_SCP_SERVER_RSA)
+	scpKnownHosts = os.Getenv(ENV_SCP_SERVER_KNOWN_HOSTS)
 	remoteFilePath = os.Getenv(ENV_DEVICE_REMOTE_FILE_PATH)
+	deviceListURL = os.Getenv(ENV_DEVICE_LIST_URL)
+	verifyLocal, _ = strconv.ParseBool(os.Getenv(ENV_DEVICE_LIST_VERIFY))
 	targetFolder = os.Getenv(ENV_DEVICE_LOCAL_TARGET_FOLDER)
 	projectID = os.Getenv(ENV_PROJECT_ID)
 	subscriptionName = os.Getenv(ENV_SUBSCRIPTION_NAME)
 	topicName = os.Getenv(ENV_TOPIC_NAME)
+	adminToken = os.Getenv(ENV_ADMIN_TOKEN)
+	if adminToken == "" {
+		log.Printf("[CacheUpdater] %s unset, job controls disabled", ENV_ADMIN_TOKEN)
+	}
+	deadLetterTopic = os.Getenv(ENV_DEADLETTER_TOPIC_NAME)
 	maxQueue, _ := strconv.Atoi(os.Getenv(ENV_MAX_QUEUE))
 	maxWorker, _ := strconv.Atoi(os.Getenv(ENV_MAX_WORKER))
+	jobTimeout, _ := time.ParseDuration(os.Getenv(ENV_JOB_TIMEOUT))
+
+	// Devices dropped from the list
+	deviceRemovalPolicy = os.Getenv(ENV_DEVICE_REMOVAL_POLICY)
+	switch deviceRemovalPolicy {
+	case DEVICE_REMOVAL_KEEP, DEVICE_REMOVAL_EXPIRE, DEVICE_REMOVAL_DELETE:
+	default:
+		if deviceRemovalPolicy != "" {
+			log.Printf("[CacheUpdater] Unknown device removal policy %s, using %s", deviceRemovalPolicy, DEVICE_REMOVAL_EXPIRE)
+		}
+		deviceRemovalPolicy = DEVICE_REMOVAL_EXPIRE
+	}
+	deviceRemovalTTL = DEVICE_REMOVAL_DEFAULT_TTL
+	if v := os.Getenv(ENV_DEVICE_REMOVAL_TTL); v != "" {
+		if ttl, err := time.ParseDuration(v); err == nil && ttl > 0 {
+			deviceRemovalTTL = ttl
+		} else {
+			log.Printf("[CacheUpdater] Invalid %s %s, using %v", ENV_DEVICE_REMOVAL_TTL, v, deviceRemovalTTL)
+		}
+	}
+	if v := os.Getenv(ENV_RETRY_MAX_ATTEMPTS); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			deviceRetryMaxAttempts = n
+		} else {
+			log.Printf("[CacheUpdater] Invalid %s %s, using %d", ENV_RETRY_MAX_ATTEMPTS, v, deviceRetryMaxAttempts)
+		}
+	}
 
 	// Derive Attribute PubSub Items
 	attributeSubscription = subscriptionName + "_Attr"
-	attributeTopic = "AttrSync"
+	attributeTopic = os.Getenv(ENV_ATTRIBUTE_TOPIC_NAME)
+	if attributeTopic == "" {
+		attributeTopic = "AttrSync"
+	}
 
 	// Prepare Full File Path for Upload
-	devicesFile = filepath.Join(targetFolder, filepath.Base(remoteFilePath))
+	listName := remoteFilePath
+	if u, err := url.Parse(deviceListURL); listName == "" && err == nil {
+		listName = u.Path
+	}
+	devicesFile = filepath.Join(targetFolder, path.Base(listName))
+
+	// Device List Source, runs are skipped while it is misconfigured
+	var err error
+	deviceListSource, err = NewDeviceListSource(os.Getenv(ENV_DEVICE_LIST_SOURCE))
+	if err != nil {
+		log.Printf("[CacheUpdater] Device list source error: %v", err)
+	}
 
 	//-------------------------------------------------
 	// Init Globals
@@ -100,30 +205,66 @@ func runIt(c *cli.Context) {
 	options["accuweather.key"] = os.Getenv(ENV_ACCU_API_KEY)
 	options["datastore.project"] = "lax-gateway" // os.Getenv(ENV_PROJECT_ID)
 	options["config.categories"] = "/conf/categories.json"
+	options["clock"] = clk
 	init.LoadCommonEnvironment(options)
 
 	//-----------------------------------------
 	// Launch Services
 	//-----------------------------------------
-	JobQueue = make(chan Job, maxQueue)
-	dispatcher := NewDispatcher(maxWorker)
+	dispatcher = NewDispatcher(clk, maxWorker, maxQueue, jobTimeout, processJob)
 	dispatcher.Run()
-	go listenGeo()
-	go listenAttr()
-	log.Println("[cacheUpdater] runCacheIdUpdater()")
-
-	runCacheIDUpdater()
-	deviceCacheUpdater := time.NewTicker(120 * time.Minute)
-	dstUpdater := time.NewTicker(6 * time.Hour)
-	done := make(chan bool)
-	for {
-		select {
-		case <-deviceCacheUpdater.C:
-			runCacheIDUpdater()
-		case <-dstUpdater.C:
-			dstUpdateProcess()
-		case <-done:
-			return
+	consumerCtx, stopConsumers := context.WithCancel(common.CTX)
+	for _, consumer := range deviceConsumers(clk) {
+		go consumer.Run(consumerCtx)
+	}
+
+	// Scheduled Jobs, the schedule file overrides the defaults per job
+	scheduleFile := os.Getenv(ENV_SCHEDULE_FILE)
+	if scheduleFile == "" {
+		scheduleFile = DEFAULT_SCHEDULE_FILE
+	}
+	scheduleConfig, err := LoadScheduleConfig(scheduleFile)
+	if err != nil {
+		log.Printf("[CacheUpdater] Schedule file %s error, using defaults| %v", scheduleFile, err)
+	}
+	scheduler = NewScheduler(clk)
+	for _, job := range []struct {
+		name     string
+		fn       JobFunc
+		defaults JobConfig
+	}{
+		{"device-sync", runCacheIDUpdater, JobConfig{Schedule: "@every 2h", RunOnStart: true}},
+		{"device-retry", processDeviceRetries, JobConfig{Schedule: "@every " + DEVICE_RETRY_POLL_INTERVAL.String()}},
+		{"location-expiry", expireLocationRecords, JobConfig{Schedule: "@daily"}},
+		{"device-index", rebuildDeviceIndex, JobConfig{Schedule: "@daily", RunOnStart: true}},
+		{"forecast-update", runForecastUpdater, JobConfig{Schedule: "@every 1h"}},
+		{"geo-refresh-reset", runDeviceGeoRefreshUpdater, JobConfig{Schedule: "@daily"}},
+	} {
+		if err := scheduler.Add(job.name, job.fn, job.defaults, scheduleConfig); err != nil {
+			log.Printf("[CacheUpdater] %v, using the default schedule", err)
+			scheduler.Add(job.name, job.fn, job.defaults, ScheduleConfig{})
 		}
 	}
+	scheduler.Run()
+
+	if port := os.Getenv(FLAG_HTTP_PORT); port != "" {
+		go serveStatus(port, clk.Now())
+	}
+
+	// Graceful stop, running jobs and in-flight dispatcher jobs share
+	// DISPATCHER_STOP_TIMEOUT to finish
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	log.Println("[CacheUpdater] Stopping")
+	stopConsumers()
+
+	ctx, cancel := context.WithTimeout(context.Background(), DISPATCHER_STOP_TIMEOUT)
+	defer cancel()
+	if err := scheduler.Stop(ctx); err != nil {
+		log.Printf("[CacheUpdater] Scheduled jobs still running on stop| %v", err)
+	}
+	if err := dispatcher.Stop(ctx); err != nil {
+		log.Printf("[CacheUpdater] Jobs cancelled on stop| %v", err)
+	}
 }
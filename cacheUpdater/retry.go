@@ -0,0 +1,279 @@
+package cacheUpdater
+
+//----------------------------------------------
+// CopyRight 2019 La Crosse Technology, LTD.
+//----------------------------------------------
+
+//----------------------------------------------
+// Imports
+//----------------------------------------------
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/sibivishnu/Weather/common"
+	"github.com/sibivishnu/Weather/common/clock"
+	"github.com/sibivishnu/Weather/common/const/device"
+	"golang.org/x/net/context"
+)
+
+// ----------------------------------------------
+// Constants
+// ----------------------------------------------
+const (
+	DEVICE_RETRY_KEY      = "devicesync.retry"      // sorted set serial -> next attempt (unix)
+	DEVICE_FAILURES_KEY   = "devicesync.failures"   // hash serial -> FailedDevice, retries pending
+	DEVICE_DEADLETTER_KEY = "devicesync.deadletter" // hash serial -> FailedDevice, retries given up
+
+	DEVICE_RETRY_DEFAULT_MAX_ATTEMPTS = 8
+	DEVICE_RETRY_BASE_DELAY           = time.Minute
+	DEVICE_RETRY_MAX_DELAY            = 6 * time.Hour
+	DEVICE_RETRY_POLL_INTERVAL        = time.Minute
+	DEVICE_RETRY_POLL_BATCH           = 500
+
+	// Due devices are pushed back by this much while their job runs, a job lost
+	// with the process comes due again afterwards
+	DEVICE_RETRY_LEASE = 10 * time.Minute
+)
+
+// ----------------------------------------------
+// Types
+// ----------------------------------------------
+type (
+	// FailedDevice - a device of the list that could not be saved.
+	FailedDevice struct {
+		Serial      string    `json:"serial"`
+		Line        string    `json:"line"`
+		Attempts    int       `json:"attempts"`
+		LastError   string    `json:"lastError"`
+		FirstFailed time.Time `json:"firstFailed"`
+		LastFailed  time.Time `json:"lastFailed"`
+		NextAttempt time.Time `json:"nextAttempt,omitempty"`
+	}
+)
+
+// ----------------------------------------------
+// Exports
+// ----------------------------------------------
+
+// GetDeadLetters - devices retries gave up on, by serial.
+func GetDeadLetters() ([]FailedDevice, error) {
+	entries, err := common.RedisInstance.RedisSession.HGetAll(DEVICE_DEADLETTER_KEY).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	failed := []FailedDevice{}
+	for _, entry := range entries {
+		var x FailedDevice
+		if err := json.Unmarshal([]byte(entry), &x); err == nil {
+			failed = append(failed, x)
+		}
+	}
+	sort.Slice(failed, func(i, j int) bool { return failed[i].Serial < failed[j].Serial })
+	return failed, nil
+}
+
+// RequeueDeadLetter - gives a dead-lettered device a fresh set of retries, the
+// first one at the next poll.
+func RequeueDeadLetter(clk clock.Clock, serial string) error {
+	entry, err := common.RedisInstance.RedisSession.HGet(DEVICE_DEADLETTER_KEY, serial).Result()
+	if err == redis.Nil {
+		return fmt.Errorf("device %s is not dead-lettered", serial)
+	}
+	if err != nil {
+		return err
+	}
+
+	var x FailedDevice
+	if err := json.Unmarshal([]byte(entry), &x); err != nil {
+		return err
+	}
+	x.Attempts = 0
+	x.NextAttempt = clk.Now().UTC()
+	dataBytes, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+
+	pipe := common.RedisInstance.RedisSession.TxPipeline()
+	pipe.HSet(DEVICE_FAILURES_KEY, serial, dataBytes)
+	pipe.ZAdd(DEVICE_RETRY_KEY, redis.Z{Score: float64(x.NextAttempt.Unix()), Member: serial})
+	pipe.HDel(DEVICE_DEADLETTER_KEY, serial)
+	_, err = pipe.Exec()
+	return err
+}
+
+// ----------------------------------------------
+// Local Funcs
+// ----------------------------------------------
+
+// recordDeviceFailure - schedules the next attempt of a device line, or
+// dead-letters it once deviceRetryMaxAttempts is reached.
+func recordDeviceFailure(clk clock.Clock, line string, cause error) {
+	serial := deviceListSerial(line)
+	if serial == "" {
+		return
+	}
+
+	now := clk.Now().UTC()
+	x := FailedDevice{Serial: serial, FirstFailed: now}
+	entry, err := common.RedisInstance.RedisSession.HGet(DEVICE_FAILURES_KEY, serial).Result()
+	if err == nil {
+		json.Unmarshal([]byte(entry), &x)
+	}
+	x.Line = line
+	x.Attempts++
+	x.LastError = cause.Error()
+	x.LastFailed = now
+
+	pipe := common.RedisInstance.RedisSession.TxPipeline()
+	if x.Attempts >= deviceRetryMaxAttempts {
+		x.NextAttempt = time.Time{}
+		dataBytes, _ := json.Marshal(x)
+		pipe.HSet(DEVICE_DEADLETTER_KEY, serial, dataBytes)
+		pipe.HDel(DEVICE_FAILURES_KEY, serial)
+		pipe.ZRem(DEVICE_RETRY_KEY, serial)
+		log.Printf("[DeviceSync] Device %s dead-lettered after %d attempts| %v", serial, x.Attempts, cause)
+	} else {
+		x.NextAttempt = now.Add(deviceRetryDelay(x.Attempts))
+		dataBytes, _ := json.Marshal(x)
+		pipe.HSet(DEVICE_FAILURES_KEY, serial, dataBytes)
+		pipe.ZAdd(DEVICE_RETRY_KEY, redis.Z{Score: float64(x.NextAttempt.Unix()), Member: serial})
+	}
+	if _, err := pipe.Exec(); err != nil {
+		// The device is not in the snapshot either, the next run picks it up
+		log.Printf("[DeviceSync] Unable to record failure of %s| %v", serial, err)
+	}
+}
+
+// requeueDevice - schedules a device line interrupted by a stop for the next
+// retry poll. Its attempts are left as they are, the line did not fail.
+func requeueDevice(clk clock.Clock, line string) {
+	serial := deviceListSerial(line)
+	if serial == "" {
+		return
+	}
+
+	x := FailedDevice{Serial: serial}
+	entry, err := common.RedisInstance.RedisSession.HGet(DEVICE_FAILURES_KEY, serial).Result()
+	if err == nil {
+		json.Unmarshal([]byte(entry), &x)
+	}
+	x.Line = line
+	x.NextAttempt = clk.Now().UTC()
+	dataBytes, _ := json.Marshal(x)
+
+	pipe := common.RedisInstance.RedisSession.TxPipeline()
+	pipe.HSet(DEVICE_FAILURES_KEY, serial, dataBytes)
+	pipe.ZAdd(DEVICE_RETRY_KEY, redis.Z{Score: float64(x.NextAttempt.Unix()), Member: serial})
+	if _, err := pipe.Exec(); err != nil {
+		log.Printf("[DeviceSync] Unable to requeue %s| %v", serial, err)
+	}
+}
+
+// deviceRetryDelay - DEVICE_RETRY_BASE_DELAY doubled for every attempt after
+// the first, capped at DEVICE_RETRY_MAX_DELAY.
+func deviceRetryDelay(attempts int) time.Duration {
+	delay := DEVICE_RETRY_BASE_DELAY
+	for i := 1; i < attempts && delay < DEVICE_RETRY_MAX_DELAY; i++ {
+		delay *= 2
+	}
+	if delay > DEVICE_RETRY_MAX_DELAY {
+		delay = DEVICE_RETRY_MAX_DELAY
+	}
+	return delay
+}
+
+// processDeviceRetries - queues the devices due for another attempt.
+func processDeviceRetries(ctx context.Context, clk clock.Clock) (map[string]int, error) {
+	now := clk.Now()
+	serials, err := common.RedisInstance.RedisSession.ZRangeByScore(DEVICE_RETRY_KEY, redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.Unix(), 10),
+		Count: DEVICE_RETRY_POLL_BATCH,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(serials) == 0 {
+		return nil, nil
+	}
+
+	entries, err := common.RedisInstance.RedisSession.HMGet(DEVICE_FAILURES_KEY, serials...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	// Lease the devices for the time of the job
+	lease := redis.Z{Score: float64(now.Add(DEVICE_RETRY_LEASE).Unix())}
+	pipe := common.RedisInstance.RedisSession.TxPipeline()
+	var lines []string
+	for i, serial := range serials {
+		var x FailedDevice
+		entry, ok := entries[i].(string)
+		if !ok || json.Unmarshal([]byte(entry), &x) != nil || x.Line == "" {
+			pipe.ZRem(DEVICE_RETRY_KEY, serial)
+			continue
+		}
+		lease.Member = serial
+		pipe.ZAdd(DEVICE_RETRY_KEY, lease)
+		lines = append(lines, x.Line)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+
+	log.Printf("[DeviceSync] Retrying %d devices", len(lines))
+	for start := 0; start < len(lines); start += device.SensorLookupBatchSize {
+		end := start + device.SensorLookupBatchSize
+		if end > len(lines) {
+			end = len(lines)
+		}
+		if err := dispatcher.Submit(ctx, Job{Lines: lines[start:end]}); err != nil {
+			// Leased devices come due again once the lease is over
+			return map[string]int{"queued": start}, err
+		}
+	}
+	return map[string]int{"queued": len(lines)}, nil
+}
+
+// reconcileDeviceFailures - serials of the list with a pending retry or a dead
+// letter for the same line. Records of serials gone from the list, or whose
+// line changed, are dropped so the device is synced from the list again.
+func reconcileDeviceFailures(lines map[string]string, summary *DeviceSyncSummary) (map[string]bool, error) {
+	skip := map[string]bool{}
+	for _, key := range []string{DEVICE_FAILURES_KEY, DEVICE_DEADLETTER_KEY} {
+		entries, err := common.RedisInstance.RedisSession.HGetAll(key).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		for serial, entry := range entries {
+			var x FailedDevice
+			json.Unmarshal([]byte(entry), &x)
+			if line, ok := lines[serial]; ok && line == x.Line {
+				skip[serial] = true
+				if key == DEVICE_DEADLETTER_KEY {
+					summary.DeadLettered++
+				} else {
+					summary.Retrying++
+				}
+				continue
+			}
+
+			pipe := common.RedisInstance.RedisSession.TxPipeline()
+			pipe.HDel(key, serial)
+			pipe.ZRem(DEVICE_RETRY_KEY, serial)
+			if _, err := pipe.Exec(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return skip, nil
+}
@@ -0,0 +1,233 @@
+package cacheUpdater
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+	"github.com/sibivishnu/Weather/common"
+	"github.com/sibivishnu/Weather/common/clock"
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+)
+
+func failedDevice(t *testing.T, m *miniredis.Miniredis, key string, serial string) (FailedDevice, bool) {
+	t.Helper()
+	entry := m.HGet(key, serial)
+	if entry == "" {
+		return FailedDevice{}, false
+	}
+	var x FailedDevice
+	if err := json.Unmarshal([]byte(entry), &x); err != nil {
+		t.Fatal(err)
+	}
+	return x, true
+}
+
+func retryAt(t *testing.T, m *miniredis.Miniredis, serial string) (time.Time, bool) {
+	t.Helper()
+	members, _ := m.ZMembers(DEVICE_RETRY_KEY)
+	for _, member := range members {
+		if member == serial {
+			score, _ := m.ZScore(DEVICE_RETRY_KEY, serial)
+			return time.Unix(int64(score), 0).UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+func TestDeviceRetryDelay(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  DEVICE_RETRY_BASE_DELAY,
+		2:  2 * DEVICE_RETRY_BASE_DELAY,
+		4:  8 * DEVICE_RETRY_BASE_DELAY,
+		9:  256 * DEVICE_RETRY_BASE_DELAY,
+		10: DEVICE_RETRY_MAX_DELAY,
+		60: DEVICE_RETRY_MAX_DELAY,
+	} {
+		if delay := deviceRetryDelay(attempts); delay != want {
+			t.Errorf("attempt %d: %v, want %v", attempts, delay, want)
+		}
+	}
+}
+
+func TestDeviceFailuresDeadLetter(t *testing.T) {
+	m := useTestStore(t)
+	defer func(n int) { deviceRetryMaxAttempts = n }(deviceRetryMaxAttempts)
+	deviceRetryMaxAttempts = 3
+	start := time.Date(2020, 5, 4, 18, 0, 0, 0, time.UTC)
+	fake := clock.NewFakeClock(start)
+
+	recordDeviceFailure(fake, "A1,key", errors.New("first"))
+	x, ok := failedDevice(t, m, DEVICE_FAILURES_KEY, "A1")
+	if !ok || x.Attempts != 1 || x.LastError != "first" || !x.FirstFailed.Equal(start) {
+		t.Fatalf("first failure %+v", x)
+	}
+	if at, _ := retryAt(t, m, "A1"); !at.Equal(start.Add(DEVICE_RETRY_BASE_DELAY)) {
+		t.Errorf("first retry at %v", at)
+	}
+
+	fake.Advance(time.Hour)
+	recordDeviceFailure(fake, "A1,key", errors.New("second"))
+	if at, _ := retryAt(t, m, "A1"); !at.Equal(fake.Now().Add(2 * DEVICE_RETRY_BASE_DELAY)) {
+		t.Errorf("second retry at %v", at)
+	}
+
+	fake.Advance(time.Hour)
+	recordDeviceFailure(fake, "A1,key", errors.New("third"))
+	if _, ok := failedDevice(t, m, DEVICE_FAILURES_KEY, "A1"); ok {
+		t.Errorf("dead letter still pending")
+	}
+	if _, ok := retryAt(t, m, "A1"); ok {
+		t.Errorf("dead letter still scheduled")
+	}
+	dead, err := GetDeadLetters()
+	if err != nil || len(dead) != 1 || dead[0].Attempts != 3 || dead[0].LastError != "third" || !dead[0].FirstFailed.Equal(start) {
+		t.Fatalf("dead letters %+v %v", dead, err)
+	}
+
+	// A fresh set of retries, the first one at the next poll
+	fake.Advance(time.Hour)
+	if err := RequeueDeadLetter(fake, "A1"); err != nil {
+		t.Fatal(err)
+	}
+	if x, ok := failedDevice(t, m, DEVICE_FAILURES_KEY, "A1"); !ok || x.Attempts != 0 || x.Line != "A1,key" {
+		t.Errorf("requeued %+v", x)
+	}
+	if at, _ := retryAt(t, m, "A1"); !at.Equal(fake.Now()) {
+		t.Errorf("requeued retry at %v", at)
+	}
+	if dead, _ := GetDeadLetters(); len(dead) != 0 {
+		t.Errorf("dead letters after requeue %+v", dead)
+	}
+	if err := RequeueDeadLetter(fake, "A1"); err == nil {
+		t.Errorf("requeued a device that is not dead-lettered")
+	}
+}
+
+func TestStoppedLinesKeepTheirAttempts(t *testing.T) {
+	m := useTestStore(t)
+	fake := clock.NewFakeClock(time.Date(2020, 5, 4, 18, 0, 0, 0, time.UTC))
+	recordDeviceFailure(fake, "A1,key", errors.New("first"))
+
+	// Stopping, the line is requeued as is
+	fake.Advance(time.Hour)
+	stopped, cancel := context.WithCancel(context.Background())
+	cancel()
+	deviceAttemptFailed(stopped, fake, "A1,key", stopped.Err())
+	deviceAttemptFailed(context.Background(), fake, "B2,key", context.Canceled)
+	for _, serial := range []string{"A1", "B2"} {
+		x, _ := failedDevice(t, m, DEVICE_FAILURES_KEY, serial)
+		if want := map[string]int{"A1": 1, "B2": 0}[serial]; x.Attempts != want {
+			t.Errorf("%s attempts %d after a stop, want %d", serial, x.Attempts, want)
+		}
+		if at, _ := retryAt(t, m, serial); !at.Equal(fake.Now()) {
+			t.Errorf("%s retried at %v", serial, at)
+		}
+	}
+
+	// A timeout is a failure
+	timedOut, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	deviceAttemptFailed(timedOut, fake, "A1,key", timedOut.Err())
+	if x, _ := failedDevice(t, m, DEVICE_FAILURES_KEY, "A1"); x.Attempts != 2 {
+		t.Errorf("attempts %d after a timeout", x.Attempts)
+	}
+}
+
+func TestDeviceRetriesLeasedWhileQueued(t *testing.T) {
+	m := useTestStore(t)
+	dispatcher.Stop(context.Background())
+	jobs := make(chan Job, 10)
+	dispatcher = NewDispatcher(clock.SystemClock{}, 1, 10, time.Minute, func(ctx context.Context, clk clock.Clock, job Job) error {
+		jobs <- job
+		return nil
+	})
+	dispatcher.Run()
+
+	start := time.Date(2020, 5, 4, 18, 0, 0, 0, time.UTC)
+	fake := clock.NewFakeClock(start)
+	recordDeviceFailure(fake, "A1,key", errors.New("failed"))
+	recordDeviceFailure(fake, "B2,key", errors.New("failed"))
+	recordDeviceFailure(fake, "B2,key", errors.New("failed"))
+	m.ZAdd(DEVICE_RETRY_KEY, float64(start.Unix()), "C3") // no failure record
+
+	// Only A1 is due
+	fake.Advance(DEVICE_RETRY_BASE_DELAY)
+	counts, err := processDeviceRetries(context.Background(), fake)
+	if err != nil || counts["queued"] != 1 {
+		t.Fatalf("queued %v %v", counts, err)
+	}
+	if job := <-jobs; len(job.Lines) != 1 || job.Lines[0] != "A1,key" {
+		t.Errorf("job %+v", job)
+	}
+	if at, _ := retryAt(t, m, "A1"); !at.Equal(fake.Now().Add(DEVICE_RETRY_LEASE)) {
+		t.Errorf("A1 leased until %v", at)
+	}
+	if at, _ := retryAt(t, m, "B2"); !at.Equal(start.Add(2 * DEVICE_RETRY_BASE_DELAY)) {
+		t.Errorf("B2 moved to %v", at)
+	}
+	if _, ok := retryAt(t, m, "C3"); ok {
+		t.Errorf("retry without a failure record kept")
+	}
+
+	// Leased, not queued again before the lease is over
+	if counts, _ := processDeviceRetries(context.Background(), fake); counts["queued"] != 0 {
+		t.Errorf("leased device queued again")
+	}
+	fake.Advance(DEVICE_RETRY_LEASE)
+	if counts, _ := processDeviceRetries(context.Background(), fake); counts["queued"] != 2 {
+		t.Errorf("after the lease queued %v", counts)
+	}
+}
+
+func TestRequeueDeadLettersCommand(t *testing.T) {
+	m := useTestStore(t)
+	defer func(client *redis.Client) { common.RedisClient = client }(common.RedisClient)
+	t.Setenv(ENV_REDIS_HOST, m.Addr())
+
+	dead := func(serial string) {
+		data, _ := json.Marshal(FailedDevice{Serial: serial, Line: serial + ",key", Attempts: 8})
+		m.HSet(DEVICE_DEADLETTER_KEY, serial, string(data))
+	}
+	for _, serial := range []string{"A1", "B2", "C3"} {
+		dead(serial)
+	}
+
+	app := cli.NewApp()
+	app.Commands = []cli.Command{{
+		Name:   "requeue",
+		Flags:  []cli.Flag{cli.BoolFlag{Name: "all"}},
+		Action: requeueDeadLetters,
+	}}
+	run := func(args ...string) error {
+		return app.Run(append([]string{"cacheUpdater", "requeue"}, args...))
+	}
+
+	if err := run(); err == nil {
+		t.Errorf("requeue without serials accepted")
+	}
+	if err := run("B2", "missing"); err != nil {
+		t.Fatal(err)
+	}
+	if remaining, _ := GetDeadLetters(); len(remaining) != 2 {
+		t.Errorf("%d dead letters left", len(remaining))
+	}
+	if err := run("--all"); err != nil {
+		t.Fatal(err)
+	}
+	if remaining, _ := GetDeadLetters(); len(remaining) != 0 {
+		t.Errorf("%d dead letters left", len(remaining))
+	}
+	for _, serial := range []string{"A1", "B2", "C3"} {
+		if x, _ := failedDevice(t, m, DEVICE_FAILURES_KEY, serial); x.Attempts != 0 {
+			t.Errorf("%s requeued with %d attempts", serial, x.Attempts)
+		}
+		if _, ok := retryAt(t, m, serial); !ok {
+			t.Errorf("%s not scheduled", serial)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package cacheUpdater
+
+//----------------------------------------------
+// CopyRight 2019 La Crosse Technology, LTD.
+//----------------------------------------------
+
+//----------------------------------------------
+// Imports
+//----------------------------------------------
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/sibivishnu/Weather/common/clock"
+	"golang.org/x/net/context"
+)
+
+// ----------------------------------------------
+// Constants
+// ----------------------------------------------
+const (
+	SCHEDULER_TICK = time.Second
+
+	JOB_TRIGGER_SCHEDULE = "schedule"
+	JOB_TRIGGER_START    = "start"
+	JOB_TRIGGER_MANUAL   = "manual"
+
+	JOB_OUTCOME_SUCCESS = "success"
+	JOB_OUTCOME_FAILED  = "failed"
+)
+
+// ----------------------------------------------
+// Types
+// ----------------------------------------------
+type (
+	// JobFunc - one run of a scheduled job, counts are reported in its status.
+	JobFunc func(ctx context.Context, clk clock.Clock) (map[string]int, error)
+
+	// JobConfig - schedule of a job, a standard cron expression or a descriptor
+	// (@every 2h, @daily). An empty schedule only runs when triggered.
+	JobConfig struct {
+		Schedule   string `json:"schedule"`
+		Paused     bool   `json:"paused,omitempty"`
+		RunOnStart bool   `json:"runOnStart,omitempty"`
+	}
+
+	// ScheduleConfig - schedule file, jobs left out keep their default.
+	ScheduleConfig struct {
+		Jobs map[string]JobConfig `json:"jobs"`
+	}
+
+	// JobStatus - state and last run of a job.
+	JobStatus struct {
+		Name           string         `json:"name"`
+		Schedule       string         `json:"schedule"`
+		Paused         bool           `json:"paused"`
+		Running        bool           `json:"running"`
+		NextRun        time.Time      `json:"nextRun,omitempty"`
+		LastTrigger    string         `json:"lastTrigger,omitempty"`
+		LastStart      time.Time      `json:"lastStart,omitempty"`
+		LastEnd        time.Time      `json:"lastEnd,omitempty"`
+		LastDurationMs int64          `json:"lastDurationMs"`
+		LastOutcome    string         `json:"lastOutcome,omitempty"`
+		LastError      string         `json:"lastError,omitempty"`
+		LastCounts     map[string]int `json:"lastCounts,omitempty"`
+		Runs           int            `json:"runs"`
+		Failures       int            `json:"failures"`
+		Skipped        int            `json:"skipped"` // still running when due
+	}
+
+	// Scheduler - runs jobs on their schedule, never two runs of a job at once.
+	Scheduler struct {
+		clock   clock.Clock
+		lock    sync.Mutex
+		jobs    map[string]*scheduledJob
+		ctx     context.Context
+		cancel  context.CancelFunc
+		running sync.WaitGroup
+		stopped bool
+	}
+
+	scheduledJob struct {
+		fn         JobFunc
+		schedule   cron.Schedule
+		runOnStart bool
+		status     JobStatus
+	}
+)
+
+// ----------------------------------------------
+// Errors
+// ----------------------------------------------
+var (
+	ErrJobNotFound      = errors.New("job not found")
+	ErrJobRunning       = errors.New("job already running")
+	ErrSchedulerStopped = errors.New("scheduler stopped")
+)
+
+// ----------------------------------------------
+// Exports
+// ----------------------------------------------
+func NewScheduler(clk clock.Clock) *Scheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Scheduler{clock: clk, jobs: map[string]*scheduledJob{}, ctx: ctx, cancel: cancel}
+}
+
+// LoadScheduleConfig - schedule file, a missing file is an empty config.
+func LoadScheduleConfig(filename string) (ScheduleConfig, error) {
+	var config ScheduleConfig
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(data, &config)
+	return config, err
+}
+
+// Add - registers a job, with the config of the file when it has one.
+func (s *Scheduler) Add(name string, fn JobFunc, defaults JobConfig, config ScheduleConfig) error {
+	jobConfig := defaults
+	if c, ok := config.Jobs[name]; ok {
+		jobConfig = c
+	}
+
+	job := &scheduledJob{fn: fn, runOnStart: jobConfig.RunOnStart}
+	job.status = JobStatus{Name: name, Schedule: jobConfig.Schedule, Paused: jobConfig.Paused}
+	if jobConfig.Schedule != "" {
+		schedule, err := cron.ParseStandard(jobConfig.Schedule)
+		if err != nil {
+			return fmt.Errorf("job %s: %v", name, err)
+		}
+		job.schedule = schedule
+		job.status.NextRun = schedule.Next(s.clock.Now())
+	}
+
+	s.lock.Lock()
+	s.jobs[name] = job
+	s.lock.Unlock()
+	log.Printf("[Scheduler] Job %s scheduled %q paused:%v", name, jobConfig.Schedule, jobConfig.Paused)
+	return nil
+}
+
+// Run - starts the runOnStart jobs and checks schedules every SCHEDULER_TICK.
+func (s *Scheduler) Run() {
+	s.lock.Lock()
+	for name, job := range s.jobs {
+		if job.runOnStart && !job.status.Paused {
+			s.start(name, job, JOB_TRIGGER_START)
+		}
+	}
+	s.lock.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(SCHEDULER_TICK)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+				s.tick()
+			}
+		}
+	}()
+}
+
+// Stop - cancels the running jobs and waits for them to return, or for ctx.
+func (s *Scheduler) Stop(ctx context.Context) error {
+	s.lock.Lock()
+	s.stopped = true
+	s.lock.Unlock()
+	s.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Trigger - runs a job now, paused jobs included.
+func (s *Scheduler) Trigger(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	job, ok := s.jobs[name]
+	if !ok {
+		return ErrJobNotFound
+	}
+	if s.stopped {
+		return ErrSchedulerStopped
+	}
+	if job.status.Running {
+		return ErrJobRunning
+	}
+	s.start(name, job, JOB_TRIGGER_MANUAL)
+	return nil
+}
+
+// SetPaused - a paused job is skipped by its schedule until resumed, the run
+// in progress is not interrupted.
+func (s *Scheduler) SetPaused(name string, paused bool) (JobStatus, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	job, ok := s.jobs[name]
+	if !ok {
+		return JobStatus{}, ErrJobNotFound
+	}
+	if job.status.Paused != paused {
+		log.Printf("[Scheduler] Job %s paused:%v", name, paused)
+	}
+	job.status.Paused = paused
+	if !paused && job.schedule != nil {
+		job.status.NextRun = job.schedule.Next(s.clock.Now())
+	}
+	return job.status, nil
+}
+
+// Status - status of a job.
+func (s *Scheduler) Status(name string) (JobStatus, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	job, ok := s.jobs[name]
+	if !ok {
+		return JobStatus{}, ErrJobNotFound
+	}
+	return job.status, nil
+}
+
+// Statuses - status of every job, by name.
+func (s *Scheduler) Statuses() []JobStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	statuses := make([]JobStatus, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		statuses = append(statuses, job.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// ----------------------------------------------
+// Local Funcs
+// ----------------------------------------------
+func (s *Scheduler) tick() {
+	now := s.clock.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stopped {
+		return
+	}
+
+	for name, job := range s.jobs {
+		if job.schedule == nil || job.status.Paused || now.Before(job.status.NextRun) {
+			continue
+		}
+		job.status.NextRun = job.schedule.Next(now)
+		if job.status.Running {
+			job.status.Skipped++
+			log.Printf("[Scheduler] Job %s still running, run skipped", name)
+			continue
+		}
+		s.start(name, job, JOB_TRIGGER_SCHEDULE)
+	}
+}
+
+// start - runs a job in the background, s.lock must be held.
+func (s *Scheduler) start(name string, job *scheduledJob, trigger string) {
+	job.status.Running = true
+	job.status.LastTrigger = trigger
+	job.status.LastStart = s.clock.Now()
+	s.running.Add(1)
+	log.Printf("[Scheduler] Job %s started (%s)", name, trigger)
+
+	go func() {
+		defer s.running.Done()
+		counts, err := s.call(job.fn)
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		end := s.clock.Now()
+		job.status.Running = false
+		job.status.LastEnd = end
+		job.status.LastDurationMs = end.Sub(job.status.LastStart).Milliseconds()
+		job.status.LastCounts = counts
+		job.status.Runs++
+		if err != nil {
+			job.status.Failures++
+			job.status.LastOutcome = JOB_OUTCOME_FAILED
+			job.status.LastError = err.Error()
+			log.Printf("[Scheduler] Job %s failed after %v| %v", name, end.Sub(job.status.LastStart), err)
+			return
+		}
+		job.status.LastOutcome = JOB_OUTCOME_SUCCESS
+		job.status.LastError = ""
+		log.Printf("[Scheduler] Job %s done in %v %v", name, end.Sub(job.status.LastStart), counts)
+	}()
+}
+
+// call - a panicking job fails its run only
+func (s *Scheduler) call(fn JobFunc) (counts map[string]int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return fn(s.ctx, s.clock)
+}
@@ -0,0 +1,233 @@
+package cacheUpdater
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sibivishnu/Weather/common/clock"
+	"golang.org/x/net/context"
+)
+
+// blockingJob - runs wait for release, or for their ctx
+func blockingJob(release chan struct{}) JobFunc {
+	return func(ctx context.Context, clk clock.Clock) (map[string]int, error) {
+		select {
+		case <-release:
+			return map[string]int{"devices": 3}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func jobStatus(t *testing.T, s *Scheduler, name string) JobStatus {
+	t.Helper()
+	status, err := s.Status(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func waitForJob(t *testing.T, s *Scheduler, name string) JobStatus {
+	t.Helper()
+	waitFor(t, name+" to be done", func() bool { return !jobStatus(t, s, name).Running })
+	return jobStatus(t, s, name)
+}
+
+func TestSchedulerSkipsRunsWhileRunning(t *testing.T) {
+	start := time.Date(2020, 5, 4, 18, 0, 0, 0, time.UTC)
+	fake := clock.NewFakeClock(start)
+	s := NewScheduler(fake)
+	defer s.Stop(context.Background())
+	release := make(chan struct{})
+	if err := s.Add("sync", blockingJob(release), JobConfig{Schedule: "@every 1m"}, ScheduleConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if status := jobStatus(t, s, "sync"); !status.NextRun.Equal(start.Add(time.Minute)) {
+		t.Fatalf("next run %v", status.NextRun)
+	}
+
+	// Not due yet
+	s.tick()
+	if status := jobStatus(t, s, "sync"); status.Running {
+		t.Fatalf("started before its schedule")
+	}
+
+	fake.Advance(time.Minute)
+	s.tick()
+	if status := jobStatus(t, s, "sync"); !status.Running || status.LastTrigger != JOB_TRIGGER_SCHEDULE || !status.LastStart.Equal(fake.Now()) {
+		t.Fatalf("due job %+v", status)
+	}
+
+	// Due again while the first run is going
+	fake.Advance(time.Minute)
+	s.tick()
+	status := jobStatus(t, s, "sync")
+	if status.Skipped != 1 || !status.NextRun.Equal(fake.Now().Add(time.Minute)) {
+		t.Errorf("overlapping run %+v", status)
+	}
+
+	fake.Advance(30 * time.Second)
+	close(release)
+	status = waitForJob(t, s, "sync")
+	if status.Runs != 1 || status.LastOutcome != JOB_OUTCOME_SUCCESS || status.LastCounts["devices"] != 3 || status.LastDurationMs != 90000 {
+		t.Errorf("finished job %+v", status)
+	}
+}
+
+func TestSchedulerRunOnStart(t *testing.T) {
+	fake := clock.NewFakeClock(time.Date(2020, 5, 4, 18, 0, 0, 0, time.UTC))
+	s := NewScheduler(fake)
+	ran := make(chan string, 3)
+	job := func(name string) JobFunc {
+		return func(ctx context.Context, clk clock.Clock) (map[string]int, error) {
+			ran <- name
+			return nil, nil
+		}
+	}
+	s.Add("on-start", job("on-start"), JobConfig{Schedule: "@daily", RunOnStart: true}, ScheduleConfig{})
+	s.Add("paused", job("paused"), JobConfig{Schedule: "@daily", RunOnStart: true, Paused: true}, ScheduleConfig{})
+	s.Add("scheduled", job("scheduled"), JobConfig{Schedule: "@daily"}, ScheduleConfig{})
+
+	s.Run()
+	if name := <-ran; name != "on-start" {
+		t.Errorf("%s run on start", name)
+	}
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) != 0 {
+		t.Errorf("%s run on start", <-ran)
+	}
+	if status := jobStatus(t, s, "on-start"); status.Runs != 1 || status.LastTrigger != JOB_TRIGGER_START {
+		t.Errorf("on start %+v", status)
+	}
+}
+
+func TestSchedulerPauseAndResume(t *testing.T) {
+	fake := clock.NewFakeClock(time.Date(2020, 5, 4, 18, 0, 0, 0, time.UTC))
+	s := NewScheduler(fake)
+	defer s.Stop(context.Background())
+	release := make(chan struct{})
+	close(release)
+	s.Add("expiry", blockingJob(release), JobConfig{Schedule: "@every 1h"}, ScheduleConfig{})
+
+	if _, err := s.SetPaused("expiry", true); err != nil {
+		t.Fatal(err)
+	}
+	fake.Advance(2 * time.Hour)
+	s.tick()
+	if status := jobStatus(t, s, "expiry"); status.Running || status.Runs != 0 {
+		t.Fatalf("paused job started %+v", status)
+	}
+
+	// Next run counted from the resume, not the missed one
+	fake.Advance(20 * time.Minute)
+	status, err := s.SetPaused("expiry", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Paused || !status.NextRun.Equal(fake.Now().Add(time.Hour)) {
+		t.Errorf("resumed %+v", status)
+	}
+	s.tick()
+	if status := jobStatus(t, s, "expiry"); status.Running || status.Runs != 0 {
+		t.Errorf("resumed job started before its next run")
+	}
+	fake.Advance(time.Hour)
+	s.tick()
+	if status := waitForJob(t, s, "expiry"); status.Runs != 1 {
+		t.Errorf("resumed job %+v", status)
+	}
+
+	if _, err := s.SetPaused("missing", true); err != ErrJobNotFound {
+		t.Errorf("pausing a missing job got %v", err)
+	}
+}
+
+func TestSchedulerRecoversPanics(t *testing.T) {
+	s := NewScheduler(clock.NewFakeClock(time.Date(2020, 5, 4, 18, 0, 0, 0, time.UTC)))
+	defer s.Stop(context.Background())
+	calls := 0
+	s.Add("forecast", func(ctx context.Context, clk clock.Clock) (map[string]int, error) {
+		calls++
+		if calls == 1 {
+			panic("broken location")
+		}
+		return nil, nil
+	}, JobConfig{}, ScheduleConfig{})
+
+	if err := s.Trigger("forecast"); err != nil {
+		t.Fatal(err)
+	}
+	status := waitForJob(t, s, "forecast")
+	if status.Runs != 1 || status.Failures != 1 || status.LastOutcome != JOB_OUTCOME_FAILED || status.LastError != "panic: broken location" {
+		t.Errorf("panicking job %+v", status)
+	}
+
+	// The scheduler keeps going
+	s.Trigger("forecast")
+	status = waitForJob(t, s, "forecast")
+	if status.Runs != 2 || status.Failures != 1 || status.LastOutcome != JOB_OUTCOME_SUCCESS || status.LastError != "" {
+		t.Errorf("next run %+v", status)
+	}
+}
+
+func TestSchedulerTrigger(t *testing.T) {
+	fake := clock.NewFakeClock(time.Date(2020, 5, 4, 18, 0, 0, 0, time.UTC))
+	s := NewScheduler(fake)
+	s.Add("geo", blockingJob(nil), JobConfig{Schedule: "@daily", Paused: true}, ScheduleConfig{})
+
+	// Triggered only, and paused jobs included
+	s.tick()
+	if err := s.Trigger("geo"); err != nil {
+		t.Fatal(err)
+	}
+	if status := jobStatus(t, s, "geo"); !status.Running || status.LastTrigger != JOB_TRIGGER_MANUAL {
+		t.Errorf("triggered %+v", status)
+	}
+	if err := s.Trigger("geo"); err != ErrJobRunning {
+		t.Errorf("trigger while running got %v", err)
+	}
+	if err := s.Trigger("missing"); err != ErrJobNotFound {
+		t.Errorf("trigger of a missing job got %v", err)
+	}
+
+	// Stop cancels the running job
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	status := jobStatus(t, s, "geo")
+	if status.Running || status.Failures != 1 || status.LastError != context.Canceled.Error() {
+		t.Errorf("stopped job %+v", status)
+	}
+	if err := s.Trigger("geo"); err != ErrSchedulerStopped {
+		t.Errorf("trigger after stop got %v", err)
+	}
+}
+
+func TestSchedulerConfig(t *testing.T) {
+	s := NewScheduler(clock.NewFakeClock(time.Date(2020, 5, 4, 18, 0, 0, 0, time.UTC)))
+	config := ScheduleConfig{Jobs: map[string]JobConfig{
+		"device-sync": {Schedule: "*/30 * * * *", Paused: true},
+		"broken":      {Schedule: "every hour"},
+	}}
+	noop := func(ctx context.Context, clk clock.Clock) (map[string]int, error) { return nil, errors.New("not run") }
+
+	if err := s.Add("device-sync", noop, JobConfig{Schedule: "@every 2h", RunOnStart: true}, config); err != nil {
+		t.Fatal(err)
+	}
+	s.Add("device-index", noop, JobConfig{Schedule: "@daily"}, config)
+	statuses := s.Statuses()
+	if len(statuses) != 2 || statuses[0].Name != "device-index" || statuses[0].Schedule != "@daily" {
+		t.Errorf("default kept %+v", statuses)
+	}
+	if sync := statuses[1]; sync.Schedule != "*/30 * * * *" || !sync.Paused || !sync.NextRun.Equal(time.Date(2020, 5, 4, 18, 30, 0, 0, time.UTC)) {
+		t.Errorf("file schedule %+v", sync)
+	}
+	if err := s.Add("broken", noop, JobConfig{}, config); err == nil {
+		t.Errorf("bad schedule accepted")
+	}
+}
@@ -0,0 +1,333 @@
+package cacheUpdater
+
+//----------------------------------------------
+// CopyRight 2019 La Crosse Technology, LTD.
+//----------------------------------------------
+
+//----------------------------------------------
+// Imports
+//----------------------------------------------
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/context"
+)
+
+// ----------------------------------------------
+// Constants
+// ----------------------------------------------
+const (
+	DEVICE_LIST_SOURCE_SFTP  = "sftp"
+	DEVICE_LIST_SOURCE_LOCAL = "local"
+	DEVICE_LIST_SOURCE_HTTP  = "http"
+
+	// The published checksum is the list path followed by this suffix, in sha256sum format
+	DEVICE_LIST_CHECKSUM_SUFFIX = ".sha256"
+	DEVICE_LIST_FETCH_TIMEOUT   = 5 * time.Minute
+)
+
+// ----------------------------------------------
+// Types
+// ----------------------------------------------
+type (
+	// DeviceListSource - where the device CSV is published, along with its sha256.
+	DeviceListSource interface {
+		String() string
+		Open(ctx context.Context) (io.ReadCloser, error)
+		Checksum(ctx context.Context) (string, error)
+	}
+
+	// LocalDeviceListSource - file on the updater file system, checked against
+	// its .sha256 only when Verify is set.
+	LocalDeviceListSource struct {
+		Path   string
+		Verify bool
+	}
+
+	// HTTPDeviceListSource - file served over http(s), the checksum at URL + .sha256.
+	HTTPDeviceListSource struct {
+		URL    string
+		Client *http.Client
+	}
+
+	// SFTPDeviceListSource - file on an sftp server, the host key must be in KnownHosts.
+	SFTPDeviceListSource struct {
+		Host       string // host or host:port
+		User       string
+		KeyFile    string
+		KnownHosts string
+		Path       string
+	}
+
+	// sftpFile - remote file closing its session along with it.
+	sftpFile struct {
+		*sftp.File
+		client *sftp.Client
+		conn   *ssh.Client
+	}
+)
+
+// ----------------------------------------------
+// Errors
+// ----------------------------------------------
+var (
+	ErrDeviceListChecksum = errors.New("device list checksum mismatch")
+)
+
+// ----------------------------------------------
+// Exports
+// ----------------------------------------------
+
+// FetchDeviceList - downloads the list of a source to dst. dst is only replaced
+// once the download matches the published checksum, sources without one return
+// an empty checksum.
+func FetchDeviceList(ctx context.Context, source DeviceListSource, dst string) error {
+	ctx, cancel := context.WithTimeout(ctx, DEVICE_LIST_FETCH_TIMEOUT)
+	defer cancel()
+
+	expected, err := source.Checksum(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: checksum: %v", source, err)
+	}
+
+	in, err := source.Open(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: %v", source, err)
+	}
+	defer in.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), in)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", source, err)
+	}
+
+	actual := hex.EncodeToString(hash.Sum(nil))
+	if expected != "" && actual != expected {
+		return fmt.Errorf("%s: %w (expected %s, got %s)", source, ErrDeviceListChecksum, expected, actual)
+	}
+
+	if err = os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+	log.Printf("Device list fetched from %s (%d bytes, sha256 %s)", source, n, actual)
+	return nil
+}
+
+// NewDeviceListSource - source for a DEVICE_LIST_SOURCE setting, sftp when a
+// SCP server is configured and local otherwise.
+func NewDeviceListSource(kind string) (DeviceListSource, error) {
+	if kind == "" {
+		kind = DEVICE_LIST_SOURCE_LOCAL
+		if scpServerHost != "" {
+			kind = DEVICE_LIST_SOURCE_SFTP
+		}
+	}
+
+	switch kind {
+	case DEVICE_LIST_SOURCE_SFTP:
+		if scpServerHost == "" || scpServerUser == "" || scpServerRSA == "" || scpKnownHosts == "" {
+			return nil, errors.New("sftp device list source needs the scp host, user, key and known hosts")
+		}
+		return SFTPDeviceListSource{Host: scpServerHost, User: scpServerUser, KeyFile: scpServerRSA, KnownHosts: scpKnownHosts, Path: remoteFilePath}, nil
+	case DEVICE_LIST_SOURCE_HTTP:
+		if deviceListURL == "" {
+			return nil, errors.New("http device list source needs a url")
+		}
+		return HTTPDeviceListSource{URL: deviceListURL}, nil
+	case DEVICE_LIST_SOURCE_LOCAL:
+		// A relative path is the list already dropped in the target folder
+		if !filepath.IsAbs(remoteFilePath) {
+			return LocalDeviceListSource{Path: devicesFile, Verify: verifyLocal}, nil
+		}
+		return LocalDeviceListSource{Path: remoteFilePath, Verify: verifyLocal}, nil
+	}
+	return nil, fmt.Errorf("unknown device list source %q", kind)
+}
+
+// ----------------------------------------------
+// Local Device List
+// ----------------------------------------------
+func (s LocalDeviceListSource) String() string {
+	return "file://" + s.Path
+}
+
+func (s LocalDeviceListSource) Open(ctx context.Context) (io.ReadCloser, error) {
+	return os.Open(s.Path)
+}
+
+func (s LocalDeviceListSource) Checksum(ctx context.Context) (string, error) {
+	if !s.Verify {
+		return "", nil
+	}
+	f, err := os.Open(s.Path + DEVICE_LIST_CHECKSUM_SUFFIX)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return readChecksum(f)
+}
+
+// ----------------------------------------------
+// HTTP Device List
+// ----------------------------------------------
+func (s HTTPDeviceListSource) String() string {
+	return s.URL
+}
+
+func (s HTTPDeviceListSource) Open(ctx context.Context) (io.ReadCloser, error) {
+	return s.get(ctx, s.URL)
+}
+
+func (s HTTPDeviceListSource) Checksum(ctx context.Context) (string, error) {
+	body, err := s.get(ctx, s.URL+DEVICE_LIST_CHECKSUM_SUFFIX)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	return readChecksum(body)
+}
+
+func (s HTTPDeviceListSource) get(ctx context.Context, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// ----------------------------------------------
+// SFTP Device List
+// ----------------------------------------------
+func (s SFTPDeviceListSource) String() string {
+	return "sftp://" + s.User + "@" + s.Host + "/" + strings.TrimPrefix(s.Path, "/")
+}
+
+func (s SFTPDeviceListSource) Open(ctx context.Context) (io.ReadCloser, error) {
+	return s.open(ctx, s.Path)
+}
+
+func (s SFTPDeviceListSource) Checksum(ctx context.Context) (string, error) {
+	f, err := s.open(ctx, s.Path+DEVICE_LIST_CHECKSUM_SUFFIX)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return readChecksum(f)
+}
+
+func (s SFTPDeviceListSource) open(ctx context.Context, path string) (io.ReadCloser, error) {
+	key, err := ioutil.ReadFile(s.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	hostKeyCallback, err := knownhosts.New(s.KnownHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	host := s.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "22")
+	}
+	config := &ssh.ClientConfig{
+		User:            s.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}
+
+	conn, err := ssh.Dial("tcp", host, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Drop the session if the fetch is cancelled or times out
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	f, err := client.Open(path)
+	if err != nil {
+		client.Close()
+		conn.Close()
+		return nil, err
+	}
+	return sftpFile{File: f, client: client, conn: conn}, nil
+}
+
+func (f sftpFile) Close() error {
+	err := f.File.Close()
+	f.client.Close()
+	f.conn.Close()
+	return err
+}
+
+// ----------------------------------------------
+// Local Funcs
+// ----------------------------------------------
+
+// readChecksum - first field of a sha256sum line.
+func readChecksum(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(io.LimitReader(r, 4096)).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", errors.New("empty checksum")
+	}
+	sum := strings.ToLower(fields[0])
+	if _, err := hex.DecodeString(sum); err != nil || len(sum) != sha256.Size*2 {
+		return "", fmt.Errorf("invalid sha256 %q", fields[0])
+	}
+	return sum, nil
+}
@@ -0,0 +1,230 @@
+package cacheUpdater
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/context"
+)
+
+const testDeviceList = "A1,54601,US\nB2,H2X,CA\n"
+
+func checksumLine(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:]) + "  devices.csv\n"
+}
+
+func writeTestFile(t *testing.T, name string, data string) {
+	t.Helper()
+	if err := ioutil.WriteFile(name, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t *testing.T, name string) string {
+	t.Helper()
+	data, _ := ioutil.ReadFile(name)
+	return string(data)
+}
+
+func TestFetchDeviceListHTTP(t *testing.T) {
+	checksum := checksumLine(testDeviceList)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/devices.csv":
+			rw.Write([]byte(testDeviceList))
+		case "/devices.csv.sha256":
+			rw.Write([]byte(checksum))
+		default:
+			http.NotFound(rw, r)
+		}
+	}))
+	defer server.Close()
+
+	dst := filepath.Join(t.TempDir(), "devices.csv")
+	source := HTTPDeviceListSource{URL: server.URL + "/devices.csv"}
+	if err := FetchDeviceList(context.Background(), source, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, dst); got != testDeviceList {
+		t.Errorf("fetched %q", got)
+	}
+
+	// A list not matching its checksum leaves the previous one in place
+	checksum = checksumLine("A1,54601,US\n")
+	if err := FetchDeviceList(context.Background(), source, dst); !errors.Is(err, ErrDeviceListChecksum) {
+		t.Errorf("checksum mismatch got %v", err)
+	}
+	if got := readTestFile(t, dst); got != testDeviceList {
+		t.Errorf("list replaced by %q", got)
+	}
+
+	if err := FetchDeviceList(context.Background(), HTTPDeviceListSource{URL: server.URL + "/missing.csv"}, dst); err == nil {
+		t.Errorf("missing list fetched")
+	}
+}
+
+func TestFetchDeviceListLocal(t *testing.T) {
+	dir := t.TempDir()
+	list := filepath.Join(dir, "devices.csv")
+	dst := filepath.Join(dir, "target.csv")
+	writeTestFile(t, list, testDeviceList)
+
+	// Unverified by default, the checksum file is optional
+	if err := FetchDeviceList(context.Background(), LocalDeviceListSource{Path: list}, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, dst); got != testDeviceList {
+		t.Errorf("fetched %q", got)
+	}
+
+	verified := LocalDeviceListSource{Path: list, Verify: true}
+	if err := FetchDeviceList(context.Background(), verified, dst); err == nil {
+		t.Errorf("verified without a checksum file")
+	}
+	writeTestFile(t, list+DEVICE_LIST_CHECKSUM_SUFFIX, checksumLine(testDeviceList))
+	if err := FetchDeviceList(context.Background(), verified, dst); err != nil {
+		t.Error(err)
+	}
+	writeTestFile(t, list+DEVICE_LIST_CHECKSUM_SUFFIX, checksumLine("changed"))
+	if err := FetchDeviceList(context.Background(), verified, dst); !errors.Is(err, ErrDeviceListChecksum) {
+		t.Errorf("checksum mismatch got %v", err)
+	}
+
+	// The list already dropped in the target folder is its own source
+	if err := FetchDeviceList(context.Background(), LocalDeviceListSource{Path: dst}, dst); err != nil {
+		t.Error(err)
+	}
+	if got := readTestFile(t, dst); got != testDeviceList {
+		t.Errorf("list in place became %q", got)
+	}
+}
+
+func TestFetchDeviceListSFTP(t *testing.T) {
+	dir := t.TempDir()
+	list := filepath.Join(dir, "devices.csv")
+	writeTestFile(t, list, testDeviceList)
+	writeTestFile(t, list+DEVICE_LIST_CHECKSUM_SUFFIX, checksumLine(testDeviceList))
+
+	addr, hostKey, keyFile := startSFTPServer(t)
+	knownHosts := filepath.Join(dir, "known_hosts")
+	writeTestFile(t, knownHosts, knownhosts.Line([]string{knownhosts.Normalize(addr)}, hostKey)+"\n")
+
+	dst := filepath.Join(dir, "target.csv")
+	source := SFTPDeviceListSource{Host: addr, User: "updater", KeyFile: keyFile, KnownHosts: knownHosts, Path: list}
+	if err := FetchDeviceList(context.Background(), source, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, dst); got != testDeviceList {
+		t.Errorf("fetched %q", got)
+	}
+
+	// A host key missing from known_hosts is refused
+	_, otherKey, _ := startSFTPServer(t)
+	writeTestFile(t, knownHosts, knownhosts.Line([]string{knownhosts.Normalize(addr)}, otherKey)+"\n")
+	if err := FetchDeviceList(context.Background(), source, filepath.Join(dir, "other.csv")); err == nil {
+		t.Errorf("fetched from a host with an unknown key")
+	}
+}
+
+// startSFTPServer - sftp server on a local port, serving the file system to
+// the returned client key.
+func startSFTPServer(t *testing.T) (string, ssh.PublicKey, string) {
+	t.Helper()
+	newKey := func() (*ecdsa.PrivateKey, ssh.Signer) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key, signer
+	}
+	_, hostSigner := newKey()
+	clientKey, clientSigner := newKey()
+
+	der, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ecdsa")
+	writeTestFile(t, keyFile, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})))
+
+	authorized := string(clientSigner.PublicKey().Marshal())
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != authorized {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, config)
+		}
+	}()
+	return listener.Addr().String(), hostSigner.PublicKey(), keyFile
+}
+
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "session only")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range channelRequests {
+				// Subsystem payload, the length prefixed "sftp"
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					if server, err := sftp.NewServer(channel); err == nil {
+						server.Serve()
+					}
+					channel.Close()
+				}
+			}
+		}()
+	}
+}
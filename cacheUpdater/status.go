@@ -0,0 +1,151 @@
+package cacheUpdater
+
+//----------------------------------------------
+// CopyRight 2019 La Crosse Technology, LTD.
+//----------------------------------------------
+
+//----------------------------------------------
+// Imports
+//----------------------------------------------
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ----------------------------------------------
+// Types
+// ----------------------------------------------
+type (
+	// UpdaterStatus - GET /status
+	UpdaterStatus struct {
+		Started    time.Time       `json:"started"`
+		Jobs       []JobStatus     `json:"jobs"`
+		Dispatcher DispatcherStats `json:"dispatcher"`
+	}
+
+	outcomeReply struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+)
+
+// ----------------------------------------------
+// Local Funcs
+// ----------------------------------------------
+
+// serveStatus - job status and control endpoints on port
+func serveStatus(port string, started time.Time) {
+	router := mux.NewRouter()
+	router.HandleFunc("/status", func(rw http.ResponseWriter, r *http.Request) {
+		actionGetStatus(rw, r, started)
+	}).Methods("GET")
+	router.HandleFunc("/jobs/{name}", actionGetJob).Methods("GET")
+	router.HandleFunc("/jobs/{name}/trigger", actionTriggerJob).Methods("POST")
+	router.HandleFunc("/jobs/{name}/pause", actionPauseJob).Methods("POST")
+	router.HandleFunc("/jobs/{name}/resume", actionPauseJob).Methods("POST")
+
+	log.Println("[CacheUpdater] Status server on port : " + port)
+	if err := http.ListenAndServe(":"+port, router); err != nil {
+		log.Printf("[CacheUpdater] Status server error| %v", err)
+	}
+}
+
+// ----------------------------------------------
+// @actionGetStatus
+// [GET] /status
+// ----------------------------------------------
+func actionGetStatus(rw http.ResponseWriter, r *http.Request, started time.Time) {
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(UpdaterStatus{
+		Started:    started,
+		Jobs:       scheduler.Statuses(),
+		Dispatcher: dispatcher.Stats(),
+	})
+}
+
+// ----------------------------------------------
+// @actionGetJob
+// [GET] /jobs/{name}
+// ----------------------------------------------
+func actionGetJob(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	status, err := scheduler.Status(mux.Vars(r)["name"])
+	if err != nil {
+		sendOutcomeResponse(rw, http.StatusNotFound, err)
+		return
+	}
+	json.NewEncoder(rw).Encode(status)
+}
+
+// ----------------------------------------------
+// @actionTriggerJob
+// [POST] /jobs/{name}/trigger
+// Runs the job now, 409 while it is running
+// ----------------------------------------------
+func actionTriggerJob(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	if !checkAdminRequest(rw, r) {
+		return
+	}
+
+	switch err := scheduler.Trigger(mux.Vars(r)["name"]); err {
+	case nil:
+		sendOutcomeResponse(rw, http.StatusAccepted, nil)
+	case ErrJobNotFound:
+		sendOutcomeResponse(rw, http.StatusNotFound, err)
+	case ErrJobRunning:
+		sendOutcomeResponse(rw, http.StatusConflict, err)
+	default:
+		sendOutcomeResponse(rw, http.StatusServiceUnavailable, err)
+	}
+}
+
+// ----------------------------------------------
+// @actionPauseJob
+// [POST] /jobs/{name}/pause, /jobs/{name}/resume
+// ----------------------------------------------
+func actionPauseJob(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	if !checkAdminRequest(rw, r) {
+		return
+	}
+
+	paused := strings.HasSuffix(r.URL.Path, "/pause")
+	status, err := scheduler.SetPaused(mux.Vars(r)["name"], paused)
+	if err != nil {
+		sendOutcomeResponse(rw, http.StatusNotFound, err)
+		return
+	}
+	json.NewEncoder(rw).Encode(status)
+}
+
+// checkAdminRequest - control endpoints need the ADMIN_TOKEN bearer, they are
+// disabled while no token is set. Answers the request when refused.
+func checkAdminRequest(rw http.ResponseWriter, r *http.Request) bool {
+	if adminToken == "" {
+		sendOutcomeResponse(rw, http.StatusForbidden, errors.New("Job controls disabled, no admin token set"))
+		return false
+	}
+	expected := []byte("Bearer " + adminToken)
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+		sendOutcomeResponse(rw, http.StatusUnauthorized, errors.New("Wrong bearer token"))
+		return false
+	}
+	return true
+}
+
+func sendOutcomeResponse(rw http.ResponseWriter, code int, err error) {
+	rw.WriteHeader(code)
+	res := outcomeReply{Code: code, Message: "Success"}
+	if err != nil {
+		res.Message = err.Error()
+	}
+	json.NewEncoder(rw).Encode(res)
+}
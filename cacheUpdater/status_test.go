@@ -0,0 +1,44 @@
+package cacheUpdater
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestJobControlsNeedAdminToken(t *testing.T) {
+	previous := adminToken
+	t.Cleanup(func() { adminToken = previous })
+
+	request := func(authorization string) int {
+		r := httptest.NewRequest(http.MethodPost, "/jobs/sync/trigger", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		rw := httptest.NewRecorder()
+		if checkAdminRequest(rw, r) {
+			return http.StatusOK
+		}
+		return rw.Code
+	}
+
+	// Disabled without a token, whatever the request carries
+	adminToken = ""
+	for _, authorization := range []string{"", "Bearer ", "Bearer x"} {
+		if code := request(authorization); code != http.StatusForbidden {
+			t.Errorf("no token, %q got %d", authorization, code)
+		}
+	}
+
+	adminToken = "secret"
+	for authorization, want := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"secret":        http.StatusUnauthorized,
+		"Bearer secret": http.StatusOK,
+	} {
+		if code := request(authorization); code != want {
+			t.Errorf("%q got %d, want %d", authorization, code, want)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package cacheUpdater
+
+//----------------------------------------------
+// CopyRight 2019 La Crosse Technology, LTD.
+//----------------------------------------------
+
+//----------------------------------------------
+// Imports
+//----------------------------------------------
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/sibivishnu/Weather/common"
+	"github.com/sibivishnu/Weather/common/clock"
+	"github.com/sibivishnu/Weather/common/const/device"
+	"golang.org/x/net/context"
+)
+
+// ----------------------------------------------
+// Constants
+// ----------------------------------------------
+const (
+	// What happens to devices dropped from the list
+	DEVICE_REMOVAL_KEEP   = "keep"   // forgotten by the sync only
+	DEVICE_REMOVAL_EXPIRE = "expire" // marked removed, Redis keys expire after DEVICE_REMOVAL_TTL, Datastore keeps the record
+	DEVICE_REMOVAL_DELETE = "delete" // record and Redis keys deleted
+
+	DEVICE_REMOVAL_DEFAULT_TTL = 30 * 24 * time.Hour
+
+	// A list dropping more than this share of the known devices is assumed broken,
+	// removals are skipped for the run
+	DEVICE_REMOVAL_MAX_RATIO = 0.5
+
+	DEVICE_SYNC_SNAPSHOT_KEY = "devicelist.snapshot" // hash serial -> line checksum
+	DEVICE_SYNC_RUNS_KEY     = "devicelist.runs"     // run summaries, newest first
+	DEVICE_SYNC_RUNS_MAX     = 100
+)
+
+// ----------------------------------------------
+// Types
+// ----------------------------------------------
+type (
+	// DeviceSyncSummary - outcome of a runCacheIDUpdater run.
+	DeviceSyncSummary struct {
+		Started         time.Time `json:"started"`
+		Finished        time.Time `json:"finished"`
+		Source          string    `json:"source"`
+		Total           int       `json:"total"`
+		Added           int       `json:"added"`
+		Changed         int       `json:"changed"`
+		Unchanged       int       `json:"unchanged"`
+		Removed         int       `json:"removed"`
+		RemovalPolicy   string    `json:"removalPolicy"`
+		RemovalsSkipped bool      `json:"removalsSkipped,omitempty"`
+		Invalid         int       `json:"invalid"`
+		Duplicates      int       `json:"duplicates"`
+		Retrying        int       `json:"retrying"`     // left to the retry queue
+		DeadLettered    int       `json:"deadLettered"` // left until requeued
+		Jobs            int       `json:"jobs"`
+		JobsFailed      int       `json:"jobsFailed"`
+		JobsTimedOut    int       `json:"jobsTimedOut"`
+		Errors          []string  `json:"errors,omitempty"`
+	}
+
+	// deviceListDiff - serials of the new list against the snapshot
+	deviceListDiff struct {
+		Added     []string
+		Changed   []string
+		Removed   []string
+		Unchanged int
+	}
+)
+
+// ----------------------------------------------
+// Exports
+// ----------------------------------------------
+
+// GetDeviceSyncRuns - most recent run summaries, newest first.
+func GetDeviceSyncRuns(limit int) ([]DeviceSyncSummary, error) {
+	if limit <= 0 || limit > DEVICE_SYNC_RUNS_MAX {
+		limit = DEVICE_SYNC_RUNS_MAX
+	}
+	entries, err := common.RedisInstance.RedisSession.LRange(DEVICE_SYNC_RUNS_KEY, 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	runs := []DeviceSyncSummary{}
+	for _, entry := range entries {
+		var run DeviceSyncSummary
+		if err := json.Unmarshal([]byte(entry), &run); err == nil {
+			runs = append(runs, run)
+		}
+	}
+	return runs, nil
+}
+
+// ----------------------------------------------
+// Local Funcs
+// ----------------------------------------------
+
+// syncDeviceList - queues the added and changed lines of the device file and
+// applies the removal policy to serials no longer listed.
+func syncDeviceList(ctx context.Context, run *Run, summary *DeviceSyncSummary) error {
+	lines, err := readDeviceList(devicesFile, summary)
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := common.RedisInstance.RedisSession.HGetAll(DEVICE_SYNC_SNAPSHOT_KEY).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	skip, err := reconcileDeviceFailures(lines, summary)
+	if err != nil {
+		return err
+	}
+
+	diff := diffDeviceList(snapshot, lines)
+	summary.Added = len(diff.Added)
+	summary.Changed = len(diff.Changed)
+	summary.Unchanged = diff.Unchanged
+
+	// The snapshot entry is written by cacheID once the device is saved, failed
+	// devices are retried from the retry queue rather than by the next run
+	var batch []string
+	for _, serials := range [][]string{diff.Added, diff.Changed} {
+		for _, serial := range serials {
+			if skip[serial] {
+				continue
+			}
+			batch = append(batch, lines[serial])
+			if len(batch) == device.SensorLookupBatchSize {
+				if err := dispatcher.Submit(ctx, run.Job(batch)); err != nil {
+					return err
+				}
+				batch = nil
+			}
+		}
+	}
+	if len(batch) > 0 {
+		if err := dispatcher.Submit(ctx, run.Job(batch)); err != nil {
+			return err
+		}
+	}
+
+	// Without a snapshot, the devices stored before the first run are the known ones
+	known := len(snapshot)
+	if len(snapshot) == 0 {
+		stored, err := device.Store.Find(device.DeviceFilter{})
+		if err != nil {
+			return err
+		}
+		diff.Removed = orphanedDevices(stored, lines)
+		known = len(stored)
+	}
+
+	if len(diff.Removed) > 0 && float64(len(diff.Removed)) > float64(known)*DEVICE_REMOVAL_MAX_RATIO {
+		log.Printf("[DeviceSync] %d of %d devices missing from the list, removals skipped", len(diff.Removed), known)
+		summary.RemovalsSkipped = true
+		return nil
+	}
+
+	for _, serial := range diff.Removed {
+		if err := removeDevice(serial); err != nil {
+			summary.Errors = append(summary.Errors, fmt.Sprintf("remove %s: %v", serial, err))
+			continue
+		}
+		summary.Removed++
+	}
+	return nil
+}
+
+// readDeviceList - lines of the device file by serial, the last line of a serial wins.
+func readDeviceList(filename string, summary *DeviceSyncSummary) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		serial := deviceListSerial(line)
+		if serial == "" {
+			log.Printf("[DeviceSync] Invalid device line %q", line)
+			summary.Invalid++
+			continue
+		}
+		if _, ok := lines[serial]; ok {
+			summary.Duplicates++
+		}
+		lines[serial] = line
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	summary.Total = len(lines)
+	return lines, nil
+}
+
+func diffDeviceList(snapshot map[string]string, lines map[string]string) deviceListDiff {
+	var diff deviceListDiff
+	for serial, line := range lines {
+		previous, ok := snapshot[serial]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, serial)
+		case previous != deviceLineChecksum(line):
+			diff.Changed = append(diff.Changed, serial)
+		default:
+			diff.Unchanged++
+		}
+	}
+	for serial := range snapshot {
+		if _, ok := lines[serial]; !ok {
+			diff.Removed = append(diff.Removed, serial)
+		}
+	}
+	return diff
+}
+
+// orphanedDevices - stored devices missing from the list.
+func orphanedDevices(stored []string, lines map[string]string) []string {
+	var orphans []string
+	for _, serial := range stored {
+		if _, ok := lines[serial]; !ok {
+			orphans = append(orphans, serial)
+		}
+	}
+	return orphans
+}
+
+// markDeviceSynced - records the line the device was last saved from, and
+// clears its retries.
+func markDeviceSynced(serial string, line string) {
+	pipe := common.RedisInstance.RedisSession.TxPipeline()
+	pipe.HSet(DEVICE_SYNC_SNAPSHOT_KEY, serial, deviceLineChecksum(line))
+	pipe.HDel(DEVICE_FAILURES_KEY, serial)
+	pipe.ZRem(DEVICE_RETRY_KEY, serial)
+	if _, err := pipe.Exec(); err != nil {
+		log.Printf("[DeviceSync] Unable to update snapshot for %s| %v", serial, err)
+	}
+}
+
+// removeDevice - applies deviceRemovalPolicy to a serial dropped from the list.
+func removeDevice(serial string) error {
+	var err error
+	switch deviceRemovalPolicy {
+	case DEVICE_REMOVAL_DELETE:
+		err = device.PurgeDevice(serial)
+		if err == device.ErrDeviceNotFound {
+			err = nil
+		}
+	case DEVICE_REMOVAL_EXPIRE:
+		err = device.ExpireDevice(serial, deviceRemovalTTL)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[DeviceSync] Device %s removed from the list (%s)", serial, deviceRemovalPolicy)
+	return common.RedisInstance.RedisSession.HDel(DEVICE_SYNC_SNAPSHOT_KEY, serial).Err()
+}
+
+// recordDeviceSync - stores and logs a run summary.
+func recordDeviceSync(clk clock.Clock, summary DeviceSyncSummary) {
+	summary.Finished = clk.Now().UTC()
+	log.Printf("[DeviceSync] %s total:%d added:%d changed:%d unchanged:%d removed:%d invalid:%d duplicates:%d retrying:%d deadlettered:%d jobs:%d failed:%d timedout:%d errors:%d",
+		summary.Source, summary.Total, summary.Added, summary.Changed, summary.Unchanged, summary.Removed, summary.Invalid, summary.Duplicates,
+		summary.Retrying, summary.DeadLettered, summary.Jobs, summary.JobsFailed, summary.JobsTimedOut, len(summary.Errors))
+
+	dataBytes, err := json.Marshal(summary)
+	if err != nil {
+		return
+	}
+	pipe := common.RedisInstance.RedisSession.TxPipeline()
+	pipe.LPush(DEVICE_SYNC_RUNS_KEY, dataBytes)
+	pipe.LTrim(DEVICE_SYNC_RUNS_KEY, 0, DEVICE_SYNC_RUNS_MAX-1)
+	if _, err = pipe.Exec(); err != nil {
+		log.Printf("[DeviceSync] Unable to record run summary| %v", err)
+	}
+}
+
+func deviceListSerial(line string) string {
+	fields := strings.Split(line, ",")
+	if len(fields) < 2 {
+		return ""
+	}
+	return strings.TrimSpace(fields[0])
+}
+
+func deviceLineChecksum(line string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(line)))
+	return hex.EncodeToString(sum[:8])
+}
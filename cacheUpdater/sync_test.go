@@ -0,0 +1,102 @@
+package cacheUpdater
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+	"github.com/sibivishnu/Weather/common"
+	"github.com/sibivishnu/Weather/common/cache"
+	"github.com/sibivishnu/Weather/common/clock"
+	"github.com/sibivishnu/Weather/common/const/device"
+	"golang.org/x/net/context"
+)
+
+// useTestStore - device store and dispatcher on a local Redis, jobs are dropped.
+func useTestStore(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	m := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	previousRedis, previousStore, previousDispatcher := common.RedisInstance, device.Store, dispatcher
+	common.RedisInstance = &cache.RedisInstance{RedisSession: client}
+	device.Store = device.NewRedisDeviceStore(common.RedisInstance, nil)
+	dispatcher = NewDispatcher(clock.SystemClock{}, 1, 10, time.Minute, func(context.Context, clock.Clock, Job) error { return nil })
+	dispatcher.Run()
+	t.Cleanup(func() {
+		dispatcher.Stop(context.Background())
+		common.RedisInstance, device.Store, dispatcher = previousRedis, previousStore, previousDispatcher
+		client.Close()
+	})
+	return m
+}
+
+func TestFirstSyncRemovesOrphanedDevices(t *testing.T) {
+	useTestStore(t)
+	defer func(file, policy string, ttl time.Duration) {
+		devicesFile, deviceRemovalPolicy, deviceRemovalTTL = file, policy, ttl
+	}(devicesFile, deviceRemovalPolicy, deviceRemovalTTL)
+	devicesFile = filepath.Join(t.TempDir(), "devices.csv")
+	deviceRemovalPolicy = DEVICE_REMOVAL_EXPIRE
+	deviceRemovalTTL = time.Hour
+
+	for _, id := range []string{"A1", "B2", "C3"} {
+		device.Store.Put(device.Device{ID: id, Category: device.CAT2})
+	}
+	syncList := func(list string) DeviceSyncSummary {
+		t.Helper()
+		writeTestFile(t, devicesFile, list)
+		var summary DeviceSyncSummary
+		run := NewRun()
+		if err := syncDeviceList(context.Background(), run, &summary); err != nil {
+			t.Fatal(err)
+		}
+		run.Wait(context.Background())
+		return summary
+	}
+
+	// Most of the stored devices missing, the list is assumed broken
+	if summary := syncList("A1,key\n"); summary.Removed != 0 || !summary.RemovalsSkipped {
+		t.Errorf("short list removed %d devices", summary.Removed)
+	}
+
+	summary := syncList("A1,key\nB2,key\n")
+	if summary.Added != 2 || summary.Removed != 1 || summary.RemovalsSkipped {
+		t.Errorf("got %+v", summary)
+	}
+	if _, err := device.Store.Get("C3"); err != device.ErrDeviceNotFound {
+		t.Errorf("orphaned device got %v", err)
+	}
+	if ids, _ := device.Store.Find(device.DeviceFilter{}); !reflect.DeepEqual(ids, []string{"A1", "B2"}) {
+		t.Errorf("index holds %v", ids)
+	}
+}
+
+func TestPaddedDeviceLineSyncsTrimmedSerial(t *testing.T) {
+	m := useTestStore(t)
+	clk := clock.NewFakeClock(time.Date(2020, 5, 4, 18, 0, 0, 0, time.UTC))
+
+	line := " A1 , psk \n"
+	if err := cacheID(clk, line, device.RawSensorEntity{Serial: "A1"}); err != nil {
+		t.Fatal(err)
+	}
+	d, err := device.Store.Get("A1")
+	if err != nil {
+		t.Fatalf("device not stored under its trimmed serial: %v", err)
+	}
+	if d.PSK != "psk" {
+		t.Errorf("stored PSK %q", d.PSK)
+	}
+	if _, err := device.Store.Get(" A1 "); err != device.ErrDeviceNotFound {
+		t.Errorf("padded serial got %v", err)
+	}
+	if checksum := m.HGet(DEVICE_SYNC_SNAPSHOT_KEY, "A1"); checksum != deviceLineChecksum(line) {
+		t.Errorf("snapshot holds %q", checksum)
+	}
+
+	if err := cacheID(clk, " ,psk", device.RawSensorEntity{}); err == nil {
+		t.Errorf("line without serial saved")
+	}
+}
@@ -8,19 +8,18 @@ package cacheUpdater
 // Imports
 //----------------------------------------------
 import (
-	"bufio"
-	"bytes"
-	"cloud.google.com/go/datastore"
 	"cloud.google.com/go/pubsub"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/sibivishnu/Weather/common"
+	"github.com/sibivishnu/Weather/common/clock"
 	"github.com/sibivishnu/Weather/common/const/device"
 	"github.com/sibivishnu/Weather/common/providers/weather_api"
 	"golang.org/x/net/context"
 	"log"
-	"os"
-	"os/exec"
+	"math/rand"
+	"path/filepath"
 	"strings"
 	"time"
 )
@@ -32,39 +31,37 @@ import (
 // ----------------------------------------------
 // Local Funcs
 // ----------------------------------------------
-func copyFile() {
-	if scpServerHost == "" {
-		log.Printf("NO SCP Settings Provided, Bypassing SCP Remote File Step.")
-	} else {
-		log.Printf("COPYING DEVICE FILE FROM REMOTE SERVER : scpServerRSA: %s, scpServerUser: %s, scpServerHost: %s, remoteFilePath: %s, targetFolder: %s", scpServerRSA, scpServerUser, scpServerHost, remoteFilePath, targetFolder)
-
-		var out_cmd, err_cmd bytes.Buffer
-		cmd := exec.Command("scp", "-o", "StrictHostKeyChecking=no", "-i", scpServerRSA, scpServerUser+"@"+scpServerHost+":"+remoteFilePath, targetFolder)
-		cmd.Stdout = &out_cmd
-		cmd.Stderr = &err_cmd
-
-		err := cmd.Run()
-
-		if err != nil {
-			fmt.Println("Scp Command error :", err_cmd.String())
-		}
+func copyFile() error {
+	if deviceListSource == nil {
+		return errors.New("no device list source configured")
 	}
+	return FetchDeviceList(common.CTX, deviceListSource, devicesFile)
 }
 
-func runForecastUpdater() {
+func runForecastUpdater(ctx context.Context, clk clock.Clock) (map[string]int, error) {
 	log.Printf("forecast runing")
-	locationListMap, _ := common.RedisInstance.QueryCache("activelocations*")
+	locationListMap, err := common.RedisInstance.QueryCache("activelocations*")
+	if err != nil {
+		return nil, err
+	}
 
+	counts := map[string]int{"locations": len(locationListMap)}
 	for locKey, locVal := range locationListMap {
+		if err := ctx.Err(); err != nil {
+			return counts, err
+		}
+
 		keyArr := strings.Split(locKey, ":")
 		if len(keyArr) < 2 {
 			log.Printf("Wrong location key %s", locKey)
+			counts["invalid"]++
 			continue
 		}
 
 		valArr := strings.Split(locVal, ":")
 		if len(valArr) < 2 {
 			log.Printf("Wrong location value %s", locVal)
+			counts["invalid"]++
 			continue
 		}
 
@@ -73,67 +70,88 @@ func runForecastUpdater() {
 		devCategory := valArr[1]
 
 		//accuWeather.SetLocalDateAndHour(timeZone)
-		weatherTime, err := weather_api.GetLocalDateAndHour(timeZone)
+		weatherTime, err := weather_api.GetLocalDateAndHour(clk, timeZone)
 		if err != nil {
 			log.Printf("Could not get time for the timeZone %s", timeZone)
+			counts["invalid"]++
 			continue
 		}
 
 		log.Printf("Forecast refreshing for Category : %s, Accuweather key : %s, Timezone : %s, Local Date : %s, Local Time : %s, Hour range : %s", devCategory, rawLocKey, timeZone, weatherTime.LocalDate, weatherTime.LocalTime, weatherTime.HourRange)
 		switch devCategory {
 		case device.CAT2, device.CAT1:
-			weather_api.QueryAccuDayForecastAPI(rawLocKey, timeZone, "1day", weatherTime)
+			weather_api.QueryAccuDayForecastAPI(clk, rawLocKey, timeZone, "1day", weatherTime)
 		case device.CAT3:
 			weather_api.QueryAccuHourForecastAPI(rawLocKey, "24hour", weatherTime)
-			weather_api.QueryAccuDayForecastAPI(rawLocKey, timeZone, "10day", weatherTime)
+			weather_api.QueryAccuDayForecastAPI(clk, rawLocKey, timeZone, "10day", weatherTime)
 		}
-
+		counts["refreshed"]++
 	}
 
+	return counts, nil
 }
 
-func dstUpdateProcess() {
-
-	// Zip code
-	runDSTUpdater("zip:*")
-
-	// Postal Code
-	runDSTUpdater("postalcode:*")
-
-}
-
-func runDSTUpdater(filter string) {
-
-	log.Printf("forecast runing")
-	locationListMap, _ := common.RedisInstance.QueryCache(filter)
-	now := time.Now()
-
-	for locKey, locVal := range locationListMap {
-		var pc weather_api.PostalCodeResponse
-		err := json.Unmarshal([]byte(locVal), &pc)
-
-		layout := "2006-01-02T15:04:05Z"
-		t, err := time.Parse(layout, pc.TimeZone.NextOffsetChange)
-		if err != nil {
-			//log.Printf("runDSTUpdater : Could not parse time %s for key %s", pc.TimeZone.NextOffsetChange, locKey)
-			continue
-		}
-
-		if t.Before(now) {
-			log.Printf("DST reached for key : %s", locKey)
-			common.RedisInstance.RemoveKeyFromCache(locKey)
+// expireLocationRecords - location records saved without an expiry (before
+// LocationRecordTTL) get one, spread over the second half of the TTL so they
+// are not all looked up again the same day.
+func expireLocationRecords(ctx context.Context, clk clock.Clock) (map[string]int, error) {
+	counts := map[string]int{}
+	for _, filter := range []string{"zip:*", "postalcode:*"} {
+		var cursor uint64
+		for {
+			if err := ctx.Err(); err != nil {
+				return counts, err
+			}
+			keys, next, err := common.RedisInstance.RedisSession.Scan(cursor, filter, 500).Result()
+			if err != nil {
+				return counts, err
+			}
+			counts["scanned"] += len(keys)
+
+			for _, key := range keys {
+				ttl, err := common.RedisInstance.RedisSession.TTL(key).Result()
+				if err != nil || ttl >= 0 {
+					continue
+				}
+				expiration := weather_api.LocationRecordTTL/2 + time.Duration(rand.Int63n(int64(weather_api.LocationRecordTTL/2)))
+				if common.RedisInstance.RedisSession.Expire(key, expiration).Err() == nil {
+					counts["expiring"]++
+				}
+			}
+
+			if cursor = next; cursor == 0 {
+				break
+			}
 		}
-
 	}
+	return counts, nil
+}
 
+// rebuildDeviceIndex - the deviceindex: sets of the cached devices, for records
+// written before the index or writes it missed.
+func rebuildDeviceIndex(ctx context.Context, clk clock.Clock) (map[string]int, error) {
+	store, ok := device.Store.(*device.RedisDeviceStore)
+	if !ok {
+		return nil, nil
+	}
+	devices, err := store.RebuildIndex()
+	return map[string]int{"devices": devices}, err
 }
 
-func runDeviceGeoRefreshUpdater() {
+func runDeviceGeoRefreshUpdater(ctx context.Context, clk clock.Clock) (map[string]int, error) {
 
 	log.Printf("Updating geo refresh count")
-	deviceListMap, _ := common.RedisInstance.QueryCache("devicerequested:*")
+	deviceListMap, err := common.RedisInstance.QueryCache("devicerequested:*")
+	if err != nil {
+		return nil, err
+	}
 
+	counts := map[string]int{"devices": len(deviceListMap)}
 	for deviceKey, _ := range deviceListMap {
+		if err := ctx.Err(); err != nil {
+			return counts, err
+		}
+
 		keyArr := strings.Split(deviceKey, ":")
 		if len(keyArr) < 2 {
 			log.Printf("Wrong device requested record key %s", deviceKey)
@@ -141,247 +159,262 @@ func runDeviceGeoRefreshUpdater() {
 		}
 
 		deviceID := keyArr[1]
-		key := "device:" + deviceID
-
-		data, err := common.RedisInstance.GetCachedData(key)
-
-		// No data found from the cache
-		if err != nil {
-			log.Printf("Wrong device requested record key %s", deviceKey)
-			continue
-		}
-
-		var d device.Device
-		json.Unmarshal(data, &d)
 
-		d.GeoRefreshCount = 0
-		dataBytes, _ := json.Marshal(d)
-		err = common.RedisInstance.SaveRedisData(dataBytes, key, 0)
+		_, err := device.UpdateDevice(deviceID, func(d *device.Device) error {
+			d.GeoRefreshCount = 0
+			return nil
+		})
 		if err != nil {
 			log.Printf("Wrong device requested record key %s", deviceKey)
+			counts["failed"]++
 			continue
 		}
-
+		counts["reset"]++
 	}
 
+	return counts, nil
 }
 
-func listenGeo() {
-	log.Println("[Listen] Geo: " + subscriptionName + " @ " + topicName)
-	client, err := pubsub.NewClient(common.CTX, projectID)
-	if err != nil {
-		panic(err)
-	}
+// handleGeoMessage - geo topic, location of a device without AccuWeather key
+func handleGeoMessage(ctx context.Context, clk clock.Clock, m *pubsub.Message) error {
+	log.Println("[Listen] Geo: New pub/sub request")
+	var dps device.DevicePubSub
 
-	/*
-		log.Println(projectID)
-		log.Println(subscriptionName)
-		log.Println(topicName)
-	*/
-
-	sub := client.Subscription(subscriptionName)
-
-	// We check if the subscription exists
-	ok, err := sub.Exists(common.CTX)
-	if err != nil {
-		log.Printf("[Listen] Geo: Exception %v", err)
-		panic(err)
+	// We need to extract the device UUID from the payload
+	if err := json.Unmarshal(m.Data, &dps); err != nil {
+		return Poison(err)
 	}
-
-	topic := client.Topic(topicName)
-	//attribute := client.Topic(attributeTopic)
-
-	// If the subscription doesn't exist, then we need to create one
-	if !ok {
-		log.Println("[Listen] Geo: Subscription does not exist. Creating one")
-		sub, err = client.CreateSubscription(common.CTX, subscriptionName, pubsub.SubscriptionConfig{Topic: topic})
-		if err != nil {
-			log.Printf("[Listen] Geo: Exception %v", err)
-			panic(err)
-		}
-
+	if err := dps.Validate(); err != nil {
+		return Poison(err)
 	}
+	log.Printf("[Listen] Geo: Serial : %s Zip : %s", dps.Serial, dps.Zip)
 
-	// Receive messages
-	log.Println("[Listen] Geo: Begining listening on the queue")
-	err = sub.Receive(common.CTX, func(ctx context.Context, m *pubsub.Message) {
-
-		log.Println("[Listen] Geo: New pub/sub request")
-		var dev device.Device
-		var dps device.DevicePubSub
-
-		// We need to extract the device UUID from the payload
-		json.Unmarshal(m.Data, &dps)
-		key := "device:" + dps.Serial
-		log.Printf("[Listen] Geo: Serial : %s Zip : %s", dps.Serial, dps.Zip)
-
-		deviceByte, _ := common.RedisInstance.GetCachedData(key)
-		json.Unmarshal(deviceByte, &dev)
-
+	var previous device.Geo
+	updated := false
+	dev, err := device.UpsertDevice(dps.Serial, func(dev *device.Device) error {
+		updated = false
 		if dev.Geo.ACWKey != "" {
 			log.Printf("[Listen] Geo:We already have an ACW Key %s in the cache for device %s, The pub/sub received will be ignored", dev.Geo.ACWKey, dev.ID)
-		} else {
+			return device.ErrNoChange
+		}
 
-			dev.Geo.Zip = dps.Zip
-			dev.Geo.CountryCode = dps.CountryCode
-			dev.Geo.Timezone = dps.Timezone
-			dev.Geo.Anonymous = dps.Anonymous
-			dev.Geo.Latitude = dps.Latitude
+		// Redeliveries and retries can arrive after a newer message
+		if m.PublishTime.Before(dev.GeoPublished) {
+			log.Printf("[Listen] Geo: Message %s published %v, device %s already at %v, ignored", m.ID, m.PublishTime, dev.ID, dev.GeoPublished)
+			return device.ErrNoChange
+		}
 
-			newDeviceByte, _ := json.Marshal(dev)
-			common.RedisInstance.SaveRedisData(newDeviceByte, key, 0)
-			log.Println("[Listen] Geo: Device Data updated successfully")
+		geo := dev.Geo
+		geo.Zip = strings.TrimSpace(dps.Zip)
+		geo.CountryCode = device.NormalizeCountryCode(dps.CountryCode)
+		geo.Timezone = dps.Timezone
+		geo.Anonymous = dps.Anonymous
+		geo.Latitude = dps.Latitude
+		geo.Longitude = dps.Longitude
+		if geo == dev.Geo && !m.PublishTime.After(dev.GeoPublished) {
+			return device.ErrNoChange
 		}
 
-		m.Ack()
+		dev.GeoPublished = m.PublishTime
+		if geo != dev.Geo {
+			previous = dev.Geo
+			dev.Geo = geo
+			updated = true
+		}
+		return nil
 	})
+	if err != nil {
+		log.Printf("[Listen] Geo: Unable to save device %s| %v", dps.Serial, err)
+		return err
+	}
 
-	// If context don't get canceled and program exit then something is wrong
-	if err != context.Canceled {
-		panic(err)
+	if updated {
+		device.RecordLocationChange(clk, dev.ID, device.LocationSourcePubSub, m.ID, previous, dev.Geo)
+		log.Println("[Listen] Geo: Device Data updated successfully")
 	}
+	return nil
 }
 
-func listenAttr() {
-	log.Println("[Listen] Attribute: " + attributeSubscription + " @ " + attributeTopic)
-	client, err := pubsub.NewClient(common.CTX, projectID)
-	if err != nil {
-		panic(err)
-	}
-	sub := client.Subscription(attributeSubscription)
+// handleAttrMessage - attribute topic, the device attributes changed in Datastore
+func handleAttrMessage(ctx context.Context, clk clock.Clock, m *pubsub.Message) error {
+	log.Println("[Listen] Attribute: New pub/sub request")
+	var dps device.DevicePubSub
 
-	// We check if the subscription exists
-	ok, err := sub.Exists(common.CTX)
-	if err != nil {
-		log.Printf("[Listen] Attribute Exception %v", err)
-		panic(err)
+	// We need to extract the device UUID from the payload
+	if err := json.Unmarshal(m.Data, &dps); err != nil {
+		return Poison(err)
+	}
+	if err := dps.Validate(); err != nil {
+		return Poison(err)
 	}
 
-	topic := client.Topic(attributeTopic)
+	// Redelivered once Datastore and Redis answer again
+	_, err := device.RefreshExtendedInfo(dps.Serial, nil)
+	return err
+}
 
-	// If the subscription doesn't exist, then we need to create one
-	if !ok {
-		log.Println("[Listen] Attribute: Subscription does not exist. Creating one")
-		sub, err = client.CreateSubscription(common.CTX, attributeSubscription, pubsub.SubscriptionConfig{Topic: topic})
-		if err != nil {
-			log.Printf("[Listen] Attribute: failed to create sub %v", err)
-			panic(err)
+// deviceConsumers - geo and attribute subscriptions
+func deviceConsumers(clk clock.Clock) []*Consumer {
+	consumers := []*Consumer{
+		{Name: "Geo", Subscription: subscriptionName, Topic: topicName, Handler: handleGeoMessage},
+		{Name: "Attribute", Subscription: attributeSubscription, Topic: attributeTopic, Handler: handleAttrMessage},
+	}
+	for _, c := range consumers {
+		c.Clock = clk
+		c.DeadLetterTopic = deadLetterTopic
+		if c.DeadLetterTopic == "" {
+			c.DeadLetterTopic = c.Topic + PUBSUB_DEADLETTER_SUFFIX
 		}
 	}
+	return consumers
+}
 
-	// Receive messages
-	log.Println("[Listen] Attribute: Receiving")
-	err = sub.Receive(common.CTX, func(ctx context.Context, m *pubsub.Message) {
-		log.Println("[Listen] Attribute: New pub/sub request")
-		var dps device.DevicePubSub
-
-		// We need to extract the device UUID from the payload
-		json.Unmarshal(m.Data, &dps)
-		device.RefreshExtendedInfo(dps.Serial, nil)
-		m.Ack()
-	})
-
-	// If context don't get canceled and program exit then something is wrong
-	if err != context.Canceled {
-		panic(err)
+func runCacheIDUpdater(ctx context.Context, clk clock.Clock) (map[string]int, error) {
+	summary := DeviceSyncSummary{Started: clk.Now().UTC(), RemovalPolicy: deviceRemovalPolicy}
+	if deviceListSource != nil {
+		summary.Source = deviceListSource.String()
 	}
-}
+	defer func() { recordDeviceSync(clk, summary) }()
 
-func listenDevicePubSub() {
-	listenAttr()
-	listenGeo()
-}
+	// Fetch the device list, a stale list is never processed
+	if err := copyFile(); err != nil {
+		log.Printf("Device list fetch failed, skipping run| %v", err)
+		summary.Errors = append(summary.Errors, err.Error())
+		return nil, err
+	}
 
-func runCacheIDUpdater() {
+	log.Printf("Cache update process started")
 
-	// Copy the file from SCP Server
-	copyFile()
+	// Ranges edited since the last watch poll, cacheID assigns the categories from them
+	if device.Categories != nil {
+		device.Categories.Reload()
+	}
 
-	file, err := os.Open(devicesFile)
+	// Only devices added or changed since the last run are queued
+	run := NewRun()
+	err := syncDeviceList(ctx, run, &summary)
 	if err != nil {
-		fmt.Println("Error opening the file :", err.Error())
-		return
+		log.Printf("Device list sync failed| %v", err)
+		summary.Errors = append(summary.Errors, err.Error())
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	//var wg sync.WaitGroup
+	// Wait for the queued jobs, the next run starts from a settled snapshot
+	run.Wait(ctx)
+	summary.Jobs, _, summary.JobsFailed, summary.JobsTimedOut = run.Counts()
 
-	log.Printf("Cache update process started")
+	log.Printf("Cache update process completed")
+	return map[string]int{
+		"total":        summary.Total,
+		"added":        summary.Added,
+		"changed":      summary.Changed,
+		"removed":      summary.Removed,
+		"retrying":     summary.Retrying,
+		"deadLettered": summary.DeadLettered,
+		"jobs":         summary.Jobs,
+		"jobsFailed":   summary.JobsFailed,
+	}, err
+}
 
-	for scanner.Scan() {
-		job := &Job{}
-		job.Line = scanner.Text()
-		JobQueue <- *job
+// processJob - JobHandler of the dispatcher
+func processJob(ctx context.Context, clk clock.Clock, job Job) error {
+	return cacheIDs(ctx, clk, job.Lines)
+}
+
+// cacheIDs - saves a batch of device file lines with a single Datastore lookup.
+// Devices not saved are recorded for a retry.
+func cacheIDs(ctx context.Context, clk clock.Clock, lines []string) error {
+	serials := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if serial := deviceListSerial(line); serial != "" {
+			serials = append(serials, serial)
+		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+	entities, err := device.LookupSensorEntities(ctx, serials)
+	if err != nil {
+		log.Printf("Datastore lookup failed, %d devices left for a retry| %v", len(serials), err)
+		for _, line := range lines {
+			deviceAttemptFailed(ctx, clk, line, err)
+		}
+		return err
 	}
 
-	log.Printf("Cache update process completed")
-	//wg.Wait()
+	failed := 0
+	for i, line := range lines {
+		// Timed out or stopping, the rest is left for a retry
+		if err := ctx.Err(); err != nil {
+			for _, line := range lines[i:] {
+				deviceAttemptFailed(ctx, clk, line, err)
+			}
+			return err
+		}
+		if err := cacheID(clk, line, entities[deviceListSerial(line)]); err != nil {
+			deviceAttemptFailed(ctx, clk, line, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d devices not saved", failed, len(lines))
+	}
+	return nil
+}
 
-	// Once all goroutines have finished processing, empty the file
-	// TODO : Delete the file from the scp server using ssh commands
+// deviceAttemptFailed - a line cut short by a stop is requeued as is, any other
+// failure, timeouts included, counts as an attempt.
+func deviceAttemptFailed(ctx context.Context, clk clock.Clock, line string, err error) {
+	if ctx.Err() == context.Canceled || errors.Is(err, context.Canceled) {
+		requeueDevice(clk, line)
+		return
+	}
+	recordDeviceFailure(clk, line, err)
 }
 
-func cacheID(line string) {
+func cacheID(clk clock.Clock, line string, x device.RawSensorEntity) error {
 	lineArr := strings.Split(line, ",")
+	serial := deviceListSerial(line)
 
-	if len(lineArr) < 1 {
+	if serial == "" {
 		log.Printf("Can't extract ID and PSK for %s", line)
-		return
+		return fmt.Errorf("invalid device line %q", line)
 	}
 
+	// Same serial as the sync snapshot and the retries
 	dev := device.Device{}
-	dev.ID = lineArr[0]
-	dev.PSK = lineArr[1]
-	log.Printf("Device: %s", lineArr[0])
-
-	// Query device Geo
-	//log.Printf("Datastore query for %s started", dev.ID)
-	q := datastore.NewQuery("SensorEntity").Filter("serial =", dev.ID).Limit(1)
-	it := common.DataStoreClient.Run(common.CTX, q)
-	var x device.RawSensorEntity
-	_, _ = it.Next(&x)
-
-	/*
-		if err != nil {
-			log.Printf("Error fetching next: %v", err)
-		}
-	*/
+	dev.ID = serial
+	dev.PSK = strings.TrimSpace(lineArr[1])
+	log.Printf("Device: %s", dev.ID)
 
-	// Set the Geo we got from datastore
+	// Set the Geo we got from datastore, empty for devices without entity
 	dev.Geo = x.Geo
 
 	// Set the right category
 	dev.Category = device.Categories.GetDeviceCat(dev.ID)
 	//log.Printf(dev.ID)
 	//log.Printf(dev.Category)
-	if (dev.Category == device.CAT2 || dev.Category == device.CAT3) && strings.TrimSpace(dev.Geo.Zip) == "" {
+	// Devices with coordinates are located through them
+	_, _, hasCoordinates := dev.Geo.Coordinates()
+	if (dev.Category == device.CAT2 || dev.Category == device.CAT3) && strings.TrimSpace(dev.Geo.Zip) == "" && !hasCoordinates {
 		dev.Geo.Zip = "17036"
 	}
 
-	dataBytes, _ := json.Marshal(dev)
-	key := "device:" + dev.ID
-
-	data, err := common.RedisInstance.GetCachedData(key)
-	var d device.Device
-	// No data found from the cache
-	if err == nil {
-		json.Unmarshal(data, &d)
-	}
-
-	if d.Geo.Zip != dev.Geo.Zip {
-		nowStr := time.Now().Format("02:01:2006")
-		mismatch_key := "geomismatch:" + dev.ID + ":" + nowStr
-		val := "Old : " + d.Geo.Zip + " New :" + dev.Geo.Zip
-		common.RedisInstance.SaveRedisData([]byte(val), mismatch_key, 0)
+	// The device file is authoritative, keep only the record revision
+	var previous device.Geo
+	_, err := device.UpsertDevice(dev.ID, func(d *device.Device) error {
+		previous = d.Geo
+		d.PSK = dev.PSK
+		device.ReassignCategory(d)
+		d.Geo = dev.Geo
+		d.GeoRefreshCount = 0
+		return nil
+	})
+	if err != nil {
+		log.Printf("Unable to save device %s| %v", dev.ID, err)
+	} else {
+		device.RecordLocationChange(clk, dev.ID, device.LocationSourceDeviceFile, filepath.Base(devicesFile), previous, dev.Geo)
+		markDeviceSynced(dev.ID, line)
 	}
-	common.RedisInstance.SaveRedisData(dataBytes, key, 0)
 
 	// Load Device Attribute Information
 	device.RefreshExtendedInfo(dev.ID, &x)
-	return
+	return err
 }
@@ -1,59 +1,146 @@
 package cacheUpdater
 
 import (
+	"fmt"
 	"log"
+	"sync"
+
+	"golang.org/x/net/context"
 )
 
+// Job - device file lines looked up in Datastore together
 type Job struct {
-	Line string
+	Lines []string
+	run   *Run
 }
 
-// A buffered channel that we can send work requests on.
-var JobQueue chan Job
-
 // Worker represents the worker that executes the job
 type Worker struct {
-	WorkerPool chan chan Job
-	JobChannel chan Job
-	quit       chan bool
+	id         int
+	dispatcher *Dispatcher
+}
+
+// Run tracks the jobs submitted for one sync run
+type Run struct {
+	wg        sync.WaitGroup
+	lock      sync.Mutex
+	submitted int
+	succeeded int
+	failed    int
+	timedOut  int
 }
 
 //---------------------------------------------------
 // Exports
 //---------------------------------------------------
 
-func NewWorker(workerPool chan chan Job) Worker {
-	log.Println("[CacheUpdater] init worker")
-	return Worker{
-		WorkerPool: workerPool,
-		JobChannel: make(chan Job),
-		quit:       make(chan bool)}
+func NewWorker(id int, dispatcher *Dispatcher) Worker {
+	return Worker{id: id, dispatcher: dispatcher}
 }
 
-// Start method starts the run loop for the worker, listening for a quit channel in
-// case we need to stop it
+// Start method starts the run loop for the worker, it returns once the queue
+// is closed and drained
 func (w Worker) Start() {
 	go func() {
-		for {
-			// register the current worker into the worker queue.
-			w.WorkerPool <- w.JobChannel
-
-			select {
-			case job := <-w.JobChannel:
-				// we have received a work request.
-				cacheID(job.Line)
-
-			case <-w.quit:
-				// we have received a signal to stop
-				return
-			}
+		defer w.dispatcher.workers.Done()
+		for job := range w.dispatcher.queue {
+			w.process(job)
 		}
 	}()
 }
 
-// Stop signals the worker to stop listening for work requests.
-func (w Worker) Stop() {
+func NewRun() *Run {
+	return &Run{}
+}
+
+// Job - a job counted towards the run
+func (r *Run) Job(lines []string) Job {
+	return Job{Lines: lines, run: r}
+}
+
+// Wait - blocks until every submitted job is done or ctx is done
+func (r *Run) Wait(ctx context.Context) error {
+	done := make(chan struct{})
 	go func() {
-		w.quit <- true
+		r.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Counts - submitted, succeeded, failed and timed out jobs
+func (r *Run) Counts() (int, int, int, int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.submitted, r.succeeded, r.failed, r.timedOut
+}
+
+//---------------------------------------------------
+// Local Funcs
+//---------------------------------------------------
+
+func (w Worker) process(job Job) {
+	d := w.dispatcher
+	ctx, cancel := context.WithTimeout(d.ctx, d.jobTimeout)
+	defer cancel()
+
+	d.jobStarted()
+	err := w.handle(ctx, job)
+	timedOut := ctx.Err() == context.DeadlineExceeded
+	if timedOut && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		log.Printf("[CacheUpdater] Worker %d job failed| %v", w.id, err)
+	}
+
+	d.jobDone(err, timedOut)
+	if job.run != nil {
+		job.run.done(err, timedOut)
+	}
+}
+
+// handle - a panicking job fails alone
+func (w Worker) handle(ctx context.Context, job Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
 	}()
+	return w.dispatcher.handler(ctx, w.dispatcher.clock, job)
+}
+
+func (r *Run) add() {
+	r.lock.Lock()
+	r.submitted++
+	r.lock.Unlock()
+	r.wg.Add(1)
+}
+
+func (r *Run) cancelled() {
+	r.lock.Lock()
+	r.submitted--
+	r.lock.Unlock()
+	r.wg.Done()
+}
+
+func (r *Run) done(err error, timedOut bool) {
+	r.lock.Lock()
+	switch {
+	case timedOut:
+		r.timedOut++
+		r.failed++
+	case err != nil:
+		r.failed++
+	default:
+		r.succeeded++
+	}
+	r.lock.Unlock()
+	r.wg.Done()
 }
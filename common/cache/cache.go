@@ -9,17 +9,15 @@ package cache
 //----------------------------------------------
 import (
 	"github.com/go-redis/redis"
-	"io/ioutil"
 	"log"
-	"path"
 	"time"
 )
 
 const (
-	CACHE_BUST__GLOBAL      = ""
-	CACHE_BUST__DEVICE      = ""
-	CACHE_BUST__FILE        = ""
-	CACHE_BUST__DEVICE_INFO = ":di-v4:"
+	CACHE_BUST__GLOBAL = ""
+	CACHE_BUST__DEVICE = ""
+	CACHE_BUST__FILE   = ""
+	// Device info records carry device.ExtendedInfoSchemaVersion instead of a cache bust.
 )
 
 type (
@@ -28,55 +26,9 @@ type (
 	}
 )
 
-var (
-	localCache map[string][]byte
-)
-
 // ----------------------------------------------
 // Exports
 // ----------------------------------------------
-func (redisInstance RedisInstance) GetCachedFile(folder string, file string, expiration time.Duration) ([]byte, error) {
-
-	if localCache == nil {
-		localCache = make(map[string][]byte)
-	}
-
-	var v []byte
-	var ok bool
-	if v, ok = localCache[file]; ok {
-		return v, nil
-	} else {
-		body, err := ioutil.ReadFile(path.Join(folder, file))
-		if err == nil {
-			//redisInstance.SaveRedisData(body, key, expiration)
-			log.Printf("[Redis] Saved file to in memory cache %s:%s", folder, file)
-			localCache[file] = body
-		} else {
-			log.Printf("[Redis] Unable to read file %s:%s| %v", folder, file, err)
-		}
-		return body, err
-	}
-
-	/*
-		hasher := md5.New()
-		hasher.Write([]byte(file))
-		hash := hex.EncodeToString(hasher.Sum(nil))
-		key := "file.cache:" + hash
-
-		r, err := redisInstance.GetCachedData(key)
-		if (err != nil) {
-			// Loading the template file, which depends on the category
-			body, err := ioutil.ReadFile(path.Join(folder, file))
-			if err == nil {
-				redisInstance.SaveRedisData(body, key, expiration)
-			} else {
-				log.Printf("[Cache] Unable to read file %s:%s| %v", folder, file, err)
-			}
-			return body, err
-		}
-		return r, err
-	*/
-}
 
 // Write the data to the cache
 func (redisInstance RedisInstance) SaveRedisData(data []byte, key string, expiration time.Duration) error {
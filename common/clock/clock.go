@@ -0,0 +1,70 @@
+package clock
+
+//----------------------------------------------
+// CopyRight 2019 La Crosse Technology, LTD.
+//----------------------------------------------
+
+//----------------------------------------------
+// Imports
+//----------------------------------------------
+import (
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------
+// Types
+// ----------------------------------------------
+type (
+	// Clock - source of the current time, passed to the service entry points.
+	// Device time compression, time loops and clock sources are applied on top of it.
+	Clock interface {
+		Now() time.Time
+	}
+
+	// SystemClock - the machine clock.
+	SystemClock struct{}
+
+	// FakeClock - manually driven clock, for tests and reproducing time bound
+	// behaviour (flow control cutoff, DST transitions...).
+	FakeClock struct {
+		lock sync.RWMutex
+		now  time.Time
+	}
+)
+
+// ----------------------------------------------
+// Exports
+// ----------------------------------------------
+
+// Now - time.Now.
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewFakeClock - fake clock stopped at now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now - the time the clock was last set to.
+func (c *FakeClock) Now() time.Time {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.now
+}
+
+// Set - moves the clock to now.
+func (c *FakeClock) Set(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = now
+}
+
+// Advance - moves the clock by d, which may be negative.
+func (c *FakeClock) Advance(d time.Duration) time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	return c.now
+}
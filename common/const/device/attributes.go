@@ -0,0 +1,213 @@
+package device
+
+//----------------------------------------------
+// CopyRight 2019 La Crosse Technology, LTD.
+//----------------------------------------------
+
+//----------------------------------------------
+// Imports
+//----------------------------------------------
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// ----------------------------------------------
+// Constants
+// ----------------------------------------------
+const (
+	// SensorEntity.attributes names, read by RefreshExtendedInfo
+	AttributeDateTimeBug        = "date-time-bug"
+	AttributeTimeCompress       = "time-compress"
+	AttributeTimeCompressStart  = "time-compress.start"
+	AttributeTimeCompressOffset = "time-compress.offset"
+	AttributeTimeZoneOverride   = "time-zone-override"
+	AttributeTimeLoop           = "time-loop"
+	AttributeTimeLoopStart      = "time-loop.start"
+	AttributeTimeLoopEnd        = "time-loop.end"
+	AttributeTimeLoopOffset     = "time-loop.offset"
+	AttributeTimeLoopWindow     = "time-loop.window"
+	AttributeForecastScript     = "forecast-script"
+)
+
+// ----------------------------------------------
+// Types
+// ----------------------------------------------
+type (
+	// AttributeUpdate - typed attribute changes, nil fields are left as they are.
+	AttributeUpdate struct {
+		DateTimeBug        *bool  `json:"date-time-bug"`
+		TimeCompress       *int64 `json:"time-compress"`        // acceleration rate, 0 disables
+		TimeCompressStart  *int64 `json:"time-compress.start"`  // epoch seconds
+		TimeCompressOffset *int64 `json:"time-compress.offset"` // seconds
+		TimeZoneOverride   *int64 `json:"time-zone-override"`   // signed hhmm, 0 disables
+		TimeLoop           *int64 `json:"time-loop"`            // TimeLoop* mode, 0 disables
+		TimeLoopStart      *int64 `json:"time-loop.start"`      // epoch seconds, TimeLoopCustom
+		TimeLoopEnd        *int64 `json:"time-loop.end"`        // epoch seconds, TimeLoopCustom
+		TimeLoopOffset     *int64 `json:"time-loop.offset"`     // seconds
+		TimeLoopWindow     *int64 `json:"time-loop.window"`     // seconds, TimeLoopDstIn / TimeLoopDstOut
+		ForecastScript     *int64 `json:"forecast-script"`      // ForecastScript* mode, 0 disables
+	}
+
+	// DeviceAttribute - attribute set through SetDeviceAttributes, kept on the
+	// device record and applied over the SensorEntity attribute of the same name.
+	DeviceAttribute struct {
+		Name  string
+		Value int64
+	}
+)
+
+// ----------------------------------------------
+// Exports
+// ----------------------------------------------
+
+// Attributes - the update as SensorEntity attribute values.
+func (u AttributeUpdate) Attributes() map[string]int64 {
+	attrs := map[string]int64{}
+	if u.DateTimeBug != nil {
+		attrs[AttributeDateTimeBug] = 0
+		if *u.DateTimeBug {
+			attrs[AttributeDateTimeBug] = 1
+		}
+	}
+	set := func(name string, v *int64) {
+		if v != nil {
+			attrs[name] = *v
+		}
+	}
+	set(AttributeTimeCompress, u.TimeCompress)
+	set(AttributeTimeCompressStart, u.TimeCompressStart)
+	set(AttributeTimeCompressOffset, u.TimeCompressOffset)
+	set(AttributeTimeZoneOverride, u.TimeZoneOverride)
+	set(AttributeTimeLoop, u.TimeLoop)
+	set(AttributeTimeLoopStart, u.TimeLoopStart)
+	set(AttributeTimeLoopEnd, u.TimeLoopEnd)
+	set(AttributeTimeLoopOffset, u.TimeLoopOffset)
+	set(AttributeTimeLoopWindow, u.TimeLoopWindow)
+	set(AttributeForecastScript, u.ForecastScript)
+	return attrs
+}
+
+// ValidateAttribute - checks a value against the modes RefreshExtendedInfo understands.
+func ValidateAttribute(name string, v int64) error {
+	switch name {
+	case AttributeDateTimeBug:
+		if v != 0 && v != 1 {
+			return fmt.Errorf("%s must be 0 or 1", name)
+		}
+	case AttributeTimeZoneOverride:
+		if v < 0 {
+			v = -v
+		}
+		if v%100 >= 60 || v/100 > 14 {
+			return fmt.Errorf("%s must be a signed hhmm offset up to 1400", name)
+		}
+	case AttributeTimeLoop:
+		if v < 0 || v > TimeLoopBackendDriver {
+			return fmt.Errorf("%s must be between 0 and %d", name, TimeLoopBackendDriver)
+		}
+	case AttributeTimeLoopWindow:
+		if v < 1 || v > TimeLoopDstMaxWindow {
+			return fmt.Errorf("%s must be between 1 and %d seconds", name, TimeLoopDstMaxWindow)
+		}
+	case AttributeForecastScript:
+		if v != ForecastScriptDisabled && v != ForecastScriptStaticA && v != ForecastScriptBackendDriver {
+			return fmt.Errorf("%s must be %d, %d or %d", name, ForecastScriptDisabled, ForecastScriptStaticA, ForecastScriptBackendDriver)
+		}
+	case AttributeTimeCompress:
+		if v < 0 {
+			return fmt.Errorf("%s must be 0 or a positive rate", name)
+		}
+	case AttributeTimeCompressStart, AttributeTimeCompressOffset,
+		AttributeTimeLoopStart, AttributeTimeLoopEnd, AttributeTimeLoopOffset:
+	default:
+		return fmt.Errorf("unknown attribute %s", name)
+	}
+	return nil
+}
+
+// SetDeviceAttributes - validates attributes and stores them on the device record
+// through the Store, then refreshes the cached ExtendedDeviceInfo. The SensorEntity
+// stays as the gateway wrote it, the stored attributes override its values.
+func SetDeviceAttributes(ID string, attrs map[string]int64) (ExtendedDeviceInfo, error) {
+	current, _ := GetExtendedDeviceInfo(ID)
+	if _, err := setDeviceAttributes(Store, ID, attrs, current.Attributes); err != nil {
+		log.Printf("[Device] Attributes Update Failed ID=%s| %v", ID, err)
+		return ExtendedDeviceInfo{}, err
+	}
+	log.Printf("[Device] Attributes Updated ID=%s %v", ID, attrs)
+	return RefreshExtendedInfo(ID, nil)
+}
+
+// SetAttribute - sets a stored attribute, added if missing.
+func (d *Device) SetAttribute(name string, v int64) {
+	for i := range d.Attributes {
+		if d.Attributes[i].Name == name {
+			d.Attributes[i].Value = v
+			return
+		}
+	}
+	d.Attributes = append(d.Attributes, DeviceAttribute{Name: name, Value: v})
+}
+
+// ----------------------------------------------
+// Local Funcs
+// ----------------------------------------------
+
+// Validates attrs against the current attributes and the stored ones, then
+// writes them to the device record
+func setDeviceAttributes(store DeviceStore, ID string, attrs map[string]int64, current map[string]int64) (Device, error) {
+	if len(attrs) == 0 {
+		return Device{}, errors.New("no attribute to set")
+	}
+	for name, v := range attrs {
+		if err := ValidateAttribute(name, v); err != nil {
+			return Device{}, err
+		}
+	}
+
+	return store.Update(ID, false, func(d *Device) error {
+		merged := map[string]int64{}
+		for name, v := range current {
+			merged[name] = v
+		}
+		for _, a := range d.Attributes {
+			merged[a.Name] = a.Value
+		}
+		for name, v := range attrs {
+			merged[name] = v
+		}
+
+		// Only checked when the update moves a bound
+		_, setStart := attrs[AttributeTimeLoopStart]
+		_, setEnd := attrs[AttributeTimeLoopEnd]
+		if setStart || setEnd {
+			start, hasStart := merged[AttributeTimeLoopStart]
+			end, hasEnd := merged[AttributeTimeLoopEnd]
+			if hasStart && hasEnd && end <= start {
+				return fmt.Errorf("%s must be after %s", AttributeTimeLoopEnd, AttributeTimeLoopStart)
+			}
+		}
+
+		for name, v := range attrs {
+			d.SetAttribute(name, v)
+		}
+		return nil
+	})
+}
+
+// Attributes stored on the device record, none when it can not be read
+func storedAttributes(ID string) []DeviceAttribute {
+	if Store == nil {
+		return nil
+	}
+	d, err := Store.Get(ID)
+	if err != nil {
+		if err != ErrDeviceNotFound {
+			log.Printf("[Device] Stored attributes of %s not read| %v", ID, err)
+		}
+		return nil
+	}
+	return d.Attributes
+}
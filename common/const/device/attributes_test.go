@@ -0,0 +1,38 @@
+package device
+
+import (
+	"testing"
+)
+
+func TestSetDeviceAttributesThroughStore(t *testing.T) {
+	store := NewMemoryDeviceStore()
+	store.Put(Device{ID: "A1"})
+	current := map[string]int64{AttributeTimeLoopStart: 1000, AttributeTimeLoopEnd: 2000}
+
+	d, err := setDeviceAttributes(store, "A1", map[string]int64{AttributeTimeLoop: TimeLoopCustom, AttributeTimeLoopEnd: 3000}, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Attributes) != 2 || d.Revision != 1 {
+		t.Errorf("stored %+v at revision %d", d.Attributes, d.Revision)
+	}
+
+	// Bounds are ordered against the stored and current values
+	if _, err := setDeviceAttributes(store, "A1", map[string]int64{AttributeTimeLoopStart: 3000}, current); err == nil {
+		t.Errorf("loop start at the stored end accepted")
+	}
+	if _, err := setDeviceAttributes(store, "A1", map[string]int64{AttributeTimeLoopEnd: 500}, current); err == nil {
+		t.Errorf("loop end before the current start accepted")
+	}
+	if _, err := setDeviceAttributes(store, "A1", map[string]int64{AttributeTimeCompress: -4}, current); err == nil {
+		t.Errorf("negative time compression rate accepted")
+	}
+	if _, err := setDeviceAttributes(store, "B2", map[string]int64{AttributeTimeCompress: 60}, current); err != ErrDeviceNotFound {
+		t.Errorf("unknown device got %v", err)
+	}
+
+	d, _ = store.Get("A1")
+	if d.Revision != 1 {
+		t.Errorf("rejected updates written, revision %d", d.Revision)
+	}
+}
@@ -0,0 +1,433 @@
+package device
+
+//----------------------------------------------
+// CopyRight 2019 La Crosse Technology, LTD.
+//----------------------------------------------
+
+//----------------------------------------------
+// Imports
+//----------------------------------------------
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/sibivishnu/Weather/common"
+	"github.com/sibivishnu/Weather/common/cache"
+)
+
+// ----------------------------------------------
+// Globals
+// ----------------------------------------------
+var (
+	Categories *CategoryConfList
+)
+
+// ----------------------------------------------
+// Types
+// ----------------------------------------------
+type (
+	CategoryConf struct {
+		Category string          `bson:"category" json:"category"`
+		Ranges   []CategoryRange `bson:"ranges" json:"ranges"`
+	}
+
+	// Serials are hex strings in the file, compared as integers
+	CategoryRange struct {
+		Min   string `bson:"min" json:"min"`
+		Max   string `bson:"max" json:"max"`
+		MinID uint32 `bson:"-" json:"-"`
+		MaxID uint32 `bson:"-" json:"-"`
+	}
+
+	// CategoryConfList - validated category ranges, safe to reload while in use.
+	// The ranges are shared by the services through Redis (CategoryConfKey), the
+	// categories file only seeds them. Without Redis the file is used alone.
+	CategoryConfList struct {
+		CategoryConf []CategoryConf
+
+		filename string
+		redis    *cache.RedisInstance
+		shared   string
+		modTime  time.Time
+		lock     sync.RWMutex
+		watching bool
+	}
+)
+
+// ----------------------------------------------
+// Exports
+// ----------------------------------------------
+
+// LoadCategoryConf - reads and validates the shared ranges, seeded from the
+// categories file when Redis has none. On error the list is empty, devices fall back on CAT1.
+func LoadCategoryConf(filename string, redisInstance *cache.RedisInstance) (*CategoryConfList, error) {
+	catConf := &CategoryConfList{filename: filename, redis: redisInstance, CategoryConf: []CategoryConf{}}
+	return catConf, catConf.Reload()
+}
+
+// ParseSerial - device serial as an integer.
+func ParseSerial(deviceID string) (uint32, error) {
+	n, err := strconv.ParseUint(strings.TrimSpace(deviceID), 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid serial %q", deviceID)
+	}
+	return uint32(n), nil
+}
+
+// ValidateCategoryConf - parses the range bounds and rejects empty categories,
+// inverted ranges and ranges overlapping each other.
+func ValidateCategoryConf(cc []CategoryConf) error {
+	type bound struct {
+		category string
+		r        CategoryRange
+	}
+	var all []bound
+
+	seen := map[string]bool{}
+	for i := range cc {
+		category := strings.TrimSpace(cc[i].Category)
+		if category == "" {
+			return errors.New("category name is required")
+		}
+		if seen[category] {
+			return fmt.Errorf("category %s is defined twice", category)
+		}
+		seen[category] = true
+
+		for j := range cc[i].Ranges {
+			r := &cc[i].Ranges[j]
+			var err error
+			if r.MinID, err = ParseSerial(r.Min); err != nil {
+				return fmt.Errorf("category %s: %v", category, err)
+			}
+			if r.MaxID, err = ParseSerial(r.Max); err != nil {
+				return fmt.Errorf("category %s: %v", category, err)
+			}
+			if r.MinID > r.MaxID {
+				return fmt.Errorf("category %s: range %s::%s is inverted", category, r.Min, r.Max)
+			}
+			all = append(all, bound{category: category, r: *r})
+		}
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].r.MinID < all[j].r.MinID })
+	for i := 1; i < len(all); i++ {
+		if all[i].r.MinID <= all[i-1].r.MaxID {
+			return fmt.Errorf("range %s::%s (category %s) overlaps %s::%s (category %s)",
+				all[i].r.Min, all[i].r.Max, all[i].category,
+				all[i-1].r.Min, all[i-1].r.Max, all[i-1].category)
+		}
+	}
+	return nil
+}
+
+func (catConf *CategoryConfList) GetDeviceCat(deviceID string) string {
+	if catConf == nil {
+		return CAT1
+	}
+	id, err := ParseSerial(deviceID)
+	if err != nil {
+		log.Printf("[Category] %v, using category %s", err, CAT1)
+		return CAT1
+	}
+
+	catConf.lock.RLock()
+	defer catConf.lock.RUnlock()
+	for _, catStruct := range catConf.CategoryConf {
+		for _, cRange := range catStruct.Ranges {
+			if id >= cRange.MinID && id <= cRange.MaxID {
+				return catStruct.Category
+			}
+		}
+	}
+
+	return CAT1
+}
+
+func (catConf *CategoryConfList) GetDeviceCatRanges(cat string) string {
+	ranges := ""
+
+	catConf.lock.RLock()
+	defer catConf.lock.RUnlock()
+	for _, catStruct := range catConf.CategoryConf {
+		if cat != catStruct.Category {
+			continue
+		}
+		for _, cRange := range catStruct.Ranges {
+			if ranges != "" {
+				ranges = ranges + ";"
+			}
+			ranges = ranges + cRange.Min + "::" + cRange.Max
+		}
+	}
+
+	return ranges
+}
+
+// List - copy of the current categories.
+func (catConf *CategoryConfList) List() []CategoryConf {
+	catConf.lock.RLock()
+	defer catConf.lock.RUnlock()
+
+	list := make([]CategoryConf, len(catConf.CategoryConf))
+	for i, c := range catConf.CategoryConf {
+		list[i] = CategoryConf{Category: c.Category, Ranges: append([]CategoryRange{}, c.Ranges...)}
+	}
+	return list
+}
+
+// Reload - re-reads the shared ranges, or the file without Redis.
+// Invalid ranges keep the current ones.
+func (catConf *CategoryConfList) Reload() error {
+	if catConf.redis == nil {
+		return catConf.reloadFile()
+	}
+
+	raw, err := catConf.redis.RedisSession.Get(CategoryConfKey).Result()
+	if err == redis.Nil {
+		raw, err = catConf.seed()
+	}
+	if err != nil {
+		log.Printf("[Category] Unable to read the shared ranges| %v", err)
+		return err
+	}
+
+	cc, err := parseCategoryConf([]byte(raw))
+	if err != nil {
+		log.Printf("[Category] Invalid shared ranges, keeping current ranges| %v", err)
+		return err
+	}
+
+	catConf.lock.Lock()
+	catConf.CategoryConf = cc
+	catConf.shared = raw
+	catConf.lock.Unlock()
+	log.Printf("[Category] Loaded %d categories from %s", len(cc), CategoryConfKey)
+	return nil
+}
+
+// Watch - polls the shared ranges (or the file modification time without
+// Redis) and reloads them when they change.
+func (catConf *CategoryConfList) Watch(interval time.Duration) {
+	catConf.lock.Lock()
+	if catConf.watching {
+		catConf.lock.Unlock()
+		return
+	}
+	catConf.watching = true
+	catConf.lock.Unlock()
+
+	go func() {
+		for range time.Tick(interval) {
+			if catConf.changed() {
+				catConf.Reload()
+			}
+		}
+	}()
+}
+
+// SetCategoryRanges - replaces the ranges of a category (created if missing),
+// an empty list removes it. The shared ranges are updated first, the other
+// services pick the change up on their next Watch poll.
+func (catConf *CategoryConfList) SetCategoryRanges(cat string, ranges []CategoryRange) error {
+	cat = strings.TrimSpace(cat)
+	if cat == "" {
+		return errors.New("category name is required")
+	}
+	if catConf.redis == nil {
+		return errors.New("category ranges are read from a file, no shared storage to edit")
+	}
+
+	var cc []CategoryConf
+	var raw []byte
+	err := catConf.redis.RedisSession.Watch(func(tx *redis.Tx) error {
+		current, err := tx.Get(CategoryConfKey).Bytes()
+		if err == redis.Nil {
+			cc = catConf.List()
+		} else if err != nil {
+			return err
+		} else if cc, err = parseCategoryConf(current); err != nil {
+			return err
+		}
+
+		cc = withCategoryRanges(cc, cat, ranges)
+		if err = ValidateCategoryConf(cc); err != nil {
+			return err
+		}
+		if raw, err = json.MarshalIndent(cc, "", "\t"); err != nil {
+			return err
+		}
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.Set(CategoryConfKey, raw, 0)
+			return nil
+		})
+		return err
+	}, CategoryConfKey)
+	if err == redis.TxFailedErr {
+		return errors.New("category ranges updated concurrently, retry")
+	}
+	if err != nil {
+		return err
+	}
+
+	catConf.lock.Lock()
+	catConf.CategoryConf = cc
+	catConf.shared = string(raw)
+	catConf.lock.Unlock()
+	log.Printf("[Category] Category %s set to %d ranges", cat, len(ranges))
+	return nil
+}
+
+// ReassignDeviceCategories - applies the current ranges to every cached device,
+// returns the number of devices whose category changed.
+func ReassignDeviceCategories() (int, error) {
+	cached, err := common.RedisInstance.QueryCache(deviceKey("*"))
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for _, data := range cached {
+		d, _, err := DecodeDevice([]byte(data))
+		if err != nil || d.ID == "" || d.Removed || Categories.GetDeviceCat(d.ID) == d.Category {
+			continue
+		}
+
+		_, err = UpdateDevice(d.ID, func(d *Device) error {
+			if !ReassignCategory(d) {
+				return ErrNoChange
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("[Category] Unable to reassign %s| %v", d.ID, err)
+			continue
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// ReassignCategory - sets the category from the current ranges, logged when it changes.
+func ReassignCategory(d *Device) bool {
+	category := Categories.GetDeviceCat(d.ID)
+	if category == d.Category {
+		return false
+	}
+	log.Printf("[Category] Device %s reassigned from category %q to %q", d.ID, d.Category, category)
+	d.Category = category
+	return true
+}
+
+// ----------------------------------------------
+// Local Funcs
+// ----------------------------------------------
+
+// Validated ranges of a categories json
+func parseCategoryConf(raw []byte) ([]CategoryConf, error) {
+	var cc []CategoryConf
+	if err := json.Unmarshal(raw, &cc); err != nil {
+		return nil, err
+	}
+	if err := ValidateCategoryConf(cc); err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
+
+// Copy of cc with the ranges of cat replaced, removed when ranges is empty
+func withCategoryRanges(cc []CategoryConf, cat string, ranges []CategoryRange) []CategoryConf {
+	updated := []CategoryConf{}
+	found := false
+	for _, c := range cc {
+		if c.Category == cat {
+			found = true
+			if len(ranges) == 0 {
+				continue
+			}
+			c = CategoryConf{Category: cat, Ranges: ranges}
+		}
+		updated = append(updated, CategoryConf{Category: c.Category, Ranges: append([]CategoryRange{}, c.Ranges...)})
+	}
+	if !found && len(ranges) > 0 {
+		updated = append(updated, CategoryConf{Category: cat, Ranges: append([]CategoryRange{}, ranges...)})
+	}
+	return updated
+}
+
+// Seeds the shared ranges from the file, unless another service did it first
+func (catConf *CategoryConfList) seed() (string, error) {
+	raw, err := ioutil.ReadFile(catConf.filename)
+	if err != nil {
+		return "", err
+	}
+	if _, err = parseCategoryConf(raw); err != nil {
+		return "", fmt.Errorf("%s: %v", catConf.filename, err)
+	}
+	seeded, err := catConf.redis.RedisSession.SetNX(CategoryConfKey, raw, 0).Result()
+	if err != nil {
+		return "", err
+	}
+	if seeded {
+		log.Printf("[Category] Shared ranges seeded from %s", catConf.filename)
+		return string(raw), nil
+	}
+	return catConf.redis.RedisSession.Get(CategoryConfKey).Result()
+}
+
+// True when the shared ranges, or the file without Redis, changed since the last load
+func (catConf *CategoryConfList) changed() bool {
+	if catConf.redis == nil {
+		info, err := os.Stat(catConf.filename)
+		if err != nil {
+			return false
+		}
+		catConf.lock.RLock()
+		defer catConf.lock.RUnlock()
+		return !info.ModTime().Equal(catConf.modTime)
+	}
+
+	raw, err := catConf.redis.RedisSession.Get(CategoryConfKey).Result()
+	if err != nil && err != redis.Nil {
+		return false
+	}
+	catConf.lock.RLock()
+	defer catConf.lock.RUnlock()
+	return raw != catConf.shared
+}
+
+func (catConf *CategoryConfList) reloadFile() error {
+	info, err := os.Stat(catConf.filename)
+	if err != nil {
+		log.Printf("[Category] Unable to read %s| %v", catConf.filename, err)
+		return err
+	}
+	raw, err := ioutil.ReadFile(catConf.filename)
+	if err != nil {
+		log.Printf("[Category] Unable to read %s| %v", catConf.filename, err)
+		return err
+	}
+
+	cc, err := parseCategoryConf(raw)
+	if err != nil {
+		log.Printf("[Category] Invalid ranges in %s, keeping current ranges| %v", catConf.filename, err)
+		return err
+	}
+
+	catConf.lock.Lock()
+	catConf.CategoryConf = cc
+	catConf.modTime = info.ModTime()
+	catConf.lock.Unlock()
+	log.Printf("[Category] Loaded %d categories from %s", len(cc), catConf.filename)
+	return nil
+}
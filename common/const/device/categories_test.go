@@ -0,0 +1,72 @@
+package device
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestCategoryRangesSharedThroughRedis(t *testing.T) {
+	store, m := newTestRedisStore(t)
+	filename := filepath.Join(t.TempDir(), "categories.json")
+	seed := `[{"category":"2","ranges":[{"min":"280001","max":"280865"}]}]`
+	if err := ioutil.WriteFile(filename, []byte(seed), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first service seeds the shared ranges, the second reads them
+	webapp, err := LoadCategoryConf(filename, store.Redis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updater, err := LoadCategoryConf(filename, store.Redis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := updater.GetDeviceCat("280002"); got != CAT2 {
+		t.Fatalf("seeded ranges give category %q", got)
+	}
+
+	if err := webapp.SetCategoryRanges(CAT3, []CategoryRange{{Min: "280866", Max: "280900"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := webapp.SetCategoryRanges(CAT2, []CategoryRange{{Min: "280001", Max: "280900"}}); err == nil {
+		t.Errorf("overlapping ranges accepted")
+	}
+	if !updater.changed() {
+		t.Fatalf("edit not seen by the other service")
+	}
+	if err := updater.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := updater.GetDeviceCat("280870"); got != CAT3 {
+		t.Errorf("other service assigns category %q after the edit", got)
+	}
+	if updater.changed() {
+		t.Errorf("reloaded ranges still reported as changed")
+	}
+
+	// The file only seeds, it is neither rewritten nor read again
+	if raw, _ := ioutil.ReadFile(filename); string(raw) != seed {
+		t.Errorf("categories file rewritten: %s", raw)
+	}
+	if !m.Exists(CategoryConfKey) {
+		t.Errorf("shared ranges not stored under %s", CategoryConfKey)
+	}
+}
+
+func TestCategoryRangesFileOnly(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "categories.json")
+	ioutil.WriteFile(filename, []byte(`[{"category":"3","ranges":[{"min":"A0","max":"AF"}]}]`), 0644)
+
+	catConf, err := LoadCategoryConf(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := catConf.GetDeviceCat("A5"); got != CAT3 {
+		t.Errorf("file ranges give category %q", got)
+	}
+	if err := catConf.SetCategoryRanges(CAT2, []CategoryRange{{Min: "B0", Max: "BF"}}); err == nil {
+		t.Errorf("edit accepted without shared storage")
+	}
+}
@@ -7,6 +7,7 @@ package device
 // Imports
 //----------------------------------------------
 import (
+	"time"
 )
 
 //----------------------------------------------
@@ -26,6 +27,10 @@ const (
 	TimeLoopCustom           = 5
 	TimeLoopBackendDriver    = 6
 
+	// DST loops, seconds looped around the transition (time-loop.window)
+	TimeLoopDstDefaultWindow = 30 * 60
+	TimeLoopDstMaxWindow     = 7 * 24 * 60 * 60
+
 	// Time Acceleration
 	// TimeCompressionDisabled = 0
 
@@ -36,4 +41,17 @@ const (
 	// ForecastScriptStaticC        = 3
 	// ForecastScriptExtremeWeather = 4
 	ForecastScriptBackendDriver  = 5
+
+	// Stored record versions, bump together with a migration step
+	DeviceSchemaVersion       = 1 // Device, see MigrateDevice
+	ExtendedInfoSchemaVersion = 6 // ExtendedDeviceInfo, 5 replaced the ":di-v4:" cache bust
+	DeviceStoreKind           = "WeatherServiceDevice"
+
+	// Concurrent device updates, see UpdateDevice
+	DeviceUpdateRetries = 10
+	DeviceUpdateBackoff = 5 * time.Millisecond
+
+	// Category ranges shared by the services, see CategoryConfList.Watch
+	CategoryConfKey       = "config:categories"
+	CategoryWatchInterval = 30 * time.Second
 )
@@ -10,49 +10,32 @@ package device
 import (
 	"cloud.google.com/go/datastore"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/sibivishnu/Weather/common"
 	"github.com/sibivishnu/Weather/common/cache"
-	"io/ioutil"
 	"log"
 	"math"
 	"strconv"
+	"strings"
 	"time"
 )
 
-// ----------------------------------------------
-// Globals
-// ----------------------------------------------
-var (
-	Categories *CategoryConfList
-)
-
 // ----------------------------------------------
 // Types
 // ----------------------------------------------
 type (
-	CategoryConf struct {
-		Category string          `bson:"category" json:"category"`
-		Ranges   []CategoryRange `bson:"ranges" json:"ranges"`
-	}
-
-	CategoryRange struct {
-		Min      string `bson:"min" json:"min"`
-		Max      string `bson:"max" json:"max"`
-		MinFloat float32
-		MaxFloat float32
-	}
-
-	CategoryConfList struct {
-		CategoryConf []CategoryConf
-	}
-
 	Device struct {
 		ID              string
 		PSK             string
 		Category        string
 		GeoRefreshCount int // This variable control the amount of times we called Keith Geo refresh api
 		Geo             Geo
+		SchemaVersion   int               // see DeviceSchemaVersion / MigrateDevice
+		Revision        int64             // bumped by every UpdateDevice, guards the Datastore copy
+		Attributes      []DeviceAttribute // set by SetDeviceAttributes, override the SensorEntity ones
+		Removed         bool              // dropped from the device list, see ExpireDevice
+		GeoPublished    time.Time         // publish time of the last geo message applied, older ones are dropped
 	}
 
 	TimeLoopSettings struct {
@@ -61,6 +44,7 @@ type (
 		LoopOffset int64
 		LoopStart  int64
 		LoopEnd    int64
+		LoopWindow int64 // seconds around the transition, DST modes
 	}
 
 	TimeCompressionSettings struct {
@@ -83,6 +67,7 @@ type (
 	}
 
 	ExtendedDeviceInfo struct {
+		SchemaVersion     int // records from an older ExtendedInfoSchemaVersion are refreshed on read
 		ID                string
 		DataScript        int
 		TimeZoneOverride  TimeZoneOverrideSettings
@@ -149,101 +134,50 @@ type (
 )
 
 // ----------------------------------------------
-// Exports
+// Errors
 // ----------------------------------------------
-func LoadCategoryConf(filename string) *CategoryConfList {
-
-	raw, err := ioutil.ReadFile(filename)
-	if err != nil {
-		fmt.Println(err.Error())
-	}
-
-	var cc []CategoryConf
-	json.Unmarshal(raw, &cc)
-
-	for i := range cc {
-		for j := range cc[i].Ranges {
-			cc[i].Ranges[j].MinFloat = hexToFloat(cc[i].Ranges[j].Min)
-			cc[i].Ranges[j].MaxFloat = hexToFloat(cc[i].Ranges[j].Max)
-		}
-	}
-
-	return &CategoryConfList{CategoryConf: cc}
-}
-
-func (catConf *CategoryConfList) GetDeviceCat(deviceID string) string {
-
-	for _, catStruct := range catConf.CategoryConf {
-		for _, cRange := range catStruct.Ranges {
-			if hexToFloat(deviceID) >= cRange.MinFloat && hexToFloat(deviceID) <= cRange.MaxFloat {
-				return catStruct.Category
-			}
-		}
-	}
-
-	return CAT1
-
-}
-
-func (catConf *CategoryConfList) GetDeviceCatRanges(cat string) string {
-
-	ranges := ""
-
-	for _, catStruct := range catConf.CategoryConf {
-
-		if cat != catStruct.Category {
-			continue
-		} else {
-			for _, cRange := range catStruct.Ranges {
-				if ranges != "" {
-					ranges = ranges + ";"
-				}
-				ranges = ranges + cRange.Min + "::" + cRange.Max
-			}
-		}
-	}
-
-	return ranges
-
-}
-
-func GetDeviceCat(deviceID string) string {
-
-	f := hexToFloat(deviceID)
-	if f >= hexToFloat("280001") && f <= hexToFloat("2B3DE2") {
-		return CAT1
-	} else if f >= hexToFloat("2CF269") && f <= hexToFloat("2CF2CC") {
-		return CAT2
-	} else if f >= hexToFloat("2CF2CD") && f <= hexToFloat("2CF330") {
-		return CAT3
-	} else {
-		return ""
-	}
-
-}
+var (
+	// RefreshExtendedInfo built the info but could not cache it
+	ErrExtendedInfoNotSaved = errors.New("extended info not saved")
+)
 
+// ----------------------------------------------
+// Exports
+// ----------------------------------------------
 func GetExtendedDeviceInfo(ID string) (ExtendedDeviceInfo, error) {
-	key := "device.attributes:" + cache.CACHE_BUST__GLOBAL + cache.CACHE_BUST__DEVICE_INFO + ID
-	raw, err := common.RedisInstance.GetCachedData(key)
+	raw, err := common.RedisInstance.GetCachedData(extendedInfoKey(ID))
 	if err != nil {
-		return RefreshExtendedInfo(ID, nil)
+		refreshed, err := RefreshExtendedInfo(ID, nil)
+		if errors.Is(err, ErrExtendedInfoNotSaved) {
+			return refreshed, nil
+		}
+		return refreshed, err
 	}
 	var extendedInfo ExtendedDeviceInfo
 	json.Unmarshal(raw, &extendedInfo)
+	if extendedInfo.SchemaVersion != ExtendedInfoSchemaVersion {
+		// Serve the outdated record while Datastore is unavailable
+		if refreshed, err := RefreshExtendedInfo(ID, nil); err == nil || errors.Is(err, ErrExtendedInfoNotSaved) {
+			return refreshed, nil
+		}
+	}
 	return extendedInfo, nil
 }
 
 func RefreshExtendedInfo(ID string, raw *RawSensorEntity) (ExtendedDeviceInfo, error) {
 	log.Printf("[Device] Attributes Refresh Processing ID=%s", ID)
 	extendedInfo := ExtendedDeviceInfo{}
+	extendedInfo.SchemaVersion = ExtendedInfoSchemaVersion
 	extendedInfo.ID = ID
 	extendedInfo.Attributes = map[string]int64{}
 
 	if raw == nil {
-		var x RawSensorEntity
-		q := datastore.NewQuery("SensorEntity").Filter("serial =", ID).Limit(1)
-		it := common.DataStoreClient.Run(common.CTX, q)
-		_, _ = it.Next(&x)
+		// A failed lookup keeps the cached info, defaults are only for devices without entity
+		x, _, err := LookupSensorEntity(common.CTX, ID)
+		if err != nil {
+			log.Printf("[Device] Attributes Refresh Failed ID=%s| %v", ID, err)
+			return extendedInfo, err
+		}
 		raw = &x
 	}
 
@@ -258,6 +192,9 @@ func RefreshExtendedInfo(ID string, raw *RawSensorEntity) (ExtendedDeviceInfo, e
 			extendedInfo.Attributes[raw.Attributes[k].Name] = av
 		}
 	}
+	for _, a := range storedAttributes(ID) {
+		extendedInfo.Attributes[a.Name] = a.Value
+	}
 
 	var v int64
 	v = 0
@@ -322,6 +259,7 @@ func RefreshExtendedInfo(ID string, raw *RawSensorEntity) (ExtendedDeviceInfo, e
 	extendedInfo.TimeLoop.LoopOffset = 0
 	extendedInfo.TimeLoop.LoopStart = 0
 	extendedInfo.TimeLoop.LoopEnd = 0
+	extendedInfo.TimeLoop.LoopWindow = TimeLoopDstDefaultWindow
 
 	if v, ok = extendedInfo.Attributes["time-loop"]; ok {
 		vm := int(v)
@@ -351,6 +289,9 @@ func RefreshExtendedInfo(ID string, raw *RawSensorEntity) (ExtendedDeviceInfo, e
 			if v, ok = extendedInfo.Attributes["time-loop.offset"]; ok {
 				extendedInfo.TimeLoop.LoopOffset = v
 			}
+			if v, ok = extendedInfo.Attributes["time-loop.window"]; ok && v > 0 {
+				extendedInfo.TimeLoop.LoopWindow = v
+			}
 		}
 	}
 
@@ -372,31 +313,60 @@ func RefreshExtendedInfo(ID string, raw *RawSensorEntity) (ExtendedDeviceInfo, e
 	// Persist
 	//---------
 
-	key := "device.attributes:" + cache.CACHE_BUST__GLOBAL + cache.CACHE_BUST__DEVICE_INFO + ID
+	key := extendedInfoKey(ID)
 	dataBytes, err := json.Marshal(extendedInfo)
 	if err != nil {
 		log.Printf("[Device] Marshall ExtendedInfo Failed: %s, %o", key, err)
 	} else {
 		log.Printf("[Device] Attributes Persist (%s) %v", key, extendedInfo)
-		common.RedisInstance.SaveRedisData(dataBytes, key, 0)
+		if err = common.RedisInstance.SaveRedisData(dataBytes, key, 0); err != nil {
+			err = fmt.Errorf("%w: %v", ErrExtendedInfoNotSaved, err)
+		}
 	}
 	return extendedInfo, err
 }
 
-// ----------------------------------------------
-// Local Funcs
-// ----------------------------------------------
-func hexToFloat(h string) float32 {
-
-	un, err := strconv.ParseUint(h, 16, 32)
-	if err != nil {
-		fmt.Println(err.Error())
-		return 0.0
+// Validate - rejects payloads no redelivery can fix. Empty coordinates are
+// unset, present ones must be in range.
+func (p DevicePubSub) Validate() error {
+	if strings.TrimSpace(p.Serial) == "" {
+		return errors.New("serial is required")
 	}
+	for _, c := range []struct {
+		value string
+		limit float64
+	}{{p.Latitude, 90}, {p.Longitude, 180}} {
+		if strings.TrimSpace(c.value) == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(c.value), 64)
+		if err != nil || math.IsNaN(v) || v < -c.limit || v > c.limit {
+			return fmt.Errorf("invalid coordinates %q,%q", p.Latitude, p.Longitude)
+		}
+	}
+	return nil
+}
 
-	un32 := uint32(un)
-
-	f := math.Float32frombits(un32)
-	return f
+// Coordinates - parsed Latitude and Longitude, false when either is missing or out of range.
+func (g Geo) Coordinates() (float64, float64, bool) {
+	lat, err := strconv.ParseFloat(strings.TrimSpace(g.Latitude), 64)
+	if err != nil || math.IsNaN(lat) || lat < -90 || lat > 90 {
+		return 0, 0, false
+	}
+	lon, err := strconv.ParseFloat(strings.TrimSpace(g.Longitude), 64)
+	if err != nil || math.IsNaN(lon) || lon < -180 || lon > 180 {
+		return 0, 0, false
+	}
+	// Unset coordinates come through as 0,0
+	if lat == 0 && lon == 0 {
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
 
+// ----------------------------------------------
+// Local Funcs
+// ----------------------------------------------
+func extendedInfoKey(ID string) string {
+	return "device.attributes:" + cache.CACHE_BUST__GLOBAL + ID
 }
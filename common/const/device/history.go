@@ -0,0 +1,115 @@
+package device
+
+//----------------------------------------------
+// CopyRight 2019 La Crosse Technology, LTD.
+//----------------------------------------------
+
+//----------------------------------------------
+// Imports
+//----------------------------------------------
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/sibivishnu/Weather/common"
+	"github.com/sibivishnu/Weather/common/cache"
+	"github.com/sibivishnu/Weather/common/clock"
+)
+
+// ----------------------------------------------
+// Constants
+// ----------------------------------------------
+const (
+	// Who changed the location
+	LocationSourceClient     = "client"      // actionSetDeviceLocation, user app
+	LocationSourceAdmin      = "admin"       // admin location endpoint
+	LocationSourcePubSub     = "pubsub"      // geo topic, handleGeoMessage
+	LocationSourceDeviceFile = "device-file" // SCP device list, cacheID
+
+	// Retention, newest entries are kept
+	LocationHistoryMaxEntries = 100
+	LocationHistoryRetention  = 180 * 24 * time.Hour // since the last change
+)
+
+// ----------------------------------------------
+// Types
+// ----------------------------------------------
+type (
+	// LocationChange - one entry of device.history:<id>, newest first.
+	LocationChange struct {
+		Timestamp time.Time `json:"timestamp"`
+		Source    string    `json:"source"`
+		Actor     string    `json:"actor"` // token UID or pub/sub message ID
+		Previous  Geo       `json:"previous"`
+		Current   Geo       `json:"current"`
+	}
+)
+
+// ----------------------------------------------
+// Exports
+// ----------------------------------------------
+
+// RecordLocationChange - appends to the device history when the geo changed,
+// stamped with the time of clk.
+func RecordLocationChange(clk clock.Clock, id string, source string, actor string, previous Geo, current Geo) error {
+	if previous == current {
+		return nil
+	}
+
+	entry := LocationChange{
+		Timestamp: clk.Now().UTC(),
+		Source:    source,
+		Actor:     actor,
+		Previous:  previous,
+		Current:   current,
+	}
+	dataBytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	key := historyKey(id)
+	pipe := common.RedisInstance.RedisSession.TxPipeline()
+	pipe.LPush(key, dataBytes)
+	pipe.LTrim(key, 0, LocationHistoryMaxEntries-1)
+	pipe.Expire(key, LocationHistoryRetention)
+	if _, err = pipe.Exec(); err != nil {
+		log.Printf("[History] Unable to record location change for %s| %v", id, err)
+		return err
+	}
+
+	log.Printf("[History] %s location changed by %s (%s): %s/%s -> %s/%s", id, source, actor, previous.Zip, previous.CountryCode, current.Zip, current.CountryCode)
+	return nil
+}
+
+// GetLocationHistory - newest first, limit <= 0 returns every entry kept.
+func GetLocationHistory(id string, limit int) ([]LocationChange, error) {
+	history := []LocationChange{}
+
+	stop := int64(-1)
+	if limit > 0 {
+		stop = int64(limit) - 1
+	}
+	raw, err := common.RedisInstance.RedisSession.LRange(historyKey(id), 0, stop).Result()
+	if err != nil {
+		return history, err
+	}
+
+	for _, item := range raw {
+		var entry LocationChange
+		if err := json.Unmarshal([]byte(item), &entry); err != nil {
+			log.Printf("[History] Skipping malformed entry for %s| %v", id, err)
+			continue
+		}
+		history = append(history, entry)
+	}
+	return history, nil
+}
+
+// ----------------------------------------------
+// Local Funcs
+// ----------------------------------------------
+func historyKey(id string) string {
+	return "device.history:" + id + cache.CACHE_BUST__GLOBAL
+}
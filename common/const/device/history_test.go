@@ -0,0 +1,68 @@
+package device
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sibivishnu/Weather/common"
+	"github.com/sibivishnu/Weather/common/cache"
+	"github.com/sibivishnu/Weather/common/clock"
+)
+
+func TestLocationHistory(t *testing.T) {
+	store, m := newTestRedisStore(t)
+	defer func(r *cache.RedisInstance) { common.RedisInstance = r }(common.RedisInstance)
+	common.RedisInstance = store.Redis
+
+	start := time.Date(2020, 5, 4, 18, 0, 0, 0, time.UTC)
+	fake := clock.NewFakeClock(start)
+	geo := func(i int) Geo { return Geo{Zip: fmt.Sprintf("%05d", i), CountryCode: "US"} }
+
+	// Same geo, nothing recorded
+	if err := RecordLocationChange(fake, "A1", LocationSourceClient, "uid", geo(1), geo(1)); err != nil {
+		t.Fatal(err)
+	}
+	if m.Exists(historyKey("A1")) {
+		t.Errorf("unchanged geo recorded")
+	}
+
+	for i := 1; i <= LocationHistoryMaxEntries+5; i++ {
+		fake.Advance(time.Minute)
+		if err := RecordLocationChange(fake, "A1", LocationSourcePubSub, fmt.Sprint(i), geo(i-1), geo(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Newest first, trimmed to the last LocationHistoryMaxEntries
+	history, err := GetLocationHistory("A1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != LocationHistoryMaxEntries {
+		t.Fatalf("%d entries kept", len(history))
+	}
+	newest, oldest := history[0], history[len(history)-1]
+	if newest.Current != geo(LocationHistoryMaxEntries+5) || !newest.Timestamp.Equal(fake.Now()) || newest.Actor != fmt.Sprint(LocationHistoryMaxEntries+5) {
+		t.Errorf("newest entry %+v", newest)
+	}
+	if oldest.Current != geo(6) || !oldest.Timestamp.Equal(start.Add(6*time.Minute)) {
+		t.Errorf("oldest entry %+v", oldest)
+	}
+
+	if history, _ := GetLocationHistory("A1", 3); len(history) != 3 || history[0] != newest {
+		t.Errorf("limited history %+v", history)
+	}
+	if history, err := GetLocationHistory("B2", 0); err != nil || len(history) != 0 {
+		t.Errorf("device without history got %v %v", history, err)
+	}
+
+	// Kept LocationHistoryRetention after the last change
+	if ttl := m.TTL(historyKey("A1")); ttl != LocationHistoryRetention {
+		t.Errorf("history expires in %v", ttl)
+	}
+	m.FastForward(LocationHistoryRetention)
+	if history, _ := GetLocationHistory("A1", 0); len(history) != 0 {
+		t.Errorf("%d entries left after the retention", len(history))
+	}
+}
@@ -0,0 +1,204 @@
+package device
+
+//----------------------------------------------
+// CopyRight 2019 La Crosse Technology, LTD.
+//----------------------------------------------
+
+//----------------------------------------------
+// Imports
+//----------------------------------------------
+import (
+	"sort"
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+// ----------------------------------------------
+// Constants
+// ----------------------------------------------
+const (
+	// Sets of device IDs, kept up to date by the RedisDeviceStore writes
+	deviceIndexPrefix  = "deviceindex:"
+	deviceIndexAll     = deviceIndexPrefix + "all"
+	deviceIndexScan    = 500
+	deviceIndexBatches = 1000
+)
+
+// ----------------------------------------------
+// Types
+// ----------------------------------------------
+type (
+	// DeviceFilter - devices matching every non empty field.
+	DeviceFilter struct {
+		Category    string
+		ACWKey      string
+		Zip         string
+		CountryCode string
+	}
+)
+
+// ----------------------------------------------
+// Exports
+// ----------------------------------------------
+
+// Matches - the record values the index was built from.
+func (f DeviceFilter) Matches(d Device) bool {
+	return (f.Category == "" || d.Category == f.Category) &&
+		(f.ACWKey == "" || strings.TrimSpace(d.Geo.ACWKey) == f.ACWKey) &&
+		(f.Zip == "" || strings.TrimSpace(d.Geo.Zip) == f.Zip) &&
+		(f.CountryCode == "" || strings.TrimSpace(d.Geo.CountryCode) == f.CountryCode)
+}
+
+// Find - IDs of the indexed devices matching f, sorted. The index may lag a
+// concurrent write, callers check the records they load with f.Matches.
+func (s *RedisDeviceStore) Find(f DeviceFilter) ([]string, error) {
+	ids, err := s.Redis.RedisSession.SInter(f.indexKeys()...).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// RebuildIndex - replaces the index with the one of the cached records, for
+// records written before the index existed or writes it missed.
+func (s *RedisDeviceStore) RebuildIndex() (int, error) {
+	members := map[string][]interface{}{}
+	count := 0
+	var cursor uint64
+	for {
+		keys, next, err := s.Redis.RedisSession.Scan(cursor, deviceKey("*"), deviceIndexScan).Result()
+		if err != nil {
+			return count, err
+		}
+		for _, key := range keys {
+			data, err := s.Redis.RedisSession.Get(key).Bytes()
+			if err != nil {
+				continue
+			}
+			d, _, err := DecodeDevice(data)
+			if err != nil || d.ID == "" || d.Removed {
+				continue
+			}
+			for _, indexKey := range deviceIndexKeys(d) {
+				members[indexKey] = append(members[indexKey], d.ID)
+			}
+			count++
+		}
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+
+	stale, err := s.indexKeys()
+	if err != nil {
+		return count, err
+	}
+
+	// Swapped in one transaction, readers see the old or the new index
+	pipe := s.Redis.RedisSession.TxPipeline()
+	if len(stale) > 0 {
+		pipe.Del(stale...)
+	}
+	for indexKey, ids := range members {
+		for start := 0; start < len(ids); start += deviceIndexBatches {
+			end := start + deviceIndexBatches
+			if end > len(ids) {
+				end = len(ids)
+			}
+			pipe.SAdd(indexKey, ids[start:end]...)
+		}
+	}
+	_, err = pipe.Exec()
+	return count, err
+}
+
+// Find - linear scan, the memory store has no index.
+func (s *MemoryDeviceStore) Find(f DeviceFilter) ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var ids []string
+	for id, d := range s.devices {
+		if !d.Removed && f.Matches(d) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// ----------------------------------------------
+// Local Funcs
+// ----------------------------------------------
+
+// indexKeys - sets holding the devices matching f.
+func (f DeviceFilter) indexKeys() []string {
+	keys := []string{deviceIndexAll}
+	if f.Category != "" {
+		keys = append(keys, deviceIndexPrefix+"category:"+f.Category)
+	}
+	if f.ACWKey != "" {
+		keys = append(keys, deviceIndexPrefix+"acw:"+f.ACWKey)
+	}
+	if f.Zip != "" {
+		keys = append(keys, deviceIndexPrefix+"zip:"+f.Zip)
+	}
+	if f.CountryCode != "" {
+		keys = append(keys, deviceIndexPrefix+"country:"+f.CountryCode)
+	}
+	return keys
+}
+
+// deviceIndexKeys - sets d belongs to, none once removed.
+func deviceIndexKeys(d Device) []string {
+	if d.Removed {
+		return nil
+	}
+	return DeviceFilter{
+		Category:    d.Category,
+		ACWKey:      strings.TrimSpace(d.Geo.ACWKey),
+		Zip:         strings.TrimSpace(d.Geo.Zip),
+		CountryCode: strings.TrimSpace(d.Geo.CountryCode),
+	}.indexKeys()
+}
+
+// indexDevice - moves d between the sets of its previous and current values.
+func indexDevice(pipe redis.Pipeliner, previous *Device, d Device) {
+	current := deviceIndexKeys(d)
+	if previous != nil {
+		keep := map[string]bool{}
+		for _, key := range current {
+			keep[key] = true
+		}
+		for _, key := range deviceIndexKeys(*previous) {
+			if !keep[key] {
+				pipe.SRem(key, d.ID)
+			}
+		}
+	}
+	for _, key := range current {
+		pipe.SAdd(key, d.ID)
+	}
+}
+
+func unindexDevice(pipe redis.Pipeliner, d Device) {
+	for _, key := range deviceIndexKeys(d) {
+		pipe.SRem(key, d.ID)
+	}
+}
+
+func (s *RedisDeviceStore) indexKeys() ([]string, error) {
+	var all []string
+	var cursor uint64
+	for {
+		keys, next, err := s.Redis.RedisSession.Scan(cursor, deviceIndexPrefix+"*", deviceIndexScan).Result()
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, keys...)
+		if cursor = next; cursor == 0 {
+			return all, nil
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package device
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+	"github.com/sibivishnu/Weather/common/cache"
+)
+
+func newTestRedisStore(t *testing.T) (*RedisDeviceStore, *miniredis.Miniredis) {
+	t.Helper()
+	m := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return NewRedisDeviceStore(&cache.RedisInstance{RedisSession: client}, nil), m
+}
+
+func TestDeviceIndexFollowsWrites(t *testing.T) {
+	store, m := newTestRedisStore(t)
+
+	store.Put(Device{ID: "A1", Category: CAT2, Geo: Geo{Zip: "54601", CountryCode: "US"}})
+	store.Put(Device{ID: "B2", Category: CAT3, Geo: Geo{Zip: "54601", CountryCode: "US"}})
+	store.Put(Device{ID: "C3", Category: CAT2, Geo: Geo{Zip: "H2X", CountryCode: "CA"}})
+
+	find := func(f DeviceFilter) []string {
+		t.Helper()
+		ids, err := store.Find(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+
+	if ids := find(DeviceFilter{Zip: "54601", CountryCode: "US"}); !reflect.DeepEqual(ids, []string{"A1", "B2"}) {
+		t.Errorf("zip filter got %v", ids)
+	}
+	if ids := find(DeviceFilter{Category: CAT2}); !reflect.DeepEqual(ids, []string{"A1", "C3"}) {
+		t.Errorf("category filter got %v", ids)
+	}
+
+	// A location change moves the device between the sets
+	if _, err := store.Update("A1", false, func(d *Device) error {
+		d.Geo = Geo{Zip: "H2X", CountryCode: "CA"}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if ids := find(DeviceFilter{Zip: "54601"}); !reflect.DeepEqual(ids, []string{"B2"}) {
+		t.Errorf("after update, old zip got %v", ids)
+	}
+	if ids := find(DeviceFilter{Category: CAT2, CountryCode: "CA"}); !reflect.DeepEqual(ids, []string{"A1", "C3"}) {
+		t.Errorf("after update, new country got %v", ids)
+	}
+
+	if err := store.Delete("C3"); err != nil {
+		t.Fatal(err)
+	}
+	if ids := find(DeviceFilter{}); !reflect.DeepEqual(ids, []string{"A1", "B2"}) {
+		t.Errorf("after delete got %v", ids)
+	}
+
+	// Records written without the index are picked up by a rebuild
+	m.Set(deviceKey("D4"), `{"ID":"D4","Category":"3","SchemaVersion":1}`)
+	m.SAdd(deviceIndexPrefix+"category:9", "GONE")
+	count, err := store.RebuildIndex()
+	if err != nil || count != 3 {
+		t.Fatalf("rebuild indexed %d devices, %v", count, err)
+	}
+	if ids := find(DeviceFilter{Category: CAT3}); !reflect.DeepEqual(ids, []string{"B2", "D4"}) {
+		t.Errorf("after rebuild got %v", ids)
+	}
+	if m.Exists(deviceIndexPrefix + "category:9") {
+		t.Errorf("stale index set kept by the rebuild")
+	}
+}
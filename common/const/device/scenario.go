@@ -0,0 +1,87 @@
+package device
+
+//----------------------------------------------
+// CopyRight 2019 La Crosse Technology, LTD.
+//----------------------------------------------
+
+//----------------------------------------------
+// Imports
+//----------------------------------------------
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"github.com/sibivishnu/Weather/common"
+	"github.com/sibivishnu/Weather/common/clock"
+)
+
+// ----------------------------------------------
+// Constants
+// ----------------------------------------------
+const (
+	// Scenario replayed by devices in ForecastScriptStaticA mode
+	ScenarioStaticA = "static-a"
+)
+
+// ----------------------------------------------
+// Types
+// ----------------------------------------------
+type (
+	// ScenarioAssignment - scenario replayed by a device in ForecastScriptBackendDriver
+	// mode, from Start (epoch seconds).
+	ScenarioAssignment struct {
+		Name  string `json:"name"`
+		Start int64  `json:"start"`
+	}
+)
+
+// ----------------------------------------------
+// Exports
+// ----------------------------------------------
+
+// GetScenarioAssignment - nil when the device has none.
+func GetScenarioAssignment(ID string) (*ScenarioAssignment, error) {
+	data, err := common.RedisInstance.GetCachedData(scenarioKey(ID))
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var assignment ScenarioAssignment
+	if err = json.Unmarshal(data, &assignment); err != nil {
+		return nil, err
+	}
+	return &assignment, nil
+}
+
+// SetScenarioAssignment - Start defaults to the time of clk.
+func SetScenarioAssignment(clk clock.Clock, ID string, assignment ScenarioAssignment) (ScenarioAssignment, error) {
+	assignment.Name = strings.TrimSpace(assignment.Name)
+	if assignment.Name == "" {
+		return assignment, errors.New("scenario name is required")
+	}
+	if assignment.Start == 0 {
+		assignment.Start = clk.Now().Unix()
+	}
+
+	dataBytes, err := json.Marshal(assignment)
+	if err != nil {
+		return assignment, err
+	}
+	return assignment, common.RedisInstance.SaveRedisData(dataBytes, scenarioKey(ID), 0)
+}
+
+// DeleteScenarioAssignment - the device goes back to provider data.
+func DeleteScenarioAssignment(ID string) error {
+	return common.RedisInstance.RemoveKeyFromCache(scenarioKey(ID))
+}
+
+// ----------------------------------------------
+// Local Funcs
+// ----------------------------------------------
+func scenarioKey(ID string) string {
+	return "device.scenario:" + ID
+}
@@ -0,0 +1,104 @@
+package device
+
+//----------------------------------------------
+// CopyRight 2019 La Crosse Technology, LTD.
+//----------------------------------------------
+
+//----------------------------------------------
+// Imports
+//----------------------------------------------
+import (
+	"cloud.google.com/go/datastore"
+	"fmt"
+	"github.com/sibivishnu/Weather/common"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+)
+
+// ----------------------------------------------
+// Constants
+// ----------------------------------------------
+const (
+	SensorEntityKind = "SensorEntity"
+
+	// Serials per "in" query
+	SensorLookupBatchSize = 10
+)
+
+// ----------------------------------------------
+// Types
+// ----------------------------------------------
+type (
+	// SensorLookupError - the lookup failed, absent entities are not an error.
+	// Callers should retry rather than treat the devices as having no geo.
+	SensorLookupError struct {
+		Serials []string
+		Err     error
+	}
+)
+
+// ----------------------------------------------
+// Exports
+// ----------------------------------------------
+func (e *SensorLookupError) Error() string {
+	return fmt.Sprintf("SensorEntity lookup of %d serials failed: %v", len(e.Serials), e.Err)
+}
+
+func (e *SensorLookupError) Unwrap() error {
+	return e.Err
+}
+
+// LookupSensorEntities - gateway entities by serial, SensorLookupBatchSize serials
+// per query. Serials without an entity are left out of the map.
+func LookupSensorEntities(ctx context.Context, serials []string) (map[string]RawSensorEntity, error) {
+	entities := make(map[string]RawSensorEntity, len(serials))
+	for start := 0; start < len(serials); start += SensorLookupBatchSize {
+		end := start + SensorLookupBatchSize
+		if end > len(serials) {
+			end = len(serials)
+		}
+		if err := lookupSensorBatch(ctx, serials[start:end], entities); err != nil {
+			return nil, &SensorLookupError{Serials: serials, Err: err}
+		}
+	}
+	return entities, nil
+}
+
+// LookupSensorEntity - false when the serial has no entity.
+func LookupSensorEntity(ctx context.Context, serial string) (RawSensorEntity, bool, error) {
+	entities, err := LookupSensorEntities(ctx, []string{serial})
+	if err != nil {
+		return RawSensorEntity{}, false, err
+	}
+	x, ok := entities[serial]
+	return x, ok, nil
+}
+
+// ----------------------------------------------
+// Local Funcs
+// ----------------------------------------------
+func lookupSensorBatch(ctx context.Context, serials []string, entities map[string]RawSensorEntity) error {
+	values := make([]interface{}, len(serials))
+	for i, serial := range serials {
+		values[i] = serial
+	}
+
+	q := datastore.NewQuery(SensorEntityKind).FilterField("serial", "in", values)
+	it := common.DataStoreClient.Run(ctx, q)
+	for {
+		var x RawSensorEntity
+		_, err := it.Next(&x)
+		if err == iterator.Done {
+			return nil
+		}
+		// Properties missing from RawSensorEntity, the known ones are loaded
+		if _, mismatch := err.(*datastore.ErrFieldMismatch); err != nil && !mismatch {
+			return err
+		}
+
+		// First entity of a serial wins, as with the former Limit(1) queries
+		if _, ok := entities[x.Serial]; !ok {
+			entities[x.Serial] = x
+		}
+	}
+}
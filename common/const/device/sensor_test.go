@@ -0,0 +1,113 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/sibivishnu/Weather/common"
+	"golang.org/x/net/context"
+)
+
+// emulatorSensor - SensorEntity with a property RawSensorEntity does not know
+type emulatorSensor struct {
+	Serial  string    `datastore:"serial"`
+	Geo     Geo       `datastore:"geo"`
+	Handle  string    `datastore:"handle"`
+	Unknown string    `datastore:"propertyAddedLater"`
+	Created time.Time `datastore:"createdOn"`
+}
+
+// useDatastoreEmulator - DataStoreClient on the emulator at DATASTORE_EMULATOR_HOST.
+func useDatastoreEmulator(t *testing.T) *datastore.Client {
+	t.Helper()
+	if os.Getenv("DATASTORE_EMULATOR_HOST") == "" {
+		t.Skip("DATASTORE_EMULATOR_HOST not set")
+	}
+	project := os.Getenv("DATASTORE_PROJECT_ID")
+	if project == "" {
+		project = "weather-test"
+	}
+	client, err := datastore.NewClient(context.Background(), project)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := common.DataStoreClient
+	common.DataStoreClient = client
+	t.Cleanup(func() {
+		common.DataStoreClient = previous
+		client.Close()
+	})
+	return client
+}
+
+func TestLookupSensorEntitiesEmulator(t *testing.T) {
+	client := useDatastoreEmulator(t)
+	ctx := context.Background()
+
+	// Over two batches, serials unique to the run
+	prefix := fmt.Sprintf("T%d-", time.Now().UnixNano())
+	var serials []string
+	var keys []*datastore.Key
+	var sensors []emulatorSensor
+	for i := 0; i < SensorLookupBatchSize*2+3; i++ {
+		serial := fmt.Sprintf("%s%02d", prefix, i)
+		serials = append(serials, serial)
+		keys = append(keys, datastore.IncompleteKey(SensorEntityKind, nil))
+		sensors = append(sensors, emulatorSensor{Serial: serial, Geo: Geo{Zip: "54601", CountryCode: "US"}, Handle: "h" + serial, Unknown: "x"})
+	}
+	keys, err := client.PutMulti(ctx, keys, sensors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.DeleteMulti(context.Background(), keys) })
+
+	missing := prefix + "missing"
+	lookup := append([]string{missing}, serials...)
+
+	// Queries of the emulator are eventually consistent
+	var entities map[string]RawSensorEntity
+	for attempt := 0; attempt < 20; attempt++ {
+		if entities, err = LookupSensorEntities(ctx, lookup); err != nil {
+			t.Fatal(err)
+		}
+		if len(entities) == len(serials) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if len(entities) != len(serials) {
+		t.Fatalf("found %d of %d entities", len(entities), len(serials))
+	}
+	if _, ok := entities[missing]; ok {
+		t.Errorf("entity found for a serial without one")
+	}
+	for _, serial := range serials {
+		x := entities[serial]
+		if x.Serial != serial || x.Handle != "h"+serial || x.Geo.Zip != "54601" {
+			t.Errorf("%s loaded as %+v", serial, x)
+		}
+	}
+
+	x, ok, err := LookupSensorEntity(ctx, serials[0])
+	if err != nil || !ok || x.Serial != serials[0] {
+		t.Errorf("single lookup got %+v %v %v", x, ok, err)
+	}
+}
+
+func TestLookupSensorEntitiesEmulatorFailure(t *testing.T) {
+	useDatastoreEmulator(t)
+
+	// A cancelled lookup is an error, not devices without an entity
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := LookupSensorEntities(ctx, []string{"A1", "B2"})
+	var lookupErr *SensorLookupError
+	if !errors.As(err, &lookupErr) || len(lookupErr.Serials) != 2 {
+		t.Errorf("cancelled lookup got %v", err)
+	}
+}
@@ -0,0 +1,475 @@
+package device
+
+//----------------------------------------------
+// CopyRight 2019 La Crosse Technology, LTD.
+//----------------------------------------------
+
+//----------------------------------------------
+// Imports
+//----------------------------------------------
+import (
+	"cloud.google.com/go/datastore"
+	"encoding/json"
+	"errors"
+	"github.com/go-redis/redis"
+	"github.com/sibivishnu/Weather/common"
+	"github.com/sibivishnu/Weather/common/cache"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------
+// Globals
+// ----------------------------------------------
+var (
+	// Device store used by the services, set by LoadCommonEnvironment.
+	Store DeviceStore
+
+	ErrDeviceNotFound = errors.New("device not found")
+	ErrDeviceConflict = errors.New("device updated concurrently, retries exhausted")
+
+	// Returned by an update func to leave the record untouched
+	ErrNoChange = errors.New("no change")
+)
+
+// ----------------------------------------------
+// Types
+// ----------------------------------------------
+type (
+	// DeviceStore - device records keyed by serial.
+	// Put is a blind overwrite, read-modify-write goes through Update.
+	// Removed records are not found, an Update with create brings them back.
+	DeviceStore interface {
+		Get(id string) (Device, error)
+		Put(d Device) error
+		Delete(id string) error
+		Update(id string, create bool, fn func(*Device) error) (Device, error)
+		Find(f DeviceFilter) ([]string, error)
+	}
+
+	// RedisDeviceStore - Redis cache (device:<id>) in front of Datastore.
+	// Writes go to Datastore first so a Redis flush does not lose locations,
+	// the deviceindex: sets follow the cached records.
+	RedisDeviceStore struct {
+		Redis     *cache.RedisInstance
+		Datastore *datastore.Client
+		Kind      string
+	}
+
+	// MemoryDeviceStore - in process store for tooling and local runs.
+	MemoryDeviceStore struct {
+		lock    sync.RWMutex
+		devices map[string]Device
+	}
+)
+
+// ----------------------------------------------
+// Exports
+// ----------------------------------------------
+func NewRedisDeviceStore(redisInstance *cache.RedisInstance, datastoreClient *datastore.Client) *RedisDeviceStore {
+	return &RedisDeviceStore{Redis: redisInstance, Datastore: datastoreClient, Kind: DeviceStoreKind}
+}
+
+func NewMemoryDeviceStore() *MemoryDeviceStore {
+	return &MemoryDeviceStore{devices: map[string]Device{}}
+}
+
+// UpdateDevice - compare-and-swap update of an existing device, fn may run more than once.
+func UpdateDevice(id string, fn func(*Device) error) (Device, error) {
+	return Store.Update(id, false, fn)
+}
+
+// UpsertDevice - same as UpdateDevice, fn gets a record with only the ID set for new devices.
+func UpsertDevice(id string, fn func(*Device) error) (Device, error) {
+	return Store.Update(id, true, fn)
+}
+
+// PurgeDevice - removes the device record and its cached attributes, history and overrides.
+func PurgeDevice(id string) error {
+	if err := Store.Delete(id); err != nil {
+		return err
+	}
+	return common.RedisInstance.RedisSession.Del(deviceRedisKeys(id)...).Err()
+}
+
+// ExpireDevice - marks the device removed and lets its cached keys expire after
+// ttl, Datastore keeps the removed record. The next upsert of the device brings
+// it back and clears the expiry.
+func ExpireDevice(id string, ttl time.Duration) error {
+	_, err := Store.Update(id, false, func(d *Device) error {
+		d.Removed = true
+		return nil
+	})
+	if err != nil && err != ErrDeviceNotFound {
+		return err
+	}
+
+	pipe := common.RedisInstance.RedisSession.Pipeline()
+	pipe.Expire(deviceKey(id), ttl)
+	for _, key := range deviceRedisKeys(id) {
+		pipe.Expire(key, ttl)
+	}
+	_, err = pipe.Exec()
+	return err
+}
+
+// DecodeDevice - unmarshal a cached record, migrating it to the current schema.
+func DecodeDevice(data []byte) (Device, bool, error) {
+	var d Device
+	if err := json.Unmarshal(data, &d); err != nil {
+		return d, false, err
+	}
+	migrated := MigrateDevice(&d)
+	return d, migrated, nil
+}
+
+// MigrateDevice - brings a record up to DeviceSchemaVersion and normalizes its
+// geo, returns true if it changed. Runs on every read and write of the stores.
+func MigrateDevice(d *Device) bool {
+	changed := normalizeGeo(&d.Geo)
+	if d.SchemaVersion >= DeviceSchemaVersion {
+		return changed
+	}
+
+	// 0 -> 1: Records written before versioning, their geo was normalized above.
+
+	d.SchemaVersion = DeviceSchemaVersion
+	return true
+}
+
+// NormalizeCountryCode - upper case ISO code, Elixir/Appengine send 'USA' instead of 'US'.
+func NormalizeCountryCode(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if strings.Contains(code, "USA") {
+		return "US"
+	}
+	return code
+}
+
+// ----------------------------------------------
+// RedisDeviceStore
+// ----------------------------------------------
+func (s *RedisDeviceStore) Get(id string) (Device, error) {
+	data, err := s.Redis.GetCachedData(deviceKey(id))
+	if err == nil {
+		d, migrated, err := DecodeDevice(data)
+		if err != nil {
+			return d, err
+		}
+		if d.Removed {
+			return Device{}, ErrDeviceNotFound
+		}
+		if migrated {
+			// Written back through Update, a blind Put could drop a concurrent write
+			log.Printf("[DeviceStore] Migrated %s to schema %d", id, DeviceSchemaVersion)
+			if updated, err := s.Update(id, false, func(*Device) error { return nil }); err == nil {
+				return updated, nil
+			}
+		}
+		return d, nil
+	}
+	if err != redis.Nil {
+		log.Printf("[DeviceStore] Redis get %s failed, using Datastore| %v", id, err)
+	}
+
+	// Cache miss, fall back on the durable copy. A removed record is not cached again
+	d, err := s.load(id)
+	if err != nil {
+		return d, err
+	}
+	if d.Removed {
+		return Device{}, ErrDeviceNotFound
+	}
+	s.cacheMissing(d)
+	return d, nil
+}
+
+func (s *RedisDeviceStore) Put(d Device) error {
+	if d.ID == "" {
+		return errors.New("device id is required")
+	}
+	MigrateDevice(&d)
+
+	if s.Datastore != nil {
+		if _, err := s.Datastore.Put(common.CTX, datastore.NameKey(s.Kind, d.ID, nil), &d); err != nil {
+			log.Printf("[DeviceStore] Datastore put %s failed| %v", d.ID, err)
+			return err
+		}
+	}
+	return s.cache(d)
+}
+
+func (s *RedisDeviceStore) Delete(id string) error {
+	if s.Datastore != nil {
+		if err := s.Datastore.Delete(common.CTX, datastore.NameKey(s.Kind, id, nil)); err != nil && err != datastore.ErrNoSuchEntity {
+			log.Printf("[DeviceStore] Datastore delete %s failed| %v", id, err)
+			return err
+		}
+	}
+
+	pipe := s.Redis.RedisSession.TxPipeline()
+	if previous, ok := s.cached(id); ok {
+		unindexDevice(pipe, previous)
+	}
+	pipe.SRem(deviceIndexAll, id)
+	pipe.Del(deviceKey(id) + cache.CACHE_BUST__GLOBAL)
+	_, err := pipe.Exec()
+	if err != nil {
+		log.Printf("[Redis] Unable to delete key : %s from the cache| %v", deviceKey(id), err)
+	}
+	return err
+}
+
+// Update - WATCH device:<id>, apply fn and commit with MULTI/EXEC, retried on conflict.
+// The Datastore copy is only replaced by a higher revision.
+func (s *RedisDeviceStore) Update(id string, create bool, fn func(*Device) error) (Device, error) {
+	if id == "" {
+		return Device{}, errors.New("device id is required")
+	}
+	key := deviceKey(id) + cache.CACHE_BUST__GLOBAL
+
+	var d Device
+	for attempt := 0; attempt < DeviceUpdateRetries; attempt++ {
+		err := s.Redis.RedisSession.Watch(func(tx *redis.Tx) error {
+			d = Device{}
+			var previous *Device
+			data, err := tx.Get(key).Bytes()
+			if err == nil {
+				if d, _, err = DecodeDevice(data); err != nil {
+					return err
+				}
+				cached := d
+				previous = &cached
+			} else if err == redis.Nil {
+				if d, err = s.load(id); err == ErrDeviceNotFound && create {
+					d = Device{ID: id}
+				} else if err != nil {
+					return err
+				}
+			} else {
+				return err
+			}
+
+			if d.Removed {
+				if !create {
+					return ErrDeviceNotFound
+				}
+				d.Removed = false
+			}
+
+			if err = fn(&d); err != nil {
+				return err
+			}
+			d.ID = id
+			d.Revision++
+			MigrateDevice(&d)
+
+			dataBytes, err := json.Marshal(d)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+				pipe.Set(key, dataBytes, 0)
+				indexDevice(pipe, previous, d)
+				return nil
+			})
+			return err
+		}, key)
+
+		if err == ErrNoChange {
+			return d, nil
+		}
+		if err == redis.TxFailedErr {
+			log.Printf("[DeviceStore] Update %s conflict, retry %d", id, attempt+1)
+			time.Sleep(time.Duration(attempt+1) * DeviceUpdateBackoff)
+			continue
+		}
+		if err != nil {
+			return d, err
+		}
+		return d, s.persist(d)
+	}
+
+	log.Printf("[DeviceStore] Update %s gave up after %d attempts", id, DeviceUpdateRetries)
+	return d, ErrDeviceConflict
+}
+
+// Datastore copy only, used on a cache miss
+func (s *RedisDeviceStore) load(id string) (Device, error) {
+	var d Device
+	if s.Datastore == nil {
+		return d, ErrDeviceNotFound
+	}
+	err := s.Datastore.Get(common.CTX, datastore.NameKey(s.Kind, id, nil), &d)
+	if err == datastore.ErrNoSuchEntity {
+		return d, ErrDeviceNotFound
+	} else if err != nil {
+		log.Printf("[DeviceStore] Datastore get %s failed| %v", id, err)
+		return d, err
+	}
+	MigrateDevice(&d)
+	return d, nil
+}
+
+// Writes d to Datastore unless a newer revision is already there
+func (s *RedisDeviceStore) persist(d Device) error {
+	if s.Datastore == nil {
+		return nil
+	}
+	k := datastore.NameKey(s.Kind, d.ID, nil)
+	_, err := s.Datastore.RunInTransaction(common.CTX, func(tx *datastore.Transaction) error {
+		var stored Device
+		if err := tx.Get(k, &stored); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if stored.Revision > d.Revision {
+			return nil
+		}
+		_, err := tx.Put(k, &d)
+		return err
+	})
+	if err != nil {
+		log.Printf("[DeviceStore] Datastore put %s failed| %v", d.ID, err)
+	}
+	return err
+}
+
+func (s *RedisDeviceStore) cache(d Device) error {
+	dataBytes, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	pipe := s.Redis.RedisSession.TxPipeline()
+	previous, ok := s.cached(d.ID)
+	pipe.Set(deviceKey(d.ID)+cache.CACHE_BUST__GLOBAL, dataBytes, 0)
+	if ok {
+		indexDevice(pipe, &previous, d)
+	} else {
+		indexDevice(pipe, nil, d)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		log.Printf("[Redis] Unable to save key: %s to the cache| %v", deviceKey(d.ID), err)
+		return err
+	}
+	return nil
+}
+
+// Caches d unless the key was written since the miss, an Update between the
+// Datastore read and this write keeps its record.
+func (s *RedisDeviceStore) cacheMissing(d Device) error {
+	dataBytes, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	key := deviceKey(d.ID) + cache.CACHE_BUST__GLOBAL
+	err = s.Redis.RedisSession.Watch(func(tx *redis.Tx) error {
+		if n, err := tx.Exists(key).Result(); err != nil || n > 0 {
+			return err
+		}
+		_, err := tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.SetNX(key, dataBytes, 0)
+			indexDevice(pipe, nil, d)
+			return nil
+		})
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		return nil
+	}
+	if err != nil {
+		log.Printf("[Redis] Unable to save key: %s to the cache| %v", deviceKey(d.ID), err)
+	}
+	return err
+}
+
+// Current cached record, if any
+func (s *RedisDeviceStore) cached(id string) (Device, bool) {
+	data, err := s.Redis.RedisSession.Get(deviceKey(id) + cache.CACHE_BUST__GLOBAL).Bytes()
+	if err != nil {
+		return Device{}, false
+	}
+	d, _, err := DecodeDevice(data)
+	return d, err == nil
+}
+
+// ----------------------------------------------
+// MemoryDeviceStore
+// ----------------------------------------------
+func (s *MemoryDeviceStore) Get(id string) (Device, error) {
+	s.lock.RLock()
+	d, ok := s.devices[id]
+	s.lock.RUnlock()
+	if !ok || d.Removed {
+		return Device{}, ErrDeviceNotFound
+	}
+	MigrateDevice(&d)
+	return d, nil
+}
+
+func (s *MemoryDeviceStore) Put(d Device) error {
+	if d.ID == "" {
+		return errors.New("device id is required")
+	}
+	MigrateDevice(&d)
+	s.lock.Lock()
+	s.devices[d.ID] = d
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemoryDeviceStore) Update(id string, create bool, fn func(*Device) error) (Device, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	d, ok := s.devices[id]
+	if (!ok || d.Removed) && !create {
+		return Device{}, ErrDeviceNotFound
+	}
+	if !ok {
+		d = Device{ID: id}
+	}
+	d.Removed = false
+	if err := fn(&d); err == ErrNoChange {
+		return d, nil
+	} else if err != nil {
+		return d, err
+	}
+	d.ID = id
+	d.Revision++
+	MigrateDevice(&d)
+	s.devices[id] = d
+	return d, nil
+}
+
+func (s *MemoryDeviceStore) Delete(id string) error {
+	s.lock.Lock()
+	delete(s.devices, id)
+	s.lock.Unlock()
+	return nil
+}
+
+// ----------------------------------------------
+// Local Funcs
+// ----------------------------------------------
+// normalizeGeo - geo fields as the location lookups expect them, true if one changed.
+func normalizeGeo(g *Geo) bool {
+	countryCode := NormalizeCountryCode(g.CountryCode)
+	zip := strings.TrimSpace(g.Zip)
+	changed := countryCode != g.CountryCode || zip != g.Zip
+	g.CountryCode = countryCode
+	g.Zip = zip
+	return changed
+}
+
+// deviceRedisKeys - per device keys besides device:<id>
+func deviceRedisKeys(id string) []string {
+	return []string{extendedInfoKey(id), historyKey(id), timelineKey(id), scenarioKey(id), "devicerequested:" + id}
+}
+
+func deviceKey(id string) string {
+	return "device:" + id
+}
@@ -0,0 +1,141 @@
+package device
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sibivishnu/Weather/common"
+	"github.com/sibivishnu/Weather/common/cache"
+)
+
+func TestStoresNormalizeCountryCode(t *testing.T) {
+	redisStore, m := newTestRedisStore(t)
+	for name, store := range map[string]DeviceStore{"redis": redisStore, "memory": NewMemoryDeviceStore()} {
+		if err := store.Put(Device{ID: "A1", Geo: Geo{Zip: " 54601 ", CountryCode: "USA"}}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Update("B2", true, func(d *Device) error {
+			d.Geo = Geo{Zip: "54601", CountryCode: "usa"}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, id := range []string{"A1", "B2"} {
+			d, err := store.Get(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.Geo.CountryCode != "US" || d.Geo.Zip != "54601" {
+				t.Errorf("%s %s stored %q %q", name, id, d.Geo.CountryCode, d.Geo.Zip)
+			}
+		}
+	}
+
+	// Current schema records written before the normalization
+	m.Set(deviceKey("C3"), `{"ID":"C3","Geo":{"countryCode":"USA"},"SchemaVersion":1}`)
+	d, err := redisStore.Get("C3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Geo.CountryCode != "US" {
+		t.Errorf("read %q", d.Geo.CountryCode)
+	}
+}
+
+func TestNormalizeCountryCode(t *testing.T) {
+	for code, want := range map[string]string{"USA": "US", " usa": "US", "US": "US", "ca": "CA", "": ""} {
+		if got := NormalizeCountryCode(code); got != want {
+			t.Errorf("NormalizeCountryCode(%q) = %q, want %q", code, got, want)
+		}
+	}
+}
+
+func TestRedisStoreReadWriteBack(t *testing.T) {
+	store, m := newTestRedisStore(t)
+
+	// Migrations are written back as an update of the cached record
+	m.Set(deviceKey("A1"), `{"ID":"A1","Category":"2","Geo":{"countryCode":"USA"},"Revision":4}`)
+	d, err := store.Get("A1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Revision != 5 || d.SchemaVersion != DeviceSchemaVersion {
+		t.Errorf("migrated record at revision %d schema %d", d.Revision, d.SchemaVersion)
+	}
+	if cached, _ := store.cached("A1"); cached.Revision != 5 || cached.Geo.CountryCode != "US" {
+		t.Errorf("migration not written back: %+v", cached)
+	}
+
+	// A cache fill loses against a record written since the miss
+	if err := store.cacheMissing(Device{ID: "A1", Category: CAT3}); err != nil {
+		t.Fatal(err)
+	}
+	if cached, _ := store.cached("A1"); cached.Category != CAT2 {
+		t.Errorf("cache fill overwrote the record, category %q", cached.Category)
+	}
+	if ids, _ := store.Find(DeviceFilter{Category: CAT3}); len(ids) != 0 {
+		t.Errorf("cache fill indexed a record it did not write: %v", ids)
+	}
+
+	if err := store.cacheMissing(Device{ID: "B2", Category: CAT3}); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ := store.Find(DeviceFilter{Category: CAT3}); len(ids) != 1 || ids[0] != "B2" {
+		t.Errorf("cache fill of a missing record indexed %v", ids)
+	}
+}
+
+func TestExpiredDeviceStaysRemoved(t *testing.T) {
+	store, m := newTestRedisStore(t)
+	defer func(s DeviceStore, r *cache.RedisInstance) { Store, common.RedisInstance = s, r }(Store, common.RedisInstance)
+	Store, common.RedisInstance = store, store.Redis
+
+	geo := Geo{Zip: "54601", CountryCode: "US"}
+	store.Put(Device{ID: "A1", Category: CAT2, Geo: geo})
+	store.Put(Device{ID: "B2", Category: CAT2, Geo: geo})
+
+	if err := ExpireDevice("A1", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("A1"); err != ErrDeviceNotFound {
+		t.Errorf("removed device got %v", err)
+	}
+	if _, err := store.Update("A1", false, func(*Device) error { return nil }); err != ErrDeviceNotFound {
+		t.Errorf("update of a removed device got %v", err)
+	}
+	if ids, _ := store.Find(DeviceFilter{Zip: "54601"}); !reflect.DeepEqual(ids, []string{"B2"}) {
+		t.Errorf("index holds %v", ids)
+	}
+	if count, err := store.RebuildIndex(); err != nil || count != 1 {
+		t.Errorf("rebuild indexed %d devices, %v", count, err)
+	}
+	if ttl := m.TTL(deviceKey("A1")); ttl <= 0 {
+		t.Errorf("removed device key expires in %v", ttl)
+	}
+
+	// Listed again, the device comes back with its record
+	d, err := store.Update("A1", true, func(*Device) error { return nil })
+	if err != nil || d.Removed || d.Geo != geo {
+		t.Fatalf("upsert got %+v %v", d, err)
+	}
+	if ttl := m.TTL(deviceKey("A1")); ttl != 0 {
+		t.Errorf("upserted device key expires in %v", ttl)
+	}
+	if ids, _ := store.Find(DeviceFilter{Zip: "54601"}); !reflect.DeepEqual(ids, []string{"A1", "B2"}) {
+		t.Errorf("index holds %v", ids)
+	}
+
+	memory := NewMemoryDeviceStore()
+	memory.Put(Device{ID: "A1", Geo: geo, Removed: true})
+	if _, err := memory.Get("A1"); err != ErrDeviceNotFound {
+		t.Errorf("memory store got %v", err)
+	}
+	if ids, _ := memory.Find(DeviceFilter{}); len(ids) != 0 {
+		t.Errorf("memory store found %v", ids)
+	}
+	if d, err := memory.Update("A1", true, func(*Device) error { return nil }); err != nil || d.Removed || d.Geo != geo {
+		t.Errorf("memory upsert got %+v %v", d, err)
+	}
+}
@@ -0,0 +1,148 @@
+package device
+
+//----------------------------------------------
+// CopyRight 2019 La Crosse Technology, LTD.
+//----------------------------------------------
+
+//----------------------------------------------
+// Imports
+//----------------------------------------------
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/sibivishnu/Weather/common"
+	"github.com/sibivishnu/Weather/common/clock"
+)
+
+// ----------------------------------------------
+// Constants
+// ----------------------------------------------
+const (
+	ClockTimelineMaxSteps = 1000
+)
+
+// ----------------------------------------------
+// Types
+// ----------------------------------------------
+type (
+	// ClockStep - the clock starts at At (epoch seconds), or at the real time
+	// plus Offset when At is 0, and runs for Duration seconds.
+	ClockStep struct {
+		At       int64 `json:"at,omitempty"`
+		Offset   int64 `json:"offset,omitempty"`
+		Duration int64 `json:"duration"`
+	}
+
+	// ClockTimeline - scripted clock of a device in TimeLoopBackendDriver mode,
+	// replayed from Start (epoch seconds). Without Loop the last step keeps running.
+	ClockTimeline struct {
+		Start int64       `json:"start"`
+		Loop  bool        `json:"loop"`
+		Steps []ClockStep `json:"steps"`
+	}
+)
+
+// ----------------------------------------------
+// Exports
+// ----------------------------------------------
+
+// Validate - at least one step, each lasting a positive number of seconds.
+func (t ClockTimeline) Validate() error {
+	if len(t.Steps) == 0 {
+		return errors.New("timeline needs at least one step")
+	}
+	if len(t.Steps) > ClockTimelineMaxSteps {
+		return fmt.Errorf("timeline is limited to %d steps", ClockTimelineMaxSteps)
+	}
+	for i, step := range t.Steps {
+		if step.Duration <= 0 {
+			return fmt.Errorf("step %d: duration must be positive", i)
+		}
+		if step.At != 0 && step.Offset != 0 {
+			return fmt.Errorf("step %d: set either at or offset", i)
+		}
+	}
+	return nil
+}
+
+// Length - replay length of one pass.
+func (t ClockTimeline) Length() time.Duration {
+	var total int64
+	for _, step := range t.Steps {
+		total += step.Duration
+	}
+	return time.Duration(total) * time.Second
+}
+
+// At - scripted time for the real instant now, false before Start.
+func (t ClockTimeline) At(now time.Time) (time.Time, bool) {
+	elapsed := now.Sub(time.Unix(t.Start, 0))
+	total := t.Length()
+	if elapsed < 0 || total <= 0 {
+		return now, false
+	}
+	if t.Loop {
+		elapsed = elapsed % total
+	}
+
+	for i, step := range t.Steps {
+		duration := time.Duration(step.Duration) * time.Second
+		if elapsed < duration || i == len(t.Steps)-1 {
+			if step.At != 0 {
+				return time.Unix(step.At, 0).Add(elapsed), true
+			}
+			return now.Add(time.Duration(step.Offset) * time.Second), true
+		}
+		elapsed -= duration
+	}
+	return now, false
+}
+
+// GetClockTimeline - timeline set for a device, nil when there is none.
+func GetClockTimeline(ID string) (*ClockTimeline, error) {
+	data, err := common.RedisInstance.GetCachedData(timelineKey(ID))
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var timeline ClockTimeline
+	if err = json.Unmarshal(data, &timeline); err != nil {
+		return nil, err
+	}
+	return &timeline, nil
+}
+
+// SetClockTimeline - validates and stores a timeline, Start defaults to the
+// time of clk, the clock forecasts are later served with.
+func SetClockTimeline(clk clock.Clock, ID string, timeline ClockTimeline) (ClockTimeline, error) {
+	if err := timeline.Validate(); err != nil {
+		return timeline, err
+	}
+	if timeline.Start == 0 {
+		timeline.Start = clk.Now().Unix()
+	}
+
+	dataBytes, err := json.Marshal(timeline)
+	if err != nil {
+		return timeline, err
+	}
+	return timeline, common.RedisInstance.SaveRedisData(dataBytes, timelineKey(ID), 0)
+}
+
+// DeleteClockTimeline - the device falls back on the real clock.
+func DeleteClockTimeline(ID string) error {
+	return common.RedisInstance.RemoveKeyFromCache(timelineKey(ID))
+}
+
+// ----------------------------------------------
+// Local Funcs
+// ----------------------------------------------
+func timelineKey(ID string) string {
+	return "device.timeline:" + ID
+}
@@ -13,11 +13,11 @@ import (
 
 	//	cache "github.com/sibivishnu/Weather/cacheUpdater"
 	"log"
-	"time"
 
 	"github.com/sibivishnu/Weather/common"
 	common "github.com/sibivishnu/Weather/common"
 	cache "github.com/sibivishnu/Weather/common/cache"
+	"github.com/sibivishnu/Weather/common/clock"
 	"github.com/sibivishnu/Weather/common/const/device"
 	"github.com/sibivishnu/Weather/common/providers/weather_api"
 	"golang.org/x/net/context"
@@ -73,24 +73,52 @@ func LoadCommonEnvironment(options map[string]interface{}) error {
 	// Initialize accuWeather
 	//=============================================
 
-	// 1. Setup LocationMap
-	weather_api.LocationMap = make(map[string]*time.Location)
-
-	// 2. Setup  AccuWeather Key
+	// 1. Setup  AccuWeather Key
 	if v, ok = options["accuweather.key"]; ok {
 		weather_api.AccuApiKey = v.(string)
 	} else {
 		log.Printf("[Common] Options should include accuweather.key entry")
 	}
 
+	// 2. Compile Templates (services rendering legacy forecasts only)
+	if v, ok = options["templates.path"]; ok {
+		weather_api.Templates = weather_api.NewTemplateRegistry(v.(string))
+		if err := weather_api.Templates.Load(); err != nil {
+			log.Printf("[Common] Template load error: %v", err)
+		}
+		weather_api.Templates.Watch(weather_api.DefaultTemplateWatchInterval)
+	}
+
+	// 3. Time zones, offsets served with the locations are the ones at the service clock
+	if v, ok = options["clock"]; ok {
+		weather_api.TimeZones = weather_api.NewTimeZoneResolver(weather_api.DefaultTimeZoneAliases, v.(clock.Clock))
+	}
+
+	// 4. Forecast Scenarios (devices with forecast scripting enabled)
+	if v, ok = options["scenarios.path"]; ok {
+		weather_api.Scenarios = weather_api.NewScenarioRegistry(v.(string))
+		if err := weather_api.Scenarios.Load(); err != nil {
+			log.Printf("[Common] Scenario load error: %v", err)
+		}
+		weather_api.Scenarios.Watch(weather_api.DefaultScenarioWatchInterval)
+	}
+
 	//=============================================
 	// Initialize device
 	//=============================================
 	if v, ok = options["config.categories"]; ok {
-		device.Categories = device.LoadCategoryConf(v.(string))
+		var err error
+		device.Categories, err = device.LoadCategoryConf(v.(string), common.RedisInstance)
+		if err != nil {
+			log.Printf("[Common] Category config error: %v", err)
+		}
+		device.Categories.Watch(device.CategoryWatchInterval)
 	} else {
 		log.Printf("[Common] Options should include config.categories entry")
 	}
 
+	// Device records, Redis in front of Datastore
+	device.Store = device.NewRedisDeviceStore(common.RedisInstance, common.DataStoreClient)
+
 	return nil
 }
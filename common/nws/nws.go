@@ -8,6 +8,7 @@ package nws
 //----------------------------------------------
 import (
 	"encoding/xml"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -62,7 +63,10 @@ type Coords struct {
 //----------------------------------------------
 // Exports
 //----------------------------------------------
-func GetSevereComponentMap(zip string) map[string]string {
+
+// GetSevereComponentMap - tornado and hail probabilities of the hour starting
+// at now, an error when NWS could not be asked or did not answer.
+func GetSevereComponentMap(zip string, now time.Time) (map[string]string, error) {
 
 	// We create the map and initialize it with null values in case nothing is returned
 	severeMap := make(map[string]string)
@@ -71,7 +75,6 @@ func GetSevereComponentMap(zip string) map[string]string {
 
 	log.Printf("GetSevereComponentMap for zip: %s", zip)
 
-	now := time.Now()
 	hourAfter := now.Add(1 * time.Hour)
 	beginTime := now.Format("2006-01-02T15")
 	beginTime = beginTime + ":00:00"
@@ -93,18 +96,21 @@ func GetSevereComponentMap(zip string) map[string]string {
 
 	resp, err := http.Get(Url.String())
 	if err != nil {
-		log.Printf("GetSevereComponentMap Error: %+v\n", err)
-		return severeMap
+		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("nws status %d for zip %s", resp.StatusCode, zip)
+	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Printf("GetSevereComponentMap Error: %+v\n", err)
-		return severeMap
+		return nil, err
 	}
 
 	var ms MainStruct
-	xml.Unmarshal(body, &ms)
+	if err := xml.Unmarshal(body, &ms); err != nil {
+		return nil, err
+	}
 
 	if len(ms.Data.Parameters) > 0 {
 		for i := 0; i < len(ms.Data.Parameters[0].ConvectiveHazards); i++ {
@@ -112,9 +118,7 @@ func GetSevereComponentMap(zip string) map[string]string {
 			log.Printf("GetSevereComponentMap for zip: %s type : %s", zip, ms.Data.Parameters[0].ConvectiveHazards[i].SevereComponent.Value)
 			severeMap[ms.Data.Parameters[0].ConvectiveHazards[i].SevereComponent.Type] = ms.Data.Parameters[0].ConvectiveHazards[i].SevereComponent.Value
 		}
-	} else {
-		return severeMap
 	}
 
-	return severeMap
+	return severeMap, nil
 }
@@ -8,13 +8,12 @@ package weather_api
 // Imports
 //==============================================
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
+	"github.com/sibivishnu/Weather/common/clock"
 	"github.com/sibivishnu/Weather/common/const/device"
 	"github.com/sibivishnu/Weather/common/nws"
 	"gopkg.in/guregu/null.v3"
-	"html/template"
 	"io/ioutil"
 	"log"
 	"math"
@@ -80,6 +79,9 @@ type (
 		AdministrativeArea AccuCountry
 		Country            AccuCountry
 		Code               string
+
+		// Locations the postal code search returned in this country, set on zip: records
+		PostalCodeCandidates int `json:",omitempty"`
 	}
 
 	//----------------------------------------------
@@ -129,6 +131,8 @@ type (
 		HourRange string
 		Iso8601   string
 		DateTime  time.Time
+		GmtOffset float64 // hours, at DateTime
+		Simulated bool    // DateTime moved by time compression or a time loop
 	}
 
 	//----------------------------------------------
@@ -2091,6 +2095,36 @@ func (s NullableAccuCurrentForecastResponseFormatV1p2) ResponseFormat(version st
 	}
 }
 
+//----------------------------------------------
+// @fillDailySunMoon
+//----------------------------------------------
+/**
+ * @brief Fills the null moon and sun times of a day from the previous day, the
+ * first day from the next one. Left null when the list holds a single day.
+ */
+func fillDailySunMoon(daily []NullableAccuDailyForecast, i int) {
+	other := i - 1
+	if i == 0 {
+		other = 1
+	}
+	if other >= len(daily) {
+		return
+	}
+
+	if !daily[i].Moon.Rise.Valid {
+		daily[i].Moon.Rise = daily[other].Moon.Rise
+	}
+	if !daily[i].Moon.Set.Valid {
+		daily[i].Moon.Set = daily[other].Moon.Set
+	}
+	if !daily[i].Sun.Rise.Valid {
+		daily[i].Sun.Rise = daily[other].Sun.Rise
+	}
+	if !daily[i].Sun.Set.Valid {
+		daily[i].Sun.Set = daily[other].Sun.Set
+	}
+}
+
 //----------------------------------------------
 //
 //----------------------------------------------
@@ -2130,34 +2164,7 @@ func (s NullableUniversalForecast) ResponseFormat(version string) (ApiResponseIn
 		if s.Daily != nil {
 			for i := 0; i < len(*s.Daily); i++ {
 
-				if !((*s.Daily)[i]).Moon.Rise.Valid {
-					if i > 0 {
-						((*s.Daily)[i]).Moon.Rise = ((*s.Daily)[i-1]).Moon.Rise
-					} else {
-						((*s.Daily)[i]).Moon.Rise = ((*s.Daily)[i+1]).Moon.Rise
-					}
-				}
-				if !((*s.Daily)[i]).Moon.Set.Valid {
-					if i > 0 {
-						((*s.Daily)[i]).Moon.Set = ((*s.Daily)[i-1]).Moon.Set
-					} else {
-						((*s.Daily)[i]).Moon.Set = ((*s.Daily)[i+1]).Moon.Set
-					}
-				}
-				if !((*s.Daily)[i]).Sun.Rise.Valid {
-					if i > 0 {
-						((*s.Daily)[i]).Sun.Rise = ((*s.Daily)[i-1]).Sun.Rise
-					} else {
-						((*s.Daily)[i]).Sun.Rise = ((*s.Daily)[i+1]).Sun.Rise
-					}
-				}
-				if !((*s.Daily)[i]).Sun.Set.Valid {
-					if i > 0 {
-						((*s.Daily)[i]).Sun.Set = ((*s.Daily)[i-1]).Sun.Set
-					} else {
-						((*s.Daily)[i]).Sun.Set = ((*s.Daily)[i+1]).Sun.Set
-					}
-				}
+				fillDailySunMoon(*s.Daily, i)
 
 				r, _ := ((*s.Daily)[i]).ResponseFormat(version)
 				daily = append(daily, r)
@@ -2170,7 +2177,7 @@ func (s NullableUniversalForecast) ResponseFormat(version string) (ApiResponseIn
 			for i := 0; i < len(*s.Hourly); i++ {
 
 				// work around for null incoming temperature
-				if i == 0 && !((*s.Hourly)[i]).Temperature.Value.Valid {
+				if i == 0 && !((*s.Hourly)[i]).Temperature.Value.Valid && len(*s.Hourly) > 1 {
 					((*s.Hourly)[i]).Temperature.Value = ((*s.Hourly)[i+1]).Temperature.Value
 				}
 
@@ -2210,34 +2217,7 @@ func (s NullableUniversalForecast) ResponseFormat(version string) (ApiResponseIn
 		if s.Daily != nil {
 			for i := 0; i < len(*s.Daily); i++ {
 
-				if !((*s.Daily)[i]).Moon.Rise.Valid {
-					if i > 0 {
-						((*s.Daily)[i]).Moon.Rise = ((*s.Daily)[i-1]).Moon.Rise
-					} else {
-						((*s.Daily)[i]).Moon.Rise = ((*s.Daily)[i+1]).Moon.Rise
-					}
-				}
-				if !((*s.Daily)[i]).Moon.Set.Valid {
-					if i > 0 {
-						((*s.Daily)[i]).Moon.Set = ((*s.Daily)[i-1]).Moon.Set
-					} else {
-						((*s.Daily)[i]).Moon.Set = ((*s.Daily)[i+1]).Moon.Set
-					}
-				}
-				if !((*s.Daily)[i]).Sun.Rise.Valid {
-					if i > 0 {
-						((*s.Daily)[i]).Sun.Rise = ((*s.Daily)[i-1]).Sun.Rise
-					} else {
-						((*s.Daily)[i]).Sun.Rise = ((*s.Daily)[i+1]).Sun.Rise
-					}
-				}
-				if !((*s.Daily)[i]).Sun.Set.Valid {
-					if i > 0 {
-						((*s.Daily)[i]).Sun.Set = ((*s.Daily)[i-1]).Sun.Set
-					} else {
-						((*s.Daily)[i]).Sun.Set = ((*s.Daily)[i+1]).Sun.Set
-					}
-				}
+				fillDailySunMoon(*s.Daily, i)
 
 				r, _ := ((*s.Daily)[i]).ResponseFormat(version)
 				daily = append(daily, r)
@@ -2250,7 +2230,7 @@ func (s NullableUniversalForecast) ResponseFormat(version string) (ApiResponseIn
 			for i := 0; i < len(*s.Hourly); i++ {
 
 				// work around for null incoming temperature
-				if i == 0 && !((*s.Hourly)[i]).Temperature.Value.Valid {
+				if i == 0 && !((*s.Hourly)[i]).Temperature.Value.Valid && len(*s.Hourly) > 1 {
 					((*s.Hourly)[i]).Temperature.Value = ((*s.Hourly)[i+1]).Temperature.Value
 				}
 
@@ -2290,34 +2270,7 @@ func (s NullableUniversalForecast) ResponseFormat(version string) (ApiResponseIn
 		if s.Daily != nil {
 			for i := 0; i < len(*s.Daily); i++ {
 
-				if !((*s.Daily)[i]).Moon.Rise.Valid {
-					if i > 0 {
-						((*s.Daily)[i]).Moon.Rise = ((*s.Daily)[i-1]).Moon.Rise
-					} else {
-						((*s.Daily)[i]).Moon.Rise = ((*s.Daily)[i+1]).Moon.Rise
-					}
-				}
-				if !((*s.Daily)[i]).Moon.Set.Valid {
-					if i > 0 {
-						((*s.Daily)[i]).Moon.Set = ((*s.Daily)[i-1]).Moon.Set
-					} else {
-						((*s.Daily)[i]).Moon.Set = ((*s.Daily)[i+1]).Moon.Set
-					}
-				}
-				if !((*s.Daily)[i]).Sun.Rise.Valid {
-					if i > 0 {
-						((*s.Daily)[i]).Sun.Rise = ((*s.Daily)[i-1]).Sun.Rise
-					} else {
-						((*s.Daily)[i]).Sun.Rise = ((*s.Daily)[i+1]).Sun.Rise
-					}
-				}
-				if !((*s.Daily)[i]).Sun.Set.Valid {
-					if i > 0 {
-						((*s.Daily)[i]).Sun.Set = ((*s.Daily)[i-1]).Sun.Set
-					} else {
-						((*s.Daily)[i]).Sun.Set = ((*s.Daily)[i+1]).Sun.Set
-					}
-				}
+				fillDailySunMoon(*s.Daily, i)
 
 				r, _ := ((*s.Daily)[i]).ResponseFormat(version)
 				daily = append(daily, r)
@@ -2329,7 +2282,7 @@ func (s NullableUniversalForecast) ResponseFormat(version string) (ApiResponseIn
 		if s.Hourly != nil {
 			for i := 0; i < len(*s.Hourly); i++ {
 
-				if i == 0 && !((*s.Hourly)[i]).Temperature.Value.Valid {
+				if i == 0 && !((*s.Hourly)[i]).Temperature.Value.Valid && len(*s.Hourly) > 1 {
 					((*s.Hourly)[i]).Temperature.Value = ((*s.Hourly)[i+1]).Temperature.Value
 				}
 
@@ -2369,34 +2322,7 @@ func (s NullableUniversalForecast) ResponseFormat(version string) (ApiResponseIn
 		if s.Daily != nil {
 			for i := 0; i < len(*s.Daily); i++ {
 
-				if !((*s.Daily)[i]).Moon.Rise.Valid {
-					if i > 0 {
-						((*s.Daily)[i]).Moon.Rise = ((*s.Daily)[i-1]).Moon.Rise
-					} else {
-						((*s.Daily)[i]).Moon.Rise = ((*s.Daily)[i+1]).Moon.Rise
-					}
-				}
-				if !((*s.Daily)[i]).Moon.Set.Valid {
-					if i > 0 {
-						((*s.Daily)[i]).Moon.Set = ((*s.Daily)[i-1]).Moon.Set
-					} else {
-						((*s.Daily)[i]).Moon.Set = ((*s.Daily)[i+1]).Moon.Set
-					}
-				}
-				if !((*s.Daily)[i]).Sun.Rise.Valid {
-					if i > 0 {
-						((*s.Daily)[i]).Sun.Rise = ((*s.Daily)[i-1]).Sun.Rise
-					} else {
-						((*s.Daily)[i]).Sun.Rise = ((*s.Daily)[i+1]).Sun.Rise
-					}
-				}
-				if !((*s.Daily)[i]).Sun.Set.Valid {
-					if i > 0 {
-						((*s.Daily)[i]).Sun.Set = ((*s.Daily)[i-1]).Sun.Set
-					} else {
-						((*s.Daily)[i]).Sun.Set = ((*s.Daily)[i+1]).Sun.Set
-					}
-				}
+				fillDailySunMoon(*s.Daily, i)
 
 				r, _ := ((*s.Daily)[i]).ResponseFormat(version)
 				daily = append(daily, r)
@@ -2408,7 +2334,7 @@ func (s NullableUniversalForecast) ResponseFormat(version string) (ApiResponseIn
 		if s.Hourly != nil {
 			for i := 0; i < len(*s.Hourly); i++ {
 
-				if i == 0 && !((*s.Hourly)[i]).Temperature.Value.Valid {
+				if i == 0 && !((*s.Hourly)[i]).Temperature.Value.Valid && len(*s.Hourly) > 1 {
 					((*s.Hourly)[i]).Temperature.Value = ((*s.Hourly)[i+1]).Temperature.Value
 				}
 
@@ -2468,15 +2394,25 @@ func (s NullableUniversalForecastFormatV1p2) ResponseFormat(version string) (Api
 /**
  * @brief
  */
-func (accuLocation PostalCodeResponse) NullableGetWeatherForecastJsonExtended(category string, deviceID string, firmwareVersion string, callSubVersion string, includeToday bool, includeDaily bool, includeHourly bool, includeCurrent bool) ApiResponseInterface {
-	//log.Printf("getWeatherForecast location key : %s, Timezone:%s, Device Category: %s, Device ID: %s", accuLocation.Key, accuLocation.TimeZone.Name, category, deviceID)
+func (accuLocation PostalCodeResponse) NullableGetWeatherForecastJsonExtended(clk clock.Clock, category string, deviceID string, firmwareVersion string, callSubVersion string, includeToday bool, includeDaily bool, includeHourly bool, includeCurrent bool) ApiResponseInterface {
+	sections := DefaultForecastSections(callSubVersion)
+	sections.Today = includeToday
+	sections.Daily = includeDaily
+	sections.Hourly = includeHourly
+	sections.Current = includeCurrent
+	return accuLocation.NullableGetWeatherForecastJsonSections(clk, category, deviceID, firmwareVersion, sections)
+}
 
-	var dailyClip = 7
-	var hourlyClip = 12
-	if callSubVersion == "3" || callSubVersion == "4" || callSubVersion == "5" {
-		dailyClip = 8
-		hourlyClip = 15
-	}
+//----------------------------------------------
+// @NullableGetWeatherForecastJsonSections
+//----------------------------------------------
+/**
+ * @brief Json forecast limited to the requested sections.
+ *
+ * Only the accuweather / nws queries backing a requested section are made.
+ */
+func (accuLocation PostalCodeResponse) NullableGetWeatherForecastJsonSections(clk clock.Clock, category string, deviceID string, firmwareVersion string, sections ForecastSections) ApiResponseInterface {
+	//log.Printf("getWeatherForecast location key : %s, Timezone:%s, Device Category: %s, Device ID: %s", accuLocation.Key, accuLocation.TimeZone.Name, category, deviceID)
 
 	// Setup Forecast
 	forecast := NullableUniversalForecast{}
@@ -2496,36 +2432,39 @@ func (accuLocation PostalCodeResponse) NullableGetWeatherForecastJsonExtended(ca
 	forecast.ExtendedDeviceInfo = extendedInfo
 
 	// Grab Weather Time
-	weatherTime, err := GetLocalDateAndHourV2(accuLocation.TimeZone.Name, &extendedInfo)
+	weatherTime, err := GetLocalDateAndHourV2(clk, accuLocation.TimeZone.Name, &extendedInfo)
 	if err != nil {
 		return ApiString("Could not get time from the timeZone")
 	}
 
 	// Time Range to Disable Flow (Temp Cut Off.)
-	if weatherTime.DateTime.Month() < 9 || weatherTime.DateTime.Month() == 9 && weatherTime.DateTime.Day() < 20 {
+	if beforeFlowCutoff(weatherTime.DateTime) {
 		forecast.FlowControl = null.NewInt(DefaultModeFlowCommand, true)
 	}
 
-	daily, _ := JsonQueryAccuDayForecastAPI(accuLocation.Key, accuLocation.TimeZone.Name, "10day", weatherTime)
-	forecast.Headline = &daily.Headline
-	forecast.Today = daily.Today
+	// Today is the first entry of the daily query
+	var daily NullableDailyForecast
+	if sections.Today || sections.Daily {
+		daily, _ = JsonQueryAccuDayForecastAPI(clk, accuLocation.Key, accuLocation.TimeZone.Name, "10day", weatherTime)
+		forecast.Headline = &daily.Headline
+		forecast.Today = daily.Today
+	}
 
 	// Time formatting
 	forecast.Time = null.NewString(weatherTime.LocalTime, true)
-	forecast.GmtOffset = null.NewFloat(accuLocation.TimeZone.GmtOffset, true)
+	forecast.GmtOffset = null.NewFloat(servedGmtOffset(accuLocation.TimeZone.GmtOffset, weatherTime, extendedInfo), true)
 
 	//forecast.Date = null.NewString(weatherTime.LocalDate, true)
 	forecast.Date = null.NewString(weatherTime.Iso8601, true)
-	if extendedInfo.TimeZoneOverride.Enabled {
-		forecast.GmtOffset = null.NewFloat(float64(extendedInfo.TimeZoneOverride.Sign*extendedInfo.TimeZoneOverride.HourOffset)+(float64(extendedInfo.TimeZoneOverride.MinuteOffset)/60.0), true)
-	}
 
 	// Load Current & NWSForecast
-	forecast.NWSForecast = getNWSInfoV2(accuLocation)
-	current, _ := NullablequeryAccuCurrentForecastAPI(accuLocation.Key, weatherTime, forecast.NWSForecast)
+	if sections.Current {
+		forecast.NWSForecast = getNWSInfoV2(accuLocation, clk.Now())
+		current, _ := NullablequeryAccuCurrentForecastAPI(accuLocation.Key, weatherTime, forecast.NWSForecast)
 
-	// @todo better error handling
-	forecast.Current = &current
+		// @todo better error handling
+		forecast.Current = &current
+	}
 
 	// Set Category
 	switch category {
@@ -2538,60 +2477,76 @@ func (accuLocation PostalCodeResponse) NullableGetWeatherForecastJsonExtended(ca
 	}
 
 	//--------------------------------------------------------------------
-	// Load: Seven Day Forecast, 12 Hour Forecast and ForecastTime
+	// Load: Daily Forecast, Hourly Forecast and ForecastTime
 	//--------------------------------------------------------------------
-	var sevenDayForecast []NullableAccuDailyForecast
-
-	for i := 0; i < len(daily.DailyForecasts) && i < dailyClip; i++ {
-		sevenDayForecast = append(sevenDayForecast, daily.DailyForecasts[i])
+	if sections.Daily {
+		var dailyForecast []NullableAccuDailyForecast
+		for i := 0; i < len(daily.DailyForecasts) && i < sections.Days; i++ {
+			dailyForecast = append(dailyForecast, daily.DailyForecasts[i])
+		}
+		forecast.Daily = &dailyForecast
 	}
-	forecast.Daily = &sevenDayForecast
 
-	// Hourly
-	hourly := NullableQueryAccuHourForecastAPI(accuLocation.Key, "24hour", weatherTime)
-	now := time.Unix(time.Now().Unix(), 0)
-	var futureHourly []NullableAccuHourlyForecast
-	var i int
-	for i = 0; len(futureHourly) < hourlyClip && i < len(hourly); i++ {
-		if !now.After(time.Unix(int64(hourly[i].EpochDateTime.Int64), 0)) {
-			futureHourly = append(futureHourly, hourly[i])
+	// Hourly, ForecastTime is the first hour served or the current hour without
+	// hourly so the body does not change on every request. Both follow the device
+	// time, looped and compressed devices get the hours of their simulated time
+	now := time.Unix(weatherTime.DateTime.Unix(), 0)
+	forecastTime := now.Truncate(time.Hour)
+	if sections.Hourly {
+		hourly := NullableQueryAccuHourForecastAPI(accuLocation.Key, "24hour", weatherTime)
+		futureHourly := futureHourlyForecasts(hourly, now, sections.Hours)
+		forecast.Hourly = &futureHourly
+
+		if len(futureHourly) > 0 {
+			forecastTime = time.Unix(int64(futureHourly[0].EpochDateTime.Int64), 0)
 		}
 	}
-	forecast.Hourly = &futureHourly
-
-	// Note no validation of populated futureHourly is performed here.
-	unixEpoch := time.Unix(int64(futureHourly[0].EpochDateTime.Int64), 0)
-	forecast.ForecastTime = null.NewString(unixEpoch.Add(time.Minute*time.Duration(forecast.GmtOffset.Float64*60)).Format("2006-01-02T15:04:05-0700"), true)
+	forecast.ForecastTime = null.NewString(forecastTime.Add(time.Minute*time.Duration(forecast.GmtOffset.Float64*60)).Format("2006-01-02T15:04:05-0700"), true)
 	//--------------------------------------------------------------------
-	// End Load: Seven Day Forecast, 12 Hour Forecast and ForecastTime
+	// End Load: Daily Forecast, Hourly Forecast and ForecastTime
 	//--------------------------------------------------------------------
 
 	// Saving or updating keys which will be updated by the cache updater
-	toUpdateKey := "activelocations:" + accuLocation.Key
-	toUpdateVal := accuLocation.TimeZone.Name + ":" + category
-	common.RedisInstance.SaveRedisData([]byte(toUpdateVal), toUpdateKey, 720*time.Hour)
-
-	//------------------------
-	// Crude override to drop some results in api response.
-	//------------------------
-	if !includeDaily {
-		forecast.Daily = nil
-	}
-	if !includeHourly {
-		forecast.Hourly = nil
+	if !sections.ReadOnly {
+		toUpdateKey := "activelocations:" + accuLocation.Key
+		toUpdateVal := accuLocation.TimeZone.Name + ":" + category
+		common.RedisInstance.SaveRedisData([]byte(toUpdateVal), toUpdateKey, 720*time.Hour)
+		trackLocationDevice(accuLocation.Key, deviceID, clk.Now())
 	}
-	if !includeCurrent {
-		forecast.Current = nil
-	}
-	if !includeToday {
+
+	// Today was loaded as part of daily
+	if !sections.Today {
 		forecast.Today = nil
 	}
 
+	// Scripted devices get the scenario sections in place of provider data. Scenarios
+	// play in service time from the assignment start, a looped device time would
+	// keep restarting them
+	if frame := DeviceScenarioFrame(extendedInfo, clk.Now()); frame != nil {
+		frame.Apply(&forecast, sections)
+	}
+
 	return forecast
 }
 
-func (accuLocation PostalCodeResponse) NullableGetWeatherForecastJson(category string, deviceID string, firmwareVersion string, callSubVersion string) ApiResponseInterface {
-	return accuLocation.NullableGetWeatherForecastJsonExtended(category, deviceID, firmwareVersion, callSubVersion, true, true, true, true)
+//----------------------------------------------
+// @futureHourlyForecasts
+//----------------------------------------------
+/**
+ * @brief The first count hours starting at or after now.
+ */
+func futureHourlyForecasts(hourly []NullableAccuHourlyForecast, now time.Time, count int) []NullableAccuHourlyForecast {
+	var future []NullableAccuHourlyForecast
+	for i := 0; len(future) < count && i < len(hourly); i++ {
+		if !now.After(time.Unix(int64(hourly[i].EpochDateTime.Int64), 0)) {
+			future = append(future, hourly[i])
+		}
+	}
+	return future
+}
+
+func (accuLocation PostalCodeResponse) NullableGetWeatherForecastJson(clk clock.Clock, category string, deviceID string, firmwareVersion string, callSubVersion string) ApiResponseInterface {
+	return accuLocation.NullableGetWeatherForecastJsonExtended(clk, category, deviceID, firmwareVersion, callSubVersion, true, true, true, true)
 }
 
 //==============================================
@@ -2604,10 +2559,10 @@ func (accuLocation PostalCodeResponse) NullableGetWeatherForecastJson(category s
 /**
  * @brief
  */
-func (accuLocation PostalCodeResponse) GetWeatherForecastTest(category string, deviceID string) string {
+func (accuLocation PostalCodeResponse) GetWeatherForecastTest(clk clock.Clock, category string, deviceID string) string {
 
 	//log.Printf("GetWeatherForecastTest location key : %s, Timezone:%s, Device Category: %s, Device ID: %s", accuLocation.Key, accuLocation.TimeZone.Name, category, deviceID)
-	weatherTime, err := GetLocalDateAndHour(accuLocation.TimeZone.Name)
+	weatherTime, err := GetLocalDateAndHour(clk, accuLocation.TimeZone.Name)
 	if err != nil {
 		return "Could not get time from the timeZone"
 	}
@@ -2650,50 +2605,15 @@ func (accuLocation PostalCodeResponse) GetWeatherForecastTest(category string, d
 		templateFile = "templateTestDevice"
 	}
 
-	// Loading the template file, which depends on the category
-	/*
-		body, err := ioutil.ReadFile(path.Join("/templates", templateFile))
-		if err != nil {
-			log.Printf(err.Error())
-			return err.Error()
-		}
-	*/
-	body, err := common.RedisInstance.GetCachedFile("/templates", templateFile, time.Hour)
-
-	tmpl, err := template.New("body").Funcs(template.FuncMap{
-		"getWifiIcon": func(accuIcon int) int {
-			return IconMap[accuIcon]
-		},
-		"getFormatedDateFromEpoch": func(dateStr string) string {
-			layout := "2006-01-02T15:04:05-07:00"
-			t, err := time.Parse(layout, dateStr)
-
-			if err != nil {
-				log.Printf("GetWeatherForecastTest - Error parsing the time : %s %s", dateStr, err.Error())
-			}
-
-			return t.Format("15:04")
-		},
-		"getMoonPhrase": func(accuPhrase string) int {
-			return MoonPhraseMap[accuPhrase]
-		},
-		"convertValueToEnum": func(value string) int {
-			return ValueToEnumMap[value]
-		},
-	}).Parse(string(body))
-	var forecast bytes.Buffer
-	if tmpl == nil {
-		log.Printf("Template is null -- Error")
-		return "Problem loading template"
-	}
-	err = tmpl.Execute(&forecast, apiResult)
+	// Render the template, which depends on the category
+	rendered, err := Templates.Execute(templateFile, apiResult)
 	if err != nil {
 		log.Printf(err.Error())
 		return err.Error()
 	}
 
 	// This hack is just because go has issues with interpreting "<" and ">" it's trying to render it as html block. TODO Fix it to properly set the template
-	fc := strings.Replace(forecast.String(), "##", "<", -1)
+	fc := strings.Replace(rendered, "##", "<", -1)
 	fc = strings.Replace(fc, "!!", ">", -1)
 
 	return fc
@@ -2709,7 +2629,7 @@ func (accuLocation PostalCodeResponse) GetWeatherForecastTest(category string, d
 /**
  * @brief
  */
-func (accuLocation PostalCodeResponse) GetWeatherForecastV2(category string, deviceID string, firmwareVersion string) string {
+func (accuLocation PostalCodeResponse) GetWeatherForecastV2(clk clock.Clock, category string, deviceID string, firmwareVersion string) string {
 	// Get Extended Info
 	extendedInfo, err := device.GetExtendedDeviceInfo(deviceID)
 	var flow int
@@ -2728,10 +2648,10 @@ func (accuLocation PostalCodeResponse) GetWeatherForecastV2(category string, dev
 	// @TODO - time loops and compression if specified in extendedInfo
 
 	//log.Printf("getWeatherForecastV2 location key : %s, Timezone:%s, Device Category: %s, Device ID: %s", accuLocation.Key, accuLocation.TimeZone.Name, category, deviceID)
-	weatherTime, err := GetLocalDateAndHourV2(accuLocation.TimeZone.Name, &extendedInfo)
+	weatherTime, err := GetLocalDateAndHourV2(clk, accuLocation.TimeZone.Name, &extendedInfo)
 
 	// Time Range to Disable Flow (Temp Cut Off.)
-	if weatherTime.DateTime.Month() < 9 || weatherTime.DateTime.Month() == 9 && weatherTime.DateTime.Day() < 20 {
+	if beforeFlowCutoff(weatherTime.DateTime) {
 		flow = DefaultModeFlowCommand
 	} else {
 		if extendedInfo.HasDateTimeBug {
@@ -2757,7 +2677,7 @@ func (accuLocation PostalCodeResponse) GetWeatherForecastV2(category string, dev
 	case device.CAT1:
 		ats := AccuTemplateCat1Struct{}
 		ats.FlowControl = flow
-		accu1dForecast := QueryAccuDayForecastAPI(accuLocation.Key, accuLocation.TimeZone.Name, "10day", weatherTime)
+		accu1dForecast := QueryAccuDayForecastAPI(clk, accuLocation.Key, accuLocation.TimeZone.Name, "10day", weatherTime)
 		ats.Headline = &accu1dForecast.Headline
 		ats.DailyForecast = &accu1dForecast.DailyForecasts[0]
 		ats.DailyForecast.Actual.Wind.Speed.ValueRound = Round(ats.DailyForecast.Actual.Wind.Speed.Value)
@@ -2766,42 +2686,36 @@ func (accuLocation PostalCodeResponse) GetWeatherForecastV2(category string, dev
 		ats.DailyForecast.Temperature.Minimum.ValueRound = Round(ats.DailyForecast.Temperature.Minimum.Value)
 		ats.DailyForecast.Actual.Rain.ValueRound = Round(ats.DailyForecast.Actual.Rain.Value)
 		ats.DailyForecast.Actual.Snow.ValueRound = Round(ats.DailyForecast.Actual.Snow.Value)
-		ats.DailyForecast.NWSevereComponentMap = getNWSInfo(accuLocation.PrimaryPostalCode)
+		ats.DailyForecast.NWSevereComponentMap = getNWSInfo(accuLocation.Key, accuLocation.PrimaryPostalCode, clk.Now())
 
 		// Time formatting
 		ats.DateStr = weatherTime.LocalDate
 		ats.TimeStr = weatherTime.LocalTime
-		ats.GmtOffset = accuLocation.TimeZone.GmtOffset
-		if extendedInfo.TimeZoneOverride.Enabled {
-			ats.GmtOffset = float64(extendedInfo.TimeZoneOverride.Sign*extendedInfo.TimeZoneOverride.HourOffset) + (float64(extendedInfo.TimeZoneOverride.MinuteOffset) / 60.0)
-		}
+		ats.GmtOffset = servedGmtOffset(accuLocation.TimeZone.GmtOffset, weatherTime, extendedInfo)
 
 		apiResult = ats
 		templateFile = "templateCat1V2"
 	case device.CAT2:
 		ats := AccuTemplateCat2Struct{}
 		ats.FlowControl = flow
-		accu1dForecast := QueryAccuDayForecastAPI(accuLocation.Key, accuLocation.TimeZone.Name, "10day", weatherTime)
+		accu1dForecast := QueryAccuDayForecastAPI(clk, accuLocation.Key, accuLocation.TimeZone.Name, "10day", weatherTime)
 		accuCurrentForecast := queryAccuCurrentForecastAPI(accuLocation.Key, weatherTime)
 
 		ats.Headline = &accu1dForecast.Headline
 		ats.DailyForecast = &accu1dForecast.DailyForecasts[0]
-		ats.DailyForecast.NWSevereComponentMap = getNWSInfo(accuLocation.PrimaryPostalCode)
+		ats.DailyForecast.NWSevereComponentMap = getNWSInfo(accuLocation.Key, accuLocation.PrimaryPostalCode, clk.Now())
 		ats.CurrentForecast = &accuCurrentForecast[0]
 
 		// Time formatting
 		ats.DateStr = weatherTime.LocalDate
 		ats.TimeStr = weatherTime.LocalTime
-		ats.GmtOffset = accuLocation.TimeZone.GmtOffset
-		if extendedInfo.TimeZoneOverride.Enabled {
-			ats.GmtOffset = float64(extendedInfo.TimeZoneOverride.Sign*extendedInfo.TimeZoneOverride.HourOffset) + (float64(extendedInfo.TimeZoneOverride.MinuteOffset) / 60.0)
-		}
+		ats.GmtOffset = servedGmtOffset(accuLocation.TimeZone.GmtOffset, weatherTime, extendedInfo)
 		apiResult = ats
 		templateFile = "templateCat2V2"
 	case device.CAT3:
 		ats := AccuTemplateCat3Struct{}
 		ats.FlowControl = flow
-		accu10dForecast := QueryAccuDayForecastAPI(accuLocation.Key, accuLocation.TimeZone.Name, "10day", weatherTime)
+		accu10dForecast := QueryAccuDayForecastAPI(clk, accuLocation.Key, accuLocation.TimeZone.Name, "10day", weatherTime)
 		accu24hForecast := QueryAccuHourForecastAPI(accuLocation.Key, "24hour", weatherTime)
 
 		var a7f []AccuDailyForecast
@@ -2809,7 +2723,7 @@ func (accuLocation PostalCodeResponse) GetWeatherForecastV2(category string, dev
 			a7f = append(a7f, accu10dForecast.DailyForecasts[i])
 		}
 
-		n := time.Unix(time.Now().Unix(), 0)
+		n := time.Unix(weatherTime.DateTime.Unix(), 0)
 		x := 0
 		var a12f []AccuHourlyForecastResponse
 		var i int
@@ -2825,17 +2739,14 @@ func (accuLocation PostalCodeResponse) GetWeatherForecastV2(category string, dev
 
 		ats.Accu7d = &a7f
 		ats.DailyForecast = &accu10dForecast.DailyForecasts[0]
-		ats.DailyForecast.NWSevereComponentMap = getNWSInfo(accuLocation.PrimaryPostalCode)
+		ats.DailyForecast.NWSevereComponentMap = getNWSInfo(accuLocation.Key, accuLocation.PrimaryPostalCode, clk.Now())
 		ats.Accu24h = &a12f
 
 		// Time formatting
 		ats.DateStr = weatherTime.LocalDate
 		ats.TimeStr = weatherTime.LocalTime
 		utime := time.Unix(int64(accu24hForecast[i-12].EpochDateTime), 0)
-		ats.GmtOffset = accuLocation.TimeZone.GmtOffset
-		if extendedInfo.TimeZoneOverride.Enabled {
-			ats.GmtOffset = float64(extendedInfo.TimeZoneOverride.Sign*extendedInfo.TimeZoneOverride.HourOffset) + (float64(extendedInfo.TimeZoneOverride.MinuteOffset) / 60.0)
-		}
+		ats.GmtOffset = servedGmtOffset(accuLocation.TimeZone.GmtOffset, weatherTime, extendedInfo)
 		//ats.ForecastTime = utime.Format("06:01:02 15:04")
 		ats.ForecastTime = utime.Add(time.Minute * time.Duration(ats.GmtOffset*60)).Format("06:01:02 15:04")
 
@@ -2843,50 +2754,15 @@ func (accuLocation PostalCodeResponse) GetWeatherForecastV2(category string, dev
 		templateFile = "templateCat3V2"
 	}
 
-	// Loading the template file, which depends on the category
-	/*
-		body, err := ioutil.ReadFile(path.Join("/templates", templateFile))
-		if err != nil {
-			log.Printf(err.Error())
-			return err.Error()
-		}
-	*/
-	body, err := common.RedisInstance.GetCachedFile("/templates", templateFile, time.Hour)
-
-	tmpl, err := template.New("body").Funcs(template.FuncMap{
-		"getWifiIcon": func(accuIcon int) int {
-			return IconMap[accuIcon]
-		},
-		"getFormatedDateFromEpoch": func(dateStr string) string {
-			layout := "2006-01-02T15:04:05-07:00"
-			t, err := time.Parse(layout, dateStr)
-
-			if err != nil {
-				log.Printf("GetWeatherForecastV2 - Error parsing the time : %s %s", dateStr, err.Error())
-			}
-
-			return t.Format("15:04")
-		},
-		"getMoonPhrase": func(accuPhrase string) int {
-			return MoonPhraseMap[accuPhrase]
-		},
-		"convertValueToEnum": func(value string) int {
-			return ValueToEnumMap[value]
-		},
-	}).Parse(string(body))
-	var forecast bytes.Buffer
-	if tmpl == nil {
-		log.Printf("Template is null -- Error")
-		return "Problem loading template"
-	}
-	err = tmpl.Execute(&forecast, apiResult)
+	// Render the template, which depends on the category
+	rendered, err := Templates.Execute(templateFile, apiResult)
 	if err != nil {
 		log.Printf(err.Error())
 		return err.Error()
 	}
 
 	// This hack is just because go has issues with interpreting "<" and ">" it's trying to render it as html block. TODO Fix it to properly set the template
-	fc := strings.Replace(forecast.String(), "##", "<", -1)
+	fc := strings.Replace(rendered, "##", "<", -1)
 	fc = strings.Replace(fc, "!!", ">", -1)
 
 	// Saving or updating keys which will be updated by the cache updater
@@ -2894,6 +2770,7 @@ func (accuLocation PostalCodeResponse) GetWeatherForecastV2(category string, dev
 	toUpdateVal := accuLocation.TimeZone.Name + ":" + category
 
 	common.RedisInstance.SaveRedisData([]byte(toUpdateVal), toUpdateKey, 720*time.Hour)
+	trackLocationDevice(accuLocation.Key, deviceID, clk.Now())
 	return fc
 }
 
@@ -2907,7 +2784,7 @@ func (accuLocation PostalCodeResponse) GetWeatherForecastV2(category string, dev
 /**
  * @brief
  */
-func (accuLocation PostalCodeResponse) GetWeatherForecast(category string, deviceID string, forecastType string, firmwareVersion string) string {
+func (accuLocation PostalCodeResponse) GetWeatherForecast(clk clock.Clock, category string, deviceID string, forecastType string, firmwareVersion string) string {
 
 	// Get Extended Info
 	extendedInfo, err := device.GetExtendedDeviceInfo(deviceID)
@@ -2929,13 +2806,13 @@ func (accuLocation PostalCodeResponse) GetWeatherForecast(category string, devic
 	//log.Printf("getWeatherForecast location key : %s, Timezone:%s, Device Category: %s, Device ID: %s", accuLocation.Key, accuLocation.TimeZone.Name, category, deviceID)
 
 	//log.Printf("getWeatherForecastV2 location key : %s, Timezone:%s, Device Category: %s, Device ID: %s", accuLocation.Key, accuLocation.TimeZone.Name, category, deviceID)
-	weatherTime, err := GetLocalDateAndHourV2(accuLocation.TimeZone.Name, &extendedInfo)
+	weatherTime, err := GetLocalDateAndHourV2(clk, accuLocation.TimeZone.Name, &extendedInfo)
 	if err != nil {
 		return "Could not get time from the timeZone"
 	}
 
 	// Time Range to Disable Flow
-	if weatherTime.DateTime.Month() < 9 || weatherTime.DateTime.Month() == 9 && weatherTime.DateTime.Day() < 20 {
+	if beforeFlowCutoff(weatherTime.DateTime) {
 		flow = DefaultModeFlowCommand
 	} else {
 		if extendedInfo.HasDateTimeBug {
@@ -2956,17 +2833,14 @@ func (accuLocation PostalCodeResponse) GetWeatherForecast(category string, devic
 	if forecastType == ForecastTypeStreams {
 		ats := AccuTemplateCat1Struct{}
 		ats.FlowControl = flow
-		accu1dForecast := QueryAccuDayForecastAPI(accuLocation.Key, accuLocation.TimeZone.Name, "10day", weatherTime)
+		accu1dForecast := QueryAccuDayForecastAPI(clk, accuLocation.Key, accuLocation.TimeZone.Name, "10day", weatherTime)
 		ats.Headline = &accu1dForecast.Headline
 		ats.DailyForecast = &accu1dForecast.DailyForecasts[0]
 
 		// Time formatting
 		ats.DateStr = weatherTime.LocalDate
 		ats.TimeStr = weatherTime.LocalTime
-		ats.GmtOffset = accuLocation.TimeZone.GmtOffset
-		if extendedInfo.TimeZoneOverride.Enabled {
-			ats.GmtOffset = float64(extendedInfo.TimeZoneOverride.Sign*extendedInfo.TimeZoneOverride.HourOffset) + (float64(extendedInfo.TimeZoneOverride.MinuteOffset) / 60.0)
-		}
+		ats.GmtOffset = servedGmtOffset(accuLocation.TimeZone.GmtOffset, weatherTime, extendedInfo)
 		apiResult = ats
 		templateFile = "templateDatastreams"
 	} else {
@@ -2975,7 +2849,7 @@ func (accuLocation PostalCodeResponse) GetWeatherForecast(category string, devic
 		case device.CAT1:
 			ats := AccuTemplateCat1Struct{}
 			ats.FlowControl = flow
-			accu1dForecast := QueryAccuDayForecastAPI(accuLocation.Key, accuLocation.TimeZone.Name, "10day", weatherTime)
+			accu1dForecast := QueryAccuDayForecastAPI(clk, accuLocation.Key, accuLocation.TimeZone.Name, "10day", weatherTime)
 			ats.Headline = &accu1dForecast.Headline
 			ats.DailyForecast = &accu1dForecast.DailyForecasts[0]
 			ats.DailyForecast.Actual.Wind.Speed.ValueRound = Round(ats.DailyForecast.Actual.Wind.Speed.Value / 3.6)
@@ -2988,16 +2862,13 @@ func (accuLocation PostalCodeResponse) GetWeatherForecast(category string, devic
 			// Time formatting
 			ats.DateStr = weatherTime.LocalDate
 			ats.TimeStr = weatherTime.LocalTime
-			ats.GmtOffset = accuLocation.TimeZone.GmtOffset
-			if extendedInfo.TimeZoneOverride.Enabled {
-				ats.GmtOffset = float64(extendedInfo.TimeZoneOverride.Sign*extendedInfo.TimeZoneOverride.HourOffset) + (float64(extendedInfo.TimeZoneOverride.MinuteOffset) / 60.0)
-			}
+			ats.GmtOffset = servedGmtOffset(accuLocation.TimeZone.GmtOffset, weatherTime, extendedInfo)
 			apiResult = ats
 			templateFile = "templateCat1"
 		case device.CAT2:
 			ats := AccuTemplateCat2Struct{}
 			ats.FlowControl = flow
-			accu1dForecast := QueryAccuDayForecastAPI(accuLocation.Key, accuLocation.TimeZone.Name, "10day", weatherTime)
+			accu1dForecast := QueryAccuDayForecastAPI(clk, accuLocation.Key, accuLocation.TimeZone.Name, "10day", weatherTime)
 			accuCurrentForecast := queryAccuCurrentForecastAPI(accuLocation.Key, weatherTime)
 
 			ats.Headline = &accu1dForecast.Headline
@@ -3007,16 +2878,13 @@ func (accuLocation PostalCodeResponse) GetWeatherForecast(category string, devic
 			// Time formatting
 			ats.DateStr = weatherTime.LocalDate
 			ats.TimeStr = weatherTime.LocalTime
-			ats.GmtOffset = accuLocation.TimeZone.GmtOffset
-			if extendedInfo.TimeZoneOverride.Enabled {
-				ats.GmtOffset = float64(extendedInfo.TimeZoneOverride.Sign*extendedInfo.TimeZoneOverride.HourOffset) + (float64(extendedInfo.TimeZoneOverride.MinuteOffset) / 60.0)
-			}
+			ats.GmtOffset = servedGmtOffset(accuLocation.TimeZone.GmtOffset, weatherTime, extendedInfo)
 			apiResult = ats
 			templateFile = "templateCat2"
 		case device.CAT3:
 			ats := AccuTemplateCat3Struct{}
 			ats.FlowControl = flow
-			accu10dForecast := QueryAccuDayForecastAPI(accuLocation.Key, accuLocation.TimeZone.Name, "10day", weatherTime)
+			accu10dForecast := QueryAccuDayForecastAPI(clk, accuLocation.Key, accuLocation.TimeZone.Name, "10day", weatherTime)
 			accu24hForecast := QueryAccuHourForecastAPI(accuLocation.Key, "24hour", weatherTime)
 
 			var a7f []AccuDailyForecast
@@ -3024,7 +2892,7 @@ func (accuLocation PostalCodeResponse) GetWeatherForecast(category string, devic
 				a7f = append(a7f, accu10dForecast.DailyForecasts[i])
 			}
 
-			n := time.Unix(time.Now().Unix(), 0)
+			n := time.Unix(weatherTime.DateTime.Unix(), 0)
 			x := 0
 			var a12f []AccuHourlyForecastResponse
 			var i int
@@ -3045,10 +2913,7 @@ func (accuLocation PostalCodeResponse) GetWeatherForecast(category string, devic
 			ats.DateStr = weatherTime.LocalDate
 			ats.TimeStr = weatherTime.LocalTime
 			utime := time.Unix(int64(accu24hForecast[i-12].EpochDateTime), 0)
-			ats.GmtOffset = accuLocation.TimeZone.GmtOffset
-			if extendedInfo.TimeZoneOverride.Enabled {
-				ats.GmtOffset = float64(extendedInfo.TimeZoneOverride.Sign*extendedInfo.TimeZoneOverride.HourOffset) + (float64(extendedInfo.TimeZoneOverride.MinuteOffset) / 60.0)
-			}
+			ats.GmtOffset = servedGmtOffset(accuLocation.TimeZone.GmtOffset, weatherTime, extendedInfo)
 			//ats.ForecastTime = utime.Format("06:01:02 15:04")
 			ats.ForecastTime = utime.Add(time.Minute * time.Duration(ats.GmtOffset*60)).Format("06:01:02 15:04")
 
@@ -3057,50 +2922,15 @@ func (accuLocation PostalCodeResponse) GetWeatherForecast(category string, devic
 		}
 	}
 
-	// Loading the template file, which depends on the category
-	/*
-		body, err := ioutil.ReadFile(path.Join("/templates", templateFile))
-		if err != nil {
-			log.Printf(err.Error())
-			return err.Error()
-		}
-	*/
-	body, err := common.RedisInstance.GetCachedFile("/templates", templateFile, time.Hour)
-
-	tmpl, err := template.New("body").Funcs(template.FuncMap{
-		"getWifiIcon": func(accuIcon int) int {
-			return IconMap[accuIcon]
-		},
-		"getFormatedDateFromEpoch": func(dateStr string) string {
-			layout := "2006-01-02T15:04:05-07:00"
-			t, err := time.Parse(layout, dateStr)
-
-			if err != nil {
-				log.Printf("GetWeatherForecast - Error parsing the time : %s %s", dateStr, err.Error())
-			}
-
-			return t.Format("15:04")
-		},
-		"getMoonPhrase": func(accuPhrase string) int {
-			return MoonPhraseMap[accuPhrase]
-		},
-		"convertValueToEnum": func(value string) int {
-			return ValueToEnumMap[value]
-		},
-	}).Parse(string(body))
-	var forecast bytes.Buffer
-	if tmpl == nil {
-		log.Printf("Template is null -- Error")
-		return "Problem loading template"
-	}
-	err = tmpl.Execute(&forecast, apiResult)
+	// Render the template, which depends on the category
+	rendered, err := Templates.Execute(templateFile, apiResult)
 	if err != nil {
 		log.Printf(err.Error())
 		return err.Error()
 	}
 
 	// This hack is just because go has issues with interpreting "<" and ">" it's trying to render it as html block. TODO Fix it to properly set the template
-	fc := strings.Replace(forecast.String(), "##", "<", -1)
+	fc := strings.Replace(rendered, "##", "<", -1)
 	fc = strings.Replace(fc, "!!", ">", -1)
 
 	// Saving or updating keys which will be updated by the cache updater
@@ -3108,6 +2938,7 @@ func (accuLocation PostalCodeResponse) GetWeatherForecast(category string, devic
 	toUpdateVal := accuLocation.TimeZone.Name + ":" + category
 
 	common.RedisInstance.SaveRedisData([]byte(toUpdateVal), toUpdateKey, 720*time.Hour)
+	trackLocationDevice(accuLocation.Key, deviceID, clk.Now())
 	return fc
 }
 
@@ -3147,6 +2978,7 @@ func GetLocationFromPC(accuPostalCode string) (PostalCodeResponse, error) {
 			common.RedisInstance.RemoveKeyFromCache(pckey)
 		}
 
+		applyTimeZone(&postalCodeResponse.TimeZone)
 		return postalCodeResponse, nil
 
 	} else {
@@ -3179,7 +3011,8 @@ func GetLocationFromPC(accuPostalCode string) (PostalCodeResponse, error) {
 			return PostalCodeResponse{}, err
 		}
 
-		common.RedisInstance.SaveRedisData(body, pckey, 0)
+		common.RedisInstance.SaveRedisData(body, pckey, LocationRecordTTL)
+		applyTimeZone(&pc.TimeZone)
 		return pc, nil
 	}
 }
@@ -3226,6 +3059,7 @@ func GetLocation(postalCode string, countryCode string) (PostalCodeResponse, err
 			return PostalCodeResponse{}, err
 		}
 
+		applyTimeZone(&postalCodeResponse.TimeZone)
 		return postalCodeResponse, nil
 
 	} else {
@@ -3259,17 +3093,25 @@ func GetLocation(postalCode string, countryCode string) (PostalCodeResponse, err
 			return PostalCodeResponse{}, err
 		}
 
+		// A postal code can match several locations of a country
+		candidates := map[string]int{}
+		for _, pcr := range pc {
+			candidates[strings.ToUpper(pcr.Country.ID)]++
+		}
+
 		// codeIndex variable is to save the index in the response array where we will get the correct location details
 		codeIndex := -1
-		for index, pcr := range pc {
+		for index := range pc {
 
 			// Get the country code and write the data to cache
 			c := strings.ToUpper(pc[index].Country.ID)
 			countryzip := "zip:" + postalCode + "_" + c
+			pc[index].PostalCodeCandidates = candidates[c]
+			pcr := pc[index]
 
 			// Save data to redis and return
 			dataBytes, _ := json.Marshal(pcr)
-			common.RedisInstance.SaveRedisData(dataBytes, countryzip, 0)
+			common.RedisInstance.SaveRedisData(dataBytes, countryzip, LocationRecordTTL)
 
 			if (countryCode == "" && c == DefaultCountryCode) || (countryCode == c) {
 				codeIndex = index
@@ -3281,9 +3123,10 @@ func GetLocation(postalCode string, countryCode string) (PostalCodeResponse, err
 			//return PostalCodeResponse{}, err
 			// We couldn't get the location for the postal code defined for the device, since there is some values in the array, we will use the first item as location for that zip
 			log.Printf("Location not found for postal code : " + postalCode + " and country code : " + countryCode + " . Using the default location returned")
-			return pc[0], nil
+			codeIndex = 0
 		}
 
+		applyTimeZone(&pc[codeIndex].TimeZone)
 		return pc[codeIndex], nil
 	}
 }
@@ -3506,7 +3349,7 @@ func NullableQueryAccuHourForecastAPI(locationKey string, period string, weather
 /**
  * @brief
  */
-func QueryAccuDayForecastAPI(locationKey string, timeZone string, period string, weatherTime WeatherTime) DailyForecast {
+func QueryAccuDayForecastAPI(clk clock.Clock, locationKey string, timeZone string, period string, weatherTime WeatherTime) DailyForecast {
 
 	key := "forecast:" + locationKey + ":" + period + ":" + weatherTime.HourRange + "_" + weatherTime.LocalDate
 
@@ -3514,6 +3357,7 @@ func QueryAccuDayForecastAPI(locationKey string, timeZone string, period string,
 	data, err := common.RedisInstance.GetCachedData(key)
 	path := "/forecasts/v1/daily/" + period + "/" + locationKey
 
+	fetched := err != nil
 	if err != nil {
 		log.Printf("KeyNotFound : %s", key)
 		data, _ = httpAccuGetAndCache(path, key, ForecastExpireHours*time.Hour)
@@ -3532,6 +3376,7 @@ func QueryAccuDayForecastAPI(locationKey string, timeZone string, period string,
 
 		data, _ = httpAccuGetAndCache(path, key, ForecastExpireHours*time.Hour)
 		json.Unmarshal(data, &accuForecast)
+		fetched = true
 	}
 
 	if retryCount == MaxRetries {
@@ -3539,6 +3384,16 @@ func QueryAccuDayForecastAPI(locationKey string, timeZone string, period string,
 		return accuForecast
 	}
 
+	// Compared with the previous fetch of the location
+	if fetched {
+		observeHeadline(clk.Now(), locationKey, headlineState{
+			Severity:           accuForecast.Headline.Severity,
+			Text:               accuForecast.Headline.Text,
+			Category:           accuForecast.Headline.Category,
+			EffectiveEpochDate: accuForecast.Headline.EffectiveEpochDate,
+		})
+	}
+
 	if weatherTime.DayInfo == DayInfoDay {
 		accuForecast.DailyForecasts[0].Actual = &accuForecast.DailyForecasts[0].Day
 	} else {
@@ -3566,8 +3421,8 @@ func QueryAccuDayForecastAPI(locationKey string, timeZone string, period string,
 /**
  * @brief
  */
-func JsonQueryAccuDayForecastAPI(locationKey string, timeZone string, period string, weatherTime WeatherTime) (NullableDailyForecast, error) {
-	return getNullableDailyForecast(locationKey, timeZone, period, weatherTime)
+func JsonQueryAccuDayForecastAPI(clk clock.Clock, locationKey string, timeZone string, period string, weatherTime WeatherTime) (NullableDailyForecast, error) {
+	return getNullableDailyForecast(clk, locationKey, timeZone, period, weatherTime)
 }
 
 //----------------------------------------------
@@ -3576,27 +3431,18 @@ func JsonQueryAccuDayForecastAPI(locationKey string, timeZone string, period str
 /**
  * @brief
  */
-func GetLocalDateAndHourV2(timeZone string, extendedInfo *device.ExtendedDeviceInfo) (WeatherTime, error) {
+func GetLocalDateAndHourV2(clk clock.Clock, timeZone string, extendedInfo *device.ExtendedDeviceInfo) (WeatherTime, error) {
 	weatherTime := WeatherTime{}
 
-	// Load the specific location
-	var loc *time.Location
-	var err error
-	LocationMapMutex.Lock()
-	loc, keyFound := LocationMap[timeZone]
-	LocationMapMutex.Unlock()
-
-	if !keyFound {
-		loc, err = time.LoadLocation(timeZone)
-		if err != nil {
-			log.Printf("Error Loading the location for timezone %s : %s", timeZone, err.Error())
-			return weatherTime, err
-		}
-		LocationMap[timeZone] = loc
+	// Load the specific location, or the fixed zone of a time zone override
+	loc, err := TimeZones.ResolveDevice(timeZone, extendedInfo)
+	if err != nil {
+		log.Printf("Error Loading the location for timezone %s : %s", timeZone, err.Error())
+		return weatherTime, err
 	}
 
-	//set Location
-	baseTime := time.Now()
+	// Service clock, device time settings below are applied on top of it
+	baseTime := clk.Now()
 
 	// 1. Apply Time Acceleration Option
 	if extendedInfo.TimeCompression.Enabled {
@@ -3633,9 +3479,10 @@ func GetLocalDateAndHourV2(timeZone string, extendedInfo *device.ExtendedDeviceI
 			nowLocal = rangeStart.Add(delta)
 
 		case device.TimeLoopDstIn:
-			// NYI
+			nowLocal, _ = dstLoopTime(nowLocal, loc, true, time.Duration(extendedInfo.TimeLoop.LoopWindow)*time.Second)
+
 		case device.TimeLoopDstOut:
-			// NYI
+			nowLocal, _ = dstLoopTime(nowLocal, loc, false, time.Duration(extendedInfo.TimeLoop.LoopWindow)*time.Second)
 
 		case device.TimeLoopCustom:
 			rangeStart := time.Unix(extendedInfo.TimeLoop.LoopStart, 0)
@@ -3645,12 +3492,20 @@ func GetLocalDateAndHourV2(timeZone string, extendedInfo *device.ExtendedDeviceI
 			delta := elapsed % interval
 			nowLocal = rangeStart.Add(delta)
 
-		case device.TimeLoopBackendDriver:
-			// @todo make call to elixir backend to determine reported time.
+		default:
+			// Pluggable sources, e.g. the backend driver timeline
+			if source := DeviceClockSource(extendedInfo); source != nil {
+				if t, ok := source.Now(extendedInfo, nowLocal); ok {
+					nowLocal = t.In(loc)
+				}
+			}
 		}
 	}
 
 	weatherTime.DateTime = nowLocal
+	_, offset := nowLocal.Zone()
+	weatherTime.GmtOffset = float64(offset) / 3600.0
+	weatherTime.Simulated = extendedInfo.TimeCompression.Enabled || extendedInfo.TimeLoop.Enabled
 
 	// Getting the hour in that timezone
 	localHour, _ := strconv.Atoi(nowLocal.Format("15"))
@@ -3676,6 +3531,17 @@ func GetLocalDateAndHourV2(timeZone string, extendedInfo *device.ExtendedDeviceI
 	return weatherTime, nil
 }
 
+//----------------------------------------------
+// @beforeFlowCutoff
+//----------------------------------------------
+/**
+ * @brief True before September 20 of the device year, flow control is held at
+ * DefaultModeFlowCommand until then (temp cut off).
+ */
+func beforeFlowCutoff(deviceTime time.Time) bool {
+	return deviceTime.Month() < time.September || deviceTime.Month() == time.September && deviceTime.Day() < 20
+}
+
 //----------------------------------------------
 // Round function, will use this as we are using go 1.7 and round is included in go 1.10
 // After we upgrade to newer version of Go this needs to be removed
@@ -3754,12 +3620,13 @@ func httpAccuGetLocation(path string, queryString string) []PostalCodeResponse {
 /**
  * @brief
  */
-func getNullableDailyForecast(locationKey string, timeZone string, period string, weatherTime WeatherTime) (NullableDailyForecast, error) {
+func getNullableDailyForecast(clk clock.Clock, locationKey string, timeZone string, period string, weatherTime WeatherTime) (NullableDailyForecast, error) {
 	key := "forecast:" + locationKey + ":" + period + ":" + weatherTime.HourRange + "_" + weatherTime.LocalDate
 	path := "/forecasts/v1/daily/" + period + "/" + locationKey
 
 	var response NullableDailyForecast
 	data, err := common.RedisInstance.GetCachedData(key)
+	fetched := err != nil
 	if err != nil {
 		data, _ = httpAccuGetAndCache(path, key, ForecastExpireHours*time.Hour)
 		nowStr := time.Now().Format("02:01:2006 15:04:05")
@@ -3781,6 +3648,7 @@ func getNullableDailyForecast(locationKey string, timeZone string, period string
 		if err != nil {
 			log.Printf("Json Error raised %v", err)
 		}
+		fetched = true
 	}
 
 	if len(response.DailyForecasts) == 0 {
@@ -3790,6 +3658,16 @@ func getNullableDailyForecast(locationKey string, timeZone string, period string
 		return response, err
 	}
 
+	// Compared with the previous fetch of the location
+	if fetched {
+		observeHeadline(clk.Now(), locationKey, headlineState{
+			Severity:           int(response.Headline.Severity.Int64),
+			Text:               response.Headline.Text.String,
+			Category:           response.Headline.Category.String,
+			EffectiveEpochDate: int(response.Headline.EffectiveEpochDate.Int64),
+		})
+	}
+
 	if weatherTime.DayInfo == DayInfoDay {
 		response.Today = &response.DailyForecasts[0].Day
 	} else {
@@ -3817,17 +3695,26 @@ func getNullableDailyForecast(locationKey string, timeZone string, period string
 //
 //----------------------------------------------
 /**
- * @brief
+ * @brief Severe components of the NWS hour starting at now, service time,
+ * nil when NWS failed. Cached for the hour they cover, events are detected
+ * once per location and hour.
  */
-func getNWSInfo(zip string) map[string]string {
+func getNWSInfo(locationKey string, zip string, now time.Time) map[string]string {
 	var severeComponentMap map[string]string
 	if strings.TrimSpace(zip) != "" {
-		key := "nwsforecast:" + zip
+		key := "nwsforecast:" + zip + "_" + now.Format("2006010215")
 		data, err := common.RedisInstance.GetCachedData(key)
 		if err != nil {
-			severeComponentMap = nws.GetSevereComponentMap(zip)
+			severeComponentMap, err = nws.GetSevereComponentMap(zip, now)
+			if err != nil {
+				// Not asked again before NWSFailureTTL, nor observed
+				log.Printf("GetSevereComponentMap Error: %+v", err)
+				common.RedisInstance.SaveRedisData([]byte("null"), key, NWSFailureTTL)
+				return nil
+			}
 			dataBytes, _ := json.Marshal(severeComponentMap)
-			common.RedisInstance.SaveRedisData(dataBytes, key, 24*time.Hour)
+			common.RedisInstance.SaveRedisData(dataBytes, key, time.Hour)
+			observeSevere(now, locationKey, severeComponentMap)
 		} else {
 			err = json.Unmarshal(data, &severeComponentMap)
 			if err != nil {
@@ -3842,25 +3729,13 @@ func getNWSInfo(zip string) map[string]string {
 //
 //----------------------------------------------
 /**
- * @brief
+ * @brief getNWSInfo of a US location.
  */
-func getNWSInfoV2(accuLocation PostalCodeResponse) map[string]string {
-	var severeComponentMap map[string]string
-	if strings.TrimSpace(accuLocation.PrimaryPostalCode) != "" && accuLocation.Country.ID == "US" {
-		key := "nwsforecast:" + accuLocation.PrimaryPostalCode
-		data, err := common.RedisInstance.GetCachedData(key)
-		if err != nil {
-			severeComponentMap = nws.GetSevereComponentMap(accuLocation.PrimaryPostalCode)
-			dataBytes, _ := json.Marshal(severeComponentMap)
-			common.RedisInstance.SaveRedisData(dataBytes, key, 24*time.Hour)
-		} else {
-			err = json.Unmarshal(data, &severeComponentMap)
-			if err != nil {
-				log.Printf("NWS Unmarshall Error: %v", err)
-			}
-		}
+func getNWSInfoV2(accuLocation PostalCodeResponse, now time.Time) map[string]string {
+	if accuLocation.Country.ID != "US" {
+		return nil
 	}
-	return severeComponentMap
+	return getNWSInfo(accuLocation.Key, accuLocation.PrimaryPostalCode, now)
 }
 
 //----------------------------------------------
@@ -3974,28 +3849,19 @@ func NullablequeryAccuCurrentForecastAPI(locationKey string, weatherTime Weather
 /**
  * @brief
  */
-func GetLocalDateAndHour(timeZone string) (WeatherTime, error) {
+func GetLocalDateAndHour(clk clock.Clock, timeZone string) (WeatherTime, error) {
 
 	weatherTime := WeatherTime{}
 
 	// Load the specific location
-	var loc *time.Location
-	var err error
-	LocationMapMutex.Lock()
-	loc, keyFound := LocationMap[timeZone]
-	LocationMapMutex.Unlock()
-
-	if !keyFound {
-		loc, err = time.LoadLocation(timeZone)
-		if err != nil {
-			log.Printf("Error Loading the location for timezone %s : %s", timeZone, err.Error())
-			return weatherTime, err
-		}
-		LocationMap[timeZone] = loc
+	loc, err := TimeZones.Resolve(timeZone)
+	if err != nil {
+		log.Printf("Error Loading the location for timezone %s : %s", timeZone, err.Error())
+		return weatherTime, err
 	}
 
 	//set Location
-	nowLocal := time.Now().In(loc)
+	nowLocal := clk.Now().In(loc)
 
 	// Getting the hour in that timezone
 	localHour, _ := strconv.Atoi(nowLocal.Format("15"))
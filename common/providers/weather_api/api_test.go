@@ -0,0 +1,150 @@
+package weather_api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sibivishnu/Weather/common/clock"
+	"github.com/sibivishnu/Weather/common/const/device"
+	"gopkg.in/guregu/null.v3"
+)
+
+func TestResponseFormatSingleDayAndHour(t *testing.T) {
+	for _, version := range []string{"1.2", "1.3", "1.4", "1.5"} {
+		daily := []NullableAccuDailyForecast{{}}
+		hourly := []NullableAccuHourlyForecast{{}}
+		forecast := NullableUniversalForecast{Daily: &daily, Hourly: &hourly}
+
+		if _, err := forecast.JsonResponse(version); err != nil {
+			t.Errorf("version %s: %v", version, err)
+		}
+		if daily[0].Moon.Rise.Valid || daily[0].Sun.Set.Valid || hourly[0].Temperature.Value.Valid {
+			t.Errorf("version %s: fields of a single entry filled from nowhere", version)
+		}
+	}
+}
+
+func TestFillDailySunMoon(t *testing.T) {
+	daily := []NullableAccuDailyForecast{{}, {}, {}}
+	daily[0].Sun.Rise = null.StringFrom("d0")
+	daily[1].Moon.Set = null.StringFrom("d1")
+	daily[2].Moon.Set = null.StringFrom("d2")
+
+	for i := range daily {
+		fillDailySunMoon(daily, i)
+	}
+	if daily[0].Moon.Set.String != "d1" {
+		t.Errorf("first day filled with %q, want the next day", daily[0].Moon.Set.String)
+	}
+	if daily[1].Sun.Rise.String != "d0" || daily[2].Sun.Rise.String != "d0" {
+		t.Errorf("later days not filled from the previous day")
+	}
+	if daily[2].Moon.Set.String != "d2" {
+		t.Errorf("a valid field was overwritten")
+	}
+}
+
+func TestParseForecastSectionsSingleDayAndHour(t *testing.T) {
+	preset := DefaultForecastSections("1.5")
+	sections, err := ParseForecastSections("3", "", "1", "1", preset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sections.Days != 1 || sections.Hours != 1 {
+		t.Errorf("got %d days %d hours", sections.Days, sections.Hours)
+	}
+	if _, err := ParseForecastSections("3", "", "0", "", preset); err == nil {
+		t.Errorf("days=0 accepted")
+	}
+}
+
+func TestFutureHourlyForecastsFollowDeviceTime(t *testing.T) {
+	// Hours cached for a looped device, a year behind the service clock
+	start := time.Date(2019, 9, 15, 20, 0, 0, 0, time.UTC)
+	var hourly []NullableAccuHourlyForecast
+	for i := 0; i < 24; i++ {
+		var h NullableAccuHourlyForecast
+		h.EpochDateTime = null.IntFrom(start.Add(time.Duration(i) * time.Hour).Unix())
+		hourly = append(hourly, h)
+	}
+
+	deviceTime := start.Add(3*time.Hour + 20*time.Minute)
+	future := futureHourlyForecasts(hourly, deviceTime, 12)
+	if len(future) != 12 || future[0].EpochDateTime.Int64 != start.Add(4*time.Hour).Unix() {
+		t.Errorf("got %d hours from %v", len(future), future[0].EpochDateTime.Int64)
+	}
+	if future := futureHourlyForecasts(hourly, deviceTime.AddDate(1, 0, 0), 12); len(future) != 0 {
+		t.Errorf("%d hours served past the device time", len(future))
+	}
+}
+
+func TestFlowCutoffFollowsDeviceTime(t *testing.T) {
+	for _, c := range []struct {
+		at   time.Time
+		want bool
+	}{
+		{time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), true},
+		{time.Date(2020, 9, 19, 23, 59, 59, 0, time.UTC), true},
+		{time.Date(2020, 9, 20, 0, 0, 0, 0, time.UTC), false},
+		{time.Date(2020, 12, 31, 23, 59, 59, 0, time.UTC), false},
+	} {
+		if got := beforeFlowCutoff(c.at); got != c.want {
+			t.Errorf("%v: got %v", c.at, got)
+		}
+	}
+
+	// Already September 20 in UTC, still the 19th in New York
+	fake := clock.NewFakeClock(time.Date(2020, 9, 20, 3, 30, 0, 0, time.UTC))
+	weatherTime, err := GetLocalDateAndHourV2(fake, "America/New_York", &device.ExtendedDeviceInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !beforeFlowCutoff(weatherTime.DateTime) {
+		t.Errorf("cut off at %v, device time of the 19th", weatherTime.DateTime)
+	}
+	fake.Advance(time.Hour)
+	if weatherTime, _ = GetLocalDateAndHourV2(fake, "America/New_York", &device.ExtendedDeviceInfo{}); beforeFlowCutoff(weatherTime.DateTime) {
+		t.Errorf("not cut off at %v", weatherTime.DateTime)
+	}
+
+	// A device looping a March transition is held, whatever the service date
+	fake.Set(time.Date(2021, 9, 25, 12, 0, 0, 0, time.UTC))
+	extendedInfo := &device.ExtendedDeviceInfo{TimeLoop: device.TimeLoopSettings{
+		Enabled: true, Mode: device.TimeLoopDstIn, LoopWindow: 600,
+	}}
+	weatherTime, err = GetLocalDateAndHourV2(fake, "America/New_York", extendedInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if weatherTime.DateTime.Month() != time.March || !beforeFlowCutoff(weatherTime.DateTime) {
+		t.Errorf("looped device at %v not held", weatherTime.DateTime)
+	}
+}
+
+func TestTimelineStartsOnServiceClock(t *testing.T) {
+	useTestRedis(t)
+	start := time.Date(2020, 5, 4, 18, 0, 0, 0, time.UTC)
+	fake := clock.NewFakeClock(start)
+	scripted := time.Date(2019, 11, 3, 5, 30, 0, 0, time.UTC)
+
+	// Start left to the service clock, the script begins right away
+	timeline, err := device.SetClockTimeline(fake, "D1", device.ClockTimeline{Steps: []device.ClockStep{{At: scripted.Unix(), Duration: 3600}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeline.Start != fake.Now().Unix() {
+		t.Errorf("timeline starts at %d, service clock at %d", timeline.Start, fake.Now().Unix())
+	}
+
+	extendedInfo := &device.ExtendedDeviceInfo{ID: "D1", TimeLoop: device.TimeLoopSettings{Enabled: true, Mode: device.TimeLoopBackendDriver}}
+	for _, elapsed := range []time.Duration{0, 10 * time.Minute, 59 * time.Minute} {
+		fake.Set(start.Add(elapsed))
+		weatherTime, err := GetLocalDateAndHourV2(fake, "America/New_York", extendedInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := scripted.Add(elapsed); !weatherTime.DateTime.Equal(want) || !weatherTime.Simulated {
+			t.Errorf("after %v device at %v, want %v", elapsed, weatherTime.DateTime, want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package weather_api
+
+//==============================================
+// CopyRight 2020 La Crosse Technology, LTD.
+//==============================================
+
+//==============================================
+// Imports
+//==============================================
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/sibivishnu/Weather/common/const/device"
+)
+
+//==============================================
+// Globals
+//==============================================
+var (
+	/**
+	 * @brief Clock sources by time loop mode, see RegisterClockSource.
+	 */
+	clockSources     = map[int]ClockSource{device.TimeLoopBackendDriver: TimelineClockSource{}}
+	clockSourcesLock sync.RWMutex
+)
+
+//==============================================
+// Types
+//==============================================
+type (
+	//----------------------------------------------
+	// @ClockSource
+	//----------------------------------------------
+	/**
+	 * @brief Supplies the time served to a device.
+	 *
+	 * Returns false to leave the device on now.
+	 */
+	ClockSource interface {
+		Now(extendedInfo *device.ExtendedDeviceInfo, now time.Time) (time.Time, bool)
+	}
+
+	//----------------------------------------------
+	// @TimelineClockSource
+	//----------------------------------------------
+	/**
+	 * @brief Replays the device timeline set through the admin api.
+	 */
+	TimelineClockSource struct{}
+)
+
+//==============================================
+// Functions - Clock Sources
+//==============================================
+
+//----------------------------------------------
+// @RegisterClockSource
+//----------------------------------------------
+/**
+ * @brief Replaces the clock source of a time loop mode, nil removes it.
+ */
+func RegisterClockSource(mode int, source ClockSource) {
+	clockSourcesLock.Lock()
+	defer clockSourcesLock.Unlock()
+	if source == nil {
+		delete(clockSources, mode)
+		return
+	}
+	clockSources[mode] = source
+}
+
+//----------------------------------------------
+// @DeviceClockSource
+//----------------------------------------------
+/**
+ * @brief Clock source of a device, nil when its time loop mode has none.
+ */
+func DeviceClockSource(extendedInfo *device.ExtendedDeviceInfo) ClockSource {
+	if extendedInfo == nil || !extendedInfo.TimeLoop.Enabled {
+		return nil
+	}
+	clockSourcesLock.RLock()
+	defer clockSourcesLock.RUnlock()
+	return clockSources[extendedInfo.TimeLoop.Mode]
+}
+
+//----------------------------------------------
+// @Now
+//----------------------------------------------
+/**
+ * @brief
+ */
+func (TimelineClockSource) Now(extendedInfo *device.ExtendedDeviceInfo, now time.Time) (time.Time, bool) {
+	timeline, err := device.GetClockTimeline(extendedInfo.ID)
+	if err != nil {
+		log.Printf("[Clock] Unable to load timeline for %s| %v", extendedInfo.ID, err)
+		return now, false
+	}
+	if timeline == nil {
+		return now, false
+	}
+	return timeline.At(now)
+}
@@ -0,0 +1,519 @@
+package weather_api
+
+//==============================================
+// CopyRight 2020 La Crosse Technology, LTD.
+//==============================================
+
+//==============================================
+// Imports
+//==============================================
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+//==============================================
+// Globals - Constants
+//==============================================
+
+/**
+ * @brief Compact (binary) encodings of the json forecast responses.
+ */
+const (
+	CompactEncodingCbor    = "cbor"
+	CompactEncodingMsgpack = "msgpack"
+)
+
+//==============================================
+// Globals - Tables
+//==============================================
+var (
+	/**
+	 * @brief Short-key dictionaries, one per response format family.
+	 *
+	 * A map key is replaced by its index in the dictionary, keys that are not
+	 * listed (NWS messages, attribute names, ...) are sent as plain strings.
+	 * Firmware embeds these tables, so they are APPEND ONLY: never reorder or
+	 * remove an entry, new keys go at the end.
+	 */
+	compactDictionaryV1p1 = []string{
+		"Date",                     // 0
+		"Time",                     // 1
+		"Category",                 // 2
+		"GmtOffset",                // 3
+		"ForecastTime",             // 4
+		"Headline",                 // 5
+		"EffectiveDate",            // 6
+		"EffectiveEpochDate",       // 7
+		"Severity",                 // 8
+		"Text",                     // 9
+		"EndDate",                  // 10
+		"EndEpochDate",             // 11
+		"Today",                    // 12
+		"Icon",                     // 13
+		"IconPhrase",               // 14
+		"ShortPhrase",              // 15
+		"LongPhrase",               // 16
+		"PrecipitationProbability", // 17
+		"ThunderstormProbability",  // 18
+		"RainProbability",          // 19
+		"SnowProbability",          // 20
+		"IceProbability",           // 21
+		"HoursOfPrecipitation",     // 22
+		"HoursOfRain",              // 23
+		"HoursOfSnow",              // 24
+		"HoursOfIce",               // 25
+		"CloudCover",               // 26
+		"Wind",                     // 27
+		"Speed",                    // 28
+		"Direction",                // 29
+		"WindGust",                 // 30
+		"TotalLiquid",              // 31
+		"Rain",                     // 32
+		"Snow",                     // 33
+		"Ice",                      // 34
+		"Current",                  // 35
+		"LocalObservationDateTime", // 36
+		"EpochTime",                // 37
+		"WeatherText",              // 38
+		"WeatherIcon",              // 39
+		"IsDayTime",                // 40
+		"Temperature",              // 41
+		"TornadoProbability",       // 42
+		"HailProbability",          // 43
+		"Daily",                    // 44
+		"EpochDate",                // 45
+		"Sun",                      // 46
+		"Rise",                     // 47
+		"EpochRise",                // 48
+		"Set",                      // 49
+		"EpochSet",                 // 50
+		"Phase",                    // 51
+		"Age",                      // 52
+		"Moon",                     // 53
+		"Minimum",                  // 54
+		"Maximum",                  // 55
+		"RealFeelTemperature",      // 56
+		"RealFeelTemperatureShade", // 57
+		"HoursOfSun",               // 58
+		"DegreeDaySummary",         // 59
+		"Heating",                  // 60
+		"Cooling",                  // 61
+		"AirAndPollen",             // 62
+		"Name",                     // 63
+		"Value",                    // 64
+		"CategoryValue",            // 65
+		"Type",                     // 66
+		"AirAndPollenMap",          // 67
+		"AirAndPollenCategoryMap",  // 68
+		"Day",                      // 69
+		"Night",                    // 70
+		"Hourly",                   // 71
+		"DateTime",                 // 72
+		"EpochDateTime",            // 73
+		"IsDaylight",               // 74
+		"WetBulbTemperature",       // 75
+		"DewPoint",                 // 76
+		"RelativeHumidity",         // 77
+		"Visibility",               // 78
+		"Ceiling",                  // 79
+		"UVIndex",                  // 80
+		"UVIndexText",              // 81
+		"NWSForecast",              // 82
+		"FlowControl",              // 83
+		"ExtendedDeviceInfo",       // 84
+		"ID",                       // 85
+		"DataScript",               // 86
+		"TimeZoneOverride",         // 87
+		"Enabled",                  // 88
+		"Sign",                     // 89
+		"HourOffset",               // 90
+		"MinuteOffset",             // 91
+		"TimeLoop",                 // 92
+		"Mode",                     // 93
+		"LoopOffset",               // 94
+		"LoopStart",                // 95
+		"LoopEnd",                  // 96
+		"TimeCompression",          // 97
+		"AccelerationRate",         // 98
+		"StartTime",                // 99
+		"TimeOffset",               // 100
+		"ForecastScripting",        // 101
+		"HasDateTimeBug",           // 102
+		"Attributes",               // 103
+		"AirQuality",               // 104
+		"Grass",                    // 105
+		"Mold",                     // 106
+		"Ragweed",                  // 107
+		"Tree",                     // 108
+	}
+
+	compactDictionaryV1p2 = []string{
+		"Date",         // 0
+		"Time",         // 1
+		"GmtOffset",    // 2
+		"ForecastTime", // 3
+		"Category",     // 4
+		"FlowControl",  // 5
+		"Today",        // 6
+		"Current",      // 7
+		"Daily",        // 8
+		"Hourly",       // 9
+		"NWSForecast",  // 10
+		"WX",           // 11
+		"Pp",           // 12
+		"Tp",           // 13
+		"Rp",           // 14
+		"Sp",           // 15
+		"Ip",           // 16
+		"Ph",           // 17
+		"Rh",           // 18
+		"Sh",           // 19
+		"Ih",           // 20
+		"CC",           // 21
+		"WS",           // 22
+		"WH",           // 23
+		"GS",           // 24
+		"TLiq",         // 25
+		"R",            // 26
+		"S",            // 27
+		"I",            // 28
+		"U",            // 29
+		"isDT",         // 30
+		"T",            // 31
+		"TNp",          // 32
+		"Hp",           // 33
+		"tornadoes",    // 34
+		"hail",         // 35
+		"D",            // 36
+		"MP",           // 37
+		"Sr",           // 38
+		"Ss",           // 39
+		"Mr",           // 40
+		"Ms",           // 41
+		"Tl",           // 42
+		"Th",           // 43
+		"Fl",           // 44
+		"Fh",           // 45
+		"FSl",          // 46
+		"FSh",          // 47
+		"HoS",          // 48
+		"DsH",          // 49
+		"DsC",          // 50
+		"UVi",          // 51
+		"UVc",          // 52
+		"AQc",          // 53
+		"Gc",           // 54
+		"Mc",           // 55
+		"Rc",           // 56
+		"Tc",           // 57
+		"Day",          // 58
+		"Night",        // 59
+		"DT",           // 60
+		"isDL",         // 61
+		"F",            // 62
+		"WB",           // 63
+		"DP",           // 64
+		"GH",           // 65
+		"RHu",          // 66
+		"V",            // 67
+		"C",            // 68
+	}
+
+	/**
+	 * @brief Response format version to dictionary family.
+	 */
+	compactDictionaries = map[string][]string{
+		"1.1":  compactDictionaryV1p1,
+		"1.1e": compactDictionaryV1p1,
+		"1.2":  compactDictionaryV1p2,
+		"1.2e": compactDictionaryV1p2,
+		"1.3":  compactDictionaryV1p2,
+		"1.3e": compactDictionaryV1p2,
+		"1.4":  compactDictionaryV1p2,
+		"1.4e": compactDictionaryV1p2,
+		"1.5":  compactDictionaryV1p2,
+		"1.5e": compactDictionaryV1p2,
+	}
+
+	compactCborEncMode cbor.EncMode
+)
+
+//==============================================
+// Functions - Init
+//==============================================
+func init() {
+	var err error
+	compactCborEncMode, err = cbor.CoreDetEncOptions().EncMode()
+	if err != nil {
+		panic(err)
+	}
+}
+
+//==============================================
+// Functions - Compact Encoding
+//==============================================
+
+//----------------------------------------------
+// @CompactEncodingFromAccept
+//----------------------------------------------
+/**
+ * @brief Picks the compact encoding listed in an Accept header, "" for json.
+ */
+func CompactEncodingFromAccept(accept string) string {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType := strings.ToLower(strings.TrimSpace(strings.Split(part, ";")[0]))
+		switch mediaType {
+		case "application/cbor":
+			return CompactEncodingCbor
+		case "application/msgpack", "application/x-msgpack", "application/vnd.msgpack":
+			return CompactEncodingMsgpack
+		}
+	}
+	return ""
+}
+
+//----------------------------------------------
+// @CompactContentType
+//----------------------------------------------
+/**
+ * @brief
+ */
+func CompactContentType(encoding string) string {
+	switch encoding {
+	case CompactEncodingCbor:
+		return "application/cbor"
+	case CompactEncodingMsgpack:
+		return "application/msgpack"
+	default:
+		return "application/json"
+	}
+}
+
+//----------------------------------------------
+// @CompactDictionary
+//----------------------------------------------
+/**
+ * @brief Short-key dictionary used for a response format version.
+ */
+func CompactDictionary(version string) ([]string, error) {
+	dictionary, ok := compactDictionaries[version]
+	if !ok {
+		return nil, errors.New("unsupported version")
+	}
+	return append([]string(nil), dictionary...), nil
+}
+
+//----------------------------------------------
+// @CompactResponse
+//----------------------------------------------
+/**
+ * @brief Encodes a forecast in the given version using CBOR or MessagePack.
+ *
+ * The payload is the json response with its map keys swapped for dictionary
+ * indexes, so a compact response always decodes back to the json one.
+ */
+func CompactResponse(s ApiResponseInterface, version string, encoding string) ([]byte, error) {
+	dictionary, ok := compactDictionaries[version]
+	if !ok {
+		return nil, errors.New("unsupported version")
+	}
+
+	j, err := s.JsonResponse(version)
+	if err != nil {
+		return nil, err
+	}
+
+	var tree interface{}
+	decoder := json.NewDecoder(strings.NewReader(j))
+	decoder.UseNumber()
+	if err = decoder.Decode(&tree); err != nil {
+		return nil, err
+	}
+
+	index := make(map[string]int, len(dictionary))
+	for i, key := range dictionary {
+		index[key] = i
+	}
+	tree = compactKeys(tree, index)
+
+	switch encoding {
+	case CompactEncodingCbor:
+		return compactCborEncMode.Marshal(tree)
+	case CompactEncodingMsgpack:
+		var buf bytes.Buffer
+		encoder := msgpack.NewEncoder(&buf)
+		encoder.UseCompactInts(true)
+		encoder.UseCompactFloats(true)
+		if err = encoder.Encode(tree); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, errors.New("unsupported encoding")
+	}
+}
+
+//----------------------------------------------
+// @CompactDecode
+//----------------------------------------------
+/**
+ * @brief Decodes a compact response back into the json shape (string keys).
+ */
+func CompactDecode(payload []byte, version string, encoding string) (interface{}, error) {
+	dictionary, ok := compactDictionaries[version]
+	if !ok {
+		return nil, errors.New("unsupported version")
+	}
+
+	var tree interface{}
+	switch encoding {
+	case CompactEncodingCbor:
+		if err := cbor.Unmarshal(payload, &tree); err != nil {
+			return nil, err
+		}
+	case CompactEncodingMsgpack:
+		decoder := msgpack.NewDecoder(bytes.NewReader(payload))
+		decoder.SetMapDecoder(func(d *msgpack.Decoder) (interface{}, error) {
+			return d.DecodeUntypedMap()
+		})
+		if err := decoder.Decode(&tree); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unsupported encoding")
+	}
+
+	return expandKeys(tree, dictionary)
+}
+
+//----------------------------------------------
+// @CompactDecodeJson
+//----------------------------------------------
+/**
+ * @brief Same as CompactDecode, returned as a json string (tooling, diffing).
+ */
+func CompactDecodeJson(payload []byte, version string, encoding string) (string, error) {
+	tree, err := CompactDecode(payload, version, encoding)
+	if err != nil {
+		return "null", err
+	}
+	j, err := json.Marshal(tree)
+	if err != nil {
+		return "null", err
+	}
+	return string(j), nil
+}
+
+//==============================================
+// Local Funcs
+//==============================================
+
+/**
+ * @brief Replaces map keys by their dictionary index and json numbers by ints/floats.
+ */
+func compactKeys(v interface{}, index map[string]int) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[interface{}]interface{}, len(t))
+		for key, value := range t {
+			if i, ok := index[key]; ok {
+				m[uint64(i)] = compactKeys(value, index)
+			} else {
+				m[key] = compactKeys(value, index)
+			}
+		}
+		return m
+	case []interface{}:
+		for i := range t {
+			t[i] = compactKeys(t[i], index)
+		}
+		return t
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	default:
+		return v
+	}
+}
+
+/**
+ * @brief Inverse of compactKeys.
+ */
+func expandKeys(v interface{}, dictionary []string) (interface{}, error) {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for key, value := range t {
+			name, err := expandKey(key, dictionary)
+			if err != nil {
+				return nil, err
+			}
+			if m[name], err = expandKeys(value, dictionary); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case map[string]interface{}:
+		for key, value := range t {
+			expanded, err := expandKeys(value, dictionary)
+			if err != nil {
+				return nil, err
+			}
+			t[key] = expanded
+		}
+		return t, nil
+	case []interface{}:
+		for i := range t {
+			expanded, err := expandKeys(t[i], dictionary)
+			if err != nil {
+				return nil, err
+			}
+			t[i] = expanded
+		}
+		return t, nil
+	default:
+		return v, nil
+	}
+}
+
+/**
+ * @brief
+ */
+func expandKey(key interface{}, dictionary []string) (string, error) {
+	var i int64
+	switch k := key.(type) {
+	case string:
+		return k, nil
+	case uint64:
+		i = int64(k)
+	case int64:
+		i = k
+	case uint8:
+		i = int64(k)
+	case int8:
+		i = int64(k)
+	case uint16:
+		i = int64(k)
+	case int16:
+		i = int64(k)
+	case uint32:
+		i = int64(k)
+	case int32:
+		i = int64(k)
+	default:
+		return "", errors.New("unexpected map key type")
+	}
+	if i < 0 || i >= int64(len(dictionary)) {
+		return "", errors.New("map key not in dictionary")
+	}
+	return dictionary[i], nil
+}
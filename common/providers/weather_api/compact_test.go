@@ -0,0 +1,135 @@
+package weather_api
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// jsonResponse - ApiResponseInterface serving a fixed json document
+type jsonResponse string
+
+func (r jsonResponse) JsonResponse(version string) (string, error) {
+	return string(r), nil
+}
+
+func (r jsonResponse) ResponseFormat(version string) (ApiResponseInterface, error) {
+	return r, nil
+}
+
+// compactTestResponse - every dictionary key nested in a response, with keys
+// that are not in the dictionary and numbers of each kind.
+func compactTestResponse(t *testing.T, dictionary []string) (jsonResponse, interface{}) {
+	t.Helper()
+	entry := map[string]interface{}{}
+	for i, key := range dictionary {
+		entry[key] = i
+	}
+	entry["NotInDictionary"] = "kept"
+	entry["Float"] = 12.5
+	entry["Negative"] = -3
+	entry["Null"] = nil
+	response := map[string]interface{}{
+		"Daily":   []interface{}{entry, map[string]interface{}{"Nested": entry}},
+		"Message": "Tornado Watch",
+		"Flag":    true,
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want interface{}
+	json.Unmarshal(data, &want)
+	return jsonResponse(data), want
+}
+
+func TestCompactRoundTrip(t *testing.T) {
+	for version := range compactDictionaries {
+		dictionary, err := CompactDictionary(version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, want := compactTestResponse(t, dictionary)
+
+		for _, encoding := range []string{CompactEncodingCbor, CompactEncodingMsgpack} {
+			payload, err := CompactResponse(response, version, encoding)
+			if err != nil {
+				t.Fatalf("%s %s: %v", version, encoding, err)
+			}
+			if len(payload) >= len(response) {
+				t.Errorf("%s %s: %d bytes, json is %d", version, encoding, len(payload), len(response))
+			}
+			if bytes.Contains(payload, []byte(dictionary[0])) || !bytes.Contains(payload, []byte("NotInDictionary")) {
+				t.Errorf("%s %s: keys not swapped for their index", version, encoding)
+			}
+
+			decoded, err := CompactDecodeJson(payload, version, encoding)
+			if err != nil {
+				t.Fatalf("%s %s: %v", version, encoding, err)
+			}
+			var got interface{}
+			if err := json.Unmarshal([]byte(decoded), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s %s: decoded\n%s\nwant\n%s", version, encoding, decoded, response)
+			}
+		}
+	}
+}
+
+func TestCompactErrors(t *testing.T) {
+	response := jsonResponse(`{"Date":"2020-05-04"}`)
+	if _, err := CompactResponse(response, "9.9", CompactEncodingCbor); err == nil {
+		t.Errorf("unknown version encoded")
+	}
+	if _, err := CompactResponse(response, "1.5", "xml"); err == nil {
+		t.Errorf("unknown encoding accepted")
+	}
+	if _, err := CompactDecode([]byte{0xff}, "1.5", CompactEncodingCbor); err == nil {
+		t.Errorf("garbage decoded")
+	}
+
+	// An index of the 1.1 dictionary past the end of the 1.2 one
+	dictionary, _ := CompactDictionary("1.1")
+	payload, err := CompactResponse(jsonResponse(`{"`+dictionary[len(dictionary)-1]+`":1}`), "1.1", CompactEncodingMsgpack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CompactDecode(payload, "1.5", CompactEncodingMsgpack); err == nil {
+		t.Errorf("index outside the dictionary decoded")
+	}
+
+	// Callers get a copy, the firmware tables stay untouched
+	dictionary[0] = "changed"
+	if again, _ := CompactDictionary("1.1"); again[0] == "changed" {
+		t.Errorf("dictionary modified through its copy")
+	}
+}
+
+func TestCompactEncodingFromAccept(t *testing.T) {
+	for accept, want := range map[string]string{
+		"application/cbor":                         CompactEncodingCbor,
+		"Application/CBOR; q=0.9":                  CompactEncodingCbor,
+		"application/msgpack":                      CompactEncodingMsgpack,
+		"application/x-msgpack":                    CompactEncodingMsgpack,
+		"text/html, application/vnd.msgpack;q=0.5": CompactEncodingMsgpack,
+		"application/cbor, application/msgpack":    CompactEncodingCbor,
+		"application/json":                         "",
+		"*/*":                                      "",
+		"":                                         "",
+	} {
+		encoding := CompactEncodingFromAccept(accept)
+		if encoding != want {
+			t.Errorf("%q: got %q, want %q", accept, encoding, want)
+		}
+		if want == "" && CompactContentType(encoding) != "application/json" {
+			t.Errorf("%q: not served as json", accept)
+		}
+	}
+	if CompactContentType(CompactEncodingCbor) != "application/cbor" || CompactContentType(CompactEncodingMsgpack) != "application/msgpack" {
+		t.Errorf("compact content types")
+	}
+}
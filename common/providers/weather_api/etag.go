@@ -0,0 +1,79 @@
+package weather_api
+
+//==============================================
+// CopyRight 2020 La Crosse Technology, LTD.
+//==============================================
+
+//==============================================
+// Imports
+//==============================================
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+
+	"gopkg.in/guregu/null.v3"
+)
+
+//==============================================
+// Globals
+//==============================================
+var (
+	/**
+	 * @brief Matches the clock tags of the legacy text payload (<date:..>, <time:..>,
+	 * <fcast_time_hourly:..>).
+	 */
+	legacyVolatileTags = regexp.MustCompile(`<(date|time|fcast_time_hourly):[^>]*>`)
+)
+
+//==============================================
+// Functions - ETag
+//==============================================
+
+//----------------------------------------------
+// @ForecastETag
+//----------------------------------------------
+/**
+ * @brief Content hash of a json forecast response.
+ *
+ * The device clock (Date, Time, ForecastTime) changes on every request so it is
+ * left out of the hash, a 304 therefore means "forecast unchanged" and the
+ * display keeps running off its own clock. The tag is weak, the bodies it
+ * matches are equivalent but not byte identical.
+ */
+func ForecastETag(s ApiResponseInterface, version string) string {
+	if f, ok := s.(NullableUniversalForecast); ok {
+		f.Date = null.String{}
+		f.Time = null.String{}
+		f.ForecastTime = null.String{}
+		s = f
+	}
+
+	j, err := s.JsonResponse(version)
+	if err != nil {
+		return ""
+	}
+	return etagFromBytes([]byte(version + "\n" + j))
+}
+
+//----------------------------------------------
+// @LegacyForecastETag
+//----------------------------------------------
+/**
+ * @brief Content hash of a legacy text forecast, ignoring the date and time tags.
+ */
+func LegacyForecastETag(payload string) string {
+	return etagFromBytes([]byte(legacyVolatileTags.ReplaceAllString(payload, "")))
+}
+
+//----------------------------------------------
+// Local Funcs
+//----------------------------------------------
+
+/**
+ * @brief Weak entity tag built from the first 128 bits of a sha256.
+ */
+func etagFromBytes(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "W/\"" + hex.EncodeToString(sum[:16]) + "\""
+}
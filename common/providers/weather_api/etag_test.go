@@ -0,0 +1,47 @@
+package weather_api
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/guregu/null.v3"
+)
+
+func TestForecastETagIgnoresDeviceClock(t *testing.T) {
+	a := NullableUniversalForecast{
+		Date:         null.StringFrom("2020-05-04"),
+		Time:         null.StringFrom("10:00:01"),
+		ForecastTime: null.StringFrom("2020-05-04T10:00:01-0500"),
+		Category:     null.IntFrom(2),
+	}
+	b := a
+	b.Date = null.StringFrom("2020-05-05")
+	b.Time = null.StringFrom("11:30:59")
+	b.ForecastTime = null.StringFrom("2020-05-05T11:30:59-0500")
+
+	etagA := ForecastETag(a, "1.5")
+	if !strings.HasPrefix(etagA, `W/"`) {
+		t.Fatalf("ETag %s is not weak", etagA)
+	}
+	if etagB := ForecastETag(b, "1.5"); etagA != etagB {
+		t.Errorf("ETag changed with the device clock: %s != %s", etagA, etagB)
+	}
+
+	b.Category = null.IntFrom(3)
+	if etagB := ForecastETag(b, "1.5"); etagA == etagB {
+		t.Errorf("ETag unchanged after a content change: %s", etagA)
+	}
+}
+
+func TestLegacyForecastETagIgnoresClockTags(t *testing.T) {
+	a := "<date:20-05-04><time:10:00><fcast_time_hourly:20:05:04 10:00><temp_high:21>"
+	b := "<date:20-05-05><time:11:30><fcast_time_hourly:20:05:05 11:30><temp_high:21>"
+	c := "<date:20-05-05><time:11:30><fcast_time_hourly:20:05:05 11:30><temp_high:22>"
+
+	if LegacyForecastETag(a) != LegacyForecastETag(b) {
+		t.Errorf("ETag changed with the clock tags")
+	}
+	if LegacyForecastETag(a) == LegacyForecastETag(c) {
+		t.Errorf("ETag unchanged after a content change")
+	}
+}
@@ -0,0 +1,266 @@
+package weather_api
+
+//==============================================
+// CopyRight 2020 La Crosse Technology, LTD.
+//==============================================
+
+//==============================================
+// Imports
+//==============================================
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/sibivishnu/Weather/common"
+)
+
+//==============================================
+// Globals - Constants
+//==============================================
+
+/**
+ * @brief Forecast events, detected when a forecast is fetched from the
+ * provider and compared with the previous fetch of the location.
+ *
+ * AccuWeather headline severities run from 1 (significant) to 7
+ * (informational), 0 is unknown. NWS probabilities are percents.
+ */
+const (
+	ForecastEventHeadline = "forecast.headline"
+	ForecastEventSevere   = "weather.severe"
+
+	DefaultHeadlineSeverityThreshold  = 3
+	DefaultSevereProbabilityThreshold = 15
+
+	LocationDevicesTTL       = 720 * time.Hour
+	forecastEventStateTTL    = 720 * time.Hour
+	locationDevicesPrefix    = "location.lastseen:"
+	deviceLocationPrefix     = "device.location:"
+	forecastEventStatePrefix = "forecastevents:"
+
+	// A zip NWS failed for is asked again after this long
+	NWSFailureTTL = 5 * time.Minute
+)
+
+//==============================================
+// Types
+//==============================================
+type (
+	//----------------------------------------------
+	// @ForecastEventPublisher
+	//----------------------------------------------
+	/**
+	 * @brief Sends events downstream, must not block the forecast request.
+	 */
+	ForecastEventPublisher interface {
+		Publish(event ForecastEvent)
+	}
+
+	//----------------------------------------------
+	// @ForecastEvent
+	//----------------------------------------------
+	/**
+	 * @brief A material change of a location forecast. The ID is derived from
+	 * the change, a change detected twice carries the same ID.
+	 */
+	ForecastEvent struct {
+		ID          string           `json:"id"`
+		Type        string           `json:"type"`
+		LocationKey string           `json:"locationKey"`
+		Devices     int64            `json:"devices"`
+		Time        time.Time        `json:"time"`
+		Changes     []ForecastChange `json:"changes"`
+	}
+
+	ForecastChange struct {
+		Field    string `json:"field"`
+		Previous string `json:"previous"`
+		Current  string `json:"current"`
+	}
+
+	headlineState struct {
+		Severity           int
+		Text               string
+		Category           string
+		EffectiveEpochDate int
+	}
+)
+
+//==============================================
+// Globals - Variables
+//==============================================
+var (
+	// Events are only detected while a publisher is set
+	ForecastEvents ForecastEventPublisher
+
+	// Headlines at this severity or worse (lower) are published
+	HeadlineSeverityThreshold = DefaultHeadlineSeverityThreshold
+
+	// Tornado and hail probabilities crossing this value, either way, are published
+	SevereProbabilityThreshold = DefaultSevereProbabilityThreshold
+
+	severeComponents = []string{"tornadoes", "hail"}
+)
+
+//==============================================
+// Functions - Forecast Events
+//==============================================
+
+//----------------------------------------------
+// @trackLocationDevice
+//----------------------------------------------
+/**
+ * @brief Devices served a location forecast over LocationDevicesTTL, counted
+ * in its events. Scored by the time they were last served, a device served
+ * another location is dropped from the one it was served before.
+ */
+func trackLocationDevice(locationKey string, deviceID string, now time.Time) {
+	if locationKey == "" || deviceID == "" {
+		return
+	}
+	previous, err := common.RedisInstance.RedisSession.GetSet(deviceLocationPrefix+deviceID, locationKey).Result()
+	if err != nil && err != redis.Nil {
+		log.Printf("[Events] Unable to track device %s for %s| %v", deviceID, locationKey, err)
+		return
+	}
+
+	key := locationDevicesPrefix + locationKey
+	pipe := common.RedisInstance.RedisSession.TxPipeline()
+	if previous != "" && previous != locationKey {
+		pipe.ZRem(locationDevicesPrefix+previous, deviceID)
+	}
+	pipe.ZAdd(key, redis.Z{Score: float64(now.Unix()), Member: deviceID})
+	pipe.ZRemRangeByScore(key, "-inf", strconv.FormatInt(now.Add(-LocationDevicesTTL).Unix(), 10))
+	pipe.Expire(key, LocationDevicesTTL)
+	pipe.Expire(deviceLocationPrefix+deviceID, LocationDevicesTTL)
+	if _, err := pipe.Exec(); err != nil {
+		log.Printf("[Events] Unable to track device %s for %s| %v", deviceID, locationKey, err)
+	}
+}
+
+//----------------------------------------------
+// @observeHeadline
+//----------------------------------------------
+/**
+ * @brief Publishes a headline reaching HeadlineSeverityThreshold, or getting
+ * more severe than the previous one.
+ */
+func observeHeadline(now time.Time, locationKey string, current headlineState) {
+	if ForecastEvents == nil {
+		return
+	}
+
+	var previous headlineState
+	known := loadForecastEventState(locationKey, "headline", &previous)
+	saveForecastEventState(locationKey, "headline", current)
+
+	if !isSevereHeadline(current) || (known && current == previous) {
+		return
+	}
+	if known && isSevereHeadline(previous) && current.Severity >= previous.Severity {
+		return
+	}
+
+	changes := []ForecastChange{
+		{Field: "severity", Previous: strconv.Itoa(previous.Severity), Current: strconv.Itoa(current.Severity)},
+		{Field: "category", Previous: previous.Category, Current: current.Category},
+		{Field: "text", Previous: previous.Text, Current: current.Text},
+	}
+	publishForecastEvent(now, ForecastEventHeadline, locationKey, changes)
+}
+
+//----------------------------------------------
+// @observeSevere
+//----------------------------------------------
+/**
+ * @brief Publishes NWS tornado or hail probabilities crossing
+ * SevereProbabilityThreshold.
+ */
+func observeSevere(now time.Time, locationKey string, current map[string]string) {
+	if ForecastEvents == nil || locationKey == "" || current == nil {
+		return
+	}
+
+	previous := map[string]string{}
+	loadForecastEventState(locationKey, "nws", &previous)
+	saveForecastEventState(locationKey, "nws", current)
+
+	var changes []ForecastChange
+	for _, component := range severeComponents {
+		before := severeProbability(previous[component])
+		after := severeProbability(current[component])
+		if (before >= SevereProbabilityThreshold) != (after >= SevereProbabilityThreshold) {
+			changes = append(changes, ForecastChange{Field: component, Previous: strconv.Itoa(before), Current: strconv.Itoa(after)})
+		}
+	}
+	if len(changes) > 0 {
+		publishForecastEvent(now, ForecastEventSevere, locationKey, changes)
+	}
+}
+
+//----------------------------------------------
+// @publishForecastEvent
+//----------------------------------------------
+func publishForecastEvent(now time.Time, eventType string, locationKey string, changes []ForecastChange) {
+	devices, err := common.RedisInstance.RedisSession.ZCard(locationDevicesPrefix + locationKey).Result()
+	if err != nil {
+		log.Printf("[Events] Unable to count devices of %s| %v", locationKey, err)
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(eventType + "|" + locationKey))
+	for _, change := range changes {
+		hash.Write([]byte("|" + change.Field + "=" + change.Current))
+	}
+
+	event := ForecastEvent{
+		ID:          hex.EncodeToString(hash.Sum(nil)[:8]),
+		Type:        eventType,
+		LocationKey: locationKey,
+		Devices:     devices,
+		Time:        now.UTC(),
+		Changes:     changes,
+	}
+	log.Printf("[Events] %s for %s (%d devices)", eventType, locationKey, devices)
+	ForecastEvents.Publish(event)
+}
+
+func isSevereHeadline(h headlineState) bool {
+	return h.Severity > 0 && h.Severity <= HeadlineSeverityThreshold
+}
+
+func severeProbability(value string) int {
+	v, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+func loadForecastEventState(locationKey string, field string, state interface{}) bool {
+	data, err := common.RedisInstance.RedisSession.HGet(forecastEventStatePrefix+locationKey, field).Bytes()
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(data, state) == nil
+}
+
+func saveForecastEventState(locationKey string, field string, state interface{}) {
+	dataBytes, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+	key := forecastEventStatePrefix + locationKey
+	pipe := common.RedisInstance.RedisSession.TxPipeline()
+	pipe.HSet(key, field, dataBytes)
+	pipe.Expire(key, forecastEventStateTTL)
+	if _, err := pipe.Exec(); err != nil {
+		log.Printf("[Events] Unable to save %s state of %s| %v", field, locationKey, err)
+	}
+}
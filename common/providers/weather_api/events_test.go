@@ -0,0 +1,79 @@
+package weather_api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sibivishnu/Weather/common"
+)
+
+type recordedEvents []ForecastEvent
+
+func (r *recordedEvents) Publish(event ForecastEvent) {
+	*r = append(*r, event)
+}
+
+func useTestEvents(t *testing.T) *recordedEvents {
+	t.Helper()
+	useTestRedis(t)
+	events := &recordedEvents{}
+	previous := ForecastEvents
+	ForecastEvents = events
+	t.Cleanup(func() { ForecastEvents = previous })
+	return events
+}
+
+func locationDevices(t *testing.T, locationKey string) int64 {
+	t.Helper()
+	count, err := common.RedisInstance.RedisSession.ZCard(locationDevicesPrefix + locationKey).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestLocationDevicesFollowMovedDevices(t *testing.T) {
+	useTestRedis(t)
+	now := time.Date(2020, 5, 4, 18, 0, 0, 0, time.UTC)
+
+	trackLocationDevice("A", "D1", now)
+	trackLocationDevice("A", "D2", now)
+	trackLocationDevice("A", "D1", now.Add(time.Hour))
+	if n := locationDevices(t, "A"); n != 2 {
+		t.Errorf("A counts %d devices", n)
+	}
+
+	// D1 moved to B
+	trackLocationDevice("B", "D1", now.Add(2*time.Hour))
+	if a, b := locationDevices(t, "A"), locationDevices(t, "B"); a != 1 || b != 1 {
+		t.Errorf("after the move A counts %d, B %d", a, b)
+	}
+
+	// D2 not served for longer than LocationDevicesTTL
+	trackLocationDevice("A", "D3", now.Add(LocationDevicesTTL+time.Hour))
+	if n := locationDevices(t, "A"); n != 1 {
+		t.Errorf("A counts %d devices, stale one kept", n)
+	}
+}
+
+func TestSevereEventsOnCrossing(t *testing.T) {
+	events := useTestEvents(t)
+	now := time.Date(2020, 5, 4, 18, 0, 0, 0, time.UTC)
+	trackLocationDevice("335315", "D1", now)
+
+	observeSevere(now, "335315", map[string]string{"tornadoes": "0", "hail": "5"})
+	observeSevere(now, "335315", map[string]string{"tornadoes": "20", "hail": "10"})
+	observeSevere(now, "335315", map[string]string{"tornadoes": "25", "hail": "10"})
+	observeSevere(now, "335315", map[string]string{"tornadoes": "0", "hail": "10"})
+
+	if len(*events) != 2 {
+		t.Fatalf("%d events published, want 2", len(*events))
+	}
+	first := (*events)[0]
+	if first.Type != ForecastEventSevere || !first.Time.Equal(now) || first.Devices != 1 || len(first.Changes) != 1 || first.Changes[0].Current != "20" {
+		t.Errorf("crossing up published %+v", first)
+	}
+	if (*events)[1].Changes[0].Current != "0" {
+		t.Errorf("crossing down published %+v", (*events)[1])
+	}
+}
@@ -0,0 +1,196 @@
+package weather_api
+
+//==============================================
+// CopyRight 2020 La Crosse Technology, LTD.
+//==============================================
+
+//==============================================
+// Imports
+//==============================================
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/sibivishnu/Weather/common"
+	"github.com/sibivishnu/Weather/common/const/device"
+)
+
+//==============================================
+// Globals - Constants
+//==============================================
+
+/**
+ * @brief Coordinates are snapped to a 0.05 degree grid (about 5km) before the
+ * geoposition search, every device of a cell shares the cached location.
+ */
+const (
+	GeoGridStep       = 0.05
+	GeoNoEntriesTTL   = 60 * time.Minute
+	geoGridKeyPrefix  = "geo:"
+	geoGridKeyDecimal = 2
+)
+
+//==============================================
+// Functions - Geoposition
+//==============================================
+
+//----------------------------------------------
+// @GetDeviceLocation
+//----------------------------------------------
+/**
+ * @brief Location of a device Geo.
+ *
+ * An ACW key wins. Coordinates are used when the postal code is missing, does
+ * not resolve, resolves outside the device country or matches several
+ * locations of the country. The postal code location is kept when the
+ * coordinates do not resolve.
+ */
+func GetDeviceLocation(geo device.Geo) (PostalCodeResponse, error) {
+	if geo.ACWKey != "" {
+		return GetLocationFromPC(geo.ACWKey)
+	}
+
+	zip := strings.TrimSpace(geo.Zip)
+	countryCode := strings.TrimSpace(geo.CountryCode)
+	lat, lon, hasCoordinates := geo.Coordinates()
+
+	if zip == "" && hasCoordinates {
+		return GetLocationFromGeo(lat, lon)
+	}
+
+	location, err := GetLocation(zip, countryCode)
+	ambiguous := err != nil || !locationInCountry(location, countryCode) || location.PostalCodeCandidates > 1
+	if hasCoordinates && ambiguous {
+		geoLocation, geoErr := GetLocationFromGeo(lat, lon)
+		if geoErr == nil {
+			log.Printf("[Geo] Postal code %s_%s ambiguous, using coordinates %f,%f", zip, countryCode, lat, lon)
+			return geoLocation, nil
+		}
+	}
+	return location, err
+}
+
+//----------------------------------------------
+// @GetLocationFromGeo
+//----------------------------------------------
+/**
+ * @brief Location of the grid cell holding lat,lon, through the accuweather geoposition search.
+ *
+ * The cell only stores the location key, the location itself is the
+ * postalcode:<key> record shared with GetLocationFromPC.
+ */
+func GetLocationFromGeo(lat float64, lon float64) (PostalCodeResponse, error) {
+	lat, lon = GeoGridCell(lat, lon)
+	geokey := GeoGridKey(lat, lon)
+
+	data, err := common.RedisInstance.GetCachedData(geokey)
+	if err == nil {
+		if len(data) == 0 {
+			return PostalCodeResponse{}, fmt.Errorf("No location returned by accuweather for %s", geokey)
+		}
+		return GetLocationFromPC(string(data))
+	} else if err != redis.Nil {
+		return PostalCodeResponse{}, err
+	}
+
+	var Url *url.URL
+	Url, _ = url.Parse(AccuBaseUrl)
+
+	Url.Path += "/locations/v1/cities/geoposition/search"
+	parameters := url.Values{}
+	parameters.Add("apikey", AccuApiKey)
+	parameters.Add("q", formatGeoCoordinate(lat)+","+formatGeoCoordinate(lon))
+	Url.RawQuery = parameters.Encode()
+
+	resp, err := http.Get(Url.String())
+	if err != nil {
+		return PostalCodeResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return PostalCodeResponse{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return PostalCodeResponse{}, fmt.Errorf("Geoposition search for %s failed with status %d", geokey, resp.StatusCode)
+	}
+
+	var pc PostalCodeResponse
+	err = json.Unmarshal(body, &pc)
+
+	// No result returned
+	if err != nil || strings.TrimSpace(pc.Key) == "" {
+		common.RedisInstance.SaveRedisData([]byte{}, geokey, GeoNoEntriesTTL)
+		return PostalCodeResponse{}, errors.New("No location returned by accuweather for " + geokey)
+	}
+
+	common.RedisInstance.SaveRedisData(body, "postalcode:"+pc.Key, LocationRecordTTL)
+	common.RedisInstance.SaveRedisData([]byte(pc.Key), geokey, 0)
+	applyTimeZone(&pc.TimeZone)
+	return pc, nil
+}
+
+//----------------------------------------------
+// @GeoGridCell
+//----------------------------------------------
+/**
+ * @brief Coordinates of the grid cell holding lat,lon.
+ */
+func GeoGridCell(lat float64, lon float64) (float64, float64) {
+	snap := func(v float64) float64 {
+		v = math.Round(v/GeoGridStep) * GeoGridStep
+		// Keeps -0 and float noise out of the cache keys
+		return math.Round(v*100) / 100
+	}
+	return snap(lat), snap(lon)
+}
+
+//----------------------------------------------
+// @GeoGridKey
+//----------------------------------------------
+/**
+ * @brief Cache key of the grid cell holding lat,lon.
+ */
+func GeoGridKey(lat float64, lon float64) string {
+	lat, lon = GeoGridCell(lat, lon)
+	return geoGridKeyPrefix + formatGeoCoordinate(lat) + "_" + formatGeoCoordinate(lon)
+}
+
+//----------------------------------------------
+// Local Funcs
+//----------------------------------------------
+
+/**
+ * @brief
+ */
+func formatGeoCoordinate(v float64) string {
+	if v == 0 {
+		v = 0 // -0
+	}
+	return fmt.Sprintf("%.*f", geoGridKeyDecimal, v)
+}
+
+/**
+ * @brief Whether a location is in the requested country, DefaultCountryCode when empty.
+ */
+func locationInCountry(location PostalCodeResponse, countryCode string) bool {
+	countryCode = strings.ToUpper(countryCode)
+	if countryCode == "" {
+		countryCode = DefaultCountryCode
+	}
+	// Elixir/Appengine send 'USA' instead of 'US'
+	if countryCode == "USA" {
+		countryCode = "US"
+	}
+	return strings.ToUpper(location.Country.ID) == countryCode
+}
@@ -0,0 +1,99 @@
+package weather_api
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+	"github.com/sibivishnu/Weather/common"
+	"github.com/sibivishnu/Weather/common/cache"
+	"github.com/sibivishnu/Weather/common/const/device"
+)
+
+func useTestRedis(t *testing.T) {
+	t.Helper()
+	m := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	previous := common.RedisInstance
+	common.RedisInstance = &cache.RedisInstance{RedisSession: client}
+	t.Cleanup(func() {
+		common.RedisInstance = previous
+		client.Close()
+	})
+}
+
+func cacheLocation(t *testing.T, key string, location PostalCodeResponse) {
+	t.Helper()
+	data, err := json.Marshal(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := common.RedisInstance.SaveRedisData(data, key, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGeoGridSnapping(t *testing.T) {
+	for _, c := range []struct {
+		lat, lon float64
+		key      string
+	}{
+		{43.8114, -91.2396, "geo:43.80_-91.25"},
+		{43.8249, -91.2251, "geo:43.80_-91.25"},
+		{43.8251, -91.2249, "geo:43.85_-91.20"},
+		{-33.8688, 151.2093, "geo:-33.85_151.20"},
+		{-0.01, 0.02, "geo:0.00_0.00"},
+		{89.99, -179.99, "geo:90.00_-180.00"},
+	} {
+		if key := GeoGridKey(c.lat, c.lon); key != c.key {
+			t.Errorf("%v,%v: got %s, want %s", c.lat, c.lon, key, c.key)
+		}
+	}
+
+	// Every point of a cell shares its key
+	lat, lon := GeoGridCell(43.8114, -91.2396)
+	if GeoGridKey(lat, lon) != GeoGridKey(43.8114, -91.2396) {
+		t.Errorf("cell %v,%v has another key", lat, lon)
+	}
+}
+
+func TestDeviceLocationFallbackOrder(t *testing.T) {
+	useTestRedis(t)
+	us := AccuCountry{ID: "US"}
+	for _, key := range []string{"ACW", "ZIP", "AMBIGUOUS", "GEO"} {
+		cacheLocation(t, "postalcode:"+key, PostalCodeResponse{Key: key, Country: us})
+	}
+	cacheLocation(t, "zip:54601_US", PostalCodeResponse{Key: "ZIP", Country: us, PostalCodeCandidates: 1})
+	cacheLocation(t, "zip:10001_US", PostalCodeResponse{Key: "AMBIGUOUS", Country: us, PostalCodeCandidates: 2})
+	cacheLocation(t, "zip:H2X_US", PostalCodeResponse{Key: "CANADA", Country: AccuCountry{ID: "CA"}, PostalCodeCandidates: 1})
+	cacheLocation(t, "zip:00000_US", PostalCodeResponse{Code: "NoEntries"})
+	common.RedisInstance.SaveRedisData([]byte("GEO"), "geo:43.80_-91.25", 0)
+
+	for _, c := range []struct {
+		name string
+		geo  device.Geo
+		want string
+	}{
+		{"acw key first", device.Geo{ACWKey: "ACW", Zip: "54601", CountryCode: "US", Latitude: "43.81", Longitude: "-91.24"}, "ACW"},
+		{"single postal code", device.Geo{Zip: "54601", CountryCode: "US", Latitude: "43.81", Longitude: "-91.24"}, "ZIP"},
+		{"several candidates", device.Geo{Zip: "10001", CountryCode: "US", Latitude: "43.81", Longitude: "-91.24"}, "GEO"},
+		{"several candidates without coordinates", device.Geo{Zip: "10001", CountryCode: "US"}, "AMBIGUOUS"},
+		{"other country", device.Geo{Zip: "H2X", CountryCode: "US", Latitude: "43.81", Longitude: "-91.24"}, "GEO"},
+		{"unknown postal code", device.Geo{Zip: "00000", CountryCode: "US", Latitude: "43.81", Longitude: "-91.24"}, "GEO"},
+		{"no postal code", device.Geo{CountryCode: "US", Latitude: "43.81", Longitude: "-91.24"}, "GEO"},
+		{"unset coordinates", device.Geo{Zip: "10001", CountryCode: "US", Latitude: "0", Longitude: "0"}, "AMBIGUOUS"},
+	} {
+		location, err := GetDeviceLocation(c.geo)
+		if err != nil || location.Key != c.want {
+			t.Errorf("%s: got %q %v, want %q", c.name, location.Key, err, c.want)
+		}
+	}
+
+	// Coordinates without a location keep the postal code one
+	common.RedisInstance.SaveRedisData([]byte{}, "geo:10.00_10.00", 0)
+	location, err := GetDeviceLocation(device.Geo{Zip: "10001", CountryCode: "US", Latitude: "10", Longitude: "10"})
+	if err != nil || location.Key != "AMBIGUOUS" {
+		t.Errorf("empty cell: got %q %v", location.Key, err)
+	}
+}
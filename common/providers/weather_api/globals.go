@@ -12,9 +12,6 @@ import (
 	"github.com/sibivishnu/Weather/common/const/firmware"
 	"github.com/sibivishnu/Weather/common/const/legacy_firmware"
 	"github.com/sibivishnu/Weather/common/const/mcu"
-
-	"sync"
-	"time"
 )
 
 var (
@@ -265,14 +262,6 @@ var (
 		const_accuweather.WeatherCategoryVeryUnlikely:  const_firmware.WeatherCategoryVeryUnlikely,
 	}
 
-	//----------------------------------------------
-	// Globals - Tables -
-	//----------------------------------------------
-	/**
-	 * @brief
-	 */
-	LocationMap map[string]*time.Location
-
 	//----------------------------------------------
 	// Globals -
 	//----------------------------------------------
@@ -281,13 +270,4 @@ var (
 	 */
 	AccuApiKey string
 
-	//----------------------------------------------
-	// Globals -
-	//----------------------------------------------
-
-	// Mutex to control access to the map
-	/**
-	 * @brief
-	 */
-	LocationMapMutex = sync.RWMutex{}
 )
@@ -0,0 +1,385 @@
+package weather_api
+
+//==============================================
+// CopyRight 2020 La Crosse Technology, LTD.
+//==============================================
+
+//==============================================
+// Imports
+//==============================================
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sibivishnu/Weather/common/const/device"
+)
+
+//==============================================
+// Globals - Constants
+//==============================================
+
+/**
+ * @brief
+ */
+const (
+	DefaultScenarioFolder        = "/scenarios"
+	DefaultScenarioWatchInterval = 30 * time.Second
+)
+
+//==============================================
+// Globals
+//==============================================
+var (
+	/**
+	 * @brief Forecast scenarios, replaced on init by LoadCommonEnvironment.
+	 */
+	Scenarios = NewScenarioRegistry(DefaultScenarioFolder)
+)
+
+//==============================================
+// Types
+//==============================================
+type (
+	//----------------------------------------------
+	// @ForecastScenario
+	//----------------------------------------------
+	/**
+	 * @brief Declarative scenario, one <name>.json file of the scenario folder.
+	 *
+	 * Frames are played in order, each for Duration seconds. Without Loop the
+	 * last frame is kept once the scenario is over.
+	 */
+	ForecastScenario struct {
+		Name   string          `json:"name"`
+		Loop   bool            `json:"loop"`
+		Frames []ScenarioFrame `json:"frames"`
+	}
+
+	//----------------------------------------------
+	// @ScenarioFrame
+	//----------------------------------------------
+	/**
+	 * @brief Synthetic sections, in the NullableUniversalForecast field layout.
+	 *
+	 * A section left out keeps the provider data, fields left out of a section
+	 * are sent as null. Daily and hourly lists shorter than the requested days
+	 * and hours repeat their last entry.
+	 */
+	ScenarioFrame struct {
+		Duration int64                                `json:"duration"`
+		Headline *NullableAccuHeadline                `json:"headline,omitempty"`
+		Today    *NullableDayNightData                `json:"today,omitempty"`
+		Current  *NullableAccuCurrentForecastResponse `json:"current,omitempty"`
+		Daily    *[]NullableAccuDailyForecast         `json:"daily,omitempty"`
+		Hourly   *[]NullableAccuHourlyForecast        `json:"hourly,omitempty"`
+		Alerts   map[string]string                    `json:"alerts,omitempty"` // NWSForecast
+	}
+
+	//----------------------------------------------
+	// @ScenarioRegistry
+	//----------------------------------------------
+	/**
+	 * @brief Scenarios of a folder, a file that fails to load keeps its last good version.
+	 */
+	ScenarioRegistry struct {
+		folder    string
+		lock      sync.RWMutex
+		scenarios map[string]*ForecastScenario
+		modTimes  map[string]time.Time
+		watching  bool
+	}
+)
+
+//==============================================
+// Functions - Scenario Registry
+//==============================================
+
+//----------------------------------------------
+// @NewScenarioRegistry
+//----------------------------------------------
+/**
+ * @brief
+ */
+func NewScenarioRegistry(folder string) *ScenarioRegistry {
+	return &ScenarioRegistry{
+		folder:    folder,
+		scenarios: map[string]*ForecastScenario{},
+		modTimes:  map[string]time.Time{},
+	}
+}
+
+//----------------------------------------------
+// @Load
+//----------------------------------------------
+/**
+ * @brief Loads every scenario file of the folder that changed since the last load.
+ */
+func (s *ScenarioRegistry) Load() error {
+	files, err := ioutil.ReadDir(s.folder)
+	if err != nil {
+		log.Printf("[Scenario] Unable to read folder %s| %v", s.folder, err)
+		return err
+	}
+
+	var loadErr error
+	for _, file := range files {
+		if file.IsDir() || path.Ext(file.Name()) != ".json" {
+			continue
+		}
+
+		s.lock.RLock()
+		modTime, ok := s.modTimes[file.Name()]
+		s.lock.RUnlock()
+		if ok && modTime.Equal(file.ModTime()) {
+			continue
+		}
+
+		if err = s.parse(file.Name(), file.ModTime()); err != nil {
+			loadErr = err
+		}
+	}
+	return loadErr
+}
+
+//----------------------------------------------
+// @Watch
+//----------------------------------------------
+/**
+ * @brief Polls the folder and loads scenarios whose modification time changed.
+ */
+func (s *ScenarioRegistry) Watch(interval time.Duration) {
+	s.lock.Lock()
+	if s.watching {
+		s.lock.Unlock()
+		return
+	}
+	s.watching = true
+	s.lock.Unlock()
+
+	go func() {
+		for range time.Tick(interval) {
+			s.Load()
+		}
+	}()
+}
+
+//----------------------------------------------
+// @Get
+//----------------------------------------------
+/**
+ * @brief
+ */
+func (s *ScenarioRegistry) Get(name string) (*ForecastScenario, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	scenario, ok := s.scenarios[name]
+	return scenario, ok
+}
+
+//----------------------------------------------
+// @Names
+//----------------------------------------------
+/**
+ * @brief
+ */
+func (s *ScenarioRegistry) Names() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	names := []string{}
+	for name := range s.scenarios {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//==============================================
+// Functions - Scenarios
+//==============================================
+
+//----------------------------------------------
+// @Validate
+//----------------------------------------------
+/**
+ * @brief
+ */
+func (s ForecastScenario) Validate() error {
+	if strings.TrimSpace(s.Name) == "" {
+		return errors.New("scenario name is required")
+	}
+	if len(s.Frames) == 0 {
+		return errors.New("scenario needs at least one frame")
+	}
+	for i, frame := range s.Frames {
+		if frame.Duration <= 0 {
+			return fmt.Errorf("frame %d: duration must be positive", i)
+		}
+	}
+	return nil
+}
+
+//----------------------------------------------
+// @FrameAt
+//----------------------------------------------
+/**
+ * @brief Frame playing elapsed after the scenario start, nil before it.
+ */
+func (s ForecastScenario) FrameAt(elapsed time.Duration) *ScenarioFrame {
+	var total time.Duration
+	for _, frame := range s.Frames {
+		total += time.Duration(frame.Duration) * time.Second
+	}
+	if elapsed < 0 || total <= 0 {
+		return nil
+	}
+	if s.Loop {
+		elapsed = elapsed % total
+	}
+
+	for i := range s.Frames {
+		duration := time.Duration(s.Frames[i].Duration) * time.Second
+		if elapsed < duration || i == len(s.Frames)-1 {
+			return &s.Frames[i]
+		}
+		elapsed -= duration
+	}
+	return nil
+}
+
+//----------------------------------------------
+// @DeviceScenarioFrame
+//----------------------------------------------
+/**
+ * @brief Frame to serve a device with forecast scripting enabled, nil otherwise.
+ *
+ * ForecastScriptStaticA plays the static-a scenario from the epoch,
+ * ForecastScriptBackendDriver the scenario assigned through the admin api.
+ */
+func DeviceScenarioFrame(extendedInfo device.ExtendedDeviceInfo, now time.Time) *ScenarioFrame {
+	if !extendedInfo.ForecastScripting.Enabled {
+		return nil
+	}
+
+	name := ""
+	start := int64(0)
+	switch extendedInfo.ForecastScripting.Mode {
+	case device.ForecastScriptStaticA:
+		name = device.ScenarioStaticA
+	case device.ForecastScriptBackendDriver:
+		assignment, err := device.GetScenarioAssignment(extendedInfo.ID)
+		if err != nil {
+			log.Printf("[Scenario] Unable to load assignment for %s| %v", extendedInfo.ID, err)
+			return nil
+		}
+		if assignment == nil {
+			return nil
+		}
+		name = assignment.Name
+		start = assignment.Start
+	default:
+		return nil
+	}
+
+	scenario, ok := Scenarios.Get(name)
+	if !ok {
+		log.Printf("[Scenario] Scenario %s not found for %s", name, extendedInfo.ID)
+		return nil
+	}
+	return scenario.FrameAt(now.Sub(time.Unix(start, 0)))
+}
+
+//----------------------------------------------
+// @Apply
+//----------------------------------------------
+/**
+ * @brief Replaces the requested sections of a forecast with the frame ones.
+ * Daily and hourly are padded to the requested days and hours, the response
+ * formats expect full lists.
+ */
+func (frame *ScenarioFrame) Apply(forecast *NullableUniversalForecast, sections ForecastSections) {
+	if frame.Headline != nil && (sections.Today || sections.Daily) {
+		headline := *frame.Headline
+		forecast.Headline = &headline
+	}
+	if frame.Today != nil && sections.Today {
+		today := *frame.Today
+		forecast.Today = &today
+	}
+	if frame.Current != nil && sections.Current {
+		current := *frame.Current
+		forecast.Current = &current
+	}
+	if frame.Alerts != nil && sections.Current {
+		forecast.NWSForecast = frame.Alerts
+	}
+	if frame.Daily != nil && sections.Daily {
+		var daily []NullableAccuDailyForecast
+		for i := 0; len(*frame.Daily) > 0 && i < sections.Days; i++ {
+			daily = append(daily, (*frame.Daily)[scenarioEntry(i, len(*frame.Daily))])
+		}
+		forecast.Daily = &daily
+	}
+	if frame.Hourly != nil && sections.Hourly {
+		var hourly []NullableAccuHourlyForecast
+		for i := 0; len(*frame.Hourly) > 0 && i < sections.Hours; i++ {
+			hourly = append(hourly, (*frame.Hourly)[scenarioEntry(i, len(*frame.Hourly))])
+		}
+		forecast.Hourly = &hourly
+	}
+}
+
+//----------------------------------------------
+// Local Funcs
+//----------------------------------------------
+
+/**
+ * @brief Entry of a frame list served at index i, the last one past its end.
+ */
+func scenarioEntry(i int, length int) int {
+	if i >= length {
+		return length - 1
+	}
+	return i
+}
+
+/**
+ * @brief Loads one scenario file and swaps it in on success, keyed by its name.
+ */
+func (s *ScenarioRegistry) parse(file string, modTime time.Time) error {
+	body, err := ioutil.ReadFile(path.Join(s.folder, file))
+	if err != nil {
+		log.Printf("[Scenario] Unable to read file %s:%s| %v", s.folder, file, err)
+		return err
+	}
+
+	var scenario ForecastScenario
+	err = json.Unmarshal(body, &scenario)
+	if err == nil && strings.TrimSpace(scenario.Name) == "" {
+		scenario.Name = strings.TrimSuffix(file, path.Ext(file))
+	}
+	if err == nil {
+		err = scenario.Validate()
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Remember the attempt either way so a broken file is not re-read every poll
+	s.modTimes[file] = modTime
+	if err != nil {
+		log.Printf("[Scenario] Load failed %s| %v", file, err)
+		return err
+	}
+
+	s.scenarios[scenario.Name] = &scenario
+	log.Printf("[Scenario] Loaded %s (%d frames) from %s:%s", scenario.Name, len(scenario.Frames), s.folder, file)
+	return nil
+}
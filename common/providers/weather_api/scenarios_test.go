@@ -0,0 +1,51 @@
+package weather_api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sibivishnu/Weather/common/const/device"
+)
+
+func TestShippedScenarios(t *testing.T) {
+	registry := NewScenarioRegistry("../../../webapp/scenarios")
+	if err := registry.Load(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{device.ScenarioStaticA, "blizzard"} {
+		if _, ok := registry.Get(name); !ok {
+			t.Errorf("scenario %s not shipped", name)
+		}
+	}
+}
+
+func TestScenarioShortListsPadded(t *testing.T) {
+	registry := NewScenarioRegistry("../../../webapp/scenarios")
+	registry.Load()
+	blizzard, _ := registry.Get("blizzard")
+
+	// Second frame, one daily and one hourly entry
+	frame := blizzard.FrameAt(15 * time.Minute)
+	for _, version := range []string{"1.2", "1.3", "1.4", "1.5"} {
+		sections := DefaultForecastSections(version)
+		forecast := NullableUniversalForecast{}
+		frame.Apply(&forecast, sections)
+
+		if len(*forecast.Daily) != sections.Days || len(*forecast.Hourly) != sections.Hours {
+			t.Errorf("version %s: %d days %d hours, want %d and %d", version, len(*forecast.Daily), len(*forecast.Hourly), sections.Days, sections.Hours)
+		}
+		if (*forecast.Daily)[sections.Days-1].Temperature.Minimum.Value.Float64 != -20 {
+			t.Errorf("version %s: last day not padded from the frame", version)
+		}
+		if _, err := forecast.JsonResponse(version); err != nil {
+			t.Errorf("version %s: %v", version, err)
+		}
+	}
+
+	empty := ScenarioFrame{Daily: &[]NullableAccuDailyForecast{}}
+	forecast := NullableUniversalForecast{}
+	empty.Apply(&forecast, DefaultForecastSections("1.5"))
+	if len(*forecast.Daily) != 0 {
+		t.Errorf("empty daily padded to %d days", len(*forecast.Daily))
+	}
+}
@@ -0,0 +1,188 @@
+package weather_api
+
+//==============================================
+// CopyRight 2020 La Crosse Technology, LTD.
+//==============================================
+
+//==============================================
+// Imports
+//==============================================
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/sibivishnu/Weather/common/const/device"
+)
+
+//==============================================
+// Globals - Constants
+//==============================================
+
+/**
+ * @brief Forecast sections selectable on the v2.3 json endpoints.
+ */
+const (
+	ForecastSectionToday   = "today"
+	ForecastSectionDaily   = "daily"
+	ForecastSectionHourly  = "hourly"
+	ForecastSectionCurrent = "current"
+	ForecastMaxDays        = 10 // accuweather "10day" query
+	ForecastMaxHours       = 24 // accuweather "24hour" query
+)
+
+//==============================================
+// Globals - Tables
+//==============================================
+var (
+	/**
+	 * @brief Sections each device category may request.
+	 */
+	forecastSectionsByCategory = map[string][]string{
+		device.CAT1: {ForecastSectionToday, ForecastSectionDaily},
+		device.CAT2: {ForecastSectionToday, ForecastSectionDaily, ForecastSectionCurrent},
+		device.CAT3: {ForecastSectionToday, ForecastSectionDaily, ForecastSectionHourly, ForecastSectionCurrent},
+	}
+)
+
+//==============================================
+// Types
+//==============================================
+type (
+	//----------------------------------------------
+	// @ForecastSections
+	//----------------------------------------------
+	/**
+	 * @brief Sections to load for a json forecast and how many days/hours to keep.
+	 *
+	 * Sections left out are not queried upstream at all.
+	 */
+	ForecastSections struct {
+		Today   bool
+		Daily   bool
+		Hourly  bool
+		Current bool
+		Days    int
+		Hours   int
+
+		// Preview, the device and its location are not recorded as active
+		ReadOnly bool
+	}
+)
+
+//==============================================
+// Functions - Sections
+//==============================================
+
+//----------------------------------------------
+// @DefaultForecastSections
+//----------------------------------------------
+/**
+ * @brief Every section, clipped the way firmware sub version "v" expects.
+ */
+func DefaultForecastSections(callSubVersion string) ForecastSections {
+	sections := ForecastSections{Today: true, Daily: true, Hourly: true, Current: true, Days: 7, Hours: 12}
+	if callSubVersion == "3" || callSubVersion == "4" || callSubVersion == "5" {
+		sections.Days = 8
+		sections.Hours = 15
+	}
+	return sections
+}
+
+//----------------------------------------------
+// @PresetForecastSections
+//----------------------------------------------
+/**
+ * @brief Only the named sections, with the default clip sizes.
+ */
+func PresetForecastSections(callSubVersion string, names []string) ForecastSections {
+	sections := DefaultForecastSections(callSubVersion)
+	sections.Today = false
+	sections.Daily = false
+	sections.Hourly = false
+	sections.Current = false
+	for _, name := range names {
+		switch name {
+		case ForecastSectionToday:
+			sections.Today = true
+		case ForecastSectionDaily:
+			sections.Daily = true
+		case ForecastSectionHourly:
+			sections.Hourly = true
+		case ForecastSectionCurrent:
+			sections.Current = true
+		}
+	}
+	return sections
+}
+
+//----------------------------------------------
+// @AllowedForecastSections
+//----------------------------------------------
+/**
+ * @brief
+ */
+func AllowedForecastSections(category string) []string {
+	return forecastSectionsByCategory[category]
+}
+
+//----------------------------------------------
+// @ParseForecastSections
+//----------------------------------------------
+/**
+ * @brief Applies the sections=, days= and hours= query values on top of a preset.
+ *
+ * An empty value keeps the preset. Sections are a comma separated list and
+ * must be allowed for the device category.
+ */
+func ParseForecastSections(category string, sections string, days string, hours string, preset ForecastSections) (ForecastSections, error) {
+	result := preset
+
+	if strings.TrimSpace(sections) != "" {
+		allowed := map[string]bool{}
+		for _, section := range AllowedForecastSections(category) {
+			allowed[section] = true
+		}
+
+		result.Today = false
+		result.Daily = false
+		result.Hourly = false
+		result.Current = false
+		for _, section := range strings.Split(sections, ",") {
+			section = strings.ToLower(strings.TrimSpace(section))
+			switch section {
+			case ForecastSectionToday:
+				result.Today = true
+			case ForecastSectionDaily:
+				result.Daily = true
+			case ForecastSectionHourly:
+				result.Hourly = true
+			case ForecastSectionCurrent:
+				result.Current = true
+			default:
+				return preset, errors.New("unknown section: " + section)
+			}
+			if !allowed[section] {
+				return preset, errors.New("section " + section + " not available for category " + category)
+			}
+		}
+	}
+
+	if strings.TrimSpace(days) != "" {
+		n, err := strconv.Atoi(strings.TrimSpace(days))
+		if err != nil || n < 1 || n > ForecastMaxDays {
+			return preset, errors.New("days must be between 1 and " + strconv.Itoa(ForecastMaxDays))
+		}
+		result.Days = n
+	}
+
+	if strings.TrimSpace(hours) != "" {
+		n, err := strconv.Atoi(strings.TrimSpace(hours))
+		if err != nil || n < 1 || n > ForecastMaxHours {
+			return preset, errors.New("hours must be between 1 and " + strconv.Itoa(ForecastMaxHours))
+		}
+		result.Hours = n
+	}
+
+	return result, nil
+}
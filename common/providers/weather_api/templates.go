@@ -0,0 +1,243 @@
+package weather_api
+
+//==============================================
+// CopyRight 2020 La Crosse Technology, LTD.
+//==============================================
+
+//==============================================
+// Imports
+//==============================================
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+//==============================================
+// Globals - Constants
+//==============================================
+
+/**
+ * @brief
+ */
+const (
+	DefaultTemplateFolder        = "/templates"
+	DefaultTemplateWatchInterval = 30 * time.Second
+)
+
+//==============================================
+// Globals
+//==============================================
+var (
+	/**
+	 * @brief Compiled legacy forecast templates, replaced on init by LoadCommonEnvironment.
+	 */
+	Templates = NewTemplateRegistry(DefaultTemplateFolder)
+
+	/**
+	 * @brief Helpers available to every legacy forecast template.
+	 */
+	templateFuncs = template.FuncMap{
+		"getWifiIcon": func(accuIcon int) int {
+			return IconMap[accuIcon]
+		},
+		"getFormatedDateFromEpoch": func(dateStr string) string {
+			layout := "2006-01-02T15:04:05-07:00"
+			t, err := time.Parse(layout, dateStr)
+
+			if err != nil {
+				log.Printf("[Template] Error parsing the time : %s %s", dateStr, err.Error())
+			}
+
+			return t.Format("15:04")
+		},
+		"getMoonPhrase": func(accuPhrase string) int {
+			return MoonPhraseMap[accuPhrase]
+		},
+		"convertValueToEnum": func(value string) int {
+			return ValueToEnumMap[value]
+		},
+	}
+)
+
+//==============================================
+// Types
+//==============================================
+type (
+	//----------------------------------------------
+	// @TemplateRegistry
+	//----------------------------------------------
+	/**
+	 * @brief Templates of a folder, parsed once and shared by all requests.
+	 *
+	 * A template that fails to parse on reload keeps its last good version.
+	 */
+	TemplateRegistry struct {
+		folder    string
+		lock      sync.RWMutex
+		templates map[string]*template.Template
+		modTimes  map[string]time.Time
+		watching  bool
+	}
+)
+
+//==============================================
+// Functions - Template Registry
+//==============================================
+
+//----------------------------------------------
+// @NewTemplateRegistry
+//----------------------------------------------
+/**
+ * @brief
+ */
+func NewTemplateRegistry(folder string) *TemplateRegistry {
+	return &TemplateRegistry{
+		folder:    folder,
+		templates: map[string]*template.Template{},
+		modTimes:  map[string]time.Time{},
+	}
+}
+
+//----------------------------------------------
+// @Load
+//----------------------------------------------
+/**
+ * @brief Parses every template of the folder that changed since the last load.
+ *
+ * Returns the last parse error, templates that failed keep their previous version.
+ */
+func (t *TemplateRegistry) Load() error {
+	files, err := ioutil.ReadDir(t.folder)
+	if err != nil {
+		log.Printf("[Template] Unable to read folder %s| %v", t.folder, err)
+		return err
+	}
+
+	var loadErr error
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		t.lock.RLock()
+		modTime, ok := t.modTimes[file.Name()]
+		t.lock.RUnlock()
+		if ok && modTime.Equal(file.ModTime()) {
+			continue
+		}
+
+		if err = t.parse(file.Name(), file.ModTime()); err != nil {
+			loadErr = err
+		}
+	}
+	return loadErr
+}
+
+//----------------------------------------------
+// @Reload
+//----------------------------------------------
+/**
+ * @brief Re-parses every template of the folder, changed or not.
+ */
+func (t *TemplateRegistry) Reload() error {
+	t.lock.Lock()
+	t.modTimes = map[string]time.Time{}
+	t.lock.Unlock()
+	return t.Load()
+}
+
+//----------------------------------------------
+// @Watch
+//----------------------------------------------
+/**
+ * @brief Polls the folder and loads templates whose modification time changed.
+ */
+func (t *TemplateRegistry) Watch(interval time.Duration) {
+	t.lock.Lock()
+	if t.watching {
+		t.lock.Unlock()
+		return
+	}
+	t.watching = true
+	t.lock.Unlock()
+
+	go func() {
+		for range time.Tick(interval) {
+			t.Load()
+		}
+	}()
+}
+
+//----------------------------------------------
+// @Execute
+//----------------------------------------------
+/**
+ * @brief Renders a template, loading it first if it was added after startup.
+ */
+func (t *TemplateRegistry) Execute(name string, data interface{}) (string, error) {
+	t.lock.RLock()
+	tmpl, ok := t.templates[name]
+	t.lock.RUnlock()
+
+	if !ok {
+		info, err := os.Stat(path.Join(t.folder, name))
+		if err != nil {
+			log.Printf("[Template] Unable to read file %s:%s| %v", t.folder, name, err)
+			return "", errors.New("Problem loading template")
+		}
+		if err = t.parse(name, info.ModTime()); err != nil {
+			return "", errors.New("Problem loading template")
+		}
+		t.lock.RLock()
+		tmpl = t.templates[name]
+		t.lock.RUnlock()
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+//----------------------------------------------
+// Local Funcs
+//----------------------------------------------
+
+/**
+ * @brief Parses one template and swaps it in on success.
+ */
+func (t *TemplateRegistry) parse(name string, modTime time.Time) error {
+	body, err := ioutil.ReadFile(path.Join(t.folder, name))
+	if err != nil {
+		log.Printf("[Template] Unable to read file %s:%s| %v", t.folder, name, err)
+		return err
+	}
+
+	tmpl, err := template.New("body").Funcs(templateFuncs).Parse(string(body))
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// Remember the attempt either way so a broken file is not re-parsed every poll
+	t.modTimes[name] = modTime
+	if err != nil {
+		if _, ok := t.templates[name]; ok {
+			log.Printf("[Template] Parse failed, keeping previous version of %s| %v", name, err)
+		} else {
+			log.Printf("[Template] Parse failed %s| %v", name, err)
+		}
+		return err
+	}
+
+	t.templates[name] = tmpl
+	log.Printf("[Template] Loaded %s:%s", t.folder, name)
+	return nil
+}
@@ -0,0 +1,113 @@
+package weather_api
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeTemplate - template file with its own modification time, so Load sees
+// every rewrite whatever the file system resolution.
+func writeTemplate(t *testing.T, folder string, name string, body string, modTime time.Time) {
+	t.Helper()
+	file := filepath.Join(folder, name)
+	if err := ioutil.WriteFile(file, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTemplateKeepsLastGoodVersion(t *testing.T) {
+	folder := t.TempDir()
+	modTime := time.Date(2020, 5, 4, 18, 0, 0, 0, time.UTC)
+	writeTemplate(t, folder, "alert", "v1 {{.}}", modTime)
+
+	registry := NewTemplateRegistry(folder)
+	if err := registry.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := registry.Execute("alert", "x"); err != nil || out != "v1 x" {
+		t.Fatalf("got %q %v", out, err)
+	}
+
+	modTime = modTime.Add(time.Minute)
+	writeTemplate(t, folder, "alert", "v2 {{.", modTime)
+	if err := registry.Load(); err == nil {
+		t.Errorf("broken template loaded")
+	}
+	if out, err := registry.Execute("alert", "x"); err != nil || out != "v1 x" {
+		t.Errorf("after a broken reload got %q %v", out, err)
+	}
+	if err := registry.Reload(); err == nil {
+		t.Errorf("broken template reloaded")
+	}
+	if out, _ := registry.Execute("alert", "x"); out != "v1 x" {
+		t.Errorf("after a forced reload got %q", out)
+	}
+
+	modTime = modTime.Add(time.Minute)
+	writeTemplate(t, folder, "alert", "v3 {{.}}", modTime)
+	if err := registry.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := registry.Execute("alert", "x"); out != "v3 x" {
+		t.Errorf("fixed template got %q", out)
+	}
+
+	// Without a good version there is nothing to serve
+	writeTemplate(t, folder, "broken", "{{end}}", modTime)
+	if _, err := registry.Execute("broken", "x"); err == nil {
+		t.Errorf("broken template executed")
+	}
+}
+
+func TestTemplateConcurrentReload(t *testing.T) {
+	folder := t.TempDir()
+	modTime := time.Date(2020, 5, 4, 18, 0, 0, 0, time.UTC)
+	writeTemplate(t, folder, "alert", "good {{.}}", modTime)
+	registry := NewTemplateRegistry(folder)
+	if err := registry.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if out, err := registry.Execute("alert", "x"); err != nil || out != "good x" {
+					t.Errorf("got %q %v", out, err)
+					return
+				}
+			}
+		}()
+	}
+
+	// Broken and good versions alternate under the readers
+	for i := 0; i < 50; i++ {
+		modTime = modTime.Add(time.Minute)
+		body := "good {{.}}"
+		if i%2 == 0 {
+			body = "good {{."
+		}
+		writeTemplate(t, folder, "alert", body, modTime)
+		registry.Load()
+		if i%10 == 0 {
+			registry.Reload()
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,129 @@
+package weather_api
+
+//==============================================
+// CopyRight 2020 La Crosse Technology, LTD.
+//==============================================
+
+//==============================================
+// Imports
+//==============================================
+import (
+	"log"
+	"time"
+
+	"github.com/sibivishnu/Weather/common/const/device"
+)
+
+//==============================================
+// Globals - Constants
+//==============================================
+
+/**
+ * @brief Transitions are searched up to a year away, one day at a time.
+ */
+const (
+	dstSearchDays = 366
+)
+
+//==============================================
+// Functions - Time Loop
+//==============================================
+
+//----------------------------------------------
+// @FindDstTransition
+//----------------------------------------------
+/**
+ * @brief First instant after (or, when backward, at or before) from where the zone
+ * enters DST (into) or leaves it (!into). False when the zone has none within a year.
+ */
+func FindDstTransition(loc *time.Location, from time.Time, into bool, backward bool) (time.Time, bool) {
+	step := 24 * time.Hour
+	if backward {
+		step = -step
+	}
+
+	prev := from.In(loc)
+	for i := 0; i < dstSearchDays; i++ {
+		next := prev.Add(step)
+		before, after := prev, next
+		if backward {
+			before, after = next, prev
+		}
+		if before.IsDST() != after.IsDST() && after.IsDST() == into {
+			return bisectDstTransition(before, after), true
+		}
+		prev = next
+	}
+	return time.Time{}, false
+}
+
+//----------------------------------------------
+// @dstLoopTime
+//----------------------------------------------
+/**
+ * @brief Loops now through a window centered on the next DST transition, or the
+ * most recent one for zones that will not have another within a year.
+ */
+func dstLoopTime(now time.Time, loc *time.Location, into bool, window time.Duration) (time.Time, bool) {
+	transition, ok := FindDstTransition(loc, now, into, false)
+	if !ok {
+		transition, ok = FindDstTransition(loc, now, into, true)
+	}
+	if !ok {
+		log.Printf("[TimeLoop] No DST transition for %s, time loop ignored", loc.String())
+		return now, false
+	}
+
+	if window <= 0 {
+		window = time.Duration(device.TimeLoopDstDefaultWindow) * time.Second
+	}
+	rangeStart := transition.Add(-window / 2)
+	delta := now.Sub(rangeStart) % window
+	if delta < 0 {
+		delta += window
+	}
+	return rangeStart.Add(delta).In(loc), true
+}
+
+//----------------------------------------------
+// @servedGmtOffset
+//----------------------------------------------
+/**
+ * @brief Offset, in hours, sent along with the served Date and Time.
+ *
+ * A time zone override wins, then the offset of a simulated instant, then the
+ * location offset, computed from the tz database when the location is read.
+ */
+func servedGmtOffset(locationOffset float64, weatherTime WeatherTime, extendedInfo device.ExtendedDeviceInfo) float64 {
+	if extendedInfo.TimeZoneOverride.Enabled {
+		return float64(timeZoneOverrideOffset(extendedInfo.TimeZoneOverride)) / 3600.0
+	}
+	if weatherTime.Simulated {
+		return weatherTime.GmtOffset
+	}
+	return locationOffset
+}
+
+//----------------------------------------------
+// Local Funcs
+//----------------------------------------------
+
+/**
+ * @brief Narrows [before, after] down to the first second on the after side.
+ */
+func bisectDstTransition(before time.Time, after time.Time) time.Time {
+	loc := before.Location()
+	isDST := before.IsDST()
+
+	// Transitions fall on whole seconds
+	lo, hi := before.Unix(), after.Unix()
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if time.Unix(mid, 0).In(loc).IsDST() == isDST {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return time.Unix(hi, 0).In(loc)
+}
@@ -0,0 +1,85 @@
+package weather_api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sibivishnu/Weather/common/clock"
+	"github.com/sibivishnu/Weather/common/const/device"
+)
+
+// Transitions of 2020, northern and southern hemisphere
+var dstTransitions = []struct {
+	zone     string
+	into     bool
+	at       time.Time
+	from, to float64 // offsets around the transition
+}{
+	{"America/New_York", true, time.Date(2020, 3, 8, 7, 0, 0, 0, time.UTC), -5, -4},
+	{"America/New_York", false, time.Date(2020, 11, 1, 6, 0, 0, 0, time.UTC), -4, -5},
+	{"Australia/Sydney", true, time.Date(2020, 10, 3, 16, 0, 0, 0, time.UTC), 10, 11},
+	{"Australia/Sydney", false, time.Date(2020, 4, 4, 16, 0, 0, 0, time.UTC), 11, 10},
+}
+
+func TestFindDstTransitionBothHemispheres(t *testing.T) {
+	for _, tr := range dstTransitions {
+		loc, err := time.LoadLocation(tr.zone)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, ok := FindDstTransition(loc, tr.at.AddDate(0, -2, 0), tr.into, false)
+		if !ok || !got.Equal(tr.at) {
+			t.Errorf("%s into=%v forward: got %v %v, want %v", tr.zone, tr.into, got.UTC(), ok, tr.at)
+		}
+		got, ok = FindDstTransition(loc, tr.at.AddDate(0, 2, 0), tr.into, true)
+		if !ok || !got.Equal(tr.at) {
+			t.Errorf("%s into=%v backward: got %v %v, want %v", tr.zone, tr.into, got.UTC(), ok, tr.at)
+		}
+	}
+
+	tokyo, _ := time.LoadLocation("Asia/Tokyo")
+	if _, ok := FindDstTransition(tokyo, dstTransitions[0].at, true, false); ok {
+		t.Errorf("transition found for a zone without DST")
+	}
+}
+
+func TestDstTimeLoopBothHemispheres(t *testing.T) {
+	fake := clock.NewFakeClock(time.Time{})
+
+	for _, tr := range dstTransitions {
+		mode := device.TimeLoopDstOut
+		if tr.into {
+			mode = device.TimeLoopDstIn
+		}
+		extendedInfo := &device.ExtendedDeviceInfo{TimeLoop: device.TimeLoopSettings{Enabled: true, Mode: mode, LoopWindow: 600}}
+
+		// A day before the transition, whole days are whole windows
+		for _, c := range []struct {
+			now    time.Time
+			want   time.Time
+			offset float64
+		}{
+			{tr.at.Add(-24*time.Hour + 2*time.Minute), tr.at.Add(2 * time.Minute), tr.to},
+			{tr.at.Add(-24*time.Hour - 3*time.Minute), tr.at.Add(-3 * time.Minute), tr.from},
+		} {
+			fake.Set(c.now)
+			weatherTime, err := GetLocalDateAndHourV2(fake, tr.zone, extendedInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !weatherTime.DateTime.Equal(c.want) || weatherTime.GmtOffset != c.offset || !weatherTime.Simulated {
+				t.Errorf("%s mode %d at %v: got %v offset %v, want %v offset %v",
+					tr.zone, mode, c.now, weatherTime.DateTime, weatherTime.GmtOffset, c.want, c.offset)
+			}
+		}
+	}
+}
+
+func TestDstTimeLoopWithoutTransition(t *testing.T) {
+	tokyo, _ := time.LoadLocation("Asia/Tokyo")
+	now := time.Date(2020, 3, 8, 7, 0, 0, 0, tokyo)
+	if got, ok := dstLoopTime(now, tokyo, true, 10*time.Minute); ok || !got.Equal(now) {
+		t.Errorf("zone without DST looped to %v", got)
+	}
+}
@@ -0,0 +1,275 @@
+package weather_api
+
+//==============================================
+// CopyRight 2020 La Crosse Technology, LTD.
+//==============================================
+
+//==============================================
+// Imports
+//==============================================
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sibivishnu/Weather/common/clock"
+	"github.com/sibivishnu/Weather/common/const/device"
+)
+
+//==============================================
+// Globals - Constants
+//==============================================
+
+/**
+ * @brief Location records (zip:, postalcode:) only change when accuweather
+ * changes the location, offsets are computed from the tz database on read.
+ */
+const (
+	LocationRecordTTL = 720 * time.Hour
+
+	// Names missing from the tz database are looked up again after this long
+	TimeZoneFailureTTL = time.Hour
+
+	// Layout of AccuTimeZone.NextOffsetChange, as sent by accuweather
+	offsetChangeLayout = "2006-01-02T15:04:05Z"
+)
+
+//==============================================
+// Globals
+//==============================================
+var (
+	/**
+	 * @brief Zone names resolved for every request, replaced on init by
+	 * LoadCommonEnvironment with the clock of the service.
+	 */
+	TimeZones = NewTimeZoneResolver(DefaultTimeZoneAliases, clock.SystemClock{})
+
+	/**
+	 * @brief Fallbacks for names the tz database of the host may not carry,
+	 * removed or renamed zones and Windows names.
+	 */
+	DefaultTimeZoneAliases = map[string]string{
+		"US/Pacific-New":            "America/Los_Angeles",
+		"Canada/East-Saskatchewan":  "America/Regina",
+		"America/Godthab":           "America/Nuuk",
+		"Europe/Kiev":               "Europe/Kyiv",
+		"Eastern Standard Time":     "America/New_York",
+		"Central Standard Time":     "America/Chicago",
+		"Mountain Standard Time":    "America/Denver",
+		"US Mountain Standard Time": "America/Phoenix",
+		"Pacific Standard Time":     "America/Los_Angeles",
+		"Alaskan Standard Time":     "America/Anchorage",
+		"Hawaiian Standard Time":    "Pacific/Honolulu",
+	}
+)
+
+//==============================================
+// Types
+//==============================================
+type (
+	//----------------------------------------------
+	// @TimeZoneResolver
+	//----------------------------------------------
+	/**
+	 * @brief tz database locations by zone name, safe for concurrent use.
+	 *
+	 * A name that fails to load is loaded as its alias, when it has one. Names
+	 * that still fail are remembered for TimeZoneFailureTTL, requests for them
+	 * fail without a lookup. Offsets served with a location are the ones at the
+	 * time of the resolver clock.
+	 */
+	TimeZoneResolver struct {
+		clock     clock.Clock
+		lock      sync.RWMutex
+		aliases   map[string]string
+		locations map[string]*time.Location
+		failures  map[string]timeZoneFailure
+	}
+
+	timeZoneFailure struct {
+		err error
+		at  time.Time
+	}
+)
+
+//==============================================
+// Functions - Time Zone Resolver
+//==============================================
+
+//----------------------------------------------
+// @NewTimeZoneResolver
+//----------------------------------------------
+/**
+ * @brief
+ */
+func NewTimeZoneResolver(aliases map[string]string, clk clock.Clock) *TimeZoneResolver {
+	r := &TimeZoneResolver{
+		clock:     clk,
+		aliases:   map[string]string{},
+		locations: map[string]*time.Location{},
+		failures:  map[string]timeZoneFailure{},
+	}
+	for name, target := range aliases {
+		r.aliases[name] = target
+	}
+	return r
+}
+
+//----------------------------------------------
+// @AddAlias
+//----------------------------------------------
+/**
+ * @brief Resolves name as target from now on.
+ */
+func (r *TimeZoneResolver) AddAlias(name string, target string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.aliases[name] = target
+	delete(r.locations, name)
+	delete(r.failures, name)
+}
+
+//----------------------------------------------
+// @Resolve
+//----------------------------------------------
+/**
+ * @brief Location of a zone name, or of its alias.
+ */
+func (r *TimeZoneResolver) Resolve(timeZone string) (*time.Location, error) {
+	name := strings.TrimSpace(timeZone)
+	now := r.clock.Now()
+
+	r.lock.RLock()
+	loc, found := r.locations[name]
+	failure, failed := r.failures[name]
+	target, aliased := r.aliases[name]
+	r.lock.RUnlock()
+
+	if found {
+		return loc, nil
+	}
+	if failed && now.Sub(failure.at) < TimeZoneFailureTTL {
+		return nil, failure.err
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil && aliased {
+		loc, err = time.LoadLocation(target)
+	}
+
+	// Concurrent loads of a name store the same location, the last one wins.
+	// A load that raced AddAlias is not stored, the next request loads the alias.
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if current, ok := r.aliases[name]; ok != aliased || current != target {
+		return loc, err
+	}
+	if err != nil {
+		r.failures[name] = timeZoneFailure{err: err, at: now}
+		return nil, err
+	}
+	delete(r.failures, name)
+	r.locations[name] = loc
+	return loc, nil
+}
+
+//----------------------------------------------
+// @ResolveDevice
+//----------------------------------------------
+/**
+ * @brief Location of a device, a fixed offset zone when its time zone override
+ * is enabled, else the location of the zone name.
+ */
+func (r *TimeZoneResolver) ResolveDevice(timeZone string, extendedInfo *device.ExtendedDeviceInfo) (*time.Location, error) {
+	if extendedInfo != nil && extendedInfo.TimeZoneOverride.Enabled {
+		return timeZoneOverrideLocation(extendedInfo.TimeZoneOverride), nil
+	}
+	return r.Resolve(timeZone)
+}
+
+//==============================================
+// Functions - Time Zones
+//==============================================
+
+//----------------------------------------------
+// @applyTimeZone
+//----------------------------------------------
+/**
+ * @brief Replaces the offset, DST flag and next offset change cached with a
+ * location by their values at now for the zone name. The cached values are
+ * kept when the name is not in the tz database.
+ */
+func applyTimeZone(timeZone *AccuTimeZone) {
+	TimeZones.apply(timeZone)
+}
+
+//----------------------------------------------
+// Local Funcs
+//----------------------------------------------
+
+/**
+ * @brief applyTimeZone with the resolver locations and clock.
+ */
+func (r *TimeZoneResolver) apply(timeZone *AccuTimeZone) {
+	if timeZone.Name == "" {
+		return
+	}
+	loc, err := r.Resolve(timeZone.Name)
+	if err != nil {
+		log.Printf("Error Loading the location for timezone %s : %s", timeZone.Name, err.Error())
+		return
+	}
+
+	now := r.clock.Now().In(loc)
+	_, offset := now.Zone()
+	timeZone.GmtOffset = float64(offset) / 3600.0
+	timeZone.IsDaylightSaving = now.IsDST()
+	timeZone.NextOffsetChange = ""
+	if change, ok := findOffsetChange(loc, now); ok {
+		timeZone.NextOffsetChange = change.UTC().Format(offsetChangeLayout)
+	}
+}
+
+/**
+ * @brief Offset of a time zone override, in seconds east of UTC.
+ */
+func timeZoneOverrideOffset(override device.TimeZoneOverrideSettings) int {
+	return override.Sign * (override.HourOffset*3600 + override.MinuteOffset*60)
+}
+
+func timeZoneOverrideLocation(override device.TimeZoneOverrideSettings) *time.Location {
+	offset := timeZoneOverrideOffset(override)
+	sign := "+"
+	if offset < 0 {
+		sign = "-"
+	}
+	return time.FixedZone(fmt.Sprintf("UTC%s%02d:%02d", sign, override.HourOffset, override.MinuteOffset), offset)
+}
+
+/**
+ * @brief First instant after from where the zone offset changes, searched up to a
+ * year away. Unlike FindDstTransition it also finds standard offset changes.
+ */
+func findOffsetChange(loc *time.Location, from time.Time) (time.Time, bool) {
+	prev := from.In(loc)
+	_, prevOffset := prev.Zone()
+	for i := 0; i < dstSearchDays; i++ {
+		next := prev.Add(24 * time.Hour)
+		if _, nextOffset := next.Zone(); nextOffset != prevOffset {
+			lo, hi := prev.Unix(), next.Unix()
+			for hi-lo > 1 {
+				mid := lo + (hi-lo)/2
+				if _, midOffset := time.Unix(mid, 0).In(loc).Zone(); midOffset == prevOffset {
+					lo = mid
+				} else {
+					hi = mid
+				}
+			}
+			return time.Unix(hi, 0).In(loc), true
+		}
+		prev = next
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,122 @@
+package weather_api
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sibivishnu/Weather/common/clock"
+)
+
+func TestApplyTimeZoneAcrossDst(t *testing.T) {
+	transition := time.Date(2020, 3, 8, 7, 0, 0, 0, time.UTC)
+	fake := clock.NewFakeClock(transition.Add(-time.Minute))
+	resolver := NewTimeZoneResolver(nil, fake)
+
+	tz := AccuTimeZone{Name: "America/New_York", GmtOffset: 3, IsDaylightSaving: true}
+	resolver.apply(&tz)
+	if tz.GmtOffset != -5 || tz.IsDaylightSaving || tz.NextOffsetChange != "2020-03-08T07:00:00Z" {
+		t.Errorf("before the transition got %+v", tz)
+	}
+
+	fake.Set(transition)
+	resolver.apply(&tz)
+	if tz.GmtOffset != -4 || !tz.IsDaylightSaving || tz.NextOffsetChange != "2020-11-01T06:00:00Z" {
+		t.Errorf("after the transition got %+v", tz)
+	}
+
+	// Unknown names keep the cached values
+	unknown := AccuTimeZone{Name: "Nowhere/Unknown", GmtOffset: 2}
+	resolver.apply(&unknown)
+	if unknown.GmtOffset != 2 {
+		t.Errorf("unknown zone got %+v", unknown)
+	}
+}
+
+func TestResolveAliasFallback(t *testing.T) {
+	resolver := NewTimeZoneResolver(DefaultTimeZoneAliases, clock.NewFakeClock(time.Now()))
+
+	// Windows names and renamed zones load as their alias
+	for name, want := range map[string]string{
+		"Eastern Standard Time":   "America/New_York",
+		" Hawaiian Standard Time": "Pacific/Honolulu",
+		"America/Chicago":         "America/Chicago",
+	} {
+		loc, err := resolver.Resolve(name)
+		if err != nil || loc.String() != want {
+			t.Errorf("%q resolved as %v %v, want %s", name, loc, err, want)
+		}
+	}
+
+	// A name the tz database has is not replaced by its alias
+	resolver.AddAlias("Europe/Paris", "America/Chicago")
+	if loc, err := resolver.Resolve("Europe/Paris"); err != nil || loc.String() != "Europe/Paris" {
+		t.Errorf("Europe/Paris resolved as %v %v", loc, err)
+	}
+
+	// An alias added for a failed name is used right away
+	if _, err := resolver.Resolve("Nowhere/Unknown"); err == nil {
+		t.Fatalf("unknown zone resolved")
+	}
+	resolver.AddAlias("Nowhere/Unknown", "UTC")
+	if loc, err := resolver.Resolve("Nowhere/Unknown"); err != nil || loc.String() != "UTC" {
+		t.Errorf("aliased unknown zone resolved as %v %v", loc, err)
+	}
+}
+
+func TestResolveFailureTTL(t *testing.T) {
+	fake := clock.NewFakeClock(time.Date(2020, 5, 4, 18, 0, 0, 0, time.UTC))
+	resolver := NewTimeZoneResolver(nil, fake)
+
+	_, first := resolver.Resolve("Nowhere/Unknown")
+	if first == nil {
+		t.Fatalf("unknown zone resolved")
+	}
+
+	// Remembered, the same failure is returned without a lookup
+	fake.Advance(TimeZoneFailureTTL - time.Minute)
+	if _, err := resolver.Resolve("Nowhere/Unknown"); err != first {
+		t.Errorf("looked up again within the failure TTL: %v", err)
+	}
+
+	fake.Advance(time.Minute)
+	if _, err := resolver.Resolve("Nowhere/Unknown"); err == nil || err == first {
+		t.Errorf("not looked up again after the failure TTL: %v", err)
+	}
+	if at := resolver.failures["Nowhere/Unknown"].at; !at.Equal(fake.Now()) {
+		t.Errorf("failure remembered at %v, want %v", at, fake.Now())
+	}
+}
+
+func TestResolverConcurrentUse(t *testing.T) {
+	fake := clock.NewFakeClock(time.Date(2020, 5, 4, 18, 0, 0, 0, time.UTC))
+	resolver := NewTimeZoneResolver(DefaultTimeZoneAliases, fake)
+	names := []string{"America/New_York", "Eastern Standard Time", "Nowhere/Unknown", "Europe/Kiev", "Alias/0"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				switch {
+				case j%50 == 0:
+					resolver.AddAlias(fmt.Sprintf("Alias/%d", i), "America/Denver")
+				case j%70 == 0:
+					fake.Advance(TimeZoneFailureTTL)
+				default:
+					resolver.Resolve(names[(i+j)%len(names)])
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if loc, err := resolver.Resolve("Alias/0"); err != nil || loc.String() != "America/Denver" {
+		t.Errorf("alias added concurrently resolved as %v %v", loc, err)
+	}
+	if _, err := resolver.Resolve("Nowhere/Unknown"); err == nil {
+		t.Errorf("unknown zone resolved")
+	}
+}
@@ -6,9 +6,15 @@ require (
 	cloud.google.com/go/datastore v1.11.0
 	cloud.google.com/go/pubsub v1.30.1
 	firebase.google.com/go v3.13.0+incompatible
+	github.com/alicebob/miniredis/v2 v2.30.5
+	github.com/fxamacker/cbor/v2 v2.5.0
 	github.com/go-redis/redis v6.15.9+incompatible
 	github.com/gorilla/mux v1.8.0
+	github.com/pkg/sftp v1.13.5
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/urfave/cli v1.22.13
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	golang.org/x/crypto v0.7.0
 	golang.org/x/net v0.10.0
 	google.golang.org/api v0.122.0
 	gopkg.in/guregu/null.v3 v3.5.0
@@ -22,6 +28,7 @@ require (
 	cloud.google.com/go/iam v0.13.0 // indirect
 	cloud.google.com/go/longrunning v0.4.1 // indirect
 	cloud.google.com/go/storage v1.28.1 // indirect
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
 	github.com/cpuguy83/go-md2man/v2 v2.0.2 // indirect
 	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
@@ -30,11 +37,14 @@ require (
 	github.com/google/uuid v1.3.0 // indirect
 	github.com/googleapis/enterprise-certificate-proxy v0.2.3 // indirect
 	github.com/googleapis/gax-go/v2 v2.8.0 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	github.com/onsi/ginkgo v1.16.5 // indirect
 	github.com/onsi/gomega v1.27.6 // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	github.com/yuin/gopher-lua v1.1.0 // indirect
 	go.opencensus.io v0.24.0 // indirect
-	golang.org/x/crypto v0.7.0 // indirect
 	golang.org/x/oauth2 v0.7.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/sys v0.8.0 // indirect
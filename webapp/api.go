@@ -4,6 +4,7 @@ package main
 // Packages
 //----------------------------------------------
 import (
+	"cloud.google.com/go/pubsub"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
@@ -12,6 +13,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/sibivishnu/Weather/common"
 	"github.com/sibivishnu/Weather/common/cache"
+	"github.com/sibivishnu/Weather/common/clock"
 	"github.com/sibivishnu/Weather/common/const/device"
 	"github.com/sibivishnu/Weather/common/providers/weather_api"
 	"gopkg.in/guregu/null.v3"
@@ -19,8 +21,8 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
-	"time"
 )
 
 //----------------------------------------------
@@ -191,7 +193,7 @@ func (s AdminResponseV2) JsonResponse(version string) (string, error) {
 // @actionGetForecastData
 // [GET] /api/v1.1/forecast/id/{id}
 // ----------------------------------------------
-func actionGetForecastData(rw http.ResponseWriter, r *http.Request) {
+func actionGetForecastData(clk clock.Clock, rw http.ResponseWriter, r *http.Request) {
 	var res string
 	vars := mux.Vars(r)
 	deviceID := vars["id"]
@@ -241,26 +243,26 @@ func actionGetForecastData(rw http.ResponseWriter, r *http.Request) {
 
 	// Get Forecast
 	if testOverride(deviceID) {
-		res = location.GetWeatherForecastTest(display.Category, display.ID)
+		res = location.GetWeatherForecastTest(clk, display.Category, display.ID)
 	} else {
-		res = location.GetWeatherForecast(display.Category, display.ID, "BASIC", firmwareVersion)
+		res = location.GetWeatherForecast(clk, display.Category, display.ID, "BASIC", firmwareVersion)
 	}
 
 	// Update Device Request Details
-	updateDeviceRequestEntry(deviceID)
+	updateDeviceRequestEntry(clk, deviceID)
 
 	// syncElixirBackend
 	syncElixirBackend(display)
 
 	// Return response
-	io.WriteString(rw, res)
+	writeForecastResponse(rw, r, res, weather_api.LegacyForecastETag(res))
 }
 
 // ----------------------------------------------
 // @actionGetForecastDataVer2
 // [GET] /api/v2.0/forecast/id/{id}
 // ----------------------------------------------
-func actionGetForecastDataVer2(rw http.ResponseWriter, r *http.Request) {
+func actionGetForecastDataVer2(clk clock.Clock, rw http.ResponseWriter, r *http.Request) {
 	var res string
 	vars := mux.Vars(r)
 	deviceID := vars["id"]
@@ -310,27 +312,26 @@ func actionGetForecastDataVer2(rw http.ResponseWriter, r *http.Request) {
 
 	// Get Forecast
 	if testOverride(deviceID) {
-		res = location.GetWeatherForecastTest(display.Category, display.ID)
+		res = location.GetWeatherForecastTest(clk, display.Category, display.ID)
 	} else {
-		res = location.GetWeatherForecastV2(display.Category, display.ID, firmwareVersion)
+		res = location.GetWeatherForecastV2(clk, display.Category, display.ID, firmwareVersion)
 	}
 
 	// Update Device Request Details
-	updateDeviceRequestEntry(deviceID)
+	updateDeviceRequestEntry(clk, deviceID)
 
 	// syncElixirBackend
 	syncElixirBackend(display)
 
 	// Return response
-	io.WriteString(rw, res)
+	writeForecastResponse(rw, r, res, weather_api.LegacyForecastETag(res))
 }
 
 // ----------------------------------------------
 // @actionGetForecastDataJson - nullable support with json payload.
 // [GET] /api/v2.2/forecast/id/{id}
 // ----------------------------------------------
-func actionGetForecastDataJson(rw http.ResponseWriter, r *http.Request) {
-	var res string
+func actionGetForecastDataJson(clk clock.Clock, rw http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	deviceID := vars["id"]
 	(rw).Header().Set("Content-Type", "application/json")
@@ -393,113 +394,54 @@ func actionGetForecastDataJson(rw http.ResponseWriter, r *http.Request) {
 		version = version + "e"
 	}
 
+	var forecast weather_api.ApiResponseInterface
 	if testOverride(deviceID) {
 		// NYI, need json formatter. res = location.GetWeatherForecastTest(display.Category, display.ID)
-		res, _ = location.NullableGetWeatherForecastJson(display.Category, display.ID, firmwareVersion, callSubVersion).JsonResponse(version)
+		forecast = location.NullableGetWeatherForecastJson(clk, display.Category, display.ID, firmwareVersion, callSubVersion)
 	} else {
-		res, _ = location.NullableGetWeatherForecastJson(display.Category, display.ID, firmwareVersion, callSubVersion).JsonResponse(version)
+		forecast = location.NullableGetWeatherForecastJson(clk, display.Category, display.ID, firmwareVersion, callSubVersion)
 	}
 
 	// Update Device Request Details
-	updateDeviceRequestEntry(deviceID)
+	updateDeviceRequestEntry(clk, deviceID)
 
 	// syncElixirBackend
 	syncElixirBackend(display)
 
 	// Return response
-	io.WriteString(rw, res)
+	writeForecastJsonResponse(rw, r, forecast, version)
+}
+
+// ----------------------------------------------
+// @actionGetSectionsForecastDataJson - json payload limited to the requested sections.
+// [GET] /api/v2.3/forecast/id/{id}?sections=today,daily,hourly,current&days=N&hours=N
+// ----------------------------------------------
+func actionGetSectionsForecastDataJson(clk clock.Clock, rw http.ResponseWriter, r *http.Request) {
+	serveForecastSectionsJson(clk, rw, r, nil, true)
 }
 
 // ----------------------------------------------
 // @actionGetHourlyForecastDataJson - nullable support with json payload.
 // [GET] /api/v2.3/forecast/id/{id}/hourly
 // ----------------------------------------------
-func actionGetHourlyForecastDataJson(rw http.ResponseWriter, r *http.Request) {
-	var res string
-	vars := mux.Vars(r)
-	deviceID := vars["id"]
-	(rw).Header().Set("Content-Type", "application/json")
-
-	// Pending
-	// scriptOverride := strings.TrimSpace(r.FormValue("s"))
-	// timeStamp := strings.TrimSpace(r.FormValue("t"))
-	firmwareVersion := strings.TrimSpace(r.FormValue("fw"))
-	callSubVersion := strings.TrimSpace(r.FormValue("v"))
-	i8nSet := strings.TrimSpace(r.FormValue("i8nV"))
-
-	// 1. Check for unsupported devices
-	if !supportedDevice(deviceID) {
-		io.WriteString(rw, "device blocked")
-		return
-	}
-
-	// Load device from Redis
-	display, anonymous, err := getDevice(deviceID)
-	if err != nil {
-		// No data found from the cache
-		io.WriteString(rw, "device not found")
-		return
-	}
-
-	// HMAC digest check
-	err = hmacCheck(r, display.PSK)
-	if err != nil {
-		io.WriteString(rw, "{\"anonymous\": true, \"error\": true, \"msg\": \""+err.Error()+"\"}")
-		return
-	}
-
-	// Check for Anonymous
-	if anonymous {
-		io.WriteString(rw, "{\"anonymous\": true}")
-		return
-	}
-
-	// Load Location Information
-	var location weather_api.PostalCodeResponse
-	location, err = getDeviceLocation(display)
-	if err != nil {
-		//res = "Location " + display.Geo.ACWKey + "|" + display.Geo.Zip + " : " + display.Geo.CountryCode + " Not found"
-		log.Printf("Location %s,%s,%s not found, device : %s", display.Geo.ACWKey, display.Geo.Zip, display.Geo.CountryCode, deviceID)
-		log.Printf(err.Error())
-		log.Printf("Device: %+v\n", display)
-		return
-	}
-
-	// Get Forecast
-	version := "1.4"
-	if callSubVersion == "3" {
-		version = "1.5"
-	}
-	if callSubVersion == "4" {
-		version = "1.3"
-	}
-
-	if i8nSet == "2" {
-		version = version + "e"
-	}
-
-	if testOverride(deviceID) {
-		res, _ = location.NullableGetWeatherForecastJsonExtended(display.Category, display.ID, firmwareVersion, callSubVersion, false, false, true, false).JsonResponse(version)
-	} else {
-		res, _ = location.NullableGetWeatherForecastJsonExtended(display.Category, display.ID, firmwareVersion, callSubVersion, false, false, true, false).JsonResponse(version)
-	}
-
-	// Update Device Request Details
-	// updateDeviceRequestEntry(deviceID)
-
-	// syncElixirBackend
-	// syncElixirBackend(display)
-
-	// Return response
-	io.WriteString(rw, res)
+func actionGetHourlyForecastDataJson(clk clock.Clock, rw http.ResponseWriter, r *http.Request) {
+	serveForecastSectionsJson(clk, rw, r, []string{weather_api.ForecastSectionHourly}, false)
 }
 
 // ----------------------------------------------
 // @actionGetDailyForecastDataJson - nullable support with json payload.
-// [GET] /api/v2.3/forecast/id/{id}/hourly
+// [GET] /api/v2.3/forecast/id/{id}/daily
 // ----------------------------------------------
-func actionGetDailyForecastDataJson(rw http.ResponseWriter, r *http.Request) {
-	var res string
+func actionGetDailyForecastDataJson(clk clock.Clock, rw http.ResponseWriter, r *http.Request) {
+	serveForecastSectionsJson(clk, rw, r, []string{weather_api.ForecastSectionDaily, weather_api.ForecastSectionCurrent}, true)
+}
+
+// ----------------------------------------------
+// @serveForecastSectionsJson
+// Shared v2.3 handler. preset lists the sections served when the query has
+// no sections=, nil means every section allowed for the device category.
+// ----------------------------------------------
+func serveForecastSectionsJson(clk clock.Clock, rw http.ResponseWriter, r *http.Request, preset []string, trackRequest bool) {
 	vars := mux.Vars(r)
 	deviceID := vars["id"]
 	(rw).Header().Set("Content-Type", "application/json")
@@ -538,6 +480,16 @@ func actionGetDailyForecastDataJson(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Sections
+	if preset == nil {
+		preset = weather_api.AllowedForecastSections(display.Category)
+	}
+	sections, err := weather_api.ParseForecastSections(display.Category, r.FormValue("sections"), r.FormValue("days"), r.FormValue("hours"), weather_api.PresetForecastSections(callSubVersion, preset))
+	if err != nil {
+		sendApiOutcomeResponse(rw, http.StatusBadRequest, err)
+		return
+	}
+
 	// Load Location Information
 	var location weather_api.PostalCodeResponse
 	location, err = getDeviceLocation(display)
@@ -562,20 +514,18 @@ func actionGetDailyForecastDataJson(rw http.ResponseWriter, r *http.Request) {
 		version = version + "e"
 	}
 
-	if testOverride(deviceID) {
-		res, _ = location.NullableGetWeatherForecastJsonExtended(display.Category, display.ID, firmwareVersion, callSubVersion, false, true, false, true).JsonResponse(version)
-	} else {
-		res, _ = location.NullableGetWeatherForecastJsonExtended(display.Category, display.ID, firmwareVersion, callSubVersion, false, true, false, true).JsonResponse(version)
-	}
+	forecast := location.NullableGetWeatherForecastJsonSections(clk, display.Category, display.ID, firmwareVersion, sections)
 
-	// Update Device Request Details
-	updateDeviceRequestEntry(deviceID)
+	if trackRequest {
+		// Update Device Request Details
+		updateDeviceRequestEntry(clk, deviceID)
 
-	// syncElixirBackend
-	syncElixirBackend(display)
+		// syncElixirBackend
+		syncElixirBackend(display)
+	}
 
 	// Return response
-	io.WriteString(rw, res)
+	writeForecastJsonResponse(rw, r, forecast, version)
 }
 
 // ----------------------------------------------
@@ -583,7 +533,7 @@ func actionGetDailyForecastDataJson(rw http.ResponseWriter, r *http.Request) {
 // [GET] /api/v2.0/forecast/test/id/{id}
 // ----------------------------------------------
 // API for test device forecast data see ticket https://github.com/lacrossetech/weather-service/issues/16
-func actionGetTestForecastData(rw http.ResponseWriter, r *http.Request) {
+func actionGetTestForecastData(clk clock.Clock, rw http.ResponseWriter, r *http.Request) {
 	var res string
 	vars := mux.Vars(r)
 	deviceID := vars["id"]
@@ -627,17 +577,17 @@ func actionGetTestForecastData(rw http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get Forecast
-	res = location.GetWeatherForecastTest(display.Category, display.ID)
+	res = location.GetWeatherForecastTest(clk, display.Category, display.ID)
 
 	// Return response
-	io.WriteString(rw, res)
+	writeForecastResponse(rw, r, res, weather_api.LegacyForecastETag(res))
 }
 
 // ----------------------------------------------
 // @actionGetForecastDataStreams
 // [GET] /api/v1.1/forecast/data-streams/id/{id}
 // ----------------------------------------------
-func actionGetForecastDataStreams(rw http.ResponseWriter, r *http.Request) {
+func actionGetForecastDataStreams(clk clock.Clock, rw http.ResponseWriter, r *http.Request) {
 	var res string
 	vars := mux.Vars(r)
 	deviceID := vars["id"]
@@ -685,8 +635,27 @@ func actionGetForecastDataStreams(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res = location.GetWeatherForecast(display.Category, display.ID, "DATASTREAMS", firmwareVersion)
-	io.WriteString(rw, res)
+	res = location.GetWeatherForecast(clk, display.Category, display.ID, "DATASTREAMS", firmwareVersion)
+	writeForecastResponse(rw, r, res, weather_api.LegacyForecastETag(res))
+}
+
+// ----------------------------------------------
+// @actionGetCompactDictionary
+// [GET] /api/v2.2/forecast/dictionary/{version}
+// Short-key dictionary of the CBOR / MessagePack responses.
+// ----------------------------------------------
+func actionGetCompactDictionary(rw http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	version := strings.TrimSpace(vars["version"])
+
+	dictionary, err := weather_api.CompactDictionary(version)
+	if err != nil {
+		sendApiOutcomeResponse(rw, http.StatusNotFound, err)
+		return
+	}
+
+	(rw).Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(dictionary)
 }
 
 // ----------------------------------------------
@@ -750,12 +719,13 @@ func actionGetLocationByCityOrPostalCode(rw http.ResponseWriter, r *http.Request
 // @actionSetDeviceLocation
 // [PUT,POST] /api/v1.1/forecast/client/location/device/{device_id}
 // ----------------------------------------------
-func actionSetDeviceLocation(rw http.ResponseWriter, r *http.Request) {
+func actionSetDeviceLocation(clk clock.Clock, rw http.ResponseWriter, r *http.Request) {
 
 	vars := mux.Vars(r)
 	deviceID := strings.TrimSpace(vars["device_id"])
 
-	if isTokenValid(r) == false {
+	uid, valid := verifyToken(r)
+	if valid == false {
 		sendApiOutcomeResponse(rw, http.StatusUnauthorized, errors.New("Wrong bearer token"))
 		log.Printf("handleDeviceLocationUpdate error wrong barreer token for device %s", deviceID)
 		return
@@ -779,56 +749,22 @@ func actionSetDeviceLocation(rw http.ResponseWriter, r *http.Request) {
 	}
 	log.Printf("handleDeviceLocationUpdate Device received from the request: %+v\n device: %s", dl, deviceID)
 
-	// Get the device from cache
-	key := "device:" + deviceID
-	redisInstance := &cache.RedisInstance{RedisSession: common.RedisClient}
-	data, err := redisInstance.GetCachedData(key)
-	var d device.Device
-	if err == nil {
-		json.Unmarshal(data, &d)
-	} else {
+	// Update the device location, the accuweather lookup stays out of the retried update
+	var previous device.Geo
+	isCity := deviceLocationIsCity(dl)
+	d, err := device.UpdateDevice(deviceID, func(d *device.Device) error {
+		previous = d.Geo
+		return applyDeviceLocation(d, dl, isCity)
+	})
+	if err == device.ErrDeviceNotFound {
 		sendApiOutcomeResponse(rw, http.StatusInternalServerError, errors.New("Wrong device ID"))
 		log.Printf("handleDeviceLocationUpdate error device %s not found", deviceID)
 		return
-	}
-
-	// Set new location values
-	if strings.TrimSpace(dl.CountryCode) == "" && strings.TrimSpace(dl.PostalCode) == "" && strings.TrimSpace(dl.ACWKey) == "" && strings.TrimSpace(dl.CityOrPostalCode) == "" {
-		d.Geo.Anonymous = true
-	} else if strings.TrimSpace(dl.CountryCode) == "" || (strings.TrimSpace(dl.PostalCode) == "" && strings.TrimSpace(dl.CityOrPostalCode) == "") || strings.TrimSpace(dl.ACWKey) == "" {
-		sendApiOutcomeResponse(rw, http.StatusInternalServerError, errors.New("Wrong values provided, must me either all null(anonymous) or all not null"))
-		return
-	} else {
-		d.Geo.Anonymous = false
-	}
-
-	d.Geo.CountryCode = dl.CountryCode
-	if strings.TrimSpace(dl.CityOrPostalCode) != "" {
-		location, _ := weather_api.GetLocationFromPC(dl.ACWKey)
-		if location.Type == weather_api.LocationTypeCity {
-			d.Geo.City = dl.CityOrPostalCode
-			d.Geo.Zip = ""
-		} else {
-			d.Geo.Zip = dl.CityOrPostalCode
-			d.Geo.City = ""
-		}
-	} else {
-		d.Geo.Zip = dl.PostalCode
-		d.Geo.City = ""
-	}
-
-	// Reset the geo refresh count because the user location has changed
-	d.GeoRefreshCount = 0
-
-	d.Geo.ACWKey = dl.ACWKey
-	// Save the device information into the cache
-
-	dataBytes, _ := json.Marshal(d)
-	err = redisInstance.SaveRedisData(dataBytes, key, 0)
-	if err != nil {
+	} else if err != nil {
 		sendApiOutcomeResponse(rw, http.StatusInternalServerError, err)
 		return
 	}
+	device.RecordLocationChange(clk, deviceID, device.LocationSourceClient, uid, previous, d.Geo)
 
 	sendApiOutcomeResponse(rw, http.StatusOK, nil)
 
@@ -850,7 +786,7 @@ func actionDisplayCheckPage(rw http.ResponseWriter, r *http.Request) {
 // @actionAdminGetForecastData
 // [GET] /api/v1.1/forecast/admin/id/{id}
 // ----------------------------------------------
-func actionAdminGetForecastData(rw http.ResponseWriter, r *http.Request) {
+func actionAdminGetForecastData(clk clock.Clock, rw http.ResponseWriter, r *http.Request) {
 	setResponseHeaders(&rw, r)
 	if (*r).Method == "OPTIONS" {
 		return
@@ -894,7 +830,7 @@ func actionAdminGetForecastData(rw http.ResponseWriter, r *http.Request) {
 
 	// Grab Forecast
 	if details == "true" {
-		res.Forecast = location.GetWeatherForecast(display.Category, display.ID, "BASIC", firmwareVersion)
+		res.Forecast = location.GetWeatherForecast(clk, display.Category, display.ID, "BASIC", firmwareVersion)
 	}
 
 	json.NewEncoder(rw).Encode(res)
@@ -904,7 +840,7 @@ func actionAdminGetForecastData(rw http.ResponseWriter, r *http.Request) {
 // @actionAdminGetForecastDataVer2
 // [GET] /api/v2.0/forecast/admin/id/{id}
 // ----------------------------------------------
-func actionAdminGetForecastDataVer2(rw http.ResponseWriter, r *http.Request) {
+func actionAdminGetForecastDataVer2(clk clock.Clock, rw http.ResponseWriter, r *http.Request) {
 	setResponseHeaders(&rw, r)
 	if (*r).Method == "OPTIONS" {
 		return
@@ -949,7 +885,7 @@ func actionAdminGetForecastDataVer2(rw http.ResponseWriter, r *http.Request) {
 	// Grab Forecast
 	if details == "true" {
 		// Get Extended Info
-		res.Forecast = location.GetWeatherForecastV2(display.Category, display.ID, firmwareVersion)
+		res.Forecast = location.GetWeatherForecastV2(clk, display.Category, display.ID, firmwareVersion)
 	}
 
 	json.NewEncoder(rw).Encode(res)
@@ -959,7 +895,7 @@ func actionAdminGetForecastDataVer2(rw http.ResponseWriter, r *http.Request) {
 // @actionAdminGetForecastDataJson
 // [GET] /api/v2.2/forecast/admin/id/{id}
 // ----------------------------------------------
-func actionAdminGetForecastDataJson(rw http.ResponseWriter, r *http.Request) {
+func actionAdminGetForecastDataJson(clk clock.Clock, rw http.ResponseWriter, r *http.Request) {
 	setResponseHeaders(&rw, r)
 	if (*r).Method == "OPTIONS" {
 		return
@@ -1010,7 +946,7 @@ func actionAdminGetForecastDataJson(rw http.ResponseWriter, r *http.Request) {
 	// Grab Forecast
 	if details == "true" {
 		//json, _ := location.NullableGetWeatherForecastJson(display.Category, display.ID, "BASIC").JsonResponse("1.2")
-		res.Forecast = location.NullableGetWeatherForecastJson(display.Category, display.ID, firmwareVersion, callSubVersion)
+		res.Forecast = location.NullableGetWeatherForecastJson(clk, display.Category, display.ID, firmwareVersion, callSubVersion)
 	}
 
 	if version == "" {
@@ -1033,7 +969,7 @@ func actionAdminGetForecastDataJson(rw http.ResponseWriter, r *http.Request) {
 // @actionAdminUpdateDeviceLocation
 // [PUT,POST] /api/v1.1/forecast/admin/location/device/{device_id}
 // ----------------------------------------------
-func actionAdminUpdateDeviceLocation(rw http.ResponseWriter, r *http.Request) {
+func actionAdminUpdateDeviceLocation(clk clock.Clock, rw http.ResponseWriter, r *http.Request) {
 	setResponseHeaders(&rw, r)
 	if (*r).Method == "OPTIONS" {
 		return
@@ -1041,13 +977,14 @@ func actionAdminUpdateDeviceLocation(rw http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	deviceID := strings.TrimSpace(vars["device_id"])
 
-	if isTokenValid(r) == false {
+	uid, valid := verifyToken(r)
+	if valid == false {
 		sendApiOutcomeResponse(rw, http.StatusUnauthorized, errors.New("Wrong bearer token"))
 		log.Printf("handleDeviceLocationUpdate error wrong barreer token for device %s", deviceID)
 		return
 	}
 
-	err := deviceLocationUpdate(r, deviceID)
+	err := deviceLocationUpdate(clk, r, deviceID, uid)
 
 	if err != nil {
 		sendApiOutcomeResponse(rw, http.StatusInternalServerError, err)
@@ -1056,6 +993,210 @@ func actionAdminUpdateDeviceLocation(rw http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// ----------------------------------------------
+// @actionAdminGetDeviceAttributes
+// [GET] /api/v1.1/forecast/admin/attributes/device/{device_id}
+// ----------------------------------------------
+func actionAdminGetDeviceAttributes(rw http.ResponseWriter, r *http.Request) {
+	setResponseHeaders(&rw, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+	(rw).Header().Set("Content-Type", "application/json")
+
+	if isTokenValid(r) == false {
+		sendApiOutcomeResponse(rw, http.StatusUnauthorized, errors.New("Wrong bearer token"))
+		return
+	}
+
+	vars := mux.Vars(r)
+	deviceID := strings.TrimSpace(vars["device_id"])
+
+	extendedInfo, err := device.GetExtendedDeviceInfo(deviceID)
+	if err != nil {
+		sendApiOutcomeResponse(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	json.NewEncoder(rw).Encode(extendedInfo)
+}
+
+// ----------------------------------------------
+// @actionAdminSetDeviceAttributes
+// [PUT,PATCH] /api/v1.1/forecast/admin/attributes/device/{device_id}
+// Body: device.AttributeUpdate, e.g. {"time-loop": 3, "time-loop.offset": 0}
+// ----------------------------------------------
+func actionAdminSetDeviceAttributes(rw http.ResponseWriter, r *http.Request) {
+	setResponseHeaders(&rw, r)
+	(rw).Header().Set("Content-Type", "application/json")
+
+	if isTokenValid(r) == false {
+		sendApiOutcomeResponse(rw, http.StatusUnauthorized, errors.New("Wrong bearer token"))
+		return
+	}
+
+	vars := mux.Vars(r)
+	deviceID := strings.TrimSpace(vars["device_id"])
+
+	var update device.AttributeUpdate
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&update); err != nil {
+		sendApiOutcomeResponse(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	extendedInfo, err := device.SetDeviceAttributes(deviceID, update.Attributes())
+	if err == device.ErrDeviceNotFound {
+		sendApiOutcomeResponse(rw, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		sendApiOutcomeResponse(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	// Let the other services refresh their copy
+	publishAttrSync(deviceID)
+
+	json.NewEncoder(rw).Encode(extendedInfo)
+}
+
+// ----------------------------------------------
+// @actionAdminDeviceTimeline
+// [GET,PUT,DELETE] /api/v1.1/forecast/admin/timeline/device/{device_id}
+// Scripted clock used when the device time-loop attribute is the backend driver mode
+// PUT body: {"start": 0, "loop": true, "steps": [{"at": 1572760800, "duration": 600}, {"offset": -3600, "duration": 300}]}
+// ----------------------------------------------
+func actionAdminDeviceTimeline(clk clock.Clock, rw http.ResponseWriter, r *http.Request) {
+	setResponseHeaders(&rw, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+	(rw).Header().Set("Content-Type", "application/json")
+
+	if isTokenValid(r) == false {
+		sendApiOutcomeResponse(rw, http.StatusUnauthorized, errors.New("Wrong bearer token"))
+		return
+	}
+
+	vars := mux.Vars(r)
+	deviceID := strings.TrimSpace(vars["device_id"])
+
+	switch r.Method {
+	case "PUT":
+		var timeline device.ClockTimeline
+		if err := json.NewDecoder(r.Body).Decode(&timeline); err != nil {
+			sendApiOutcomeResponse(rw, http.StatusBadRequest, err)
+			return
+		}
+		timeline, err := device.SetClockTimeline(clk, deviceID, timeline)
+		if err != nil {
+			sendApiOutcomeResponse(rw, http.StatusBadRequest, err)
+			return
+		}
+		json.NewEncoder(rw).Encode(timeline)
+
+	case "DELETE":
+		if err := device.DeleteClockTimeline(deviceID); err != nil {
+			sendApiOutcomeResponse(rw, http.StatusInternalServerError, err)
+			return
+		}
+		sendApiOutcomeResponse(rw, http.StatusOK, nil)
+
+	default:
+		timeline, err := device.GetClockTimeline(deviceID)
+		if err != nil {
+			sendApiOutcomeResponse(rw, http.StatusInternalServerError, err)
+			return
+		}
+		if timeline == nil {
+			sendApiOutcomeResponse(rw, http.StatusNotFound, errors.New("No timeline for device "+deviceID))
+			return
+		}
+		json.NewEncoder(rw).Encode(timeline)
+	}
+}
+
+// ----------------------------------------------
+// @actionAdminGetScenarios
+// [GET] /api/v1.1/forecast/admin/scenarios
+// Names of the forecast scenarios loaded from the scenario folder
+// ----------------------------------------------
+func actionAdminGetScenarios(rw http.ResponseWriter, r *http.Request) {
+	setResponseHeaders(&rw, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+	(rw).Header().Set("Content-Type", "application/json")
+
+	if isTokenValid(r) == false {
+		sendApiOutcomeResponse(rw, http.StatusUnauthorized, errors.New("Wrong bearer token"))
+		return
+	}
+
+	json.NewEncoder(rw).Encode(weather_api.Scenarios.Names())
+}
+
+// ----------------------------------------------
+// @actionAdminDeviceScenario
+// [GET,PUT,DELETE] /api/v1.1/forecast/admin/scenario/device/{device_id}
+// Scenario played when the device forecast-script attribute is the backend driver mode
+// PUT body: {"name": "blizzard", "start": 0}
+// ----------------------------------------------
+func actionAdminDeviceScenario(clk clock.Clock, rw http.ResponseWriter, r *http.Request) {
+	setResponseHeaders(&rw, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+	(rw).Header().Set("Content-Type", "application/json")
+
+	if isTokenValid(r) == false {
+		sendApiOutcomeResponse(rw, http.StatusUnauthorized, errors.New("Wrong bearer token"))
+		return
+	}
+
+	vars := mux.Vars(r)
+	deviceID := strings.TrimSpace(vars["device_id"])
+
+	switch r.Method {
+	case "PUT":
+		var assignment device.ScenarioAssignment
+		if err := json.NewDecoder(r.Body).Decode(&assignment); err != nil {
+			sendApiOutcomeResponse(rw, http.StatusBadRequest, err)
+			return
+		}
+		if _, ok := weather_api.Scenarios.Get(strings.TrimSpace(assignment.Name)); !ok {
+			sendApiOutcomeResponse(rw, http.StatusBadRequest, errors.New("Unknown scenario "+assignment.Name))
+			return
+		}
+		assignment, err := device.SetScenarioAssignment(clk, deviceID, assignment)
+		if err != nil {
+			sendApiOutcomeResponse(rw, http.StatusBadRequest, err)
+			return
+		}
+		json.NewEncoder(rw).Encode(assignment)
+
+	case "DELETE":
+		if err := device.DeleteScenarioAssignment(deviceID); err != nil {
+			sendApiOutcomeResponse(rw, http.StatusInternalServerError, err)
+			return
+		}
+		sendApiOutcomeResponse(rw, http.StatusOK, nil)
+
+	default:
+		assignment, err := device.GetScenarioAssignment(deviceID)
+		if err != nil {
+			sendApiOutcomeResponse(rw, http.StatusInternalServerError, err)
+			return
+		}
+		if assignment == nil {
+			sendApiOutcomeResponse(rw, http.StatusNotFound, errors.New("No scenario for device "+deviceID))
+			return
+		}
+		json.NewEncoder(rw).Encode(assignment)
+	}
+}
+
 // ----------------------------------------------
 // @actionAdminGetCategoryRanges
 // [GET] /api/v1.1/forecast/admin/getRanges/WeatherService/{cat_type}
@@ -1074,13 +1215,143 @@ func actionAdminGetCategoryRanges(rw http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	cat_type := strings.TrimSpace(vars["cat_type"])
 
-	catList := device.LoadCategoryConf("/conf/categories.json")
-	ranges := catList.GetDeviceCatRanges(cat_type)
+	ranges := device.Categories.GetDeviceCatRanges(cat_type)
 
 	json.NewEncoder(rw).Encode(ranges)
 
 }
 
+// ----------------------------------------------
+// @actionAdminGetCategories
+// [GET] /api/v1.1/forecast/admin/categories
+// ----------------------------------------------
+func actionAdminGetCategories(rw http.ResponseWriter, r *http.Request) {
+	setResponseHeaders(&rw, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+	(rw).Header().Set("Content-Type", "application/json")
+
+	if isTokenValid(r) == false {
+		sendApiOutcomeResponse(rw, http.StatusUnauthorized, errors.New("Wrong bearer token"))
+		return
+	}
+
+	json.NewEncoder(rw).Encode(device.Categories.List())
+}
+
+// ----------------------------------------------
+// @actionAdminSetCategoryRanges
+// [PUT,DELETE] /api/v1.1/forecast/admin/categories/{cat_type}
+// PUT body: [{"min":"280001","max":"280865"}, ...]
+// ----------------------------------------------
+func actionAdminSetCategoryRanges(rw http.ResponseWriter, r *http.Request) {
+	setResponseHeaders(&rw, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+	(rw).Header().Set("Content-Type", "application/json")
+
+	if isTokenValid(r) == false {
+		sendApiOutcomeResponse(rw, http.StatusUnauthorized, errors.New("Wrong bearer token"))
+		return
+	}
+
+	vars := mux.Vars(r)
+	cat_type := strings.TrimSpace(vars["cat_type"])
+
+	var ranges []device.CategoryRange
+	if r.Method != "DELETE" {
+		if err := json.NewDecoder(r.Body).Decode(&ranges); err != nil {
+			sendApiOutcomeResponse(rw, http.StatusBadRequest, err)
+			return
+		}
+		if len(ranges) == 0 {
+			sendApiOutcomeResponse(rw, http.StatusBadRequest, errors.New("at least one range is required, use DELETE to remove a category"))
+			return
+		}
+	}
+
+	// Invalid or overlapping ranges leave the shared ranges untouched
+	err := device.Categories.SetCategoryRanges(cat_type, ranges)
+	if err != nil {
+		sendApiOutcomeResponse(rw, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	// Apply the new ranges to the cached devices
+	reassigned, err := device.ReassignDeviceCategories()
+	if err != nil {
+		sendApiOutcomeResponse(rw, http.StatusInternalServerError, err)
+		return
+	}
+	log.Printf("Category %s updated, %d devices reassigned", cat_type, reassigned)
+
+	json.NewEncoder(rw).Encode(ReplyMessage{Code: http.StatusOK, Message: map[string]int{"reassigned": reassigned}})
+}
+
+// ----------------------------------------------
+// @actionAdminReloadTemplates
+// [POST] /api/v1.1/forecast/admin/templates/reload
+// ----------------------------------------------
+func actionAdminReloadTemplates(rw http.ResponseWriter, r *http.Request) {
+	setResponseHeaders(&rw, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+
+	if isTokenValid(r) == false {
+		sendApiOutcomeResponse(rw, http.StatusUnauthorized, errors.New("Wrong bearer token"))
+		return
+	}
+
+	// Templates that fail to parse keep serving their previous version
+	err := weather_api.Templates.Reload()
+	if err != nil {
+		sendApiOutcomeResponse(rw, http.StatusUnprocessableEntity, err)
+		return
+	}
+	sendApiOutcomeResponse(rw, http.StatusOK, nil)
+}
+
+// ----------------------------------------------
+// @actionAdminGetDeviceLocationHistory
+// [GET] /api/v1.1/forecast/admin/location/device/{device_id}/history
+// ----------------------------------------------
+func actionAdminGetDeviceLocationHistory(rw http.ResponseWriter, r *http.Request) {
+	setResponseHeaders(&rw, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+	(rw).Header().Set("Content-Type", "application/json")
+
+	if isTokenValid(r) == false {
+		sendApiOutcomeResponse(rw, http.StatusUnauthorized, errors.New("Wrong bearer token"))
+		return
+	}
+
+	vars := mux.Vars(r)
+	deviceID := strings.TrimSpace(vars["device_id"])
+
+	limit := 0
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			sendApiOutcomeResponse(rw, http.StatusBadRequest, errors.New("limit must be a positive number"))
+			return
+		}
+		limit = n
+	}
+
+	history, err := device.GetLocationHistory(deviceID, limit)
+	if err != nil {
+		sendApiOutcomeResponse(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	json.NewEncoder(rw).Encode(history)
+}
+
 //==============================================
 // Functions - Support
 //==============================================
@@ -1123,11 +1394,74 @@ func sendApiOutcomeResponse(w http.ResponseWriter, code int, err error) {
 	json.NewEncoder(w).Encode(res)
 }
 
+// ----------------------------------------------
+// @writeForecastJsonResponse
+// Json forecast, or its CBOR / MessagePack encoding when the display asks
+// for one in the Accept header.
+// ----------------------------------------------
+func writeForecastJsonResponse(rw http.ResponseWriter, r *http.Request, forecast weather_api.ApiResponseInterface, version string) {
+	etag := weather_api.ForecastETag(forecast, version)
+	rw.Header().Add("Vary", "Accept")
+
+	encoding := weather_api.CompactEncodingFromAccept(r.Header.Get("Accept"))
+	if encoding != "" {
+		payload, err := weather_api.CompactResponse(forecast, version, encoding)
+		if err == nil {
+			rw.Header().Set("Content-Type", weather_api.CompactContentType(encoding))
+			if etag != "" {
+				etag = strings.TrimSuffix(etag, "\"") + "-" + encoding + "\""
+			}
+			writeForecastResponse(rw, r, string(payload), etag)
+			return
+		}
+		log.Printf("[writeForecastJsonResponse] %s encoding failed, falling back to json: %s", encoding, err.Error())
+	}
+
+	res, _ := forecast.JsonResponse(version)
+	writeForecastResponse(rw, r, res, etag)
+}
+
+// ----------------------------------------------
+// @writeForecastResponse
+// Sets the forecast ETag and answers 304 Not Modified when the display
+// already holds the same payload (If-None-Match).
+// ----------------------------------------------
+func writeForecastResponse(rw http.ResponseWriter, r *http.Request, res string, etag string) {
+	if etag != "" {
+		rw.Header().Set("ETag", etag)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	io.WriteString(rw, res)
+}
+
+// ----------------------------------------------
+// @etagMatches
+// Weak comparison of an If-None-Match header against the current ETag.
+// ----------------------------------------------
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if strings.TrimSpace(ifNoneMatch) == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
 // ----------------------------------------------
 // @deviceLocationUpdate
 // ----------------------------------------------
 // This function should also be used by the handleDeviceLocationUpdate call
-func deviceLocationUpdate(r *http.Request, deviceID string) error {
+func deviceLocationUpdate(clk clock.Clock, r *http.Request, deviceID string, actor string) error {
 
 	// Get the request body
 	body, err := ioutil.ReadAll(r.Body)
@@ -1145,17 +1479,29 @@ func deviceLocationUpdate(r *http.Request, deviceID string) error {
 	}
 	log.Printf("handleDeviceLocationUpdate Device received from the request: %+v\n device: %s", dl, deviceID)
 
-	// Get the device from cache
-	key := "device:" + deviceID
-	redisInstance := &cache.RedisInstance{RedisSession: common.RedisClient}
-	data, err := redisInstance.GetCachedData(key)
-	var d device.Device
-	if err == nil {
-		json.Unmarshal(data, &d)
-	} else {
+	// Update the device location, the accuweather lookup stays out of the retried update
+	var previous device.Geo
+	isCity := deviceLocationIsCity(dl)
+	d, err := device.UpdateDevice(deviceID, func(d *device.Device) error {
+		previous = d.Geo
+		return applyDeviceLocation(d, dl, isCity)
+	})
+	if err == device.ErrDeviceNotFound {
 		log.Printf("handleDeviceLocationUpdate error device %s not found", deviceID)
 		return err
+	} else if err != nil {
+		return err
 	}
+	device.RecordLocationChange(clk, deviceID, device.LocationSourceAdmin, actor, previous, d.Geo)
+
+	return nil
+}
+
+// ----------------------------------------------
+// @applyDeviceLocation
+// Sets the requested location on the device record, runs inside UpdateDevice
+// ----------------------------------------------
+func applyDeviceLocation(d *device.Device, dl DeviceLocation, isCity bool) error {
 
 	// Set new location values
 	if strings.TrimSpace(dl.CountryCode) == "" && strings.TrimSpace(dl.PostalCode) == "" && strings.TrimSpace(dl.ACWKey) == "" && strings.TrimSpace(dl.CityOrPostalCode) == "" {
@@ -1168,8 +1514,7 @@ func deviceLocationUpdate(r *http.Request, deviceID string) error {
 
 	d.Geo.CountryCode = dl.CountryCode
 	if strings.TrimSpace(dl.CityOrPostalCode) != "" {
-		location, _ := weather_api.GetLocationFromPC(dl.ACWKey)
-		if location.Type == weather_api.LocationTypeCity {
+		if isCity {
 			d.Geo.City = dl.CityOrPostalCode
 			d.Geo.Zip = ""
 		} else {
@@ -1185,15 +1530,36 @@ func deviceLocationUpdate(r *http.Request, deviceID string) error {
 	d.GeoRefreshCount = 0
 
 	d.Geo.ACWKey = dl.ACWKey
-	// Save the device information into the cache
+	return nil
+}
 
-	dataBytes, _ := json.Marshal(d)
-	err = redisInstance.SaveRedisData(dataBytes, key, 0)
-	if err != nil {
-		return err
+// ----------------------------------------------
+// @deviceLocationIsCity
+// True if the CityOrPostalCode of the request names a city
+// ----------------------------------------------
+func deviceLocationIsCity(dl DeviceLocation) bool {
+	if strings.TrimSpace(dl.CityOrPostalCode) == "" {
+		return false
 	}
+	location, _ := weather_api.GetLocationFromPC(dl.ACWKey)
+	return location.Type == weather_api.LocationTypeCity
+}
 
-	return nil
+// ----------------------------------------------
+// @publishAttrSync
+// Same payload as the gateway attribute notifications, see handleAttrMessage
+// ----------------------------------------------
+func publishAttrSync(deviceID string) {
+	if attrSyncTopic == nil {
+		log.Printf("publishAttrSync no topic configured, %s not published", deviceID)
+		return
+	}
+
+	data, _ := json.Marshal(device.DevicePubSub{Serial: deviceID})
+	result := attrSyncTopic.Publish(common.CTX, &pubsub.Message{Data: data})
+	if _, err := result.Get(common.CTX); err != nil {
+		log.Printf("publishAttrSync unable to publish %s| %v", deviceID, err)
+	}
 }
 
 // ----------------------------------------------
@@ -1229,8 +1595,18 @@ func hmacCheck(r *http.Request, psk string) error {
 // We are expecting the token to be passed to Authorization header, on the format : "Barrear <Token>"
 // ----------------------------------------------
 func isTokenValid(r *http.Request) bool {
+	_, valid := verifyToken(r)
+	return valid
+}
+
+// ----------------------------------------------
+// @verifyToken
+// Same as isTokenValid, also returns the token UID
+// ----------------------------------------------
+func verifyToken(r *http.Request) (string, bool) {
 
 	valid := false
+	uid := ""
 
 	tokenStr := r.Header.Get("Authorization")
 	userAgent := r.Header.Get("User-Agent")
@@ -1238,19 +1614,20 @@ func isTokenValid(r *http.Request) bool {
 	tokenArr := strings.Split(tokenStr, " ")
 	if len(tokenArr) <= 1 {
 		log.Printf("Malformed authorization header")
-		return false
+		return uid, false
 	}
 	token := strings.TrimSpace(tokenArr[1])
 
-	_, err := firebaseClient.VerifyIDToken(common.CTX, token)
+	idToken, err := firebaseClient.VerifyIDToken(common.CTX, token)
 	if err != nil {
 		log.Printf("Token ERROR %s not valid, error : %s user-agent : %s", token, err.Error(), userAgent)
 	} else {
 		log.Printf("Token Validation succeeded, user-agent : %s", userAgent)
+		uid = idToken.UID
 		valid = true
 	}
 
-	return valid
+	return uid, valid
 
 }
 
@@ -1293,24 +1670,31 @@ func supportedDevice(deviceId string) bool {
 func syncElixirBackend(display device.Device) {
 	// Tap Elixir Backend to ensure synchronization
 	if display.GeoRefreshCount >= 0 && display.GeoRefreshCount < weather_api.GEO_REFRESH_API_HIT_AMOUNT {
-		// Run the query
+		// Bump the counter on the current record, a location change may have reset it
+		bumped := false
+		_, err := device.UpdateDevice(display.ID, func(d *device.Device) error {
+			bumped = false
+			if d.GeoRefreshCount < 0 || d.GeoRefreshCount >= weather_api.GEO_REFRESH_API_HIT_AMOUNT {
+				return device.ErrNoChange
+			}
+			d.GeoRefreshCount++
+			bumped = true
+			return nil
+		})
+		if err != nil {
+			log.Printf("syncElixirBackend unable to update device %s| %v", display.ID, err)
+			return
+		}
+		if !bumped {
+			// Limit reached by a concurrent request
+			return
+		}
 
+		// Run the query
 		go tapGatewayGeo(display.ID)
-		display.GeoRefreshCount++
-		updateDevice(display)
 	}
 }
 
-// ----------------------------------------------
-//
-// ----------------------------------------------
-func updateDevice(display device.Device) error {
-	key := "device:" + display.ID
-	dataBytes, _ := json.Marshal(display)
-	redisInstance := &cache.RedisInstance{RedisSession: common.RedisClient}
-	return redisInstance.SaveRedisData(dataBytes, key, 0)
-}
-
 // ----------------------------------------------
 //
 // ----------------------------------------------
@@ -1326,48 +1710,39 @@ func testOverride(deviceId string) bool {
 //
 // ----------------------------------------------
 func getDevice(deviceId string) (device.Device, bool, error) {
-	var d device.Device
-	key := "device:" + deviceId
-	redisInstance := &cache.RedisInstance{RedisSession: common.RedisClient}
-	data, err := redisInstance.GetCachedData(key)
+	d, err := device.Store.Get(deviceId)
 
-	// No data found from the cache
+	// No device record
 	if err != nil {
 		return d, false, err
 	} else {
-		json.Unmarshal(data, &d)
-		anonymous := false
-
-		// Fix for Elixir/Appengine use of 'USA' isntead of 'US'
-		if strings.Contains(d.Geo.CountryCode, "USA") {
-			d.Geo.CountryCode = "US"
-		}
+		return d, isAnonymous(d), nil
+	}
+}
 
-		if (strings.TrimSpace(d.Geo.Zip) == "" && strings.TrimSpace(d.Geo.City) == "") || d.Geo.Anonymous == true {
-			anonymous = true
-		}
+// ----------------------------------------------
+//
+// ----------------------------------------------
+func isAnonymous(d device.Device) bool {
+	// Coordinates are enough to resolve a location
+	_, _, hasCoordinates := d.Geo.Coordinates()
 
-		return d, anonymous, nil
-	}
+	return (strings.TrimSpace(d.Geo.Zip) == "" && strings.TrimSpace(d.Geo.City) == "" && !hasCoordinates) || d.Geo.Anonymous == true
 }
 
 // ----------------------------------------------
 //
 // ----------------------------------------------
 func getDeviceLocation(display device.Device) (weather_api.PostalCodeResponse, error) {
-	if display.Geo.ACWKey != "" {
-		return weather_api.GetLocationFromPC(display.Geo.ACWKey)
-	} else {
-		return weather_api.GetLocation(strings.TrimSpace(display.Geo.Zip), strings.TrimSpace(display.Geo.CountryCode))
-	}
+	return weather_api.GetDeviceLocation(display.Geo)
 }
 
 // ----------------------------------------------
 //
 // ----------------------------------------------
-func updateDeviceRequestEntry(deviceId string) {
+func updateDeviceRequestEntry(clk clock.Clock, deviceId string) {
 	redisInstance := &cache.RedisInstance{RedisSession: common.RedisClient}
-	nowStr := time.Now().Format("02:01:2006 15:04:05")
+	nowStr := clk.Now().Format("02:01:2006 15:04:05")
 	redisInstance.SaveRedisData([]byte(nowStr), "devicerequested:"+deviceId, 0)
 }
 
@@ -0,0 +1,326 @@
+package main
+
+//----------------------------------------------
+// CopyRight 2019 La Crosse Technology, LTD.
+//----------------------------------------------
+
+//----------------------------------------------
+// Packages
+//----------------------------------------------
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/sibivishnu/Weather/common/clock"
+	"github.com/sibivishnu/Weather/common/const/device"
+	"github.com/sibivishnu/Weather/common/providers/weather_api"
+)
+
+// ----------------------------------------------
+// Constants
+// ----------------------------------------------
+const (
+	ADMIN_BATCH_MAX_DEVICES = 500 // devices per batch request
+	ADMIN_BATCH_CONCURRENCY = 8   // concurrent location / forecast loads
+)
+
+//==============================================
+// Type Definitions
+//==============================================
+
+// ----------------------------------------------
+// @AdminBatchRequest
+// Either IDs, or a filter (category / acw_key / zip + country_code) looked up
+// in the device index.
+// ----------------------------------------------
+type AdminBatchRequest struct {
+	IDs         []string `json:"ids"`
+	Category    string   `json:"category"`
+	ACWKey      string   `json:"acw_key"`
+	Zip         string   `json:"zip"`
+	CountryCode string   `json:"country_code"`
+	Details     bool     `json:"details"`
+	Version     string   `json:"version"`
+	Firmware    string   `json:"fw"`
+	SubVersion  string   `json:"v"`
+	I8nSet      string   `json:"i8nV"`
+}
+
+// ----------------------------------------------
+// @AdminBatchResponse
+// ----------------------------------------------
+type AdminBatchResponse struct {
+	Count     int                        `json:"count"`
+	Truncated bool                       `json:"truncated"`
+	Devices   map[string]json.RawMessage `json:"devices"`
+	Errors    map[string]string          `json:"errors"`
+}
+
+// ----------------------------------------------
+// @batchLocation
+// Location shared by every device with the same geo.
+// ----------------------------------------------
+type batchLocation struct {
+	once     sync.Once
+	location weather_api.PostalCodeResponse
+	err      error
+}
+
+// ----------------------------------------------
+// @batchForecast
+// Forecast shared by every device with the same location and category.
+// ----------------------------------------------
+type batchForecast struct {
+	once     sync.Once
+	forecast weather_api.ApiResponseInterface
+}
+
+//==============================================
+// Functions - Api Actions
+//==============================================
+
+// ----------------------------------------------
+// @actionAdminBatchForecastData
+// [POST] /api/v2.2/forecast/admin/batch
+// ----------------------------------------------
+func actionAdminBatchForecastData(clk clock.Clock, rw http.ResponseWriter, r *http.Request) {
+	setResponseHeaders(&rw, r)
+	if (*r).Method == "OPTIONS" {
+		return
+	}
+	(rw).Header().Set("Content-Type", "application/json")
+
+	if isTokenValid(r) == false {
+		sendApiOutcomeResponse(rw, http.StatusUnauthorized, errors.New("Wrong bearer token"))
+		return
+	}
+
+	var req AdminBatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendApiOutcomeResponse(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	if len(req.IDs) == 0 && req.Category == "" && req.ACWKey == "" && req.Zip == "" {
+		sendApiOutcomeResponse(rw, http.StatusBadRequest, errors.New("ids or a category/location filter is required"))
+		return
+	}
+
+	if req.SubVersion == "" {
+		req.SubVersion = "3"
+	}
+	version := strings.TrimSpace(req.Version)
+	if version == "" {
+		version = "1.1"
+	}
+	if req.I8nSet == "2" {
+		version = version + "e"
+	}
+
+	res := AdminBatchResponse{
+		Devices: map[string]json.RawMessage{},
+		Errors:  map[string]string{},
+	}
+
+	// Devices
+	displays := map[string]device.Device{}
+	if len(req.IDs) > 0 {
+		for _, id := range req.IDs {
+			id = strings.ToUpper(strings.TrimSpace(id))
+			if id == "" {
+				continue
+			}
+			if len(displays) >= ADMIN_BATCH_MAX_DEVICES {
+				res.Truncated = true
+				break
+			}
+			display, _, err := getDevice(id)
+			if err != nil {
+				res.Errors[id] = "device not found"
+				continue
+			}
+			displays[id] = display
+		}
+	} else {
+		var truncated bool
+		var err error
+		displays, truncated, err = filterBatchDevices(req)
+		if err != nil {
+			sendApiOutcomeResponse(rw, http.StatusServiceUnavailable, err)
+			return
+		}
+		res.Truncated = truncated
+	}
+
+	// Anonymous devices have nothing to look up
+	for id, display := range displays {
+		if isAnonymous(display) {
+			res.Errors[id] = "device has no location"
+			delete(displays, id)
+		}
+	}
+
+	// Locations & forecasts, de-duplicated and loaded in parallel
+	var lock sync.Mutex
+	locations := map[string]*batchLocation{}
+	forecasts := map[string]*batchForecast{}
+	responses := map[string]AdminResponseV2{}
+
+	semaphore := make(chan struct{}, ADMIN_BATCH_CONCURRENCY)
+	var wg sync.WaitGroup
+	for id, display := range displays {
+		wg.Add(1)
+		go func(id string, display device.Device) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			lock.Lock()
+			l, ok := locations[batchLocationKey(display)]
+			if !ok {
+				l = &batchLocation{}
+				locations[batchLocationKey(display)] = l
+			}
+			lock.Unlock()
+
+			l.once.Do(func() {
+				l.location, l.err = getDeviceLocation(display)
+			})
+
+			entry := AdminResponseV2{Geo: display.Geo}
+			if l.err != nil {
+				lock.Lock()
+				res.Errors[id] = "location not found: " + l.err.Error()
+				lock.Unlock()
+				return
+			}
+			entry.Location = l.location
+			_, entry.LastUpdated = forecastLastUpdatedString(display, l.location)
+
+			if req.Details {
+				forecastKey := l.location.Key + ":" + display.Category
+				if !batchSharedForecast(display.ID) {
+					forecastKey = forecastKey + ":" + display.ID
+				}
+
+				lock.Lock()
+				f, ok := forecasts[forecastKey]
+				if !ok {
+					f = &batchForecast{}
+					forecasts[forecastKey] = f
+				}
+				lock.Unlock()
+
+				// Previews, the devices are not marked active
+				f.once.Do(func() {
+					sections := weather_api.DefaultForecastSections(req.SubVersion)
+					sections.ReadOnly = true
+					f.forecast = l.location.NullableGetWeatherForecastJsonSections(clk, display.Category, display.ID, req.Firmware, sections)
+				})
+				entry.Forecast = batchDeviceForecast(f.forecast, display.ID)
+			}
+
+			lock.Lock()
+			responses[id] = entry
+			lock.Unlock()
+		}(id, display)
+	}
+	wg.Wait()
+
+	// Shared forecasts are formatted one device at a time
+	for id, entry := range responses {
+		j, err := entry.JsonResponse(version)
+		if err != nil {
+			res.Errors[id] = err.Error()
+			continue
+		}
+		res.Devices[id] = json.RawMessage(j)
+	}
+	res.Count = len(res.Devices)
+
+	json.NewEncoder(rw).Encode(res)
+}
+
+//==============================================
+// Functions - Support
+//==============================================
+
+// ----------------------------------------------
+// @filterBatchDevices
+// Devices of the index matching the request filter, in ID order so
+// truncated batches are repeatable.
+// ----------------------------------------------
+func filterBatchDevices(req AdminBatchRequest) (map[string]device.Device, bool, error) {
+	filter := device.DeviceFilter{
+		Category:    req.Category,
+		ACWKey:      req.ACWKey,
+		Zip:         req.Zip,
+		CountryCode: device.NormalizeCountryCode(req.CountryCode),
+	}
+	ids, err := device.Store.Find(filter)
+	if err != nil {
+		return nil, false, err
+	}
+
+	displays := map[string]device.Device{}
+	for _, id := range ids {
+		display, _, err := getDevice(id)
+		if err != nil || !filter.Matches(display) {
+			continue
+		}
+		if len(displays) >= ADMIN_BATCH_MAX_DEVICES {
+			return displays, true, nil
+		}
+		displays[display.ID] = display
+	}
+	return displays, false, nil
+}
+
+// ----------------------------------------------
+// @batchLocationKey
+// Same inputs as getDeviceLocation.
+// ----------------------------------------------
+func batchLocationKey(display device.Device) string {
+	if display.Geo.ACWKey != "" {
+		return "acw:" + display.Geo.ACWKey
+	}
+	// Coordinates may replace the postal code, devices of a grid cell share the location
+	if lat, lon, ok := display.Geo.Coordinates(); ok {
+		return weather_api.GeoGridKey(lat, lon) + ":" + strings.TrimSpace(display.Geo.Zip) + ":" + strings.TrimSpace(display.Geo.CountryCode)
+	}
+	return "pc:" + strings.TrimSpace(display.Geo.Zip) + ":" + strings.TrimSpace(display.Geo.CountryCode)
+}
+
+// ----------------------------------------------
+// @batchSharedForecast
+// Devices with time or forecast overrides get their own forecast.
+// ----------------------------------------------
+func batchSharedForecast(deviceID string) bool {
+	extendedInfo, err := device.GetExtendedDeviceInfo(deviceID)
+	if err != nil {
+		return false
+	}
+	return !extendedInfo.HasDateTimeBug &&
+		!extendedInfo.TimeLoop.Enabled &&
+		!extendedInfo.TimeCompression.Enabled &&
+		!extendedInfo.TimeZoneOverride.Enabled &&
+		!extendedInfo.ForecastScripting.Enabled
+}
+
+// ----------------------------------------------
+// @batchDeviceForecast
+// Shared forecast carrying the device's own extended info.
+// ----------------------------------------------
+func batchDeviceForecast(forecast weather_api.ApiResponseInterface, deviceID string) weather_api.ApiResponseInterface {
+	f, ok := forecast.(weather_api.NullableUniversalForecast)
+	if !ok || f.ExtendedDeviceInfo.ID == deviceID {
+		return forecast
+	}
+	if extendedInfo, err := device.GetExtendedDeviceInfo(deviceID); err == nil {
+		f.ExtendedDeviceInfo = extendedInfo
+	}
+	return f
+}
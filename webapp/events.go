@@ -0,0 +1,53 @@
+package main
+
+//----------------------------------------------
+// CopyRight 2019 La Crosse Technology, LTD.
+//----------------------------------------------
+
+//----------------------------------------------
+// Imports
+//----------------------------------------------
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/sibivishnu/Weather/common"
+	"github.com/sibivishnu/Weather/common/providers/weather_api"
+)
+
+// ----------------------------------------------
+// Types
+// ----------------------------------------------
+type (
+	// forecastEventPublisher - forecast events onto a pub/sub topic, the
+	// publish result is awaited off the request.
+	forecastEventPublisher struct {
+		topic *pubsub.Topic
+	}
+)
+
+// ----------------------------------------------
+// @Publish
+// ----------------------------------------------
+func (p forecastEventPublisher) Publish(event weather_api.ForecastEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	result := p.topic.Publish(common.CTX, &pubsub.Message{
+		Data: data,
+		Attributes: map[string]string{
+			"type":        event.Type,
+			"locationKey": event.LocationKey,
+			"devices":     strconv.FormatInt(event.Devices, 10),
+		},
+	})
+	go func() {
+		if _, err := result.Get(common.CTX); err != nil {
+			log.Printf("[Events] Unable to publish %s for %s| %v", event.Type, event.LocationKey, err)
+		}
+	}()
+}
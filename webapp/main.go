@@ -11,12 +11,16 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 
+	"cloud.google.com/go/pubsub"
 	firebase "firebase.google.com/go"
 	"firebase.google.com/go/auth"
 	"github.com/gorilla/mux"
 	"github.com/sibivishnu/Weather/common"
+	"github.com/sibivishnu/Weather/common/clock"
 	"github.com/sibivishnu/Weather/common/init"
+	"github.com/sibivishnu/Weather/common/providers/weather_api"
 	"github.com/urfave/cli"
 	"google.golang.org/api/option"
 )
@@ -31,6 +35,12 @@ const (
 	FLAG_HTTP_HOST            = "HTTP_HOST"
 	FLAG_HTTP_SCHEME          = "HTTP_SCHEME"
 	ENV_FIREBASE_SERVICE_FILE = "FIREBASE_APPLICATION_CREDENTIALS"
+	ENV_PROJECT_ID            = "PROJECT_ID"
+	ENV_ATTRIBUTE_TOPIC_NAME  = "ATTRIBUTE_TOPIC_NAME"
+
+	ENV_FORECAST_EVENTS_TOPIC_NAME   = "FORECAST_EVENTS_TOPIC_NAME"
+	ENV_HEADLINE_SEVERITY_THRESHOLD  = "HEADLINE_SEVERITY_THRESHOLD"
+	ENV_SEVERE_PROBABILITY_THRESHOLD = "SEVERE_PROBABILITY_THRESHOLD"
 )
 
 // ----------------------------------------------
@@ -41,44 +51,68 @@ var (
 	httpHost       string
 	httpScheme     string
 	firebaseClient *auth.Client
+	attrSyncTopic  *pubsub.Topic
 )
 
 //==============================================
 // Functions
 //==============================================
 
+// ----------------------------------------------
+// withClock - handler served with the clock of the service.
+// ----------------------------------------------
+func withClock(clk clock.Clock, handler func(clock.Clock, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		handler(clk, rw, r)
+	}
+}
+
 // ----------------------------------------------
 // setupHTTP - prepare http routes.
 // ----------------------------------------------
-func setupHTTP(port string) {
+func setupHTTP(port string, clk clock.Clock) {
 	log.Println("[WebApp] Starting the http server on port : " + port)
 	router := mux.NewRouter()
 
 	// Forecast Calls
-	router.HandleFunc("/api/v1.1/forecast/id/{id}", actionGetForecastData).Methods("GET")
-	router.HandleFunc("/api/v2.0/forecast/id/{id}", actionGetForecastDataVer2).Methods("GET")
-	router.HandleFunc("/api/v2.2/forecast/id/{id}", actionGetForecastDataJson).Methods("GET")
+	router.HandleFunc("/api/v1.1/forecast/id/{id}", withClock(clk, actionGetForecastData)).Methods("GET")
+	router.HandleFunc("/api/v2.0/forecast/id/{id}", withClock(clk, actionGetForecastDataVer2)).Methods("GET")
+	router.HandleFunc("/api/v2.2/forecast/id/{id}", withClock(clk, actionGetForecastDataJson)).Methods("GET")
 
-	router.HandleFunc("/api/v2.3/forecast/id/{id}/hourly", actionGetHourlyForecastDataJson).Methods("GET")
-	router.HandleFunc("/api/v2.3/forecast/id/{id}/daily", actionGetDailyForecastDataJson).Methods("GET")
+	router.HandleFunc("/api/v2.3/forecast/id/{id}", withClock(clk, actionGetSectionsForecastDataJson)).Methods("GET")
+	router.HandleFunc("/api/v2.3/forecast/id/{id}/hourly", withClock(clk, actionGetHourlyForecastDataJson)).Methods("GET")
+	router.HandleFunc("/api/v2.3/forecast/id/{id}/daily", withClock(clk, actionGetDailyForecastDataJson)).Methods("GET")
 
 	// Test Data Calls
-	router.HandleFunc("/api/v2.0/forecast/test/id/{id}", actionGetTestForecastData).Methods("GET")
+	router.HandleFunc("/api/v2.0/forecast/test/id/{id}", withClock(clk, actionGetTestForecastData)).Methods("GET")
 
 	// Data Stream Calls
-	router.HandleFunc("/api/v1.1/forecast/data-streams/id/{id}", actionGetForecastDataStreams).Methods("GET")
+	router.HandleFunc("/api/v1.1/forecast/data-streams/id/{id}", withClock(clk, actionGetForecastDataStreams)).Methods("GET")
+
+	// Compact Encoding Calls
+	router.HandleFunc("/api/v2.2/forecast/dictionary/{version}", actionGetCompactDictionary).Methods("GET")
 
 	// Device Location Calls
 	router.HandleFunc("/api/v1.1/forecast/client/pc/{postal_code}/cc/{country_code}", actionGetLocationByPostalCode).Methods("GET")
 	router.HandleFunc("/api/v1.1/forecast/client/cityorpc/{pc_or_city}/cc/{country_code}", actionGetLocationByCityOrPostalCode).Methods("GET", "OPTIONS")
-	router.HandleFunc("/api/v1.1/forecast/client/location/device/{device_id}", actionSetDeviceLocation).Methods("PUT", "POST")
+	router.HandleFunc("/api/v1.1/forecast/client/location/device/{device_id}", withClock(clk, actionSetDeviceLocation)).Methods("PUT", "POST")
 
 	// Admin Calls
-	router.HandleFunc("/api/v1.1/forecast/admin/id/{id}", actionAdminGetForecastData).Methods("GET", "OPTIONS")
-	router.HandleFunc("/api/v2.0/forecast/admin/id/{id}", actionAdminGetForecastDataVer2).Methods("GET", "OPTIONS")
-	router.HandleFunc("/api/v2.2/forecast/admin/id/{id}", actionAdminGetForecastDataJson).Methods("GET", "OPTIONS")
-	router.HandleFunc("/api/v1.1/forecast/admin/location/device/{device_id}", actionAdminUpdateDeviceLocation).Methods("PUT", "POST", "OPTIONS")
+	router.HandleFunc("/api/v1.1/forecast/admin/id/{id}", withClock(clk, actionAdminGetForecastData)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v2.0/forecast/admin/id/{id}", withClock(clk, actionAdminGetForecastDataVer2)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v2.2/forecast/admin/id/{id}", withClock(clk, actionAdminGetForecastDataJson)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v2.2/forecast/admin/batch", withClock(clk, actionAdminBatchForecastData)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/v1.1/forecast/admin/location/device/{device_id}", withClock(clk, actionAdminUpdateDeviceLocation)).Methods("PUT", "POST", "OPTIONS")
+	router.HandleFunc("/api/v1.1/forecast/admin/location/device/{device_id}/history", actionAdminGetDeviceLocationHistory).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1.1/forecast/admin/attributes/device/{device_id}", actionAdminGetDeviceAttributes).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1.1/forecast/admin/attributes/device/{device_id}", actionAdminSetDeviceAttributes).Methods("PUT", "PATCH")
+	router.HandleFunc("/api/v1.1/forecast/admin/timeline/device/{device_id}", withClock(clk, actionAdminDeviceTimeline)).Methods("GET", "PUT", "DELETE", "OPTIONS")
+	router.HandleFunc("/api/v1.1/forecast/admin/scenarios", actionAdminGetScenarios).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1.1/forecast/admin/scenario/device/{device_id}", withClock(clk, actionAdminDeviceScenario)).Methods("GET", "PUT", "DELETE", "OPTIONS")
 	router.HandleFunc("/api/v1.1/forecast/admin/getRanges/WeatherService/{cat_type}", actionAdminGetCategoryRanges).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1.1/forecast/admin/categories", actionAdminGetCategories).Methods("GET", "OPTIONS")
+	router.HandleFunc("/api/v1.1/forecast/admin/categories/{cat_type}", actionAdminSetCategoryRanges).Methods("PUT", "DELETE", "OPTIONS")
+	router.HandleFunc("/api/v1.1/forecast/admin/templates/reload", actionAdminReloadTemplates).Methods("POST", "OPTIONS")
 
 	// Root
 	router.HandleFunc("/", actionDisplayCheckPage).Methods("GET")
@@ -110,6 +144,7 @@ func main() {
 // ----------------------------------------------
 func runIt(runtimeContext *cli.Context) {
 	log.Println("[WebApp] begin")
+	clk := clock.SystemClock{}
 
 	//-------------------------------------------------
 	// Init Globals
@@ -119,6 +154,9 @@ func runIt(runtimeContext *cli.Context) {
 	options["accuweather.key"] = os.Getenv(ENV_ACCU_API_KEY)
 	options["datastore.project"] = "lax-gateway" // os.Getenv(ENV_PROJECT_ID)
 	options["config.categories"] = "/conf/categories.json"
+	options["templates.path"] = "/templates"
+	options["scenarios.path"] = "/scenarios"
+	options["clock"] = clk
 	init.LoadCommonEnvironment(options)
 
 	// Locals
@@ -143,6 +181,34 @@ func runIt(runtimeContext *cli.Context) {
 		panic(err)
 	}
 
+	// Configure Attribute Sync Topic, consumed by the cache updaters
+	projectID := os.Getenv(ENV_PROJECT_ID)
+	if projectID == "" {
+		projectID = options["datastore.project"].(string)
+	}
+	attributeTopic := os.Getenv(ENV_ATTRIBUTE_TOPIC_NAME)
+	if attributeTopic == "" {
+		attributeTopic = "AttrSync"
+	}
+	pubsubClient, err := pubsub.NewClient(common.CTX, projectID)
+	if err != nil {
+		log.Printf("[WebApp] PubSub Client Error, attribute changes will not be published| %v", err)
+	} else {
+		attrSyncTopic = pubsubClient.Topic(attributeTopic)
+
+		// Forecast Events, published only when a topic is configured
+		if eventsTopic := os.Getenv(ENV_FORECAST_EVENTS_TOPIC_NAME); eventsTopic != "" {
+			weather_api.ForecastEvents = forecastEventPublisher{topic: pubsubClient.Topic(eventsTopic)}
+			if v, err := strconv.Atoi(os.Getenv(ENV_HEADLINE_SEVERITY_THRESHOLD)); err == nil {
+				weather_api.HeadlineSeverityThreshold = v
+			}
+			if v, err := strconv.Atoi(os.Getenv(ENV_SEVERE_PROBABILITY_THRESHOLD)); err == nil {
+				weather_api.SevereProbabilityThreshold = v
+			}
+			log.Printf("[WebApp] Forecast events published to %s", eventsTopic)
+		}
+	}
+
 	// Prepare Http Request Handlers
-	setupHTTP(runtimeContext.String(FLAG_HTTP_PORT))
+	setupHTTP(runtimeContext.String(FLAG_HTTP_PORT), clk)
 }